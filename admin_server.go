@@ -0,0 +1,278 @@
+// Admin HTTP server
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Admin HTTP server
+// Exposes the health, drain, dump and kill endpoints
+type AdminServer struct {
+	server *RTMPServer // Reference to the RTMP server
+
+	address string // Listening address (host:port)
+
+	token string // Token required for the actions (POST requests). Empty if not required
+}
+
+// Health status of the Redis connection
+type RedisHealthStatus struct {
+	Enabled   bool   `json:"enabled"`         // True if Redis is enabled
+	Connected bool   `json:"connected"`       // True if the connection is working
+	Error     string `json:"error,omitempty"` // Last connection error
+	Since     int64  `json:"since,omitempty"` // Time of the last status change (unix milliseconds)
+}
+
+// Health status of the server
+type HealthStatus struct {
+	Status   string            `json:"status"`   // "ok" or "unhealthy"
+	Draining bool              `json:"draining"` // True if the server is draining
+	Sessions int               `json:"sessions"` // Number of active sessions
+	Channels int               `json:"channels"` // Number of active channels
+	Redis    RedisHealthStatus `json:"redis"`    // Status of the Redis connection
+}
+
+// Creates the admin server using the configuration from the environment variables
+// server - Reference to the RTMP server
+// Returns the admin server, or nil if disabled
+func CreateAdminServer(server *RTMPServer) *AdminServer {
+	adminPort := os.Getenv("ADMIN_PORT")
+
+	if adminPort == "" {
+		return nil
+	}
+
+	port, e := strconv.Atoi(adminPort)
+
+	if e != nil || port <= 0 {
+		LogWarning("Invalid ADMIN_PORT: " + adminPort)
+		return nil
+	}
+
+	bindAddr := os.Getenv("ADMIN_BIND_ADDRESS")
+
+	if bindAddr == "" {
+		bindAddr = os.Getenv("BIND_ADDRESS")
+	}
+
+	return &AdminServer{
+		server:  server,
+		address: bindAddr + ":" + strconv.Itoa(port),
+		token:   os.Getenv("ADMIN_TOKEN"),
+	}
+}
+
+// Binds the socket of the admin server
+// Returns the listener, or an error
+func (admin *AdminServer) Listen() (net.Listener, error) {
+	listener, err := listenTCP(LISTENER_NAME_ADMIN, admin.address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	admin.server.AddSocket(LISTENER_NAME_ADMIN, listener)
+
+	LogInfo("[ADMIN] Listening on " + admin.address)
+
+	if admin.token == "" {
+		LogWarning("[ADMIN] ADMIN_TOKEN is not set. The POST endpoints are disabled.")
+	}
+
+	return listener, nil
+}
+
+// Runs the admin server
+// Call in a separate routine.
+// listener - The listener returned by Listen
+func (admin *AdminServer) Run(listener net.Listener) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", admin.HandleHealth)
+	mux.HandleFunc("/drain", admin.HandleDrain)
+	mux.HandleFunc("/dump", admin.HandleDump)
+	mux.HandleFunc("/kill", admin.HandleKill)
+
+	err := http.Serve(listener, mux)
+
+	if err != nil && !admin.server.IsDraining() {
+		LogError(err)
+	}
+}
+
+// Gets the health status of the server
+// Returns the status, and true if healthy
+func (admin *AdminServer) GetHealthStatus() (HealthStatus, bool) {
+	status := HealthStatus{
+		Status:   "ok",
+		Draining: admin.server.IsDraining(),
+	}
+
+	status.Sessions, status.Channels = admin.server.GetCounts()
+
+	healthy := true
+
+	if isRedisEnabled() {
+		connected, lastError, since := redisStatus.Get()
+
+		status.Redis = RedisHealthStatus{
+			Enabled:   true,
+			Connected: connected,
+			Error:     lastError,
+			Since:     since,
+		}
+
+		if !connected {
+			healthy = false
+		}
+	}
+
+	if !healthy {
+		status.Status = "unhealthy"
+	}
+
+	return status, healthy
+}
+
+// Handles a request to the health endpoint
+// w - Response writer
+// req - The request
+func (admin *AdminServer) HandleHealth(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, healthy := admin.GetHealthStatus()
+
+	body, err := json.Marshal(status)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	w.Write(body) //nolint:errcheck
+}
+
+// Checks if a request is authorized to perform actions
+// If ADMIN_TOKEN is not set, the actions are disabled
+// req - The request
+// Returns true if authorized
+func (admin *AdminServer) isAuthorized(req *http.Request) bool {
+	if admin.token == "" {
+		return false
+	}
+
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	if !found {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) == 1
+}
+
+// Handles a request to the drain endpoint
+// Starts draining the server in the background
+// w - Response writer
+// req - The request
+func (admin *AdminServer) HandleDrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !admin.isAuthorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	admin.server.RequestDrain("the admin endpoint (" + req.RemoteAddr + ")")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handles a request to the dump endpoint
+// Discards the delayed media of a channel, sending the slate instead
+// w - Response writer
+// req - The request
+func (admin *AdminServer) HandleDump(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !admin.isAuthorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	channel := req.URL.Query().Get("channel")
+
+	if channel == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	LogInfo("[ADMIN] Dump of channel '" + channel + "' requested by " + req.RemoteAddr)
+
+	if !admin.server.DumpBroadcastDelay(channel) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handles a request to the kill endpoint
+// Ends the publishing session of a channel
+// w - Response writer
+// req - The request
+func (admin *AdminServer) HandleKill(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !admin.isAuthorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	channel := req.URL.Query().Get("channel")
+	streamId := req.URL.Query().Get("stream_id")
+
+	if channel == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	publisher := admin.server.GetPublisher(channel)
+
+	if publisher == nil || (streamId != "" && publisher.stream_id != streamId) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	LogInfo("[ADMIN] Kill of channel '" + channel + "' requested by " + req.RemoteAddr)
+
+	publisher.KillWithReason(PUBLISH_END_REASON_KILLED_ADMIN)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -144,6 +144,14 @@ func (v *AMF0Value) GetInteger() int64 {
 	}
 }
 
+func (v *AMF0Value) GetFloat() float64 {
+	if v.IsAMF3() {
+		return v.amf3.float_val
+	} else {
+		return v.float_val
+	}
+}
+
 func (v *AMF0Value) GetString() string {
 	if v.IsAMF3() {
 		return v.amf3.str_val
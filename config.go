@@ -0,0 +1,716 @@
+// Configuration
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration option
+type ConfigOption struct {
+	name       string             // Name of the option (environment variable)
+	validate   func(string) error // Function to validate the value, or nil if any value is valid
+	reloadable bool               // True if the option can be changed by reloading the configuration
+}
+
+// Validates a YES/NO value
+func validateConfigBool(v string) error {
+	if v != "YES" && v != "NO" {
+		return errors.New("must be YES or NO")
+	}
+
+	return nil
+}
+
+// Makes a function to validate an integer value
+// min - Min value
+// max - Max value
+// Returns the validation function
+func validateConfigInt(min int64, max int64) func(string) error {
+	return func(v string) error {
+		n, e := strconv.ParseInt(v, 10, 64)
+
+		if e != nil {
+			return errors.New("must be an integer")
+		}
+
+		if n < min || n > max {
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+
+		return nil
+	}
+}
+
+// Validates a port number
+var validateConfigPort = validateConfigInt(1, 65535)
+
+// Validates a positive integer
+var validateConfigPositive = validateConfigInt(1, 1<<31-1)
+
+// Validates a non-negative integer
+var validateConfigNonNegative = validateConfigInt(0, 1<<31-1)
+
+// Validates a broadcast delay (seconds)
+func validateConfigBroadcastDelay(v string) error {
+	n, e := strconv.ParseInt(v, 10, 64)
+
+	if e != nil || !isValidBroadcastDelay(n) {
+		return fmt.Errorf("must be 0 or between %d and %d", BROADCAST_DELAY_MIN, BROADCAST_DELAY_MAX)
+	}
+
+	return nil
+}
+
+// Validates an URL
+func validateConfigURL(v string) error {
+	u, e := url.Parse(v)
+
+	if e != nil {
+		return e
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return errors.New("must be an absolute URL")
+	}
+
+	return nil
+}
+
+// Validates a comma-separated list of URLs
+func validateConfigURLList(v string) error {
+	parts := strings.Split(v, ",")
+
+	for i := 0; i < len(parts); i++ {
+		if e := validateConfigURL(strings.TrimSpace(parts[i])); e != nil {
+			return errors.New(parts[i] + ": " + e.Error())
+		}
+	}
+
+	return nil
+}
+
+// Validates a comma-separated list of IP addresses or ranges, or *
+func validateConfigIPList(v string) error {
+	if v == "*" {
+		return nil
+	}
+
+	parts := strings.Split(v, ",")
+
+	for i := 0; i < len(parts); i++ {
+		part := strings.TrimSpace(parts[i])
+
+		if strings.Contains(part, "/") {
+			if _, _, e := net.ParseCIDR(part); e != nil {
+				return errors.New("invalid IP range: " + part)
+			}
+		} else if net.ParseIP(part) == nil {
+			return errors.New("invalid IP address: " + part)
+		}
+	}
+
+	return nil
+}
+
+// Validates the path of an existing file
+func validateConfigFile(v string) error {
+	info, e := os.Stat(v)
+
+	if e != nil {
+		return e
+	}
+
+	if info.IsDir() {
+		return errors.New("must be a file")
+	}
+
+	return nil
+}
+
+// Validates the path of an existing directory
+func validateConfigDirectory(v string) error {
+	info, e := os.Stat(v)
+
+	if e != nil {
+		return e
+	}
+
+	if !info.IsDir() {
+		return errors.New("must be a directory")
+	}
+
+	return nil
+}
+
+// Validates a comma-separated list of TLS cipher suites
+func validateConfigCipherSuites(v string) error {
+	_, e := parseTLSCipherSuites(v)
+	return e
+}
+
+// Makes a function to validate a value from a set of values
+// values - The allowed values
+// Returns the validation function
+func validateConfigEnum(values ...string) func(string) error {
+	return func(v string) error {
+		for i := 0; i < len(values); i++ {
+			if strings.EqualFold(v, values[i]) {
+				return nil
+			}
+		}
+
+		return errors.New("must be one of: " + strings.Join(values, ", "))
+	}
+}
+
+// List of every configuration option
+var configOptions = []ConfigOption{
+	// RTMP
+	{name: "RTMP_HOST"},
+	{name: "RTMP_PORT", validate: validateConfigPort},
+	{name: "BIND_ADDRESS"},
+	{name: "LISTENERS", validate: validateConfigListenerNames},
+	{name: "RTMP_CHUNK_SIZE", validate: validateConfigInt(RTMP_CHUNK_SIZE, 1<<24), reloadable: true},
+	{name: "ID_MAX_LENGTH", validate: validateConfigPositive, reloadable: true},
+	{name: "GOP_CACHE_SIZE_MB", validate: validateConfigNonNegative, reloadable: true},
+	{name: "MAX_IP_CONCURRENT_CONNECTIONS", validate: validateConfigPositive, reloadable: true},
+	{name: "CONCURRENT_LIMIT_WHITELIST", validate: validateConfigIPList, reloadable: true},
+	{name: "RTMP_PLAY_WHITELIST", validate: validateConfigIPList, reloadable: true},
+	{name: "PROXY_PROTOCOL", validate: validateConfigBool, reloadable: true},
+	{name: "PROXY_PROTOCOL_TRUSTED", validate: validateConfigIPList, reloadable: true},
+	{name: "RTMPE", validate: validateConfigBool, reloadable: true},
+	{name: "BACKUP_PUBLISHERS", validate: validateConfigBool, reloadable: true},
+	{name: "BACKUP_PUBLISHER_STALL_MS", validate: validateConfigPositive, reloadable: true},
+	{name: "PUBLISH_GRACE_PERIOD_SECONDS", validate: validateConfigNonNegative, reloadable: true},
+	{name: "SLATE_FILE", validate: validateConfigFile, reloadable: true},
+	{name: "SLATE_DIR", validate: validateConfigDirectory, reloadable: true},
+	{name: "BROADCAST_DELAY_SECONDS", validate: validateConfigBroadcastDelay, reloadable: true},
+	{name: "BROADCAST_DELAY_MAX_SIZE_MB", validate: validateConfigPositive, reloadable: true},
+	{name: "TIMESHIFT_WINDOW_SECONDS", validate: validateConfigNonNegative, reloadable: true},
+	{name: "TIMESHIFT_MAX_SIZE_MB", validate: validateConfigPositive, reloadable: true},
+	{name: "VOD_ROOT", validate: validateConfigDirectory, reloadable: true},
+	{name: "VOD_SECRET", reloadable: true},
+	{name: "RECORD_DIR", validate: validateConfigDirectory, reloadable: true},
+
+	// Logs
+	{name: "LOG_REQUESTS", validate: validateConfigBool, reloadable: true},
+	{name: "LOG_DEBUG", validate: validateConfigBool, reloadable: true},
+
+	// Callback
+	{name: "CALLBACK_URL", validate: validateConfigURL, reloadable: true},
+	{name: "JWT_SECRET", reloadable: true},
+	{name: "CUSTOM_JWT_SUBJECT", reloadable: true},
+
+	// TLS
+	{name: "SSL_PORT", validate: validateConfigPort},
+	{name: "SSL_CERT"},
+	{name: "SSL_KEY"},
+	{name: "SSL_CHECK_RELOAD_SECONDS", validate: validateConfigPositive},
+	{name: "SSL_CERTS_DIR", validate: validateConfigDirectory},
+	{name: "SSL_MIN_VERSION", validate: validateConfigEnum("1.0", "1.1", "1.2", "1.3")},
+	{name: "SSL_CIPHER_SUITES", validate: validateConfigCipherSuites},
+	{name: "SSL_CLIENT_CA", validate: validateConfigFile},
+	{name: "SSL_CLIENT_CERT_REQUIRED", validate: validateConfigBool, reloadable: true},
+
+	// Control server
+	{name: "CONTROL_USE", validate: validateConfigBool},
+	{name: "CONTROL_BASE_URL", validate: validateConfigURLList},
+	{name: "CONTROL_SECRET"},
+	{name: "EXTERNAL_IP"},
+	{name: "EXTERNAL_PORT", validate: validateConfigPort},
+	{name: "EXTERNAL_SSL", validate: validateConfigBool},
+	{name: "CONTROL_STATS_INTERVAL_SECONDS", validate: validateConfigNonNegative},
+	{name: "CONTROL_QUEUE_MAX", validate: validateConfigNonNegative},
+	{name: "CONTROL_KILL_ON_RECONNECT", validate: validateConfigBool},
+	{name: "CONTROL_PUBLISH_TIMEOUT_SECONDS", validate: validateConfigPositive},
+	{name: "CONTROL_FALLBACK_POLICY", validate: validateConfigEnum(CONTROL_FALLBACK_DENY, CONTROL_FALLBACK_ALLOW, CONTROL_FALLBACK_CALLBACK)},
+
+	// Redis
+	{name: "REDIS_USE", validate: validateConfigBool},
+	{name: "REDIS_HOST"},
+	{name: "REDIS_PORT", validate: validateConfigPort},
+	{name: "REDIS_PASSWORD"},
+	{name: "REDIS_TLS", validate: validateConfigBool},
+	{name: "REDIS_CHANNEL"},
+	{name: "REDIS_REPLY_CHANNEL"},
+	{name: "REDIS_SENTINEL_MASTER"},
+	{name: "REDIS_SENTINEL_ADDRESSES"},
+	{name: "REDIS_SENTINEL_PASSWORD"},
+	{name: "REDIS_CLUSTER_ADDRESSES"},
+	{name: "REDIS_COMMANDS_SECRET"},
+	{name: "REDIS_COMMANDS_MAX_AGE_SECONDS", validate: validateConfigPositive},
+	{name: "REDIS_EVENTS_CHANNEL"},
+	{name: "REDIS_EVENTS_STREAM"},
+	{name: "REDIS_EVENTS_STREAM_MAX_LEN", validate: validateConfigNonNegative},
+	{name: "REDIS_REGISTRY", validate: validateConfigBool},
+	{name: "REDIS_REGISTRY_PREFIX"},
+	{name: "REDIS_REGISTRY_TTL_SECONDS", validate: validateConfigPositive},
+	{name: "REDIS_REGISTRY_HEARTBEAT_SECONDS", validate: validateConfigPositive},
+	{name: "REDIS_REGISTRY_NODE_ADDRESS"},
+	{name: "NODE_ID"},
+
+	// Admin
+	{name: "ADMIN_PORT", validate: validateConfigPort},
+	{name: "ADMIN_BIND_ADDRESS"},
+	{name: "ADMIN_TOKEN"},
+
+	// Drain
+	{name: "DRAIN_TIMEOUT_SECONDS", validate: validateConfigNonNegative, reloadable: true},
+	{name: "DRAIN_RECONNECT_REQUEST", validate: validateConfigBool, reloadable: true},
+	{name: "DRAIN_RECONNECT_URL", validate: validateConfigURL, reloadable: true},
+}
+
+// List of the options of each listener
+// The option names are LISTENER_{NAME}_{OPTION}
+var listenerConfigOptions = []ConfigOption{
+	{name: "PORT", validate: validateConfigPort},
+	{name: "BIND_ADDRESS"},
+	{name: "TLS", validate: validateConfigBool},
+	{name: "PROTOCOL", validate: validateConfigEnum(LISTENER_PROTOCOL_RTMP, LISTENER_PROTOCOL_RTMPT, LISTENER_PROTOCOL_WS)},
+	{name: "ALLOW", validate: validateConfigListenerActions, reloadable: true},
+	{name: "WHITELIST", validate: validateConfigIPList, reloadable: true},
+	{name: "PUBLISH_WHITELIST", validate: validateConfigIPList, reloadable: true},
+	{name: "PLAY_WHITELIST", validate: validateConfigIPList, reloadable: true},
+	{name: "MAX_CONNECTIONS", validate: validateConfigNonNegative, reloadable: true},
+	{name: "MAX_IP_CONCURRENT_CONNECTIONS", validate: validateConfigNonNegative, reloadable: true},
+}
+
+// Validates a comma-separated list of listener names
+func validateConfigListenerNames(v string) error {
+	names := parseListenerNames(v)
+
+	if len(names) == 0 {
+		return errors.New("must contain at least one listener")
+	}
+
+	found := make(map[string]bool)
+
+	for i := 0; i < len(names); i++ {
+		if !validateListenerName(names[i]) {
+			return errors.New("invalid listener name: " + names[i] + ". Use only letters and numbers")
+		}
+
+		if names[i] == LISTENER_NAME_ADMIN {
+			return errors.New("the listener name " + LISTENER_NAME_ADMIN + " is reserved")
+		}
+
+		if found[names[i]] {
+			return errors.New("duplicated listener: " + names[i])
+		}
+
+		found[names[i]] = true
+	}
+
+	return nil
+}
+
+// Validates a comma-separated list of listener actions
+func validateConfigListenerActions(v string) error {
+	parts := strings.Split(v, ",")
+
+	for i := 0; i < len(parts); i++ {
+		part := strings.ToLower(strings.TrimSpace(parts[i]))
+
+		if part != LISTENER_ACTION_PUBLISH && part != LISTENER_ACTION_PLAY {
+			return errors.New("unknown action: " + parts[i] + ". Use " + LISTENER_ACTION_PUBLISH + " or " + LISTENER_ACTION_PLAY)
+		}
+	}
+
+	return nil
+}
+
+// Gets a configuration option by name
+// name - Name of the option
+// Returns the option, or nil if it does not exist
+func getConfigOption(name string) *ConfigOption {
+	for i := 0; i < len(configOptions); i++ {
+		if configOptions[i].name == name {
+			return &configOptions[i]
+		}
+	}
+
+	return getListenerConfigOption(name)
+}
+
+// Gets a listener configuration option by name (LISTENER_{NAME}_{OPTION})
+// name - Name of the option
+// Returns the option, or nil if it does not exist
+func getListenerConfigOption(name string) *ConfigOption {
+	if !strings.HasPrefix(name, "LISTENER_") {
+		return nil
+	}
+
+	rest := name[len("LISTENER_"):]
+
+	for i := 0; i < len(listenerConfigOptions); i++ {
+		listenerName, found := strings.CutSuffix(rest, "_"+listenerConfigOptions[i].name)
+
+		if !found || !validateListenerName(strings.ToLower(listenerName)) {
+			continue
+		}
+
+		return &ConfigOption{
+			name:       name,
+			validate:   listenerConfigOptions[i].validate,
+			reloadable: listenerConfigOptions[i].reloadable,
+		}
+	}
+
+	return nil
+}
+
+// Gets every configuration option, including the options of the configured listeners
+// getValue - Function to get the value of an option
+// Returns the list of options
+func getAllConfigOptions(getValue func(string) string) []ConfigOption {
+	options := make([]ConfigOption, 0, len(configOptions))
+	options = append(options, configOptions...)
+
+	listeners := getListenerNames(getValue)
+
+	for i := 0; i < len(listeners); i++ {
+		for j := 0; j < len(listenerConfigOptions); j++ {
+			option := listenerConfigOptions[j]
+			option.name = getListenerOptionName(listeners[i], option.name)
+			options = append(options, option)
+		}
+	}
+
+	return options
+}
+
+// Status of the configuration loader
+type ConfigLoader struct {
+	mutex *sync.Mutex // Mutex to reload the configuration
+
+	file string // Path of the configuration file. Empty if not used
+
+	envOverrides map[string]bool // Options set by environment variables, overriding the file
+}
+
+// Configuration loader
+var configLoader = &ConfigLoader{
+	mutex: &sync.Mutex{},
+}
+
+// Loads the configuration file (CONFIG_FILE) and validates the configuration
+// Environment variables override the values of the file
+// Exits the process if the configuration is not valid
+func LoadConfig() {
+	configLoader.mutex.Lock()
+	defer configLoader.mutex.Unlock()
+
+	configLoader.file = os.Getenv("CONFIG_FILE")
+	configLoader.envOverrides = make(map[string]bool)
+
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+
+		if getConfigOption(name) != nil {
+			configLoader.envOverrides[name] = true
+		}
+	}
+
+	if configLoader.file != "" {
+		values, err := readConfigFile(configLoader.file)
+
+		if err != nil {
+			LogErrorMessage("Could not load configuration file " + configLoader.file + ": " + err.Error())
+			os.Exit(1)
+		}
+
+		for name, value := range values {
+			if !configLoader.envOverrides[name] {
+				os.Setenv(name, value)
+			}
+		}
+
+		LogInfo("Loaded configuration file: " + configLoader.file)
+	}
+
+	errs := validateConfig(os.Getenv)
+
+	if len(errs) > 0 {
+		for i := 0; i < len(errs); i++ {
+			LogErrorMessage("Invalid configuration: " + errs[i].Error())
+		}
+		os.Exit(1)
+	}
+}
+
+// Reloads the configuration file
+// Only the reloadable options are applied. If the configuration is not valid, nothing is applied.
+// Returns an error if the configuration could not be reloaded
+func ReloadConfig() error {
+	configLoader.mutex.Lock()
+	defer configLoader.mutex.Unlock()
+
+	if configLoader.file == "" {
+		return errors.New("no configuration file (CONFIG_FILE) is being used")
+	}
+
+	values, err := readConfigFile(configLoader.file)
+
+	if err != nil {
+		return err
+	}
+
+	getValue := func(name string) string {
+		if configLoader.envOverrides[name] {
+			return os.Getenv(name)
+		}
+
+		return values[name]
+	}
+
+	errs := validateConfig(getValue)
+
+	if len(errs) > 0 {
+		for i := 0; i < len(errs); i++ {
+			LogErrorMessage("Invalid configuration: " + errs[i].Error())
+		}
+
+		return errors.New("the configuration is not valid")
+	}
+
+	options := getAllConfigOptions(os.Getenv)
+
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+
+		if configLoader.envOverrides[option.name] {
+			continue
+		}
+
+		newValue := values[option.name]
+
+		if newValue == os.Getenv(option.name) {
+			continue
+		}
+
+		if !option.reloadable {
+			LogWarning("Option " + option.name + " changed. Restart the server to apply it.")
+			continue
+		}
+
+		if newValue == "" {
+			os.Unsetenv(option.name)
+		} else {
+			os.Setenv(option.name, newValue)
+		}
+	}
+
+	return nil
+}
+
+// Gets the environment for a child process
+// The options loaded from the configuration file are removed, so the child process loads the file again
+// Returns the environment variables (KEY=VALUE)
+func getChildProcessEnviron() []string {
+	configLoader.mutex.Lock()
+	defer configLoader.mutex.Unlock()
+
+	env := make([]string, 0)
+
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+
+		if configLoader.file != "" && getConfigOption(name) != nil && !configLoader.envOverrides[name] {
+			continue
+		}
+
+		env = append(env, v)
+	}
+
+	return env
+}
+
+// Validates the configuration
+// getValue - Function to get the value of an option
+// Returns the list of errors
+func validateConfig(getValue func(string) string) []error {
+	errs := make([]error, 0)
+
+	options := getAllConfigOptions(getValue)
+
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+		value := getValue(option.name)
+
+		if value == "" || option.validate == nil {
+			continue
+		}
+
+		if e := option.validate(value); e != nil {
+			errs = append(errs, errors.New(option.name+"="+value+": "+e.Error()))
+		}
+	}
+
+	if getValue("SSL_CERT") != "" && getValue("SSL_KEY") == "" {
+		errs = append(errs, errors.New("SSL_KEY is required when SSL_CERT is set"))
+	}
+
+	if getValue("SSL_KEY") != "" && getValue("SSL_CERT") == "" {
+		errs = append(errs, errors.New("SSL_CERT is required when SSL_KEY is set"))
+	}
+
+	if getValue("CONTROL_USE") == "YES" && getValue("CONTROL_BASE_URL") == "" {
+		errs = append(errs, errors.New("CONTROL_BASE_URL is required when CONTROL_USE is YES"))
+	}
+
+	if getValue("SSL_CLIENT_CERT_REQUIRED") == "YES" && getValue("SSL_CLIENT_CA") == "" {
+		errs = append(errs, errors.New("SSL_CLIENT_CA is required when SSL_CLIENT_CERT_REQUIRED is YES"))
+	}
+
+	listeners := getListenerNames(getValue)
+
+	for i := 0; i < len(listeners); i++ {
+		name := listeners[i]
+
+		if name != LISTENER_NAME_RTMP && name != LISTENER_NAME_RTMPS && getValue(getListenerOptionName(name, "PORT")) == "" {
+			errs = append(errs, errors.New(getListenerOptionName(name, "PORT")+" is required for the listener "+name))
+		}
+
+		if isListenerSecure(name, getValue) && (getValue("SSL_CERT") == "" || getValue("SSL_KEY") == "") && getValue("SSL_CERTS_DIR") == "" {
+			errs = append(errs, errors.New("SSL_CERT and SSL_KEY, or SSL_CERTS_DIR, are required for the TLS listener "+name))
+		}
+	}
+
+	return errs
+}
+
+// Reads a configuration file (YAML or TOML)
+// The file contains the options with the same names as the environment variables
+// path - Path of the file
+// Returns the values. Map: Option name -> Value
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(content, &raw)
+	case ".toml":
+		err = toml.Unmarshal(content, &raw)
+	default:
+		return nil, errors.New("unknown file format. Use .yml, .yaml or .toml")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	errs := make([]string, 0)
+
+	for key, v := range raw {
+		name := strings.ToUpper(key)
+
+		if getConfigOption(name) == nil {
+			errs = append(errs, "unknown option: "+key)
+			continue
+		}
+
+		value, err := configValueToString(v)
+
+		if err != nil {
+			errs = append(errs, key+": "+err.Error())
+			continue
+		}
+
+		values[name] = value
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	return values, nil
+}
+
+// Converts a value of the configuration file to string
+// Booleans are converted to YES/NO and lists are joined by commas
+// v - The value
+// Returns the value as string
+func configValueToString(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case bool:
+		if x {
+			return "YES", nil
+		}
+		return "NO", nil
+	case int:
+		return strconv.Itoa(x), nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case uint64:
+		return strconv.FormatUint(x, 10), nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	case []interface{}:
+		parts := make([]string, 0, len(x))
+
+		for i := 0; i < len(x); i++ {
+			part, err := configValueToString(x[i])
+
+			if err != nil {
+				return "", err
+			}
+
+			parts = append(parts, part)
+		}
+
+		return strings.Join(parts, ","), nil
+	default:
+		return "", errors.New("unsupported value type")
+	}
+}
+
+// Handles the reload signal (SIGHUP)
+// Reloads the configuration file and applies it to the server
+// Runs indefinitely. Call in a separate routine.
+func (server *RTMPServer) HandleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		LogInfo("Received reload signal. Reloading configuration.")
+
+		err := ReloadConfig()
+
+		if err != nil {
+			LogErrorMessage("Could not reload the configuration: " + err.Error())
+			continue
+		}
+
+		InitLog()
+		server.LoadReloadableConfig()
+
+		LogInfo("Configuration reloaded")
+	}
+}
@@ -0,0 +1,140 @@
+// Tests for the configuration validation
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigOption(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "slate.flv")
+
+	if err := os.WriteFile(file, []byte("FLV"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{name: "RTMP_PORT", value: "1935", valid: true},
+		{name: "RTMP_PORT", value: "0", valid: false},
+		{name: "RTMP_PORT", value: "65536", valid: false},
+		{name: "RTMP_PORT", value: "abc", valid: false},
+		{name: "RTMPE", value: "YES", valid: true},
+		{name: "RTMPE", value: "NO", valid: true},
+		{name: "RTMPE", value: "yes", valid: false},
+		{name: "RTMPE", value: "true", valid: false},
+		{name: "ID_MAX_LENGTH", value: "128", valid: true},
+		{name: "ID_MAX_LENGTH", value: "0", valid: false},
+		{name: "GOP_CACHE_SIZE_MB", value: "0", valid: true},
+		{name: "GOP_CACHE_SIZE_MB", value: "-1", valid: false},
+		{name: "RTMP_PLAY_WHITELIST", value: "*", valid: true},
+		{name: "RTMP_PLAY_WHITELIST", value: "10.0.0.0/8, 192.168.1.1, ::1", valid: true},
+		{name: "RTMP_PLAY_WHITELIST", value: "10.0.0.0/33", valid: false},
+		{name: "RTMP_PLAY_WHITELIST", value: "10.0.0.1,localhost", valid: false},
+		{name: "PROXY_PROTOCOL_TRUSTED", value: "10.0.0.0/8", valid: true},
+		{name: "PROXY_PROTOCOL_TRUSTED", value: "10.0.0", valid: false},
+		{name: "DRAIN_RECONNECT_URL", value: "rtmp://example.com/live", valid: true},
+		{name: "DRAIN_RECONNECT_URL", value: "/live", valid: false},
+		{name: "SLATE_FILE", value: file, valid: true},
+		{name: "SLATE_FILE", value: dir, valid: false},
+		{name: "SLATE_FILE", value: filepath.Join(dir, "missing.flv"), valid: false},
+		{name: "LISTENERS", value: "rtmp,rtmps,ws1", valid: true},
+		{name: "LISTENERS", value: "rtmp,rtmp", valid: false},
+		{name: "LISTENERS", value: "rtmp," + LISTENER_NAME_ADMIN, valid: false},
+		{name: "LISTENERS", value: "rtmp,web-socket", valid: false},
+		{name: "LISTENER_WS1_PORT", value: "8080", valid: true},
+		{name: "LISTENER_WS1_PORT", value: "80800", valid: false},
+		{name: "LISTENER_WS1_PROTOCOL", value: "ws", valid: true},
+		{name: "LISTENER_WS1_PROTOCOL", value: "WS", valid: true},
+		{name: "LISTENER_WS1_PROTOCOL", value: "http", valid: false},
+		{name: "LISTENER_WS1_ALLOW", value: "play", valid: true},
+		{name: "LISTENER_WS1_ALLOW", value: "publish, play", valid: true},
+		{name: "LISTENER_WS1_ALLOW", value: "record", valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name+"="+test.value, func(t *testing.T) {
+			option := getConfigOption(test.name)
+
+			if option == nil || option.validate == nil {
+				t.Fatalf("the option %s has no validation", test.name)
+			}
+
+			if err := option.validate(test.value); (err == nil) != test.valid {
+				t.Fatalf("expected valid = %v, got error %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		errors []string // Expected errors (substrings), in order
+	}{
+		{
+			name:   "default configuration",
+			values: map[string]string{},
+		},
+		{
+			name:   "invalid values",
+			values: map[string]string{"RTMP_PORT": "99999", "RTMPE": "maybe"},
+			errors: []string{"RTMP_PORT=99999", "RTMPE=maybe"},
+		},
+		{
+			name:   "SSL certificate without key",
+			values: map[string]string{"SSL_CERT": "cert.pem"},
+			errors: []string{"SSL_KEY is required"},
+		},
+		{
+			name:   "control without base URL",
+			values: map[string]string{"CONTROL_USE": "YES"},
+			errors: []string{"CONTROL_BASE_URL is required"},
+		},
+		{
+			name:   "listener without port",
+			values: map[string]string{"LISTENERS": "rtmp,ws1", "LISTENER_WS1_PROTOCOL": "ws"},
+			errors: []string{"LISTENER_WS1_PORT is required"},
+		},
+		{
+			name:   "TLS listener without certificate",
+			values: map[string]string{"LISTENERS": "rtmp,ws1", "LISTENER_WS1_PORT": "8443", "LISTENER_WS1_TLS": "YES"},
+			errors: []string{"required for the TLS listener ws1"},
+		},
+		{
+			name:   "invalid listener option",
+			values: map[string]string{"LISTENERS": "rtmp,ws1", "LISTENER_WS1_PORT": "8080", "LISTENER_WS1_ALLOW": "watch"},
+			errors: []string{"LISTENER_WS1_ALLOW=watch"},
+		},
+		{
+			name:   "options of unused listeners are ignored",
+			values: map[string]string{"LISTENER_WS2_PORT": "invalid"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validateConfig(func(name string) string {
+				return test.values[name]
+			})
+
+			if len(errs) != len(test.errors) {
+				t.Fatalf("expected %d errors, got %v", len(test.errors), errs)
+			}
+
+			for i := 0; i < len(errs); i++ {
+				if !strings.Contains(errs[i].Error(), test.errors[i]) {
+					t.Errorf("expected error containing %q, got %q", test.errors[i], errs[i].Error())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Commands received from the control server
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	messages "github.com/AgustinSRG/go-simple-rpc-message"
+)
+
+// Sends the result of a command received from the coordinator server
+// cmd - The command message
+// err - The error, or nil if the command was successful
+// body - Result data of the command (JSON), or an empty string
+// Returns true if success
+func (c *ControlServerConnection) SendCommandResult(cmd *messages.RPCMessage, err error, body string) bool {
+	msgParams := make(map[string]string)
+
+	msgParams["Request-ID"] = cmd.GetParam("Request-Id")
+	msgParams["Command"] = cmd.Method
+
+	if err != nil {
+		LogWarning("[WS-CONTROL] Command " + cmd.Method + " failed: " + err.Error())
+
+		msgParams["Success"] = "false"
+		msgParams["Error-Message"] = err.Error()
+	} else {
+		msgParams["Success"] = "true"
+	}
+
+	msg := messages.RPCMessage{
+		Method: "COMMAND-RESULT",
+		Params: msgParams,
+		Body:   body,
+	}
+
+	return c.Send(msg)
+}
+
+// Handles a PLAYER-KICK message
+// msg - The message
+func (c *ControlServerConnection) OnPlayerKick(msg *messages.RPCMessage) {
+	channel := msg.GetParam("Stream-Channel")
+
+	if channel == "" {
+		c.SendCommandResult(msg, errors.New("missing Stream-Channel"), "")
+		return
+	}
+
+	var sessionId uint64
+
+	if sid := msg.GetParam("Session-Id"); sid != "" {
+		n, e := strconv.ParseUint(sid, 10, 64)
+
+		if e != nil {
+			c.SendCommandResult(msg, errors.New("invalid Session-Id"), "")
+			return
+		}
+
+		sessionId = n
+	}
+
+	kicked := c.server.KickPlayers(channel, sessionId)
+
+	if sessionId != 0 && kicked == 0 {
+		c.SendCommandResult(msg, errors.New("player not found"), "")
+		return
+	}
+
+	c.SendCommandResult(msg, nil, "{\"kicked\":"+strconv.Itoa(kicked)+"}")
+}
+
+// Handles a RECORD-START or RECORD-STOP message
+// msg - The message
+func (c *ControlServerConnection) OnRecordCommand(msg *messages.RPCMessage) {
+	channel := msg.GetParam("Stream-Channel")
+
+	if channel == "" {
+		c.SendCommandResult(msg, errors.New("missing Stream-Channel"), "")
+		return
+	}
+
+	var path string
+	var err error
+
+	if msg.Method == "RECORD-START" {
+		path, err = c.server.StartRecording(channel)
+	} else {
+		path, err = c.server.StopRecording(channel)
+	}
+
+	if err != nil {
+		c.SendCommandResult(msg, err, "")
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{"path": path})
+
+	if err != nil {
+		c.SendCommandResult(msg, err, "")
+		return
+	}
+
+	c.SendCommandResult(msg, nil, string(body))
+}
+
+// Handles a RELAY-START or RELAY-STOP message
+// msg - The message
+func (c *ControlServerConnection) OnRelayCommand(msg *messages.RPCMessage) {
+	channel := msg.GetParam("Stream-Channel")
+
+	if channel == "" {
+		c.SendCommandResult(msg, errors.New("missing Stream-Channel"), "")
+		return
+	}
+
+	relayURL := msg.GetParam("Relay-Url")
+
+	if relayURL == "" {
+		c.SendCommandResult(msg, errors.New("missing Relay-Url"), "")
+		return
+	}
+
+	var err error
+
+	if msg.Method == "RELAY-START" {
+		err = c.server.AddRelay(channel, relayURL)
+	} else {
+		err = c.server.RemoveRelay(channel, relayURL)
+	}
+
+	c.SendCommandResult(msg, err, "")
+}
+
+// Handles a NODE-DRAIN message
+// msg - The message
+func (c *ControlServerConnection) OnNodeDrain(msg *messages.RPCMessage) {
+	c.SendCommandResult(msg, nil, "")
+
+	c.server.RequestDrain("the coordinator server")
+}
+
+// Handles a CHANNEL-INFO message
+// msg - The message
+func (c *ControlServerConnection) OnChannelInfo(msg *messages.RPCMessage) {
+	channel := msg.GetParam("Stream-Channel")
+
+	if channel == "" {
+		c.SendCommandResult(msg, errors.New("missing Stream-Channel"), "")
+		return
+	}
+
+	info := c.server.GetChannelInfo(channel)
+
+	if info == nil {
+		c.SendCommandResult(msg, errors.New("channel not found"), "")
+		return
+	}
+
+	body, err := json.Marshal(info)
+
+	if err != nil {
+		c.SendCommandResult(msg, err, "")
+		return
+	}
+
+	c.SendCommandResult(msg, nil, string(body))
+}
@@ -3,10 +3,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,8 +22,15 @@ import (
 type ControlServerConnection struct {
 	server *RTMPServer // Reference to the RTMP server
 
-	connectionURL string          // Connection URL
-	connection    *websocket.Conn // Websocket connection
+	connectionURLs []string        // Connection URLs, in order of preference
+	connectionURL  string          // Connection URL of the current connection
+	connection     *websocket.Conn // Websocket connection
+	connecting     bool            // True if a connection attempt is in progress
+	ready          bool            // True if the connection is ready (the initial synchronization was sent)
+
+	connectionIndex int // Index of the URL of the current connection in the list
+
+	reconnectDelay time.Duration // Delay for the next reconnection attempt
 
 	lock *sync.Mutex // Mutex to control access to this struct
 
@@ -28,6 +39,44 @@ type ControlServerConnection struct {
 	requests map[string]*ControlServerPendingRequest // Pending requests. Map: ID -> Request status data
 
 	enabled bool // True if the connection is enabled (will reconnect)
+
+	queue    []messages.RPCMessage // Messages waiting to be sent when the connection is ready
+	queueMax int                   // Max number of messages in the queue
+
+	killOnReconnect bool // True to kill the active publishers after reconnecting (legacy). False to send ACTIVE-STREAMS to reconcile (default)
+
+	publishTimeout time.Duration // Max time to wait for the response of a publish request
+	fallbackPolicy string        // Policy for publish requests when no coordinator is reachable (CONTROL_FALLBACK_*)
+}
+
+// Fallback policy: Deny the publish requests
+const CONTROL_FALLBACK_DENY = "deny"
+
+// Fallback policy: Allow the publish requests
+const CONTROL_FALLBACK_ALLOW = "allow"
+
+// Fallback policy: Use the HTTP callback to accept or deny the publish requests
+const CONTROL_FALLBACK_CALLBACK = "callback"
+
+// Default max time to wait for the response of a publish request
+const CONTROL_PUBLISH_DEFAULT_TIMEOUT = 20 * time.Second
+
+// Min time to wait before reconnecting
+const CONTROL_RECONNECT_MIN_DELAY = 1 * time.Second
+
+// Max time to wait before reconnecting
+const CONTROL_RECONNECT_MAX_DELAY = 60 * time.Second
+
+// Default max number of queued messages
+const CONTROL_QUEUE_DEFAULT_MAX = 1000
+
+// Interval to try the preferred coordinator URLs, while connected to a standby coordinator
+const CONTROL_FAILBACK_INTERVAL = 30 * time.Second
+
+// Stream entry for the ACTIVE-STREAMS message
+type ControlActiveStream struct {
+	Channel  string `json:"channel"`   // The channel ID
+	StreamId string `json:"stream_id"` // The stream ID
 }
 
 // Status data for a pending request
@@ -48,48 +97,245 @@ func (c *ControlServerConnection) Initialize(server *RTMPServer) {
 	c.lock = &sync.Mutex{}
 	c.nextRequestId = 0
 	c.requests = make(map[string]*ControlServerPendingRequest)
+	c.queue = make([]messages.RPCMessage, 0)
+	c.queueMax = CONTROL_QUEUE_DEFAULT_MAX
+
+	customQueueMax := os.Getenv("CONTROL_QUEUE_MAX")
+	if customQueueMax != "" {
+		n, e := strconv.Atoi(customQueueMax)
+		if e == nil && n >= 0 {
+			c.queueMax = n
+		}
+	}
 
-	baseURL := os.Getenv("CONTROL_BASE_URL")
+	c.killOnReconnect = os.Getenv("CONTROL_KILL_ON_RECONNECT") == "YES"
 
-	if baseURL == "" {
-		LogWarning("CONTROL_BASE_URL not provided. The server will run in stand-alone mode.")
-		c.enabled = false
-		return
+	c.publishTimeout = CONTROL_PUBLISH_DEFAULT_TIMEOUT
+
+	customPublishTimeout := os.Getenv("CONTROL_PUBLISH_TIMEOUT_SECONDS")
+	if customPublishTimeout != "" {
+		n, e := strconv.Atoi(customPublishTimeout)
+		if e == nil && n > 0 {
+			c.publishTimeout = time.Duration(n) * time.Second
+		}
+	}
+
+	c.fallbackPolicy = strings.ToLower(os.Getenv("CONTROL_FALLBACK_POLICY"))
+
+	switch c.fallbackPolicy {
+	case CONTROL_FALLBACK_DENY, CONTROL_FALLBACK_ALLOW, CONTROL_FALLBACK_CALLBACK:
+	case "":
+		c.fallbackPolicy = CONTROL_FALLBACK_DENY
+	default:
+		LogWarning("Invalid CONTROL_FALLBACK_POLICY: " + c.fallbackPolicy + ". Using " + CONTROL_FALLBACK_DENY)
+		c.fallbackPolicy = CONTROL_FALLBACK_DENY
 	}
 
-	connectionURL, err := url.Parse(baseURL)
+	c.reconnectDelay = CONTROL_RECONNECT_MIN_DELAY
+
+	baseURLs := strings.Split(os.Getenv("CONTROL_BASE_URL"), ",")
+
+	pathURL, err := url.Parse("/ws/control/rtmp")
 	if err != nil {
 		LogError(err)
 		LogWarning("CONTROL_BASE_URL not provided. The server will run in stand-alone mode.")
 		c.enabled = false
 		return
 	}
-	pathURL, err := url.Parse("/ws/control/rtmp")
-	if err != nil {
-		LogError(err)
+
+	c.connectionURLs = make([]string, 0, len(baseURLs))
+
+	for i := 0; i < len(baseURLs); i++ {
+		baseURL := strings.TrimSpace(baseURLs[i])
+
+		if baseURL == "" {
+			continue
+		}
+
+		connectionURL, err := url.Parse(baseURL)
+		if err != nil {
+			LogError(err)
+			LogWarning("Invalid URL in CONTROL_BASE_URL: " + baseURL)
+			continue
+		}
+
+		c.connectionURLs = append(c.connectionURLs, connectionURL.ResolveReference(pathURL).String())
+	}
+
+	if len(c.connectionURLs) == 0 {
 		LogWarning("CONTROL_BASE_URL not provided. The server will run in stand-alone mode.")
 		c.enabled = false
 		return
 	}
 
-	c.connectionURL = connectionURL.ResolveReference(pathURL).String()
 	c.enabled = true
 
 	go c.Connect()
 	go c.RunHeartBeatLoop()
+	go c.RunStatsLoop()
+
+	if len(c.connectionURLs) > 1 {
+		go c.RunFailbackLoop()
+	}
 }
 
 // Connect to the websocket server
+// Tries every coordinator URL, in order of preference
+// If none is reachable, tries again after a delay
 func (c *ControlServerConnection) Connect() {
 	c.lock.Lock()
 
-	if c.connection != nil {
+	if c.connection != nil || c.connecting {
+		c.lock.Unlock()
+		return // Already connected or connecting
+	}
+
+	c.connecting = true
+
+	c.lock.Unlock()
+
+	conn, index := c.dial(len(c.connectionURLs))
+
+	c.lock.Lock()
+
+	c.connecting = false
+
+	if conn == nil {
 		c.lock.Unlock()
-		return // Already connected
+		go c.Reconnect()
+		return
+	}
+
+	c.connection = conn
+	c.connectionURL = c.connectionURLs[index]
+	c.connectionIndex = index
+	c.ready = false
+	c.reconnectDelay = CONTROL_RECONNECT_MIN_DELAY
+
+	c.lock.Unlock()
+
+	c.onConnected(conn, false)
+}
+
+// Connects to the first reachable coordinator URL
+// maxIndex - Only the URLs before this index are tried
+// Returns the connection and the index of its URL, or nil if none was reachable
+func (c *ControlServerConnection) dial(maxIndex int) (*websocket.Conn, int) {
+	for i := 0; i < maxIndex; i++ {
+		connectionURL := c.connectionURLs[i]
+
+		LogInfo("[WS-CONTROL] Connecting to " + connectionURL)
+
+		conn, _, err := websocket.DefaultDialer.Dial(connectionURL, c.MakeConnectionHeaders())
+
+		if err != nil {
+			LogErrorMessage("[WS-CONTROL] Connection error: " + err.Error())
+			continue
+		}
+
+		return conn, i
 	}
 
-	LogInfo("[WS-CONTROL] Connecting to " + c.connectionURL)
+	return nil, 0
+}
+
+// Called after a connection is established
+// Kills the active publishers or sends the active streams, and starts reading
+// conn - Websocket connection
+// switched - True if the connection replaced a working one (failback to a preferred coordinator)
+func (c *ControlServerConnection) onConnected(conn *websocket.Conn, switched bool) {
+	// No coordinator lost its state when switching, so the snapshot is always sent
+	kill := c.killOnReconnect && !switched
+
+	if kill {
+		// Kill any previous publishing sessions,
+		// since the coordinator server thinks the streaming server went down
+		c.server.KillAllActivePublishers(PUBLISH_END_REASON_KILLED_CONTROL)
+	}
+
+	c.Synchronize(conn, !kill)
+
+	go c.RunReaderLoop(conn)
+}
+
+// Sends the initial synchronization after connecting:
+// the snapshot of the active streams (if reconciling), followed by the queued messages
+// conn - Websocket connection
+// reconcile - True to send the snapshot of the active streams
+func (c *ControlServerConnection) Synchronize(conn *websocket.Conn, reconcile bool) {
+	var snapshot *messages.RPCMessage
+
+	if reconcile {
+		// The snapshot is taken without holding the lock, since the publishers
+		// may be sending messages. Any message sent in the meantime is queued
+		// and sent after the snapshot.
+		msg := c.MakeActiveStreamsMessage()
+		snapshot = &msg
+	}
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.connection != conn {
+		return // Disconnected in the meantime
+	}
+
+	if snapshot != nil && !c.sendInternal(*snapshot) {
+		return
+	}
+
+	for len(c.queue) > 0 {
+		if !c.sendInternal(c.queue[0]) {
+			return
+		}
+
+		c.queue = c.queue[1:]
+	}
+
+	c.ready = true
+}
+
+// Makes the ACTIVE-STREAMS message, with the snapshot of the active streams
+// Returns the message
+func (c *ControlServerConnection) MakeActiveStreamsMessage() messages.RPCMessage {
+	activeStreams := make([]ControlActiveStream, 0)
+
+	publishers := c.server.GetPublishers()
+
+	for i := 0; i < len(publishers); i++ {
+		channel, streamId, _ := publishers[i].GetPublishInfo()
+
+		if channel == "" {
+			continue
+		}
+
+		activeStreams = append(activeStreams, ControlActiveStream{
+			Channel:  channel,
+			StreamId: streamId,
+		})
+	}
+
+	body, err := json.Marshal(activeStreams)
+
+	if err != nil {
+		LogError(err)
+		body = []byte("[]")
+	}
+
+	msgParams := make(map[string]string)
+
+	msgParams["Stream-Count"] = fmt.Sprint(len(activeStreams))
+
+	return messages.RPCMessage{
+		Method: "ACTIVE-STREAMS",
+		Params: msgParams,
+		Body:   string(body),
+	}
+}
+
+// Makes the headers for the connection request
+// Returns the headers
+func (c *ControlServerConnection) MakeConnectionHeaders() http.Header {
 	headers := http.Header{}
 
 	authToken := MakeWebsocketAuthenticationToken()
@@ -116,42 +362,109 @@ func (c *ControlServerConnection) Connect() {
 		headers.Set("x-ssl-use", "true")
 	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(c.connectionURL, headers)
+	return headers
+}
+
+// Tries to connect to the preferred coordinator URLs, while connected to a standby coordinator
+// If one of them is reachable, the connection is switched to it
+// Runs indefinitely. Call in a separate routine.
+func (c *ControlServerConnection) RunFailbackLoop() {
+	for {
+		time.Sleep(CONTROL_FAILBACK_INTERVAL)
+
+		c.lock.Lock()
+
+		if c.connection == nil || c.connecting || c.connectionIndex == 0 {
+			c.lock.Unlock()
+			continue
+		}
+
+		c.connecting = true
+		maxIndex := c.connectionIndex
 
-	if err != nil {
 		c.lock.Unlock()
-		LogErrorMessage("[WS-CONTROL] Connection error: " + err.Error())
-		go c.Reconnect()
-		return
-	}
 
-	c.connection = conn
+		conn, index := c.dial(maxIndex)
 
-	c.lock.Unlock()
+		c.lock.Lock()
 
-	// After a connection is established, any previous publishing sessions must be killed,
-	// since the coordinator server thinks the streaming server went down
-	c.server.KillAllActivePublishers()
+		c.connecting = false
 
-	go c.RunReaderLoop(conn)
+		if conn == nil {
+			disconnected := c.connection == nil
+			c.lock.Unlock()
+
+			if disconnected {
+				// The reconnection was skipped while trying
+				go c.Connect()
+			}
+
+			continue
+		}
+
+		oldConn := c.connection
+
+		if oldConn == nil {
+			// Disconnected in the meantime, keep the new connection
+			LogInfo("[WS-CONTROL] Switching to " + c.connectionURLs[index])
+		} else {
+			LogInfo("[WS-CONTROL] Switching from " + c.connectionURL + " to " + c.connectionURLs[index])
+		}
+
+		c.connection = conn
+		c.connectionURL = c.connectionURLs[index]
+		c.connectionIndex = index
+		c.ready = false
+		c.reconnectDelay = CONTROL_RECONNECT_MIN_DELAY
+
+		c.lock.Unlock()
+
+		if oldConn != nil {
+			oldConn.Close()
+		}
+
+		c.onConnected(conn, oldConn != nil)
+	}
 }
 
-// Waits 10 seconds and reconnects
+// Waits and reconnects
+// The delay grows exponentially with each failed attempt, with random jitter
 func (c *ControlServerConnection) Reconnect() {
-	LogInfo("[WS-CONTROL] Waiting 10 seconds to reconnect.")
-	time.Sleep(10 * time.Second)
+	c.lock.Lock()
+
+	delay := c.reconnectDelay
+
+	c.reconnectDelay *= 2
+
+	if c.reconnectDelay > CONTROL_RECONNECT_MAX_DELAY {
+		c.reconnectDelay = CONTROL_RECONNECT_MAX_DELAY
+	}
+
+	c.lock.Unlock()
+
+	// Wait between half and the full delay
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	LogInfo("[WS-CONTROL] Waiting " + delay.String() + " to reconnect.")
+	time.Sleep(delay)
 	c.Connect()
 }
 
 // Called when disconnected
+// conn - The websocket connection that was closed
 // err - Disconnection error
-func (c *ControlServerConnection) OnDisconnect(err error) {
+func (c *ControlServerConnection) OnDisconnect(conn *websocket.Conn, err error) {
 	c.lock.Lock()
+	if c.connection != conn {
+		c.lock.Unlock()
+		return // Replaced by a connection to a preferred coordinator
+	}
 	c.connection = nil
-	LogInfo("[WS-CONTROL] Disconnected: " + err.Error())
+	c.ready = false
+	LogInfo("[WS-CONTROL] Disconnected from " + c.connectionURL + ": " + err.Error())
 	c.lock.Unlock()
 
-	go c.Connect() // Reconnect
+	go c.Connect() // Reconnect, trying every coordinator
 }
 
 // Sends a message
@@ -161,6 +474,44 @@ func (c *ControlServerConnection) Send(msg messages.RPCMessage) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if !c.ready {
+		return false
+	}
+
+	return c.sendInternal(msg)
+}
+
+// Sends a message, or queues it if the connection is not ready
+// The queued messages are sent after reconnecting
+// msg - The message
+// Returns true if the message was sent or queued
+func (c *ControlServerConnection) SendOrQueue(msg messages.RPCMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ready && c.sendInternal(msg) {
+		return true
+	}
+
+	if c.queueMax <= 0 {
+		return false
+	}
+
+	if len(c.queue) >= c.queueMax {
+		LogWarning("[WS-CONTROL] Message queue is full. Discarding oldest message: " + c.queue[0].Method)
+		c.queue = c.queue[1:]
+	}
+
+	c.queue = append(c.queue, msg)
+
+	return true
+}
+
+// Sends a message
+// Call with the lock acquired
+// msg - The message
+// Returns true if the message was successfully sent
+func (c *ControlServerConnection) sendInternal(msg messages.RPCMessage) bool {
 	if c.connection == nil {
 		return false
 	}
@@ -198,7 +549,7 @@ func (c *ControlServerConnection) RunReaderLoop(conn *websocket.Conn) {
 
 		if err != nil {
 			conn.Close()
-			c.OnDisconnect(err)
+			c.OnDisconnect(conn, err)
 			return
 		}
 
@@ -206,7 +557,7 @@ func (c *ControlServerConnection) RunReaderLoop(conn *websocket.Conn) {
 
 		if err != nil {
 			conn.Close()
-			c.OnDisconnect(err)
+			c.OnDisconnect(conn, err)
 			return
 		}
 
@@ -234,6 +585,16 @@ func (c *ControlServerConnection) ParseIncomingMessage(msg *messages.RPCMessage)
 		c.OnPublishDeny(msg.GetParam("Request-Id"))
 	case "STREAM-KILL":
 		c.OnStreamKill(msg.GetParam("Stream-Channel"), msg.GetParam("Stream-Id"))
+	case "PLAYER-KICK":
+		c.OnPlayerKick(msg)
+	case "RECORD-START", "RECORD-STOP":
+		c.OnRecordCommand(msg)
+	case "RELAY-START", "RELAY-STOP":
+		c.OnRelayCommand(msg)
+	case "NODE-DRAIN":
+		c.OnNodeDrain(msg)
+	case "CHANNEL-INFO":
+		c.OnChannelInfo(msg)
 	}
 }
 
@@ -254,7 +615,10 @@ func (c *ControlServerConnection) OnPublishAccept(requestId string, streamId str
 		streamId: streamId,
 	}
 
-	req.waiter <- res
+	select {
+	case req.waiter <- res:
+	default:
+	}
 }
 
 // Handles a PUBLISH-DENY message
@@ -273,7 +637,10 @@ func (c *ControlServerConnection) OnPublishDeny(requestId string) {
 		streamId: "",
 	}
 
-	req.waiter <- res
+	select {
+	case req.waiter <- res:
+	default:
+	}
 }
 
 // Handles a STREAM-KILL message
@@ -284,13 +651,13 @@ func (c *ControlServerConnection) OnStreamKill(channel string, streamId string)
 		publisher := c.server.GetPublisher(channel)
 
 		if publisher != nil {
-			publisher.Kill()
+			publisher.KillWithReason(PUBLISH_END_REASON_KILLED_CONTROL)
 		}
 	} else {
 		publisher := c.server.GetPublisher(channel)
 
 		if publisher != nil && publisher.stream_id == streamId {
-			publisher.Kill()
+			publisher.KillWithReason(PUBLISH_END_REASON_KILLED_CONTROL)
 		}
 	}
 }
@@ -316,17 +683,18 @@ func (c *ControlServerConnection) RunHeartBeatLoop() {
 // Returns:
 //   - accepted - True if the key was accepted
 //   - streamId - Contains the Stream ID if accepted
+//   - reachable - False if no coordinator was reachable (the fallback policy should be applied). If the coordinator does not respond in time, the request is denied
 //
 // This method waits for the server to return a response
-func (c *ControlServerConnection) RequestPublish(channel string, key string, userIP string) (accepted bool, streamId string) {
+func (c *ControlServerConnection) RequestPublish(channel string, key string, userIP string) (accepted bool, streamId string, reachable bool) {
 	if !c.enabled {
-		return true, ""
+		return true, "", true
 	}
 
 	requestId := fmt.Sprint(c.GetNextRequestId())
 
 	request := ControlServerPendingRequest{
-		waiter: make(chan PublishResponse),
+		waiter: make(chan PublishResponse, 1),
 	}
 
 	msgParams := make(map[string]string)
@@ -352,21 +720,36 @@ func (c *ControlServerConnection) RequestPublish(channel string, key string, use
 		delete(c.requests, requestId)
 		c.lock.Unlock()
 
-		return false, ""
+		return false, "", false
 	}
 
-	time.AfterFunc(20*time.Second, func() { request.waiter <- PublishResponse{accepted: false, streamId: ""} }) // Timeout
+	timer := time.NewTimer(c.publishTimeout)
+
+	var res PublishResponse
 
-	res := <-request.waiter // Wait
+	select {
+	case res = <-request.waiter:
+		timer.Stop()
+	case <-timer.C:
+		// The coordinator is connected, so the fallback policy does not apply
+		LogWarning("[WS-CONTROL] Publish request timed out. Denying it. Channel: " + channel)
+	}
 
 	c.lock.Lock()
 	delete(c.requests, requestId)
 	c.lock.Unlock()
 
-	return res.accepted, res.streamId
+	return res.accepted, res.streamId, true
+}
+
+// Gets the policy to apply to the publish requests when no coordinator is reachable
+// Returns the policy (CONTROL_FALLBACK_*)
+func (c *ControlServerConnection) GetFallbackPolicy() string {
+	return c.fallbackPolicy
 }
 
 // Send Publish-End message to the coordinator server
+// If the connection is not ready, the message is queued
 // channel - Streaming channel
 // streamId - Streaming session ID
 // Returns true if success
@@ -381,5 +764,5 @@ func (c *ControlServerConnection) PublishEnd(channel string, streamId string) bo
 		Params: msgParams,
 	}
 
-	return c.Send(msg)
+	return c.SendOrQueue(msg)
 }
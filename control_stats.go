@@ -0,0 +1,182 @@
+// Control server statistics
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	messages "github.com/AgustinSRG/go-simple-rpc-message"
+)
+
+const CONTROL_STATS_DEFAULT_INTERVAL_SECONDS = 10
+
+// Load of the server node
+type NodeLoad struct {
+	sessions     int     // Number of active sessions
+	publishers   int     // Number of sessions publishing
+	players      int     // Number of sessions playing
+	bandwidthIn  uint64  // Incoming bandwidth (kbit/s)
+	bandwidthOut uint64  // Outgoing bandwidth (kbit/s)
+	cpu          float64 // CPU usage of the process (percentage of the total CPU capacity)
+}
+
+// Measures the load of the server node between calls
+type NodeLoadMeter struct {
+	lastTime     time.Time     // Time of the last measure
+	lastBytesIn  uint64        // Total bytes received at the last measure
+	lastBytesOut uint64        // Total bytes sent at the last measure
+	lastCPUTime  time.Duration // CPU time at the last measure
+}
+
+// Creates a node load meter
+// server - Reference to the RTMP server
+// Returns the meter
+func CreateNodeLoadMeter(server *RTMPServer) *NodeLoadMeter {
+	return &NodeLoadMeter{
+		lastTime:     time.Now(),
+		lastBytesIn:  server.bytesIn.Load(),
+		lastBytesOut: server.bytesOut.Load(),
+		lastCPUTime:  getProcessCPUTime(),
+	}
+}
+
+// Measures the load of the server node since the last measure
+// server - Reference to the RTMP server
+// channels - Information of the active channels
+// Returns the load
+func (m *NodeLoadMeter) Measure(server *RTMPServer, channels []*RTMPChannelInfo) NodeLoad {
+	now := time.Now()
+	bytesIn := server.bytesIn.Load()
+	bytesOut := server.bytesOut.Load()
+	cpuTime := getProcessCPUTime()
+
+	load := NodeLoad{}
+
+	load.sessions, _ = server.GetCounts()
+
+	for i := 0; i < len(channels); i++ {
+		if channels[i].Publishing {
+			load.publishers++
+		}
+		load.players += channels[i].Players + channels[i].IdlePlayers
+	}
+
+	elapsed := now.Sub(m.lastTime)
+
+	if elapsed > 0 {
+		elapsedMs := float64(elapsed.Milliseconds())
+
+		if elapsedMs > 0 {
+			load.bandwidthIn = uint64(math.Round(float64(bytesIn-m.lastBytesIn) * 8 / elapsedMs))
+			load.bandwidthOut = uint64(math.Round(float64(bytesOut-m.lastBytesOut) * 8 / elapsedMs))
+		}
+
+		load.cpu = math.Round(float64(cpuTime-m.lastCPUTime)/float64(elapsed)/float64(runtime.NumCPU())*10000) / 100
+	}
+
+	m.lastTime = now
+	m.lastBytesIn = bytesIn
+	m.lastBytesOut = bytesOut
+	m.lastCPUTime = cpuTime
+
+	return load
+}
+
+// Periodically sends the statistics of the active streams
+// and the load of the node to the coordinator server
+// Runs indefinitely. Call in a separate routine.
+func (c *ControlServerConnection) RunStatsLoop() {
+	interval := CONTROL_STATS_DEFAULT_INTERVAL_SECONDS
+
+	customInterval := os.Getenv("CONTROL_STATS_INTERVAL_SECONDS")
+	if customInterval != "" {
+		n, e := strconv.Atoi(customInterval)
+		if e == nil {
+			interval = n
+		}
+	}
+
+	if interval <= 0 {
+		return // Disabled
+	}
+
+	meter := CreateNodeLoadMeter(c.server)
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		channels := c.server.GetChannelsInfo()
+		now := time.Now().UnixMilli()
+
+		for i := 0; i < len(channels); i++ {
+			if !channels[i].Publishing {
+				continue
+			}
+
+			c.SendStreamStats(channels[i], now)
+		}
+
+		c.SendNodeLoad(meter.Measure(c.server, channels))
+	}
+}
+
+// Sends a STREAM-STATS message
+// info - Information of the channel
+// now - Current time (unix milliseconds)
+// Returns true if success
+func (c *ControlServerConnection) SendStreamStats(info *RTMPChannelInfo, now int64) bool {
+	msgParams := make(map[string]string)
+
+	msgParams["Stream-Channel"] = info.Channel
+	msgParams["Stream-ID"] = info.StreamId
+	msgParams["Bitrate"] = fmt.Sprint(info.BitRate)
+	msgParams["Players"] = fmt.Sprint(info.Players)
+	msgParams["Idle-Players"] = fmt.Sprint(info.IdlePlayers)
+	msgParams["Audio-Codec"] = getAudioCodecName(info.AudioCodec)
+	msgParams["Video-Codec"] = getVideoCodecName(info.VideoCodec)
+
+	if info.Width > 0 && info.Height > 0 {
+		msgParams["Resolution"] = fmt.Sprint(info.Width) + "x" + fmt.Sprint(info.Height)
+	}
+
+	if info.FrameRate > 0 {
+		msgParams["Frame-Rate"] = strconv.FormatFloat(info.FrameRate, 'f', -1, 64)
+	}
+
+	if info.StartTime > 0 {
+		msgParams["Uptime"] = fmt.Sprint((now - info.StartTime) / 1000)
+	}
+
+	msg := messages.RPCMessage{
+		Method: "STREAM-STATS",
+		Params: msgParams,
+	}
+
+	return c.Send(msg)
+}
+
+// Sends a NODE-LOAD message
+// load - The load of the node
+// Returns true if success
+func (c *ControlServerConnection) SendNodeLoad(load NodeLoad) bool {
+	msgParams := make(map[string]string)
+
+	msgParams["Sessions"] = fmt.Sprint(load.sessions)
+	msgParams["Publishers"] = fmt.Sprint(load.publishers)
+	msgParams["Players"] = fmt.Sprint(load.players)
+	msgParams["Bandwidth-In"] = fmt.Sprint(load.bandwidthIn)
+	msgParams["Bandwidth-Out"] = fmt.Sprint(load.bandwidthOut)
+	msgParams["CPU"] = strconv.FormatFloat(load.cpu, 'f', 2, 64)
+
+	msg := messages.RPCMessage{
+		Method: "NODE-LOAD",
+		Params: msgParams,
+	}
+
+	return c.Send(msg)
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+// CPU usage (Unix)
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// Gets the CPU time consumed by the process
+// Returns the CPU time (user + system)
+func getProcessCPUTime() time.Duration {
+	var usage syscall.Rusage
+
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+// CPU usage (Windows)
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// Gets the CPU time consumed by the process
+// Returns the CPU time (user + system)
+func getProcessCPUTime() time.Duration {
+	handle, err := syscall.GetCurrentProcess()
+
+	if err != nil {
+		return 0
+	}
+
+	var creationTime, exitTime, kernelTime, userTime syscall.Filetime
+
+	err = syscall.GetProcessTimes(handle, &creationTime, &exitTime, &kernelTime, &userTime)
+
+	if err != nil {
+		return 0
+	}
+
+	// Filetime values are expressed in units of 100 nanoseconds
+	kernel := int64(kernelTime.HighDateTime)<<32 | int64(kernelTime.LowDateTime)
+	user := int64(userTime.HighDateTime)<<32 | int64(userTime.LowDateTime)
+
+	return time.Duration((kernel + user) * 100)
+}
@@ -0,0 +1,216 @@
+// FLV file reader and writer
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Size of the FLV file header
+const FLV_HEADER_SIZE = 9
+
+// Size of the header of the FLV tags
+const FLV_TAG_HEADER_SIZE = 11
+
+// Tag of a FLV file
+type FLVTag struct {
+	tagType   uint32 // Type of the tag (RTMP_TYPE_AUDIO, RTMP_TYPE_VIDEO or RTMP_TYPE_DATA)
+	timestamp int64  // Timestamp (milliseconds)
+	data      []byte // Tag data. It is the payload of the RTMP packet
+}
+
+// Checks if the tag is a video keyframe
+// Returns true if it is a video keyframe, not including the sequence headers
+func (tag *FLVTag) IsKeyFrame() bool {
+	return tag.tagType == RTMP_TYPE_VIDEO && len(tag.data) > 1 && (tag.data[0]>>4)&0x0f == 1 && !tag.IsSequenceHeader()
+}
+
+// Checks if the tag is a sequence header (AAC or AVC / HEVC)
+// Returns true if it is a sequence header
+func (tag *FLVTag) IsSequenceHeader() bool {
+	if len(tag.data) < 2 {
+		return false
+	}
+
+	switch tag.tagType {
+	case RTMP_TYPE_AUDIO:
+		soundFormat := (tag.data[0] >> 4) & 0x0f
+		return (soundFormat == 10 || soundFormat == 13) && tag.data[1] == 0
+	case RTMP_TYPE_VIDEO:
+		frameType := (tag.data[0] >> 4) & 0x0f
+		codecId := tag.data[0] & 0x0f
+		return (codecId == 7 || codecId == 12) && frameType == 1 && tag.data[1] == 0
+	default:
+		return false
+	}
+}
+
+// Reader of FLV files
+type FLVReader struct {
+	r *bufio.Reader // Reader of the file
+}
+
+// Creates a FLV reader, reading the file header
+// r - Reader of the file
+// Returns the reader, or an error if the file is not a valid FLV file
+func CreateFLVReader(r io.Reader) (*FLVReader, error) {
+	reader := &FLVReader{
+		r: bufio.NewReader(r),
+	}
+
+	header := make([]byte, FLV_HEADER_SIZE)
+
+	_, err := io.ReadFull(reader.r, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != 'F' || header[1] != 'L' || header[2] != 'V' {
+		return nil, errors.New("not a FLV file")
+	}
+
+	dataOffset := binary.BigEndian.Uint32(header[5:9])
+
+	if dataOffset < FLV_HEADER_SIZE {
+		return nil, errors.New("invalid FLV header size")
+	}
+
+	// Skip the rest of the header and the first previous tag size
+	_, err = reader.r.Discard(int(dataOffset-FLV_HEADER_SIZE) + 4)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Reads the next tag of the file
+// Unknown tag types are skipped
+// Returns the tag, or io.EOF at the end of the file
+func (reader *FLVReader) ReadTag() (*FLVTag, error) {
+	for {
+		header := make([]byte, FLV_TAG_HEADER_SIZE)
+
+		_, err := io.ReadFull(reader.r, header)
+
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF // Truncated file
+			}
+			return nil, err
+		}
+
+		tagType := uint32(header[0] & 0x1f)
+		size := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+		timestamp := int64(header[7])<<24 | int64(header[4])<<16 | int64(header[5])<<8 | int64(header[6])
+
+		data := make([]byte, size)
+
+		_, err = io.ReadFull(reader.r, data)
+
+		if err != nil {
+			return nil, io.EOF // Truncated file
+		}
+
+		// Previous tag size
+		_, err = reader.r.Discard(4)
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		switch tagType {
+		case RTMP_TYPE_AUDIO, RTMP_TYPE_VIDEO, RTMP_TYPE_DATA:
+			if size == 0 {
+				continue
+			}
+
+			return &FLVTag{
+				tagType:   tagType,
+				timestamp: timestamp,
+				data:      data,
+			}, nil
+		}
+	}
+}
+
+// Writer of FLV files
+type FLVWriter struct {
+	w *bufio.Writer // Writer of the file
+}
+
+// Creates a FLV writer, writing the file header
+// w - Writer of the file
+// Returns the writer, or an error if the header could not be written
+func CreateFLVWriter(w io.Writer) (*FLVWriter, error) {
+	writer := &FLVWriter{
+		w: bufio.NewWriter(w),
+	}
+
+	header := make([]byte, FLV_HEADER_SIZE+4)
+
+	header[0] = 'F'
+	header[1] = 'L'
+	header[2] = 'V'
+	header[3] = 1    // Version
+	header[4] = 0x05 // Audio and video
+	binary.BigEndian.PutUint32(header[5:9], FLV_HEADER_SIZE)
+	// The first previous tag size is 0
+
+	_, err := writer.w.Write(header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// Writes a tag to the file
+// tag - The tag
+// Returns an error if the tag could not be written
+func (writer *FLVWriter) WriteTag(tag *FLVTag) error {
+	size := uint32(len(tag.data))
+
+	header := make([]byte, FLV_TAG_HEADER_SIZE)
+
+	header[0] = byte(tag.tagType)
+	header[1] = byte(size >> 16)
+	header[2] = byte(size >> 8)
+	header[3] = byte(size)
+	header[4] = byte(tag.timestamp >> 16)
+	header[5] = byte(tag.timestamp >> 8)
+	header[6] = byte(tag.timestamp)
+	header[7] = byte(tag.timestamp >> 24)
+	// The stream ID is always 0
+
+	_, err := writer.w.Write(header)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.w.Write(tag.data)
+
+	if err != nil {
+		return err
+	}
+
+	previousTagSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(previousTagSize, FLV_TAG_HEADER_SIZE+size)
+
+	_, err = writer.w.Write(previousTagSize)
+
+	return err
+}
+
+// Writes the buffered data to the file
+// Returns an error if the data could not be written
+func (writer *FLVWriter) Flush() error {
+	return writer.w.Flush()
+}
@@ -5,10 +5,12 @@ go 1.22.0
 require (
 	github.com/AgustinSRG/go-simple-rpc-message v1.0.1
 	github.com/AgustinSRG/go-tls-certificate-loader v1.0.0
+	github.com/BurntSushi/toml v1.6.0
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
 	github.com/redis/go-redis/v9 v9.7.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
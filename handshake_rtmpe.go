@@ -0,0 +1,302 @@
+// RTMPE handshake (Diffie-Hellman key exchange and RC4 encryption)
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Version byte of the RTMPE handshake
+const RTMP_VERSION_RTMPE = 6
+
+// Version byte of the RTMPE handshake with the Flash Player 9 signature transform
+const RTMP_VERSION_RTMPE_FP9 = 8
+
+// Size of the Diffie-Hellman public keys (bytes)
+const RTMPE_DH_KEY_SIZE = 128
+
+// Size of the RC4 keys (bytes)
+const RTMPE_RC4_KEY_SIZE = 16
+
+// Prime of the Diffie-Hellman group (RFC 2409, 1024-bit MODP group)
+var rtmpeDHPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+// Generator of the Diffie-Hellman group
+var rtmpeDHGenerator = big.NewInt(2)
+
+// Number of rounds of the Flash Player 9 signature transform (XTEA)
+const RTMPE_FP9_ROUNDS = 32
+
+// Delta constant of the Flash Player 9 signature transform (XTEA)
+const RTMPE_FP9_DELTA = 0x9E3779B9
+
+// Keys of the Flash Player 9 signature transform (XTEA, 128 bits each)
+var rtmpeFP9Keys = [16][16]byte{
+	{0xb2, 0x34, 0xf0, 0xbf, 0x1f, 0x08, 0xd9, 0x11, 0x95, 0xb7, 0xdf, 0xcc, 0x32, 0xe7, 0x8d, 0x74},
+	{0xb6, 0x5e, 0x6a, 0x08, 0x0e, 0x09, 0x43, 0x17, 0xb8, 0x5a, 0xf0, 0x6e, 0xe2, 0x39, 0x5a, 0xfe},
+	{0x6f, 0x95, 0x10, 0x7b, 0x21, 0x05, 0xce, 0x76, 0x3a, 0xa7, 0x88, 0x23, 0xa1, 0x49, 0x01, 0x44},
+	{0x17, 0xf3, 0x43, 0xa9, 0xb2, 0x1b, 0xf1, 0xeb, 0xee, 0xa5, 0x91, 0xa6, 0x39, 0x63, 0xf3, 0x17},
+	{0x0a, 0xe0, 0x30, 0x7a, 0x2c, 0xe2, 0x29, 0xb5, 0xa5, 0xae, 0x87, 0xa0, 0xac, 0x79, 0xcb, 0xc0},
+	{0x23, 0x0c, 0xce, 0xbd, 0xff, 0xde, 0xeb, 0x2f, 0x16, 0xae, 0xfa, 0x1c, 0x9d, 0x23, 0x23, 0x11},
+	{0x7b, 0x3f, 0xdd, 0x55, 0x2e, 0xe6, 0xe7, 0x77, 0x99, 0xc4, 0xb8, 0x9b, 0xe4, 0x1e, 0x48, 0xc9},
+	{0xb4, 0xb6, 0x7b, 0x40, 0x36, 0x91, 0xe8, 0x71, 0x55, 0xbf, 0xae, 0xa7, 0x39, 0xb8, 0x33, 0xca},
+	{0xc3, 0xbd, 0xf6, 0xfc, 0x97, 0x36, 0x3c, 0xb6, 0x25, 0xf8, 0xe4, 0x7c, 0xb2, 0x59, 0xd9, 0x04},
+	{0xfd, 0x91, 0xe0, 0x28, 0x4c, 0x4c, 0x95, 0x41, 0x00, 0xdb, 0xb7, 0x7f, 0xf8, 0x66, 0xa0, 0xe3},
+	{0x76, 0x5b, 0x84, 0x57, 0x03, 0x1b, 0x25, 0x4f, 0xcd, 0x5b, 0xd4, 0x46, 0x29, 0x0d, 0xc3, 0xa2},
+	{0xf8, 0xee, 0xcc, 0x0a, 0x46, 0xb5, 0x55, 0xda, 0x52, 0x34, 0x47, 0x03, 0x3b, 0x71, 0x63, 0x58},
+	{0xdc, 0x75, 0x20, 0xb8, 0xee, 0x1f, 0x5f, 0xa7, 0xe8, 0x68, 0x42, 0xd8, 0xcc, 0x44, 0x2a, 0xa7},
+	{0x9e, 0x6e, 0xcf, 0x07, 0x25, 0x7b, 0x6d, 0xa1, 0x6c, 0xae, 0xa7, 0x9f, 0x29, 0x56, 0x2f, 0xd9},
+	{0xe4, 0xea, 0xb1, 0xfe, 0xe1, 0x3c, 0x8c, 0x8c, 0xa7, 0x64, 0x00, 0x4e, 0x2a, 0x7c, 0x38, 0x6a},
+	{0x27, 0x94, 0x3a, 0x89, 0xa2, 0x13, 0x30, 0xcc, 0x5b, 0x38, 0x06, 0xf1, 0x27, 0xf9, 0x29, 0xa8},
+}
+
+// Gets the offset of the Diffie-Hellman public key in a handshake signature
+// messageFormat - Message format (MESSAGE_FORMAT_1 or MESSAGE_FORMAT_2)
+// sig - The signature
+// Returns the offset
+func getRTMPEDHOffset(messageFormat uint32, sig []byte) uint32 {
+	var offset uint32
+
+	if messageFormat == MESSAGE_FORMAT_1 {
+		offset = uint32(sig[1532]) + uint32(sig[1533]) + uint32(sig[1534]) + uint32(sig[1535])
+		offset = (offset % 632) + 772
+	} else {
+		offset = uint32(sig[768]) + uint32(sig[769]) + uint32(sig[770]) + uint32(sig[771])
+		offset = (offset % 632) + 8
+	}
+
+	return offset
+}
+
+// Gets the offset of the digest in a handshake signature
+// messageFormat - Message format (MESSAGE_FORMAT_1 or MESSAGE_FORMAT_2)
+// sig - The signature
+// Returns the offset
+func getRTMPEDigestOffset(messageFormat uint32, sig []byte) uint32 {
+	if messageFormat == MESSAGE_FORMAT_1 {
+		return GetClientGenuineConstDigestOffset(sig[8:12])
+	}
+
+	return GetServerGenuineConstDigestOffset(sig[772:776])
+}
+
+// Converts a Diffie-Hellman key to bytes, with a fixed size
+// n - The key
+// Returns the bytes (big endian)
+func rtmpeDHKeyToBytes(n *big.Int) []byte {
+	b := make([]byte, RTMPE_DH_KEY_SIZE)
+	n.FillBytes(b)
+	return b
+}
+
+// Generates the first part of the RTMPE server handshake response
+// The Diffie-Hellman public key and the digest are placed using the same scheme as the client
+// messageFormat - Client message format
+// publicKey - Diffie-Hellman public key of the server
+// Returns the response
+func generateRTMPES1(messageFormat uint32, publicKey []byte) []byte {
+	s1 := make([]byte, RTMP_SIG_SIZE)
+
+	_, err := rand.Read(s1[8:])
+
+	if err != nil {
+		// This should never happen
+		panic(err)
+	}
+
+	copy(s1[4:8], []byte{1, 2, 3, 4})
+
+	dhOffset := getRTMPEDHOffset(messageFormat, s1)
+	copy(s1[dhOffset:dhOffset+RTMPE_DH_KEY_SIZE], publicKey)
+
+	digestOffset := getRTMPEDigestOffset(messageFormat, s1)
+
+	msg := make([]byte, 0, RTMP_SIG_SIZE-SHA256DL)
+	msg = append(msg, s1[:digestOffset]...)
+	msg = append(msg, s1[digestOffset+SHA256DL:]...)
+
+	copy(s1[digestOffset:digestOffset+SHA256DL], calcHmac(msg, []byte(GenuineFMSConst)))
+
+	return s1
+}
+
+// Encrypts a block of a handshake signature with the Flash Player 9 transform (XTEA)
+// block - The block (8 bytes), encrypted in place
+// keyIndex - Index of the key in rtmpeFP9Keys
+func rtmpeFP9TransformBlock(block []byte, keyIndex int) {
+	key := rtmpeFP9Keys[keyIndex]
+
+	var k [4]uint32
+
+	for i := 0; i < 4; i++ {
+		k[i] = binary.LittleEndian.Uint32(key[i*4 : i*4+4])
+	}
+
+	v0 := binary.LittleEndian.Uint32(block[0:4])
+	v1 := binary.LittleEndian.Uint32(block[4:8])
+
+	var sum uint32 = 0
+
+	for i := 0; i < RTMPE_FP9_ROUNDS; i++ {
+		v0 += (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + k[sum&3])
+		sum += RTMPE_FP9_DELTA
+		v1 += (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + k[(sum>>11)&3])
+	}
+
+	binary.LittleEndian.PutUint32(block[0:4], v0)
+	binary.LittleEndian.PutUint32(block[4:8], v1)
+}
+
+// Applies the Flash Player 9 transform to the signature of the second part of the server handshake response
+// Each block of the signature is encrypted with a key selected by the digest used to sign it
+// messageFormat - Client message format
+// clientSig - Client signature
+// s2 - Second part of the response, modified in place
+func transformRTMPES2FP9(messageFormat uint32, clientSig []byte, s2 []byte) {
+	challengeKeyOffset := getRTMPEDigestOffset(messageFormat, clientSig)
+	digest := calcHmac(clientSig[challengeKeyOffset:challengeKeyOffset+SHA256DL], GenuineFMSConstCrud)
+
+	signature := s2[RTMP_SIG_SIZE-SHA256DL:]
+
+	for i := 0; i < SHA256DL; i += 8 {
+		rtmpeFP9TransformBlock(signature[i:i+8], int(digest[i])%15)
+	}
+}
+
+// Creates a RC4 cipher for RTMPE
+// The key is derived from the shared secret and a public key.
+// The first part of the keystream is discarded, as it is used by the handshake.
+// secret - The shared secret
+// publicKey - The public key
+// Returns the cipher
+func createRTMPECipher(secret []byte, publicKey []byte) *rc4.Cipher {
+	key := calcHmac(publicKey, secret)[:RTMPE_RC4_KEY_SIZE]
+
+	cipher, err := rc4.NewCipher(key)
+
+	if err != nil {
+		// This should never happen, the key size is valid
+		panic(err)
+	}
+
+	skip := make([]byte, RTMP_SIG_SIZE)
+	cipher.XORKeyStream(skip, skip)
+
+	return cipher
+}
+
+// Generates a RTMPE handshake response
+// version - Version byte sent by the client (RTMP_VERSION_RTMPE or RTMP_VERSION_RTMPE_FP9)
+// clientSig - Client signature received (C1)
+// Returns the response to send to the client, and the ciphers to decrypt the incoming data and to encrypt the outgoing data
+func generateRTMPES0S1S2(version byte, clientSig []byte) ([]byte, *rc4.Cipher, *rc4.Cipher, error) {
+	messageFormat := detectClientMessageFormat(clientSig)
+
+	if messageFormat == MESSAGE_FORMAT_0 {
+		return nil, nil, nil, errors.New("the client signature has no valid digest")
+	}
+
+	// Diffie-Hellman key exchange
+	clientKeyOffset := getRTMPEDHOffset(messageFormat, clientSig)
+	clientPublicKey := clientSig[clientKeyOffset : clientKeyOffset+RTMPE_DH_KEY_SIZE]
+
+	y := new(big.Int).SetBytes(clientPublicKey)
+	pMinusOne := new(big.Int).Sub(rtmpeDHPrime, big.NewInt(1))
+
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(pMinusOne) >= 0 {
+		return nil, nil, nil, errors.New("invalid Diffie-Hellman public key")
+	}
+
+	privateKey, err := rand.Int(rand.Reader, pMinusOne)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	privateKey.Add(privateKey, big.NewInt(1))
+
+	serverPublicKey := rtmpeDHKeyToBytes(new(big.Int).Exp(rtmpeDHGenerator, privateKey, rtmpeDHPrime))
+	secret := rtmpeDHKeyToBytes(new(big.Int).Exp(y, privateKey, rtmpeDHPrime))
+
+	// Response
+	s1 := generateRTMPES1(messageFormat, serverPublicKey)
+	s2 := generateS2(messageFormat, clientSig)
+
+	if version == RTMP_VERSION_RTMPE_FP9 {
+		transformRTMPES2FP9(messageFormat, clientSig, s2)
+	}
+
+	response := make([]byte, 0, 1+2*RTMP_SIG_SIZE)
+	response = append(response, version)
+	response = append(response, s1...)
+	response = append(response, s2...)
+
+	// The client encrypts with the key derived from the server public key
+	cipherIn := createRTMPECipher(secret, serverPublicKey)
+	cipherOut := createRTMPECipher(secret, clientPublicKey)
+
+	return response, cipherIn, cipherOut, nil
+}
+
+// Reader decrypting the data of a RTMPE connection
+type RTMPEReader struct {
+	r      io.Reader   // Reader of the encrypted data
+	cipher *rc4.Cipher // Cipher to decrypt the data
+}
+
+// Reads and decrypts data
+func (r *RTMPEReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+
+	if n > 0 {
+		r.cipher.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+// Connection encrypting the data sent to a RTMPE client
+// The received data must be read with RTMPEReader
+type RTMPEConn struct {
+	net.Conn // The underlying connection
+
+	mutex *sync.Mutex // Mutex to keep the keystream in order
+
+	cipher *rc4.Cipher // Cipher to encrypt the data
+}
+
+// Creates a RTMPE connection
+// conn - The underlying connection
+// cipher - Cipher to encrypt the data
+// Returns the connection
+func CreateRTMPEConn(conn net.Conn, cipher *rc4.Cipher) *RTMPEConn {
+	return &RTMPEConn{
+		Conn:   conn,
+		mutex:  &sync.Mutex{},
+		cipher: cipher,
+	}
+}
+
+// Encrypts and sends data
+func (c *RTMPEConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	encrypted := make([]byte, len(b))
+	c.cipher.XORKeyStream(encrypted, b)
+
+	return c.Conn.Write(encrypted)
+}
@@ -0,0 +1,129 @@
+// Tests for the RTMPE handshake
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"math/big"
+	"testing"
+)
+
+// Builds a RTMPE client signature (C1), using the message format 1
+// publicKey - Diffie-Hellman public key of the client
+// Returns the signature
+func buildRTMPEClientSignature(publicKey []byte) []byte {
+	c1 := make([]byte, RTMP_SIG_SIZE)
+
+	_, err := rand.Read(c1[8:])
+
+	if err != nil {
+		panic(err)
+	}
+
+	dhOffset := getRTMPEDHOffset(MESSAGE_FORMAT_1, c1)
+	copy(c1[dhOffset:dhOffset+RTMPE_DH_KEY_SIZE], publicKey)
+
+	digestOffset := getRTMPEDigestOffset(MESSAGE_FORMAT_1, c1)
+
+	msg := make([]byte, 0, RTMP_SIG_SIZE-SHA256DL)
+	msg = append(msg, c1[:digestOffset]...)
+	msg = append(msg, c1[digestOffset+SHA256DL:]...)
+
+	copy(c1[digestOffset:digestOffset+SHA256DL], calcHmac(msg, []byte(GenuineFPConst)))
+
+	return c1
+}
+
+func TestRTMPEHandshake(t *testing.T) {
+	for _, version := range []byte{RTMP_VERSION_RTMPE, RTMP_VERSION_RTMPE_FP9} {
+		privateKey := big.NewInt(0x1234567890abcdef)
+		clientPublicKey := rtmpeDHKeyToBytes(new(big.Int).Exp(rtmpeDHGenerator, privateKey, rtmpeDHPrime))
+
+		c1 := buildRTMPEClientSignature(clientPublicKey)
+
+		response, cipherIn, cipherOut, err := generateRTMPES0S1S2(version, c1)
+
+		if err != nil {
+			t.Fatalf("version %d: unexpected error: %v", version, err)
+		}
+
+		if len(response) != 1+2*RTMP_SIG_SIZE || response[0] != version {
+			t.Fatalf("version %d: invalid response", version)
+		}
+
+		// The server signature (S1) must have a valid digest
+		s1 := response[1 : 1+RTMP_SIG_SIZE]
+		digestOffset := getRTMPEDigestOffset(MESSAGE_FORMAT_1, s1)
+
+		msg := make([]byte, 0, RTMP_SIG_SIZE-SHA256DL)
+		msg = append(msg, s1[:digestOffset]...)
+		msg = append(msg, s1[digestOffset+SHA256DL:]...)
+
+		if !bytes.Equal(s1[digestOffset:digestOffset+SHA256DL], calcHmac(msg, []byte(GenuineFMSConst))) {
+			t.Fatalf("version %d: invalid S1 digest", version)
+		}
+
+		// The client derives the same keys from the server public key
+		dhOffset := getRTMPEDHOffset(MESSAGE_FORMAT_1, s1)
+		serverPublicKey := s1[dhOffset : dhOffset+RTMPE_DH_KEY_SIZE]
+		secret := rtmpeDHKeyToBytes(new(big.Int).Exp(new(big.Int).SetBytes(serverPublicKey), privateKey, rtmpeDHPrime))
+
+		clientCipherOut := createRTMPECipher(secret, serverPublicKey)
+		clientCipherIn := createRTMPECipher(secret, clientPublicKey)
+
+		checkRTMPECiphers(t, clientCipherOut, cipherIn)
+		checkRTMPECiphers(t, cipherOut, clientCipherIn)
+	}
+}
+
+// Checks that data encrypted with a cipher is decrypted with another one
+// t - The test
+// encrypt - Cipher to encrypt
+// decrypt - Cipher to decrypt
+func checkRTMPECiphers(t *testing.T, encrypt *rc4.Cipher, decrypt *rc4.Cipher) {
+	data := []byte("RTMP chunk data")
+	encrypted := make([]byte, len(data))
+	decrypted := make([]byte, len(data))
+
+	encrypt.XORKeyStream(encrypted, data)
+	decrypt.XORKeyStream(decrypted, encrypted)
+
+	if bytes.Equal(encrypted, data) || !bytes.Equal(decrypted, data) {
+		t.Fatalf("the ciphers do not match")
+	}
+}
+
+func TestRTMPEHandshakeInvalid(t *testing.T) {
+	pMinusOne := new(big.Int).Sub(rtmpeDHPrime, big.NewInt(1))
+
+	unsigned := make([]byte, RTMP_SIG_SIZE)
+
+	_, err := rand.Read(unsigned[8:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		c1   []byte
+	}{
+		{name: "no digest", c1: unsigned},
+		{name: "public key 0", c1: buildRTMPEClientSignature(rtmpeDHKeyToBytes(big.NewInt(0)))},
+		{name: "public key 1", c1: buildRTMPEClientSignature(rtmpeDHKeyToBytes(big.NewInt(1)))},
+		{name: "public key p-1", c1: buildRTMPEClientSignature(rtmpeDHKeyToBytes(pMinusOne))},
+		{name: "public key p", c1: buildRTMPEClientSignature(rtmpeDHKeyToBytes(rtmpeDHPrime))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := generateRTMPES0S1S2(RTMP_VERSION_RTMPE, test.c1)
+
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
@@ -5,6 +5,8 @@ import "github.com/joho/godotenv"
 func main() {
 	_ = godotenv.Load() // Load env vars
 
+	LoadConfig() // Load and validate the configuration
+
 	InitLog() // Initializes log utils
 
 	LogInfo("RTMP Server (Golang Implementation)")
@@ -0,0 +1,738 @@
+// MP4 file reader (ISO base media file format), for VOD playback
+// Supports non-fragmented files with AVC / HEVC video and AAC audio
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Max size of the movie box (moov) of a MP4 file
+const MP4_MAX_MOOV_SIZE = 64 * 1024 * 1024
+
+// Max number of samples of a MP4 track
+const MP4_MAX_TRACK_SAMPLES = 16 * 1024 * 1024
+
+// Max size of the data of a MP4 sample, leaving room for the FLV video header
+const MP4_MAX_SAMPLE_SIZE = VOD_MAX_SAMPLE_SIZE - 5
+
+// Size of the fixed fields of a visual sample entry (avc1, hvc1...)
+const MP4_VISUAL_SAMPLE_ENTRY_SIZE = 78
+
+// Size of the fixed fields of an audio sample entry (mp4a)
+const MP4_AUDIO_SAMPLE_ENTRY_SIZE = 28
+
+// Box of a MP4 file
+type MP4Box struct {
+	boxType string // Type of the box (4 characters)
+	data    []byte // Data of the box, without the header
+}
+
+// Reader of the fields of a MP4 box
+// If the data is too short, the fields are read as 0, and the error flag is set
+type MP4FieldReader struct {
+	data []byte // The data
+	pos  int    // Current position
+	err  bool   // True if the data was too short
+}
+
+// Reads bytes
+// n - Number of bytes
+// Returns the bytes, or nil if the data is too short
+func (r *MP4FieldReader) Bytes(n int) []byte {
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = true
+		r.pos = len(r.data)
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b
+}
+
+// Skips bytes
+// n - Number of bytes
+func (r *MP4FieldReader) Skip(n int) {
+	r.Bytes(n)
+}
+
+// Reads an unsigned 8 bit integer
+func (r *MP4FieldReader) U8() uint32 {
+	b := r.Bytes(1)
+
+	if b == nil {
+		return 0
+	}
+
+	return uint32(b[0])
+}
+
+// Reads an unsigned 16 bit integer
+func (r *MP4FieldReader) U16() uint32 {
+	b := r.Bytes(2)
+
+	if b == nil {
+		return 0
+	}
+
+	return uint32(binary.BigEndian.Uint16(b))
+}
+
+// Reads an unsigned 32 bit integer
+func (r *MP4FieldReader) U32() uint32 {
+	b := r.Bytes(4)
+
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+// Reads an unsigned 64 bit integer
+func (r *MP4FieldReader) U64() uint64 {
+	b := r.Bytes(8)
+
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+// Parses the boxes contained in some data
+// data - The data
+// Returns the list of boxes
+func mp4ParseBoxes(data []byte) []*MP4Box {
+	boxes := make([]*MP4Box, 0)
+
+	r := &MP4FieldReader{data: data}
+
+	for r.pos+8 <= len(data) {
+		start := r.pos
+		size := uint64(r.U32())
+		boxType := string(r.Bytes(4))
+
+		switch size {
+		case 0:
+			size = uint64(len(data) - start)
+		case 1:
+			size = r.U64()
+		}
+
+		headerSize := uint64(r.pos - start)
+
+		if size < headerSize || size > uint64(len(data)-start) {
+			break
+		}
+
+		boxes = append(boxes, &MP4Box{
+			boxType: boxType,
+			data:    data[r.pos : start+int(size)],
+		})
+
+		r.pos = start + int(size)
+	}
+
+	return boxes
+}
+
+// Finds a box by type
+// boxes - The list of boxes
+// boxType - The type
+// Returns the first box of that type, or nil if not found
+func mp4FindBox(boxes []*MP4Box, boxType string) *MP4Box {
+	for i := 0; i < len(boxes); i++ {
+		if boxes[i].boxType == boxType {
+			return boxes[i]
+		}
+	}
+
+	return nil
+}
+
+// Finds a box by path
+// data - Data containing the boxes
+// path - Types of the boxes, from the outer to the inner one
+// Returns the box, or nil if not found
+func mp4FindBoxPath(data []byte, path ...string) *MP4Box {
+	var box *MP4Box
+
+	for i := 0; i < len(path); i++ {
+		box = mp4FindBox(mp4ParseBoxes(data), path[i])
+
+		if box == nil {
+			return nil
+		}
+
+		data = box.data
+	}
+
+	return box
+}
+
+// Reads the movie box (moov) of a MP4 file
+// f - The file
+// fileSize - Size of the file
+// Returns the data of the box
+func mp4ReadMovieBox(f io.ReaderAt, fileSize int64) ([]byte, error) {
+	header := make([]byte, 16)
+	pos := int64(0)
+
+	for pos+8 <= fileSize {
+		n, err := f.ReadAt(header, pos)
+
+		if n < 8 {
+			return nil, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			size = fileSize - pos
+		case 1:
+			if n < 16 {
+				return nil, errors.New("invalid MP4 box")
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+
+		if size < headerSize || pos+size > fileSize {
+			return nil, errors.New("invalid MP4 box")
+		}
+
+		if boxType == "moov" {
+			if size-headerSize > MP4_MAX_MOOV_SIZE {
+				return nil, errors.New("the MP4 movie box is too large")
+			}
+
+			data := make([]byte, size-headerSize)
+
+			_, err = f.ReadAt(data, pos+headerSize)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return data, nil
+		}
+
+		pos += size
+	}
+
+	return nil, errors.New("the MP4 file has no movie box (fragmented MP4 files are not supported)")
+}
+
+// Track of a MP4 file
+type MP4Track struct {
+	handler   string // Handler type (vide, soun)
+	timescale uint32 // Time units per second
+
+	codec          uint32 // Codec (FLV codec ID)
+	sequenceHeader []byte // Sequence header, as the payload of the RTMP packet
+	width          uint32 // Video width (pixels)
+	height         uint32 // Video height (pixels)
+
+	samples []VODSample // Samples of the track
+}
+
+// Parses the codec configuration of a track (sample description box)
+// track - The track
+// stsd - Data of the sample description box
+// Returns an error if the codec is not supported
+func (track *MP4Track) parseSampleDescription(stsd []byte) error {
+	r := &MP4FieldReader{data: stsd}
+	r.Skip(8) // Version, flags and entry count
+
+	entries := mp4ParseBoxes(r.Bytes(len(stsd) - r.pos))
+
+	if len(entries) == 0 {
+		return errors.New("no sample description")
+	}
+
+	entry := entries[0]
+
+	switch entry.boxType {
+	case "avc1", "avc3", "hvc1", "hev1":
+		er := &MP4FieldReader{data: entry.data}
+		er.Skip(24)
+		track.width = er.U16()
+		track.height = er.U16()
+
+		if len(entry.data) < MP4_VISUAL_SAMPLE_ENTRY_SIZE {
+			return errors.New("invalid video sample description")
+		}
+
+		children := mp4ParseBoxes(entry.data[MP4_VISUAL_SAMPLE_ENTRY_SIZE:])
+
+		configType := "avcC"
+		track.codec = 7
+
+		if entry.boxType == "hvc1" || entry.boxType == "hev1" {
+			configType = "hvcC"
+			track.codec = 12
+		}
+
+		config := mp4FindBox(children, configType)
+
+		if config == nil {
+			return errors.New("no " + configType + " box")
+		}
+
+		track.sequenceHeader = append([]byte{0x10 | byte(track.codec), 0, 0, 0, 0}, config.data...)
+	case "mp4a":
+		er := &MP4FieldReader{data: entry.data}
+		er.Skip(8)
+		version := er.U16()
+
+		offset := MP4_AUDIO_SAMPLE_ENTRY_SIZE
+
+		switch version {
+		case 1:
+			offset += 16
+		case 2:
+			offset += 36
+		}
+
+		if len(entry.data) < offset {
+			return errors.New("invalid audio sample description")
+		}
+
+		esds := mp4FindBox(mp4ParseBoxes(entry.data[offset:]), "esds")
+
+		if esds == nil {
+			return errors.New("no esds box")
+		}
+
+		config := mp4ParseAudioSpecificConfig(esds.data)
+
+		if config == nil {
+			return errors.New("no AAC audio specific config")
+		}
+
+		track.codec = 10
+		track.sequenceHeader = append([]byte{0xaf, 0}, config...)
+	default:
+		return errors.New("unsupported codec: " + entry.boxType)
+	}
+
+	return nil
+}
+
+// Reads the length of a MPEG-4 descriptor
+// r - Reader
+// Returns the length
+func mp4ReadDescriptorLength(r *MP4FieldReader) int {
+	length := 0
+
+	for i := 0; i < 4; i++ {
+		b := r.U8()
+		length = (length << 7) | int(b&0x7f)
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	return length
+}
+
+// Extracts the AAC audio specific config from an elementary stream descriptor box (esds)
+// esds - Data of the box
+// Returns the audio specific config, or nil if not found
+func mp4ParseAudioSpecificConfig(esds []byte) []byte {
+	r := &MP4FieldReader{data: esds}
+	r.Skip(4) // Version and flags
+
+	for !r.err && r.pos < len(esds) {
+		tag := r.U8()
+		length := mp4ReadDescriptorLength(r)
+
+		switch tag {
+		case 0x03: // ES descriptor
+			r.Skip(2) // ES ID
+			flags := r.U8()
+			if flags&0x80 != 0 {
+				r.Skip(2) // Depends on ES ID
+			}
+			if flags&0x40 != 0 {
+				r.Skip(int(r.U8())) // URL
+			}
+			if flags&0x20 != 0 {
+				r.Skip(2) // OCR ES ID
+			}
+		case 0x04: // Decoder config descriptor
+			r.Skip(13)
+		case 0x05: // Decoder specific info
+			return r.Bytes(length)
+		default:
+			r.Skip(length)
+		}
+	}
+
+	return nil
+}
+
+// Reads the entries of a table box (stts, ctts, stsc...)
+// data - Data of the box
+// fields - Number of 32 bit fields of each entry
+// Returns the entries
+func mp4ReadTable(data []byte, fields int) [][]uint32 {
+	r := &MP4FieldReader{data: data}
+	r.Skip(4) // Version and flags
+
+	count := int(r.U32())
+
+	if count < 0 || count > (len(data)-r.pos)/(4*fields) {
+		return nil
+	}
+
+	entries := make([][]uint32, count)
+
+	for i := 0; i < count; i++ {
+		entries[i] = make([]uint32, fields)
+
+		for j := 0; j < fields; j++ {
+			entries[i][j] = r.U32()
+		}
+	}
+
+	return entries
+}
+
+// Builds the sample list of a track from its sample table box (stbl)
+// track - The track
+// stbl - Data of the sample table box
+// fileSize - Size of the file
+// Returns an error if the sample table is not valid
+func (track *MP4Track) parseSampleTable(stbl []byte, fileSize int64) error {
+	boxes := mp4ParseBoxes(stbl)
+
+	stsz := mp4FindBox(boxes, "stsz")
+	stts := mp4FindBox(boxes, "stts")
+	stsc := mp4FindBox(boxes, "stsc")
+
+	if stsz == nil || stts == nil || stsc == nil {
+		return errors.New("incomplete sample table")
+	}
+
+	// Sample sizes
+	r := &MP4FieldReader{data: stsz.data}
+	r.Skip(4)
+	sampleSize := r.U32()
+	count := int(r.U32())
+
+	// The sizes of the samples are in the sample size box, unless all of them
+	// have the same size. In that case, all of them must fit in the file
+	if sampleSize == 0 {
+		if count > (len(stsz.data)-r.pos)/4 {
+			return errors.New("invalid sample sizes")
+		}
+	} else if sampleSize > MP4_MAX_SAMPLE_SIZE || int64(count)*int64(sampleSize) > fileSize {
+		return errors.New("invalid sample sizes")
+	}
+
+	if count > MP4_MAX_TRACK_SAMPLES {
+		return errors.New("too many samples")
+	}
+
+	samples := make([]VODSample, count)
+
+	for i := 0; i < count; i++ {
+		samples[i].size = sampleSize
+
+		if sampleSize == 0 {
+			samples[i].size = r.U32()
+
+			if samples[i].size > MP4_MAX_SAMPLE_SIZE {
+				return errors.New("the MP4 sample " + strconv.Itoa(i) + " is too large")
+			}
+		}
+	}
+
+	// Chunk offsets
+	chunkOffsets := make([]int64, 0)
+
+	if stco := mp4FindBox(boxes, "stco"); stco != nil {
+		for _, e := range mp4ReadTable(stco.data, 1) {
+			chunkOffsets = append(chunkOffsets, int64(e[0]))
+		}
+	} else if co64 := mp4FindBox(boxes, "co64"); co64 != nil {
+		for _, e := range mp4ReadTable(co64.data, 2) {
+			chunkOffsets = append(chunkOffsets, int64(e[0])<<32|int64(e[1]))
+		}
+	}
+
+	// Sample offsets
+	chunks := mp4ReadTable(stsc.data, 3)
+	s := 0
+
+	for i := 0; i < len(chunks) && s < count; i++ {
+		firstChunk := int(chunks[i][0]) - 1
+		lastChunk := len(chunkOffsets)
+
+		if i+1 < len(chunks) {
+			lastChunk = min(lastChunk, int(chunks[i+1][0])-1)
+		}
+
+		for c := max(0, firstChunk); c < lastChunk && s < count; c++ {
+			offset := chunkOffsets[c]
+
+			for j := uint32(0); j < chunks[i][1] && s < count; j++ {
+				samples[s].offset = offset
+				offset += int64(samples[s].size)
+				s++
+			}
+		}
+	}
+
+	if s < count {
+		return errors.New("invalid sample to chunk table")
+	}
+
+	// Timestamps
+	if track.timescale == 0 {
+		return errors.New("invalid timescale")
+	}
+
+	decodeTimes := make([]int64, count)
+	s = 0
+	t := int64(0)
+
+	for _, e := range mp4ReadTable(stts.data, 2) {
+		for j := uint32(0); j < e[0] && s < count; j++ {
+			decodeTimes[s] = t
+			t += int64(e[1])
+			s++
+		}
+	}
+
+	for ; s < count; s++ {
+		decodeTimes[s] = t
+	}
+
+	compositionOffsets := make([]int64, count)
+
+	if ctts := mp4FindBox(boxes, "ctts"); ctts != nil {
+		s = 0
+
+		for _, e := range mp4ReadTable(ctts.data, 2) {
+			for j := uint32(0); j < e[0] && s < count; j++ {
+				compositionOffsets[s] = int64(int32(e[1])) // Signed in version 1, small enough in version 0
+				s++
+			}
+		}
+	}
+
+	timescale := int64(track.timescale)
+
+	for i := 0; i < count; i++ {
+		samples[i].timestamp = decodeTimes[i] * 1000 / timescale
+		samples[i].compositionTime = (decodeTimes[i]+compositionOffsets[i])*1000/timescale - samples[i].timestamp
+	}
+
+	// Keyframes (every video sample, if there is no sync sample box)
+	if track.handler == "vide" {
+		if stss := mp4FindBox(boxes, "stss"); stss != nil {
+			for _, e := range mp4ReadTable(stss.data, 1) {
+				if e[0] >= 1 && int(e[0]) <= count {
+					samples[e[0]-1].keyFrame = true
+				}
+			}
+		} else {
+			for i := 0; i < count; i++ {
+				samples[i].keyFrame = true
+			}
+		}
+	}
+
+	tagType := uint32(RTMP_TYPE_AUDIO)
+
+	if track.handler == "vide" {
+		tagType = RTMP_TYPE_VIDEO
+	}
+
+	for i := 0; i < count; i++ {
+		samples[i].tagType = tagType
+	}
+
+	track.samples = samples
+
+	return nil
+}
+
+// Parses a track box (trak)
+// trak - Data of the box
+// fileSize - Size of the file
+// Returns the track, or an error if the track is not a supported audio or video track
+func mp4ParseTrack(trak []byte, fileSize int64) (*MP4Track, error) {
+	mdia := mp4FindBoxPath(trak, "mdia")
+
+	if mdia == nil {
+		return nil, errors.New("no media box")
+	}
+
+	track := &MP4Track{}
+
+	if hdlr := mp4FindBoxPath(mdia.data, "hdlr"); hdlr != nil && len(hdlr.data) >= 12 {
+		track.handler = string(hdlr.data[8:12])
+	}
+
+	if track.handler != "vide" && track.handler != "soun" {
+		return nil, errors.New("not an audio or video track")
+	}
+
+	if mdhd := mp4FindBoxPath(mdia.data, "mdhd"); mdhd != nil {
+		r := &MP4FieldReader{data: mdhd.data}
+
+		if r.U8() == 1 {
+			r.Skip(19)
+		} else {
+			r.Skip(11)
+		}
+
+		track.timescale = r.U32()
+	}
+
+	stbl := mp4FindBoxPath(mdia.data, "minf", "stbl")
+
+	if stbl == nil {
+		return nil, errors.New("no sample table")
+	}
+
+	stsd := mp4FindBoxPath(stbl.data, "stsd")
+
+	if stsd == nil {
+		return nil, errors.New("no sample description")
+	}
+
+	err := track.parseSampleDescription(stsd.data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = track.parseSampleTable(stbl.data, fileSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
+
+// Builds the metadata of a MP4 file
+// duration - Duration (milliseconds)
+// video - Video track, or nil
+// audio - Audio track, or nil
+// Returns the encoded metadata
+func mp4BuildMetadata(duration int64, video *MP4Track, audio *MP4Track) []byte {
+	dataObj := createAMF0Value(AMF0_TYPE_OBJECT)
+
+	setNumber := func(name string, val float64) {
+		v := createAMF0Value(AMF0_TYPE_NUMBER)
+		v.SetFloatVal(val)
+		dataObj.obj_val[name] = &v
+	}
+
+	setNumber("duration", float64(duration)/1000)
+
+	if video != nil {
+		setNumber("width", float64(video.width))
+		setNumber("height", float64(video.height))
+		setNumber("videocodecid", float64(video.codec))
+	}
+
+	if audio != nil {
+		setNumber("audiocodecid", float64(audio.codec))
+	}
+
+	data := RTMPData{
+		tag:       "onMetaData",
+		arguments: make(map[string]*AMF0Value),
+	}
+
+	data.arguments["dataObj"] = &dataObj
+
+	return data.Encode()
+}
+
+// Indexes a MP4 file for VOD playback
+// The first supported video track and the first supported audio track are used
+// Edit lists are ignored
+// vod - The VOD file
+// fileSize - Size of the file
+// Returns an error if the file is not a valid MP4 file
+func indexMP4File(vod *VODFile, fileSize int64) error {
+	moov, err := mp4ReadMovieBox(vod.file, fileSize)
+
+	if err != nil {
+		return err
+	}
+
+	var video *MP4Track
+	var audio *MP4Track
+
+	for _, box := range mp4ParseBoxes(moov) {
+		if box.boxType != "trak" {
+			continue
+		}
+
+		track, err := mp4ParseTrack(box.data, fileSize)
+
+		if err != nil {
+			LogDebug("Skipped MP4 track: " + err.Error())
+			continue
+		}
+
+		if track.handler == "vide" && video == nil {
+			video = track
+		} else if track.handler == "soun" && audio == nil {
+			audio = track
+		}
+	}
+
+	if video == nil && audio == nil {
+		return errors.New("the MP4 file has no supported tracks")
+	}
+
+	vod.samples = make([]VODSample, 0)
+
+	if video != nil {
+		vod.videoCodec = video.codec
+		vod.avcSequenceHeader = video.sequenceHeader
+		vod.samples = append(vod.samples, video.samples...)
+	}
+
+	if audio != nil {
+		vod.audioCodec = audio.codec
+		vod.aacSequenceHeader = audio.sequenceHeader
+		vod.samples = append(vod.samples, audio.samples...)
+	}
+
+	sort.SliceStable(vod.samples, func(i, j int) bool {
+		return vod.samples[i].timestamp < vod.samples[j].timestamp
+	})
+
+	for i := 0; i < len(vod.samples); i++ {
+		if vod.samples[i].offset+int64(vod.samples[i].size) > fileSize {
+			return errors.New("the MP4 sample " + strconv.Itoa(i) + " is out of the file")
+		}
+
+		vod.duration = max(vod.duration, vod.samples[i].timestamp)
+	}
+
+	vod.metaData = mp4BuildMetadata(vod.duration, video, audio)
+
+	return nil
+}
@@ -0,0 +1,244 @@
+// PROXY protocol (v1 and v2)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max time to wait for the PROXY protocol header
+const PROXY_PROTOCOL_HEADER_TIMEOUT = 5 * time.Second
+
+// Max length of a PROXY protocol v1 header, including CRLF
+const PROXY_PROTOCOL_V1_MAX_LENGTH = 107
+
+// Signature of the PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Configuration of the PROXY protocol
+type ProxyProtocolConfig struct {
+	trusted []*net.IPNet // Trusted source networks. If empty, no source is trusted
+}
+
+// Loads the PROXY protocol configuration from the environment variables
+// The PROXY protocol is not enabled without trusted sources, since any client could fake its address
+// Returns the configuration, or nil if disabled
+func loadProxyProtocolConfig() *ProxyProtocolConfig {
+	if os.Getenv("PROXY_PROTOCOL") != "YES" {
+		return nil
+	}
+
+	config := ProxyProtocolConfig{
+		trusted: parseIPNetList(os.Getenv("PROXY_PROTOCOL_TRUSTED")),
+	}
+
+	if len(config.trusted) == 0 {
+		LogWarning("PROXY protocol is not enabled, since PROXY_PROTOCOL_TRUSTED is not set.")
+		return nil
+	}
+
+	LogInfo("PROXY protocol enabled")
+
+	return &config
+}
+
+// Parses a comma-separated list of IP addresses or ranges (CIDR)
+// list - The list
+// Returns the parsed networks
+func parseIPNetList(list string) []*net.IPNet {
+	result := make([]*net.IPNet, 0)
+
+	parts := strings.Split(list, ",")
+
+	for i := 0; i < len(parts); i++ {
+		part := strings.TrimSpace(parts[i])
+
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+
+			if ip == nil {
+				LogWarning("Invalid IP address: " + part)
+				continue
+			}
+
+			if ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+
+		_, rang, e := net.ParseCIDR(part)
+
+		if e != nil {
+			LogError(e)
+			continue
+		}
+
+		result = append(result, rang)
+	}
+
+	return result
+}
+
+// Checks if a source is trusted to send the PROXY protocol header
+// ip - The source IP address
+// Returns true if trusted
+func (config *ProxyProtocolConfig) IsTrusted(ip net.IP) bool {
+	for i := 0; i < len(config.trusted); i++ {
+		if config.trusted[i].Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads the PROXY protocol header from a connection
+// Only reads the header bytes, so the rest of the data can be read from the connection
+// c - The connection
+// Returns the address of the client, or nil if the header does not contain it (LOCAL or UNKNOWN)
+func readProxyProtocolHeader(c net.Conn) (net.IP, error) {
+	err := c.SetReadDeadline(time.Now().Add(PROXY_PROTOCOL_HEADER_TIMEOUT))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	// Every header is at least 12 bytes long (the shortest v1 header is 15)
+	start := make([]byte, 12)
+
+	_, err = io.ReadFull(c, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(c)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyProtocolV1Header(c, start)
+	}
+
+	return nil, errors.New("invalid PROXY protocol header")
+}
+
+// Reads the rest of a PROXY protocol v1 header
+// c - The connection
+// start - The bytes already read
+// Returns the address of the client, or nil if UNKNOWN
+func readProxyProtocolV1Header(c net.Conn, start []byte) (net.IP, error) {
+	line := start
+	b := make([]byte, 1)
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= PROXY_PROTOCOL_V1_MAX_LENGTH {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+
+		_, err := io.ReadFull(c, b)
+
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b[0])
+	}
+
+	// PROXY PROTOCOL SRC_ADDR DST_ADDR SRC_PORT DST_PORT
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(parts) < 2 {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+
+	switch parts[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(parts) != 6 {
+			return nil, errors.New("invalid PROXY protocol v1 header")
+		}
+
+		ip := net.ParseIP(parts[2])
+
+		if ip == nil {
+			return nil, errors.New("invalid source address in PROXY protocol v1 header")
+		}
+
+		return ip, nil
+	default:
+		return nil, errors.New("unknown protocol in PROXY protocol v1 header: " + parts[1])
+	}
+}
+
+// Reads the rest of a PROXY protocol v2 header (after the signature)
+// c - The connection
+// Returns the address of the client, or nil if LOCAL or not an IP address
+func readProxyProtocolV2Header(c net.Conn) (net.IP, error) {
+	header := make([]byte, 4)
+
+	_, err := io.ReadFull(c, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	version := header[0] >> 4
+	command := header[0] & 0x0F
+	family := header[1] >> 4
+	length := binary.BigEndian.Uint16(header[2:4])
+
+	if version != 2 {
+		return nil, errors.New("unsupported PROXY protocol version: " + strconv.Itoa(int(version)))
+	}
+
+	addresses := make([]byte, length)
+
+	_, err = io.ReadFull(c, addresses)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x00: // LOCAL
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, errors.New("unknown command in PROXY protocol v2 header")
+	}
+
+	switch family {
+	case 0x01: // AF_INET
+		if len(addresses) < 12 {
+			return nil, errors.New("invalid PROXY protocol v2 header")
+		}
+
+		return net.IP(addresses[0:4]), nil
+	case 0x02: // AF_INET6
+		if len(addresses) < 36 {
+			return nil, errors.New("invalid PROXY protocol v2 header")
+		}
+
+		return net.IP(addresses[0:16]), nil
+	default:
+		return nil, nil // AF_UNSPEC or AF_UNIX
+	}
+}
@@ -0,0 +1,161 @@
+// Tests for the PROXY protocol header parser
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// Builds a PROXY protocol v2 header
+// command - Command (0x00 LOCAL, 0x01 PROXY)
+// family - Address family (0x01 AF_INET, 0x02 AF_INET6)
+// addresses - Address block
+// Returns the header
+func buildProxyProtocolV2Header(command byte, family byte, addresses []byte) []byte {
+	header := make([]byte, 0, 16+len(addresses))
+	header = append(header, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x01)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	header = append(header, addresses...)
+
+	return header
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4Addresses := []byte{
+		192, 168, 1, 10, // Source address
+		10, 0, 0, 1, // Destination address
+		0x30, 0x39, // Source port
+		0x07, 0x8f, // Destination port
+	}
+
+	ipv6Addresses := make([]byte, 36)
+	copy(ipv6Addresses, net.ParseIP("2001:db8::1"))
+	copy(ipv6Addresses[16:], net.ParseIP("2001:db8::2"))
+
+	tests := []struct {
+		name   string
+		header []byte
+		ip     string // Expected address, or empty if nil
+		err    bool   // True if an error is expected
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 192.168.1.10 10.0.0.1 12345 1935\r\n"), ip: "192.168.1.10"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 1935\r\n"), ip: "2001:db8::1"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 UNKNOWN with addresses", header: []byte("PROXY UNKNOWN 192.168.1.10 10.0.0.1 12345 1935\r\n")},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 192.168.1.10 10.0.0.1\r\n"), err: true},
+		{name: "v1 invalid address", header: []byte("PROXY TCP4 192.168.1.300 10.0.0.1 12345 1935\r\n"), err: true},
+		{name: "v1 unknown protocol", header: []byte("PROXY UDP4 192.168.1.10 10.0.0.1 12345 1935\r\n"), err: true},
+		{name: "v1 too long", header: []byte("PROXY TCP6 " + string(make([]byte, PROXY_PROTOCOL_V1_MAX_LENGTH)) + "\r\n"), err: true},
+		{name: "v2 IPv4", header: buildProxyProtocolV2Header(0x01, 0x01, ipv4Addresses), ip: "192.168.1.10"},
+		{name: "v2 IPv6", header: buildProxyProtocolV2Header(0x01, 0x02, ipv6Addresses), ip: "2001:db8::1"},
+		{name: "v2 LOCAL", header: buildProxyProtocolV2Header(0x00, 0x00, nil)},
+		{name: "v2 AF_UNSPEC", header: buildProxyProtocolV2Header(0x01, 0x00, nil)},
+		{name: "v2 TLVs after the addresses", header: buildProxyProtocolV2Header(0x01, 0x01, append(ipv4Addresses, 0x04, 0x00, 0x01, 0x00)), ip: "192.168.1.10"},
+		{name: "v2 short IPv4 block", header: buildProxyProtocolV2Header(0x01, 0x01, ipv4Addresses[:8]), err: true},
+		{name: "v2 short IPv6 block", header: buildProxyProtocolV2Header(0x01, 0x02, ipv6Addresses[:32]), err: true},
+		{name: "v2 unknown command", header: buildProxyProtocolV2Header(0x02, 0x01, ipv4Addresses), err: true},
+		{name: "v2 invalid version", header: append(append([]byte{}, proxyProtocolV2Signature...), 0x11, 0x11, 0x00, 0x00), err: true},
+		{name: "no header", header: []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			// The data after the header must be left in the connection
+			go func() {
+				client.Write(test.header)    //nolint:errcheck
+				client.Write([]byte("RTMP")) //nolint:errcheck
+			}()
+
+			ip, err := readProxyProtocolHeader(server)
+
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got address %v", ip)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if test.ip == "" {
+				if ip != nil {
+					t.Fatalf("expected no address, got %v", ip)
+				}
+			} else if !ip.Equal(net.ParseIP(test.ip)) {
+				t.Fatalf("expected address %v, got %v", test.ip, ip)
+			}
+
+			rest := make([]byte, 4)
+
+			_, err = io.ReadFull(server, rest)
+
+			if err != nil || string(rest) != "RTMP" {
+				t.Fatalf("the data after the header was not preserved: %q, %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolIsTrusted(t *testing.T) {
+	config := &ProxyProtocolConfig{
+		trusted: parseIPNetList("10.0.0.0/8, 192.168.1.10, ::1"),
+	}
+
+	tests := []struct {
+		ip      string
+		trusted bool
+	}{
+		{ip: "10.1.2.3", trusted: true},
+		{ip: "192.168.1.10", trusted: true},
+		{ip: "::1", trusted: true},
+		{ip: "192.168.1.11", trusted: false},
+		{ip: "11.0.0.1", trusted: false},
+	}
+
+	for _, test := range tests {
+		if got := config.IsTrusted(net.ParseIP(test.ip)); got != test.trusted {
+			t.Errorf("IsTrusted(%s) = %v, expected %v", test.ip, got, test.trusted)
+		}
+	}
+
+	empty := &ProxyProtocolConfig{}
+
+	if empty.IsTrusted(net.ParseIP("10.1.2.3")) {
+		t.Errorf("an empty trusted list must not trust any address")
+	}
+}
+
+func TestLoadProxyProtocolConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		trusted string
+		result  bool // True if the PROXY protocol is expected to be enabled
+	}{
+		{name: "disabled", enabled: "NO", trusted: "10.0.0.0/8", result: false},
+		{name: "no trusted sources", enabled: "YES", trusted: "", result: false},
+		{name: "only invalid trusted sources", enabled: "YES", trusted: "invalid", result: false},
+		{name: "trusted sources", enabled: "YES", trusted: "10.0.0.0/8", result: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("PROXY_PROTOCOL", test.enabled)
+			t.Setenv("PROXY_PROTOCOL_TRUSTED", test.trusted)
+
+			if config := loadProxyProtocolConfig(); (config != nil) != test.result {
+				t.Fatalf("expected enabled = %v, got %v", test.result, config != nil)
+			}
+		})
+	}
+}
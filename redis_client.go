@@ -0,0 +1,143 @@
+// Redis client
+
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Checks if Redis is enabled
+// Returns true if REDIS_USE is set to YES
+func isRedisEnabled() bool {
+	return os.Getenv("REDIS_USE") == "YES"
+}
+
+// Splits a list of addresses separated by commas
+// list - The list
+// Returns the addresses
+func splitAddressList(list string) []string {
+	result := make([]string, 0)
+
+	parts := strings.Split(list, ",")
+
+	for i := 0; i < len(parts); i++ {
+		addr := strings.TrimSpace(parts[i])
+
+		if addr != "" {
+			result = append(result, addr)
+		}
+	}
+
+	return result
+}
+
+// Creates a Redis client using the configuration from the environment variables
+// Depending on the configuration, it connects to a single Redis instance,
+// to a master using Redis Sentinel, or to a Redis Cluster
+// Returns the client
+func CreateRedisClient() redis.UniversalClient {
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+
+	var tlsConfig *tls.Config
+
+	if os.Getenv("REDIS_TLS") == "YES" {
+		tlsConfig = &tls.Config{}
+	}
+
+	sentinelMaster := os.Getenv("REDIS_SENTINEL_MASTER")
+
+	if sentinelMaster != "" {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       sentinelMaster,
+			SentinelAddrs:    splitAddressList(os.Getenv("REDIS_SENTINEL_ADDRESSES")),
+			SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+			Password:         redisPassword,
+			TLSConfig:        tlsConfig,
+		})
+	}
+
+	clusterAddresses := os.Getenv("REDIS_CLUSTER_ADDRESSES")
+
+	if clusterAddresses != "" {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     splitAddressList(clusterAddresses),
+			Password:  redisPassword,
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	redisHost := os.Getenv("REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+
+	redisPort := os.Getenv("REDIS_PORT")
+	if redisPort == "" {
+		redisPort = "6379"
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:      redisHost + ":" + redisPort,
+		Password:  redisPassword,
+		TLSConfig: tlsConfig,
+	})
+}
+
+// Status of the connection to Redis
+type RedisStatus struct {
+	mutex *sync.Mutex // Mutex to access the status
+
+	connected bool   // True if the connection is working
+	lastError string // Last connection error
+	since     int64  // Time of the last status change (unix milliseconds)
+}
+
+// Status of the connection to Redis, updated by the command receiver
+var redisStatus = RedisStatus{
+	mutex: &sync.Mutex{},
+}
+
+// Sets the Redis connection as working
+func (rs *RedisStatus) SetConnected() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if !rs.connected {
+		rs.since = time.Now().UnixMilli()
+	}
+
+	rs.connected = true
+	rs.lastError = ""
+}
+
+// Sets the Redis connection as not working
+// err - The connection error
+func (rs *RedisStatus) SetDisconnected(err error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if rs.connected || rs.since == 0 {
+		rs.since = time.Now().UnixMilli()
+	}
+
+	rs.connected = false
+	rs.lastError = err.Error()
+}
+
+// Gets the status of the Redis connection
+// Returns:
+//   - connected - True if the connection is working
+//   - lastError - Last connection error
+//   - since - Time of the last status change (unix milliseconds)
+func (rs *RedisStatus) Get() (connected bool, lastError string, since int64) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return rs.connected, rs.lastError, rs.since
+}
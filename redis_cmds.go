@@ -4,73 +4,116 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-func setupRedisCommandReceiver(server *RTMPServer) {
-	useRedis := os.Getenv("REDIS_USE")
+// Reply to a Redis command
+type RedisCommandReply struct {
+	RequestId string      `json:"request_id,omitempty"` // Request ID provided with the command
+	Command   string      `json:"command"`              // Command name
+	Node      string      `json:"node"`                 // ID of the server node
+	Success   bool        `json:"success"`              // True if the command was successful
+	Error     string      `json:"error,omitempty"`      // Error message, if not successful
+	Data      interface{} `json:"data,omitempty"`       // Result data, depending on the command
+}
+
+// Min time to wait before subscribing again after an error
+const REDIS_RESUBSCRIBE_MIN_DELAY = 1 * time.Second
 
-	if useRedis != "YES" {
+// Max time to wait before subscribing again after an error
+const REDIS_RESUBSCRIBE_MAX_DELAY = 60 * time.Second
+
+// Listens for commands sent via Redis
+// Subscribes again with backoff if the subscription breaks
+// Runs indefinitely. Call in a separate routine.
+// server - Reference to the RTMP server
+func setupRedisCommandReceiver(server *RTMPServer) {
+	if !isRedisEnabled() {
 		return // Not using redis
 	}
 
+	redisChannel := os.Getenv("REDIS_CHANNEL")
+
+	if redisChannel == "" {
+		redisChannel = "rtmp_commands"
+	}
+
+	redisReplyChannel := os.Getenv("REDIS_REPLY_CHANNEL")
+
+	if redisReplyChannel == "" {
+		redisReplyChannel = "rtmp_replies"
+	}
+
+	redisClient := CreateRedisClient()
+
+	verifier := CreateRedisCommandVerifier()
+
+	delay := REDIS_RESUBSCRIBE_MIN_DELAY
+
+	for {
+		if runRedisCommandReceiver(server, redisClient, verifier, redisChannel, redisReplyChannel) {
+			delay = REDIS_RESUBSCRIBE_MIN_DELAY // Reset the backoff after a working subscription
+		}
+
+		LogWarning("Connection to Redis lost! Subscribing again in " + delay.String())
+
+		time.Sleep(delay)
+
+		delay *= 2
+
+		if delay > REDIS_RESUBSCRIBE_MAX_DELAY {
+			delay = REDIS_RESUBSCRIBE_MAX_DELAY
+		}
+	}
+}
+
+// Subscribes to the commands channel and runs the received commands
+// Returns when the subscription breaks
+// server - Reference to the RTMP server
+// redisClient - Redis client
+// verifier - Verifier for signed commands, or nil if the commands are not signed
+// redisChannel - Channel to listen for commands
+// redisReplyChannel - Channel to publish the replies
+// Returns true if the subscription was established before breaking
+func runRedisCommandReceiver(server *RTMPServer, redisClient redis.UniversalClient, verifier *RedisCommandVerifier, redisChannel string, redisReplyChannel string) (subscribed bool) {
 	defer func() {
 		if err := recover(); err != nil {
 			switch x := err.(type) {
 			case string:
+				redisStatus.SetDisconnected(errors.New(x))
 				LogError(errors.New(x))
 			case error:
+				redisStatus.SetDisconnected(x)
 				LogError(x)
 			default:
+				redisStatus.SetDisconnected(errors.New("could not connect to redis"))
 				LogError(errors.New("could not connect to redis"))
 			}
 		}
-		LogWarning("Connection to Redis lost!")
 	}()
 
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = "localhost"
-	}
-
-	redisPort := os.Getenv("REDIS_PORT")
-	if redisPort == "" {
-		redisPort = "6379"
-	}
-
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-	redisChannel := os.Getenv("REDIS_CHANNEL")
-
-	if redisChannel == "" {
-		redisChannel = "rtmp_commands"
-	}
-
-	redisTLS := os.Getenv("REDIS_TLS")
-
 	ctx := context.Background()
 
-	var redisClient *redis.Client
+	subscriber := redisClient.Subscribe(ctx, redisChannel)
+	defer subscriber.Close()
+
+	// Wait for the subscription to be confirmed
+	_, err := subscriber.Receive(ctx)
 
-	if redisTLS == "YES" {
-		redisClient = redis.NewClient(&redis.Options{
-			Addr:      redisHost + ":" + redisPort,
-			Password:  redisPassword,
-			TLSConfig: &tls.Config{},
-		})
-	} else {
-		redisClient = redis.NewClient(&redis.Options{
-			Addr:     redisHost + ":" + redisPort,
-			Password: redisPassword,
-		})
+	if err != nil {
+		redisStatus.SetDisconnected(err)
+		LogWarning("Could not connect to Redis: " + err.Error())
+		return false
 	}
 
-	subscriber := redisClient.Subscribe(ctx, redisChannel)
+	redisStatus.SetConnected()
 
 	LogInfo("[REDIS] Listening for commands on channel '" + redisChannel + "'")
 
@@ -78,16 +121,62 @@ func setupRedisCommandReceiver(server *RTMPServer) {
 		msg, err := subscriber.ReceiveMessage(ctx)
 
 		if err != nil {
-			LogWarning("Could not connect to Redis: " + err.Error())
-			time.Sleep(10 * time.Second)
-		} else {
-			// Parse message
-			parseRedisCommand(server, msg.Payload)
+			redisStatus.SetDisconnected(err)
+			LogWarning("Could not receive messages from Redis: " + err.Error())
+			return true
+		}
+
+		redisStatus.SetConnected()
+
+		cmd := msg.Payload
+
+		if verifier != nil {
+			verifiedCmd, err := verifier.Verify(cmd)
+
+			if err != nil {
+				LogWarning("Rejected Redis command: " + err.Error() + " | " + cmd)
+				continue
+			}
+
+			cmd = verifiedCmd
 		}
+
+		// Parse message
+		reply := parseRedisCommand(server, cmd)
+
+		if reply != nil {
+			sendRedisCommandReply(ctx, redisClient, redisReplyChannel, reply)
+		}
+	}
+}
+
+// Sends the reply of a command
+// ctx - Context
+// redisClient - Redis client
+// replyChannel - Channel to publish the reply
+// reply - The reply
+func sendRedisCommandReply(ctx context.Context, redisClient redis.UniversalClient, replyChannel string, reply *RedisCommandReply) {
+	reply.Node = getNodeId()
+
+	payload, e := json.Marshal(reply)
+
+	if e != nil {
+		LogError(e)
+		return
+	}
+
+	e = redisClient.Publish(ctx, replyChannel, string(payload)).Err()
+
+	if e != nil {
+		LogWarning("[REDIS] Could not send reply: " + e.Error())
 	}
 }
 
-func parseRedisCommand(server *RTMPServer, cmd string) {
+// Parses and runs a command received from Redis
+// server - Reference to the RTMP server
+// cmd - The command message: COMMAND[#REQUEST_ID]>ARG_1|ARG2|...
+// Returns the reply, or nil if the message is invalid
+func parseRedisCommand(server *RTMPServer, cmd string) (reply *RedisCommandReply) {
 	defer func() {
 		if err := recover(); err != nil {
 			switch x := err.(type) {
@@ -98,45 +187,215 @@ func parseRedisCommand(server *RTMPServer, cmd string) {
 			default:
 				LogError(errors.New("parsing error"))
 			}
+			LogWarning("Could not parse message: " + cmd)
+			reply = nil
 		}
-		LogWarning("Could not parse message: " + cmd)
 	}()
 
-	parts := strings.Split(cmd, ">")
+	parts := strings.SplitN(cmd, ">", 2)
 	if len(parts) != 2 {
 		LogWarning("Invalid message from Redis: " + cmd)
-		return // Invalid message
+		return nil // Invalid message
 	}
 
 	cmdName := parts[0]
+	requestId := ""
+
+	if i := strings.Index(cmdName, "#"); i >= 0 {
+		requestId = cmdName[i+1:]
+		cmdName = cmdName[:i]
+	}
+
 	cmdArgs := strings.Split(parts[1], "|")
 
+	reply = &RedisCommandReply{
+		RequestId: requestId,
+		Command:   cmdName,
+	}
+
+	data, err := runRedisCommand(server, cmdName, cmdArgs)
+
+	if err != nil {
+		LogWarning("Redis command failed: " + cmd + " | " + err.Error())
+		reply.Success = false
+		reply.Error = err.Error()
+	} else {
+		reply.Success = true
+		reply.Data = data
+	}
+
+	return reply
+}
+
+// Runs a command received from Redis
+// server - Reference to the RTMP server
+// cmdName - The command name
+// cmdArgs - The command arguments
+// Returns the result data, or an error
+func runRedisCommand(server *RTMPServer, cmdName string, cmdArgs []string) (interface{}, error) {
 	switch cmdName {
 	case "kill-session":
-		if len(cmdArgs) < 1 {
-			LogWarning("Invalid message from Redis: " + cmd)
-			return
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: kill-session>CHANNEL")
 		}
+
 		channel := cmdArgs[0]
 		publisher := server.GetPublisher(channel)
 
-		if publisher != nil {
-			publisher.Kill()
+		if publisher == nil {
+			return nil, errors.New("channel is not being published")
 		}
+
+		publisher.KillWithReason(PUBLISH_END_REASON_KILLED_REDIS)
 	case "close-stream":
 		if len(cmdArgs) < 2 {
-			LogWarning("Invalid message from Redis: " + cmd)
-			return
+			return nil, errors.New("usage: close-stream>CHANNEL|STREAM_ID")
 		}
 
 		channel := cmdArgs[0]
 		streamId := cmdArgs[1]
 		publisher := server.GetPublisher(channel)
 
-		if publisher != nil && publisher.stream_id == streamId {
-			publisher.Kill()
+		if publisher == nil || publisher.stream_id != streamId {
+			return nil, errors.New("stream not found")
+		}
+
+		publisher.KillWithReason(PUBLISH_END_REASON_KILLED_REDIS)
+	case "kick-player":
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: kick-player>CHANNEL|SESSION_ID")
+		}
+
+		var sessionId uint64
+
+		if len(cmdArgs) > 1 && cmdArgs[1] != "" {
+			sid, e := strconv.ParseUint(cmdArgs[1], 10, 64)
+			if e != nil {
+				return nil, errors.New("invalid session ID")
+			}
+			sessionId = sid
+		}
+
+		kicked := server.KickPlayers(cmdArgs[0], sessionId)
+
+		if sessionId != 0 && kicked == 0 {
+			return nil, errors.New("player not found")
+		}
+
+		return map[string]interface{}{"kicked": kicked}, nil
+	case "kill-all":
+		publishers := server.GetPublishers()
+
+		for i := 0; i < len(publishers); i++ {
+			publishers[i].KillWithReason(PUBLISH_END_REASON_KILLED_REDIS)
+		}
+
+		return map[string]interface{}{"killed": len(publishers)}, nil
+	case "list-channels":
+		return server.GetChannelsInfo(), nil
+	case "channel-info":
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: channel-info>CHANNEL")
+		}
+
+		info := server.GetChannelInfo(cmdArgs[0])
+
+		if info == nil {
+			return nil, errors.New("channel not found")
+		}
+
+		return info, nil
+	case "set-max-duration":
+		if len(cmdArgs) < 2 {
+			return nil, errors.New("usage: set-max-duration>CHANNEL|SECONDS")
+		}
+
+		seconds, e := strconv.ParseInt(cmdArgs[1], 10, 64)
+
+		if e != nil || seconds < 0 {
+			return nil, errors.New("invalid duration")
+		}
+
+		publisher := server.GetPublisher(cmdArgs[0])
+
+		if publisher == nil || !publisher.SetMaxDuration(seconds) {
+			return nil, errors.New("channel is not being published")
+		}
+	case "set-delay":
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: set-delay>CHANNEL|SECONDS")
+		}
+
+		seconds := int64(-1)
+
+		if len(cmdArgs) > 1 && cmdArgs[1] != "" {
+			n, e := strconv.ParseInt(cmdArgs[1], 10, 64)
+
+			if e != nil || !isValidBroadcastDelay(n) {
+				return nil, errors.New("invalid delay")
+			}
+
+			seconds = n
+		}
+
+		server.SetBroadcastDelay(cmdArgs[0], seconds)
+	case "dump":
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: dump>CHANNEL")
+		}
+
+		if !server.DumpBroadcastDelay(cmdArgs[0]) {
+			return nil, errors.New("channel is not being published with a broadcast delay")
+		}
+	case "start-record":
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: start-record>CHANNEL")
+		}
+
+		path, e := server.StartRecording(cmdArgs[0])
+
+		if e != nil {
+			return nil, e
+		}
+
+		return map[string]interface{}{"path": path}, nil
+	case "stop-record":
+		if cmdArgs[0] == "" {
+			return nil, errors.New("usage: stop-record>CHANNEL")
+		}
+
+		path, e := server.StopRecording(cmdArgs[0])
+
+		if e != nil {
+			return nil, e
+		}
+
+		return map[string]interface{}{"path": path}, nil
+	case "relay-add":
+		if len(cmdArgs) < 2 || cmdArgs[0] == "" || cmdArgs[1] == "" {
+			return nil, errors.New("usage: relay-add>CHANNEL|URL")
 		}
+
+		e := server.AddRelay(cmdArgs[0], cmdArgs[1])
+
+		if e != nil {
+			return nil, e
+		}
+	case "relay-remove":
+		if len(cmdArgs) < 2 || cmdArgs[0] == "" || cmdArgs[1] == "" {
+			return nil, errors.New("usage: relay-remove>CHANNEL|URL")
+		}
+
+		e := server.RemoveRelay(cmdArgs[0], cmdArgs[1])
+
+		if e != nil {
+			return nil, e
+		}
+	case "drain":
+		server.RequestDrain("a Redis command")
 	default:
-		LogWarning("Unknown Redis command: " + cmd)
+		return nil, errors.New("unknown command")
 	}
+
+	return nil, nil
 }
@@ -0,0 +1,129 @@
+// Redis commands authentication
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REDIS_COMMANDS_DEFAULT_MAX_AGE_SECONDS = 30
+
+// Max length of the nonce of a signed command
+const REDIS_COMMANDS_NONCE_MAX_LENGTH = 128
+
+// Verifies signed Redis commands
+// Signed commands have the following structure: TIMESTAMP:NONCE:SIGNATURE:COMMAND
+//   - TIMESTAMP - Unix timestamp (seconds) when the command was signed
+//   - NONCE - Random string, unique for each command
+//   - SIGNATURE - HMAC-SHA256 of TIMESTAMP:NONCE:COMMAND, using the secret as key, encoded in hexadecimal
+type RedisCommandVerifier struct {
+	mutex *sync.Mutex // Mutex to access the nonces
+
+	secret []byte        // Secret to sign the commands
+	maxAge time.Duration // Max age of the commands
+
+	nonces map[string]int64 // Nonces already used. Map: Nonce -> Expiration (unix milliseconds)
+}
+
+// Creates the command verifier using the configuration from the environment variables
+// Returns the verifier, or nil if the commands are not required to be signed
+func CreateRedisCommandVerifier() *RedisCommandVerifier {
+	secret := os.Getenv("REDIS_COMMANDS_SECRET")
+
+	if secret == "" {
+		return nil
+	}
+
+	verifier := RedisCommandVerifier{
+		mutex:  &sync.Mutex{},
+		secret: []byte(secret),
+		maxAge: REDIS_COMMANDS_DEFAULT_MAX_AGE_SECONDS * time.Second,
+		nonces: make(map[string]int64),
+	}
+
+	customMaxAge := os.Getenv("REDIS_COMMANDS_MAX_AGE_SECONDS")
+	if customMaxAge != "" {
+		n, e := strconv.Atoi(customMaxAge)
+		if e == nil && n > 0 {
+			verifier.maxAge = time.Duration(n) * time.Second
+		}
+	}
+
+	LogInfo("[REDIS] Commands are required to be signed")
+
+	return &verifier
+}
+
+// Verifies a signed command
+// msg - The signed message
+// Returns the command if valid, or an error
+func (v *RedisCommandVerifier) Verify(msg string) (string, error) {
+	parts := strings.SplitN(msg, ":", 4)
+
+	if len(parts) != 4 {
+		return "", errors.New("command is not signed")
+	}
+
+	timestampStr := parts[0]
+	nonce := parts[1]
+	signature := parts[2]
+	cmd := parts[3]
+
+	timestamp, e := strconv.ParseInt(timestampStr, 10, 64)
+
+	if e != nil {
+		return "", errors.New("invalid timestamp")
+	}
+
+	if nonce == "" || len(nonce) > REDIS_COMMANDS_NONCE_MAX_LENGTH {
+		return "", errors.New("invalid nonce")
+	}
+
+	providedSignature, e := hex.DecodeString(signature)
+
+	if e != nil {
+		return "", errors.New("invalid signature")
+	}
+
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(timestampStr + ":" + nonce + ":" + cmd))
+
+	if !hmac.Equal(mac.Sum(nil), providedSignature) {
+		return "", errors.New("invalid signature")
+	}
+
+	now := time.Now()
+	age := now.Sub(time.Unix(timestamp, 0))
+
+	if age > v.maxAge || age < -v.maxAge {
+		return "", errors.New("command is too old or too far in the future")
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	// Remove expired nonces
+	nowMs := now.UnixMilli()
+	for n, exp := range v.nonces {
+		if exp < nowMs {
+			delete(v.nonces, n)
+		}
+	}
+
+	if _, used := v.nonces[nonce]; used {
+		return "", errors.New("nonce already used")
+	}
+
+	// Nonces are kept until the command can no longer be accepted due to its timestamp
+	v.nonces[nonce] = time.Unix(timestamp, 0).Add(v.maxAge).UnixMilli()
+
+	return cmd, nil
+}
@@ -0,0 +1,98 @@
+// Tests for the Redis commands authentication
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Signs a Redis command
+// secret - The secret
+// timestamp - Unix timestamp (seconds)
+// nonce - The nonce
+// cmd - The command
+// Returns the signed message
+func signRedisCommand(secret string, timestamp int64, nonce string, cmd string) string {
+	timestampStr := strconv.FormatInt(timestamp, 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestampStr + ":" + nonce + ":" + cmd))
+
+	return timestampStr + ":" + nonce + ":" + hex.EncodeToString(mac.Sum(nil)) + ":" + cmd
+}
+
+func TestRedisCommandVerifier(t *testing.T) {
+	now := time.Now().Unix()
+	longNonce := string(make([]byte, REDIS_COMMANDS_NONCE_MAX_LENGTH+1))
+
+	tests := []struct {
+		name string
+		msg  string
+		cmd  string // Expected command, or empty if an error is expected
+	}{
+		{name: "valid", msg: signRedisCommand("secret", now, "n1", "kill-session>live|test"), cmd: "kill-session>live|test"},
+		{name: "command with separators", msg: signRedisCommand("secret", now, "n2", "kill-session>live|a:b"), cmd: "kill-session>live|a:b"},
+		{name: "slightly in the future", msg: signRedisCommand("secret", now+10, "n3", "close-stream>live|test"), cmd: "close-stream>live|test"},
+		{name: "replayed nonce", msg: signRedisCommand("secret", now, "n1", "kill-session>live|test")},
+		{name: "wrong secret", msg: signRedisCommand("other", now, "n4", "kill-session>live|test")},
+		{name: "modified command", msg: signRedisCommand("secret", now, "n5", "kill-session>live|test") + "2"},
+		{name: "too old", msg: signRedisCommand("secret", now-60, "n6", "kill-session>live|test")},
+		{name: "too far in the future", msg: signRedisCommand("secret", now+60, "n7", "kill-session>live|test")},
+		{name: "empty nonce", msg: signRedisCommand("secret", now, "", "kill-session>live|test")},
+		{name: "nonce too long", msg: signRedisCommand("secret", now, longNonce, "kill-session>live|test")},
+		{name: "invalid timestamp", msg: "abc:n8:00:kill-session>live|test"},
+		{name: "invalid signature encoding", msg: strconv.FormatInt(now, 10) + ":n9:zz:kill-session>live|test"},
+		{name: "not signed", msg: "kill-session>live|test"},
+	}
+
+	verifier := &RedisCommandVerifier{
+		mutex:  &sync.Mutex{},
+		secret: []byte("secret"),
+		maxAge: REDIS_COMMANDS_DEFAULT_MAX_AGE_SECONDS * time.Second,
+		nonces: make(map[string]int64),
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd, err := verifier.Verify(test.msg)
+
+			if test.cmd == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got command %q", cmd)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if cmd != test.cmd {
+				t.Fatalf("expected command %q, got %q", test.cmd, cmd)
+			}
+		})
+	}
+}
+
+func TestCreateRedisCommandVerifier(t *testing.T) {
+	t.Setenv("REDIS_COMMANDS_SECRET", "")
+
+	if CreateRedisCommandVerifier() != nil {
+		t.Fatalf("the commands must not require a signature without a secret")
+	}
+
+	t.Setenv("REDIS_COMMANDS_SECRET", "secret")
+	t.Setenv("REDIS_COMMANDS_MAX_AGE_SECONDS", "5")
+
+	verifier := CreateRedisCommandVerifier()
+
+	if verifier == nil || verifier.maxAge != 5*time.Second {
+		t.Fatalf("expected a verifier with a max age of 5 seconds")
+	}
+}
@@ -0,0 +1,291 @@
+// Redis events
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Version of the JSON schema of the events
+// Increment it when a breaking change is made to the schema
+const REDIS_EVENTS_SCHEMA_VERSION = 1
+
+// Max number of events waiting to be sent
+const REDIS_EVENTS_QUEUE_SIZE = 1024
+
+// Event names
+const (
+	REDIS_EVENT_PUBLISH_START      = "publish_start"      // A stream started being published
+	REDIS_EVENT_PUBLISH_STOP       = "publish_stop"       // A stream stopped being published
+	REDIS_EVENT_PLAYER_JOIN        = "player_join"        // A player joined a channel
+	REDIS_EVENT_PLAYER_LEAVE       = "player_leave"       // A player left a channel
+	REDIS_EVENT_RELAY_STATUS       = "relay_status"       // The status of a relay changed
+	REDIS_EVENT_RECORDING_FINISHED = "recording_finished" // A recording finished
+)
+
+// Lifecycle event published to Redis
+type RedisEvent struct {
+	Version   int                    `json:"version"`              // Schema version (REDIS_EVENTS_SCHEMA_VERSION)
+	Event     string                 `json:"event"`                // Event name
+	Timestamp int64                  `json:"timestamp"`            // Event time (unix milliseconds)
+	Node      string                 `json:"node"`                 // ID of the server node
+	Channel   string                 `json:"channel"`              // Streaming channel
+	StreamId  string                 `json:"stream_id,omitempty"`  // Stream ID
+	SessionId uint64                 `json:"session_id,omitempty"` // ID of the session that caused the event
+	ClientIP  string                 `json:"client_ip,omitempty"`  // IP address of the client
+	Data      map[string]interface{} `json:"data,omitempty"`       // Extra data, depending on the event
+}
+
+// Publishes lifecycle events to a Redis Pub/Sub channel or a Redis stream
+type RedisEventPublisher struct {
+	client redis.UniversalClient // Redis client
+
+	channel      string // Pub/Sub channel to publish the events. Empty if not used
+	stream       string // Stream to add the events (XADD). Empty if not used
+	streamMaxLen int64  // Max length of the stream. 0 for no limit
+
+	node string // ID of the server node
+
+	queue chan *RedisEvent // Queue of events waiting to be sent
+}
+
+// Creates the Redis event publisher using the configuration from the environment variables
+// Returns the publisher, or nil if the events are disabled
+func CreateRedisEventPublisher() *RedisEventPublisher {
+	if !isRedisEnabled() {
+		return nil
+	}
+
+	channel := os.Getenv("REDIS_EVENTS_CHANNEL")
+	stream := os.Getenv("REDIS_EVENTS_STREAM")
+
+	if channel == "" && stream == "" {
+		return nil
+	}
+
+	var streamMaxLen int64
+
+	customStreamMaxLen := os.Getenv("REDIS_EVENTS_STREAM_MAX_LEN")
+	if customStreamMaxLen != "" {
+		n, e := strconv.ParseInt(customStreamMaxLen, 10, 64)
+		if e == nil && n > 0 {
+			streamMaxLen = n
+		}
+	}
+
+	publisher := RedisEventPublisher{
+		client:       CreateRedisClient(),
+		channel:      channel,
+		stream:       stream,
+		streamMaxLen: streamMaxLen,
+		node:         getNodeId(),
+		queue:        make(chan *RedisEvent, REDIS_EVENTS_QUEUE_SIZE),
+	}
+
+	if channel != "" {
+		LogInfo("[REDIS] Publishing events on channel '" + channel + "'")
+	}
+
+	if stream != "" {
+		LogInfo("[REDIS] Adding events to stream '" + stream + "'")
+	}
+
+	go publisher.Run()
+
+	return &publisher
+}
+
+// Gets the ID of the server node, to identify it in the events
+// Returns NODE_ID or the host name if not set
+func getNodeId() string {
+	nodeId := os.Getenv("NODE_ID")
+
+	if nodeId != "" {
+		return nodeId
+	}
+
+	hostname, e := os.Hostname()
+
+	if e != nil {
+		return ""
+	}
+
+	return hostname
+}
+
+// Queues an event to be sent
+// Does not block. If the queue is full, the event is discarded.
+// event - The event
+func (p *RedisEventPublisher) Send(event *RedisEvent) {
+	event.Version = REDIS_EVENTS_SCHEMA_VERSION
+	event.Timestamp = time.Now().UnixMilli()
+	event.Node = p.node
+
+	select {
+	case p.queue <- event:
+	default:
+		LogWarning("[REDIS] Event queue is full. Discarded event: " + event.Event)
+	}
+}
+
+// Sends the queued events
+// Runs indefinitely. Call in a separate routine.
+func (p *RedisEventPublisher) Run() {
+	ctx := context.Background()
+
+	for event := range p.queue {
+		payload, e := json.Marshal(event)
+
+		if e != nil {
+			LogError(e)
+			continue
+		}
+
+		if p.channel != "" {
+			e = p.client.Publish(ctx, p.channel, string(payload)).Err()
+
+			if e != nil {
+				LogWarning("[REDIS] Could not publish event: " + e.Error())
+			}
+		}
+
+		if p.stream != "" {
+			args := redis.XAddArgs{
+				Stream: p.stream,
+				Values: map[string]interface{}{"event": string(payload)},
+			}
+
+			if p.streamMaxLen > 0 {
+				args.MaxLen = p.streamMaxLen
+				args.Approx = true
+			}
+
+			e = p.client.XAdd(ctx, &args).Err()
+
+			if e != nil {
+				LogWarning("[REDIS] Could not add event to stream: " + e.Error())
+			}
+		}
+
+		if LOG_DEBUG_ENABLED {
+			LogDebug("[REDIS] Event sent: " + string(payload))
+		}
+	}
+}
+
+// Sends the publish_start event
+// Call only for publishers
+func (s *RTMPSession) SendPublishStartEvent() {
+	if s.server.redisEvents == nil {
+		return
+	}
+
+	s.server.redisEvents.Send(&RedisEvent{
+		Event:     REDIS_EVENT_PUBLISH_START,
+		Channel:   s.channel,
+		StreamId:  s.stream_id,
+		SessionId: s.id,
+		ClientIP:  s.ip,
+	})
+}
+
+// Sends the publish_stop event
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+func (s *RTMPSession) SendPublishStopEvent(reason string) {
+	if s.server.redisEvents == nil {
+		return
+	}
+
+	s.server.redisEvents.Send(&RedisEvent{
+		Event:     REDIS_EVENT_PUBLISH_STOP,
+		Channel:   s.channel,
+		StreamId:  s.stream_id,
+		SessionId: s.id,
+		ClientIP:  s.ip,
+		Data:      s.GetPublishStatsData(reason),
+	})
+}
+
+// Sends the player_join event
+// Call only for players
+func (s *RTMPSession) SendPlayerJoinEvent() {
+	if s.server.redisEvents == nil {
+		return
+	}
+
+	s.server.redisEvents.Send(&RedisEvent{
+		Event:     REDIS_EVENT_PLAYER_JOIN,
+		Channel:   s.channel,
+		SessionId: s.id,
+		ClientIP:  s.ip,
+	})
+}
+
+// Sends the player_leave event
+// Call only for players
+func (s *RTMPSession) SendPlayerLeaveEvent() {
+	if s.server.redisEvents == nil {
+		return
+	}
+
+	s.server.redisEvents.Send(&RedisEvent{
+		Event:     REDIS_EVENT_PLAYER_LEAVE,
+		Channel:   s.channel,
+		SessionId: s.id,
+		ClientIP:  s.ip,
+	})
+}
+
+// Sends the relay_status event
+// output - The relay output
+// status - The status of the relay (RTMP_OUTPUT_STATUS_*)
+// err - The error of the relay, or nil
+func (server *RTMPServer) SendRelayStatusEvent(output *RTMPOutput, status string, err error) {
+	if server.redisEvents == nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"url":    output.target,
+		"status": status,
+	}
+
+	if err != nil {
+		data["error"] = err.Error()
+	}
+
+	server.redisEvents.Send(&RedisEvent{
+		Event:    REDIS_EVENT_RELAY_STATUS,
+		Channel:  output.channel,
+		StreamId: output.streamId,
+		Data:     data,
+	})
+}
+
+// Sends the recording_finished event
+// output - The recording output
+// path - Path of the file
+// size - Size of the file (bytes)
+func (server *RTMPServer) SendRecordingFinishedEvent(output *RTMPOutput, path string, size int64) {
+	if server.redisEvents == nil {
+		return
+	}
+
+	server.redisEvents.Send(&RedisEvent{
+		Event:    REDIS_EVENT_RECORDING_FINISHED,
+		Channel:  output.channel,
+		StreamId: output.streamId,
+		Data: map[string]interface{}{
+			"path":     path,
+			"duration": output.position.Load(),
+			"size":     size,
+		},
+	})
+}
@@ -0,0 +1,272 @@
+// Redis channel registry
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const REDIS_REGISTRY_DEFAULT_PREFIX = "rtmp:channel:"
+const REDIS_REGISTRY_DEFAULT_TTL_SECONDS = 30
+const REDIS_REGISTRY_DEFAULT_HEARTBEAT_SECONDS = 10
+
+// Timeout for the registry operations
+const REDIS_REGISTRY_OPERATION_TIMEOUT = 5 * time.Second
+
+// Timeout for claiming a channel, since the publish request waits for it
+const REDIS_REGISTRY_CLAIM_TIMEOUT = 1 * time.Second
+
+// Sets the entry of a channel if it is free or owned by the same claim
+// An entry of this node with another token can only be taken over by a new claim (left by a previous process of this node)
+// KEYS[1] - Channel key
+// ARGV - Node address, node ID, stream ID, start time, TTL (milliseconds), claim token, takeover (1 or 0)
+// Returns 1 if set, 0 if the channel is owned by another node or claim
+var redisRegistryClaimScript = redis.NewScript(`
+local entry = redis.call('HMGET', KEYS[1], 'node', 'token')
+if entry[1] then
+	if entry[1] ~= ARGV[1] then
+		return 0
+	end
+	if entry[2] ~= ARGV[6] and ARGV[7] ~= '1' then
+		return 0
+	end
+end
+redis.call('HSET', KEYS[1], 'node', ARGV[1], 'node_id', ARGV[2], 'stream_id', ARGV[3], 'start_time', ARGV[4], 'token', ARGV[6])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// Removes the entry of a channel if it is owned by the claim
+// KEYS[1] - Channel key
+// ARGV - Node address, claim token
+// Returns 1 if removed, 0 otherwise
+var redisRegistryReleaseScript = redis.NewScript(`
+local entry = redis.call('HMGET', KEYS[1], 'node', 'token')
+if entry[1] == ARGV[1] and entry[2] == ARGV[2] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Creates a random token to identify a claim of a channel
+// Returns the token
+func createRegistryToken() string {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
+
+// Registry of live channels stored in Redis
+// Allows to know which node of the cluster is hosting each channel
+type RedisChannelRegistry struct {
+	server *RTMPServer // Reference to the RTMP server
+
+	client redis.UniversalClient // Redis client
+
+	prefix    string        // Prefix for the channel keys
+	ttl       time.Duration // Time to live of the channel keys
+	heartbeat time.Duration // Interval to refresh the channel keys
+
+	node   string // Address of this node
+	nodeId string // ID of this node
+
+	mutex  *sync.Mutex       // Mutex to access the claims
+	claims map[string]string // Channels claimed by this node. Map: Channel ID -> Claim token
+}
+
+// Creates the channel registry using the configuration from the environment variables
+// server - Reference to the RTMP server
+// Returns the registry, or nil if disabled
+func CreateRedisChannelRegistry(server *RTMPServer) *RedisChannelRegistry {
+	if !isRedisEnabled() || os.Getenv("REDIS_REGISTRY") != "YES" {
+		return nil
+	}
+
+	registry := RedisChannelRegistry{
+		server:    server,
+		client:    CreateRedisClient(),
+		prefix:    REDIS_REGISTRY_DEFAULT_PREFIX,
+		ttl:       REDIS_REGISTRY_DEFAULT_TTL_SECONDS * time.Second,
+		heartbeat: REDIS_REGISTRY_DEFAULT_HEARTBEAT_SECONDS * time.Second,
+		node:      getNodeAddress(server),
+		nodeId:    getNodeId(),
+		mutex:     &sync.Mutex{},
+		claims:    make(map[string]string),
+	}
+
+	customPrefix := os.Getenv("REDIS_REGISTRY_PREFIX")
+	if customPrefix != "" {
+		registry.prefix = customPrefix
+	}
+
+	customTTL := os.Getenv("REDIS_REGISTRY_TTL_SECONDS")
+	if customTTL != "" {
+		n, e := strconv.Atoi(customTTL)
+		if e == nil && n > 0 {
+			registry.ttl = time.Duration(n) * time.Second
+		}
+	}
+
+	customHeartbeat := os.Getenv("REDIS_REGISTRY_HEARTBEAT_SECONDS")
+	if customHeartbeat != "" {
+		n, e := strconv.Atoi(customHeartbeat)
+		if e == nil && n > 0 {
+			registry.heartbeat = time.Duration(n) * time.Second
+		}
+	}
+
+	if registry.heartbeat >= registry.ttl {
+		LogWarning("[REDIS] REDIS_REGISTRY_HEARTBEAT_SECONDS should be lower than REDIS_REGISTRY_TTL_SECONDS")
+	}
+
+	LogInfo("[REDIS] Registering live channels as node '" + registry.node + "'")
+
+	go registry.RunHeartBeatLoop()
+
+	return &registry
+}
+
+// Gets the address of this node, to store it in the registry
+// server - Reference to the RTMP server
+// Returns the address (host:port)
+func getNodeAddress(server *RTMPServer) string {
+	nodeAddress := os.Getenv("REDIS_REGISTRY_NODE_ADDRESS")
+
+	if nodeAddress != "" {
+		return nodeAddress
+	}
+
+	externalIP := os.Getenv("EXTERNAL_IP")
+
+	if externalIP != "" {
+		externalPort := os.Getenv("EXTERNAL_PORT")
+
+		if externalPort == "" {
+			externalPort = strconv.Itoa(server.port)
+		}
+
+		return externalIP + ":" + externalPort
+	}
+
+	hostname, e := os.Hostname()
+
+	if e != nil {
+		hostname = "localhost"
+	}
+
+	return hostname + ":" + strconv.Itoa(server.port)
+}
+
+// Claims a channel for this node, or refreshes the claim
+// channel - The channel ID
+// token - Token of the claim
+// streamId - The stream ID
+// startTime - Time the stream started (unix milliseconds)
+// Returns false if the channel is being published in another node, or by another claim of this node
+// If Redis is not available, or it does not respond within REDIS_REGISTRY_CLAIM_TIMEOUT, the channel is considered free (fail-open),
+// so an outage of Redis does not stop the streams. The conflicts are detected later, when refreshing the claims.
+func (r *RedisChannelRegistry) Claim(channel string, token string, streamId string, startTime int64) bool {
+	r.mutex.Lock()
+
+	current, claimed := r.claims[channel]
+
+	if claimed && current != token {
+		r.mutex.Unlock()
+		return false
+	}
+
+	r.claims[channel] = token
+
+	r.mutex.Unlock()
+
+	takeover := 0
+
+	if !claimed {
+		takeover = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_REGISTRY_CLAIM_TIMEOUT)
+	defer cancel()
+
+	res, e := redisRegistryClaimScript.Run(ctx, r.client, []string{r.prefix + channel}, r.node, r.nodeId, streamId, startTime, r.ttl.Milliseconds(), token, takeover).Int()
+
+	if e != nil {
+		LogWarning("[REDIS] Could not register channel '" + channel + "': " + e.Error())
+		return true
+	}
+
+	if res != 1 && !claimed {
+		r.mutex.Lock()
+		if r.claims[channel] == token {
+			delete(r.claims, channel)
+		}
+		r.mutex.Unlock()
+	}
+
+	return res == 1
+}
+
+// Releases a channel claimed by this node
+// Nothing is done if the token does not match the claim
+// channel - The channel ID
+// token - Token of the claim
+func (r *RedisChannelRegistry) Release(channel string, token string) {
+	r.mutex.Lock()
+
+	if r.claims[channel] != token {
+		r.mutex.Unlock()
+		return
+	}
+
+	delete(r.claims, channel)
+
+	r.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_REGISTRY_OPERATION_TIMEOUT)
+	defer cancel()
+
+	e := redisRegistryReleaseScript.Run(ctx, r.client, []string{r.prefix + channel}, r.node, token).Err()
+
+	if e != nil {
+		LogWarning("[REDIS] Could not unregister channel '" + channel + "': " + e.Error())
+	}
+}
+
+// Refreshes the keys of the channels published in this node, including the channels waiting for their publisher to reconnect
+// If a channel was registered by another node, its stream is ended
+// Runs indefinitely. Call in a separate routine.
+func (r *RedisChannelRegistry) RunHeartBeatLoop() {
+	for {
+		time.Sleep(r.heartbeat)
+
+		publishers := r.server.GetPublishers()
+
+		for i := 0; i < len(publishers); i++ {
+			channel, streamId, startTime := publishers[i].GetPublishInfo()
+
+			if !r.Claim(channel, publishers[i].registryToken, streamId, startTime) {
+				LogWarning("[REDIS] Channel '" + channel + "' is registered by another node. Ending the stream.")
+				publishers[i].KillWithReason(PUBLISH_END_REASON_CONFLICT)
+			}
+		}
+
+		suspended := r.server.GetSuspendedPublishers()
+
+		for i := 0; i < len(suspended); i++ {
+			channel, streamId, startTime := suspended[i].GetPublishInfo()
+
+			if !r.Claim(channel, suspended[i].registryToken, streamId, startTime) {
+				LogWarning("[REDIS] Channel '" + channel + "' is registered by another node. Ending the stream.")
+				r.server.ExpireGracePeriod(channel, suspended[i])
+			}
+		}
+	}
+}
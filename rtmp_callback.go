@@ -4,7 +4,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"time"
 
 	"net/http"
@@ -14,9 +13,13 @@ import (
 
 const JWT_EXPIRATION_TIME_SECONDS = 120
 
+// Sends the start event to the callback URL
+// Sets the stream ID if accepted
+// Returns true if the publishing session is accepted
 func (s *RTMPSession) SendStartCallback() bool {
-	JWT_SECRET := os.Getenv("JWT_SECRET")
-	CALLBACK_URL := os.Getenv("CALLBACK_URL")
+	config := s.server.GetConfig()
+	JWT_SECRET := config.jwtSecret
+	CALLBACK_URL := config.callbackURL
 
 	if CALLBACK_URL == "" {
 		return true // No callback
@@ -24,14 +27,10 @@ func (s *RTMPSession) SendStartCallback() bool {
 
 	LogDebugSession(s.id, s.ip, "POST "+CALLBACK_URL+" | Event: START | Channel: "+s.channel)
 
-	var subject = os.Getenv("CUSTOM_JWT_SUBJECT")
-
-	if subject == "" {
-		subject = "rtmp_event"
-	}
+	subject := config.jwtSubject
 
 	exp := time.Now().Unix() + JWT_EXPIRATION_TIME_SECONDS
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"sub":       subject,
 		"event":     "start",
 		"channel":   s.channel,
@@ -40,7 +39,13 @@ func (s *RTMPSession) SendStartCallback() bool {
 		"rtmp_host": s.server.host,
 		"rtmp_port": s.server.port,
 		"exp":       exp,
-	})
+	}
+
+	if s.clientCertSubject != "" {
+		claims["client_cert_subject"] = s.clientCertSubject
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	tokenB64, e := token.SignedString([]byte(JWT_SECRET))
 
@@ -78,9 +83,14 @@ func (s *RTMPSession) SendStartCallback() bool {
 	return true
 }
 
-func (s *RTMPSession) SendStopCallback() bool {
-	JWT_SECRET := os.Getenv("JWT_SECRET")
-	CALLBACK_URL := os.Getenv("CALLBACK_URL")
+// Sends the stop event to the callback URL
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// Returns true if success
+func (s *RTMPSession) SendStopCallback(reason string) bool {
+	config := s.server.GetConfig()
+	JWT_SECRET := config.jwtSecret
+	CALLBACK_URL := config.callbackURL
 
 	if CALLBACK_URL == "" {
 		return true // No callback
@@ -88,14 +98,10 @@ func (s *RTMPSession) SendStopCallback() bool {
 
 	LogDebugSession(s.id, s.ip, "POST "+CALLBACK_URL+" | Event: STOP | Channel: "+s.channel)
 
-	var subject = os.Getenv("CUSTOM_JWT_SUBJECT")
-
-	if subject == "" {
-		subject = "rtmp_event"
-	}
+	subject := config.jwtSubject
 
 	exp := time.Now().Unix() + JWT_EXPIRATION_TIME_SECONDS
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"sub":       subject,
 		"event":     "stop",
 		"channel":   s.channel,
@@ -103,7 +109,17 @@ func (s *RTMPSession) SendStopCallback() bool {
 		"stream_id": s.stream_id,
 		"client_ip": s.ip,
 		"exp":       exp,
-	})
+	}
+
+	if s.clientCertSubject != "" {
+		claims["client_cert_subject"] = s.clientCertSubject
+	}
+
+	for k, v := range s.GetPublishStatsData(reason) {
+		claims[k] = v
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	tokenB64, e := token.SignedString([]byte(JWT_SECRET))
 
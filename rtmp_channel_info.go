@@ -0,0 +1,137 @@
+// RTMP channel information
+
+package main
+
+// Information of a streaming channel, for reporting
+type RTMPChannelInfo struct {
+	Channel     string  `json:"channel"`                // The channel ID
+	Publishing  bool    `json:"publishing"`             // True if there is an stream being published
+	Suspended   bool    `json:"suspended,omitempty"`    // True if waiting for the publisher to reconnect
+	StreamId    string  `json:"stream_id,omitempty"`    // The current stream ID
+	PublisherId uint64  `json:"publisher_id,omitempty"` // ID of the session that is publishing
+	PublisherIP string  `json:"publisher_ip,omitempty"` // IP address of the publisher
+	StartTime   int64   `json:"start_time,omitempty"`   // Time the stream started (unix milliseconds)
+	BitRate     uint64  `json:"bitrate"`                // Bitrate of the stream (kbit/s)
+	AudioCodec  uint32  `json:"audio_codec"`            // Audio codec
+	VideoCodec  uint32  `json:"video_codec"`            // Video codec
+	Width       int64   `json:"width"`                  // Video width (pixels)
+	Height      int64   `json:"height"`                 // Video height (pixels)
+	FrameRate   float64 `json:"frame_rate"`             // Video frame rate (frames per second)
+	Players     int     `json:"players"`                // Number of players receiving the stream
+	IdlePlayers int     `json:"idle_players"`           // Number of players waiting for the stream
+}
+
+// Gets the information of a channel
+// channel - The channel ID
+// Returns the information, or nil if the channel does not exist
+func (server *RTMPServer) GetChannelInfo(channel string) *RTMPChannelInfo {
+	server.mutex.Lock()
+
+	c := server.channels[channel]
+
+	if c == nil {
+		server.mutex.Unlock()
+		return nil
+	}
+
+	info, publisher := server.getChannelInfoInternal(c)
+
+	server.mutex.Unlock()
+
+	if publisher != nil {
+		publisher.FillChannelInfo(info)
+	}
+
+	return info
+}
+
+// Gets the information of every active channel
+// Returns the list of channels
+func (server *RTMPServer) GetChannelsInfo() []*RTMPChannelInfo {
+	server.mutex.Lock()
+
+	channels := make([]*RTMPChannelInfo, 0, len(server.channels))
+	publishers := make([]*RTMPSession, 0, len(server.channels))
+
+	for _, c := range server.channels {
+		if c == nil {
+			continue
+		}
+
+		info, publisher := server.getChannelInfoInternal(c)
+
+		channels = append(channels, info)
+		publishers = append(publishers, publisher)
+	}
+
+	server.mutex.Unlock()
+
+	for i := 0; i < len(channels); i++ {
+		if publishers[i] != nil {
+			publishers[i].FillChannelInfo(channels[i])
+		}
+	}
+
+	return channels
+}
+
+// Gets the information of a channel
+// Call with the server mutex locked
+// c - The channel
+// Returns the information and the publisher session (or nil)
+func (server *RTMPServer) getChannelInfoInternal(c *RTMPChannel) (*RTMPChannelInfo, *RTMPSession) {
+	info := RTMPChannelInfo{
+		Channel:    c.channel,
+		Publishing: c.is_publishing,
+	}
+
+	for sid := range c.players {
+		player := server.sessions[sid]
+
+		if player == nil {
+			continue
+		}
+
+		if player.isPlaying {
+			info.Players++
+		} else if player.isIdling {
+			info.IdlePlayers++
+		}
+	}
+
+	var publisher *RTMPSession
+
+	if c.graceSession != nil {
+		info.Suspended = true
+		info.StreamId = c.stream_id
+	}
+
+	if c.is_publishing {
+		info.StreamId = c.stream_id
+		info.PublisherId = c.publisher
+		publisher = server.sessions[c.publisher]
+	}
+
+	return &info, publisher
+}
+
+// Fills the channel information with the status of the publishing session
+// Call only for publishers
+// info - The information to fill
+func (s *RTMPSession) FillChannelInfo(info *RTMPChannelInfo) {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return
+	}
+
+	info.PublisherIP = s.ip
+	info.StartTime = s.publishStats.startTime
+	info.BitRate = s.bitRate
+	info.AudioCodec = s.audioCodec
+	info.VideoCodec = s.videoCodec
+	info.Width = s.videoWidth
+	info.Height = s.videoHeight
+	info.FrameRate = s.videoFrameRate
+}
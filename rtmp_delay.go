@@ -0,0 +1,408 @@
+// Broadcast delay: the media packets are held for some seconds before sending them to the players
+
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Min broadcast delay (seconds)
+const BROADCAST_DELAY_MIN = 10
+
+// Max broadcast delay (seconds)
+const BROADCAST_DELAY_MAX = 60
+
+// Default size limit of the delay buffer of each publisher (bytes)
+const BROADCAST_DELAY_DEFAULT_MAX_SIZE = 256 * 1024 * 1024
+
+// Checks if a broadcast delay is valid
+// seconds - The delay in seconds
+// Returns true if it is 0 (no delay) or between the limits
+func isValidBroadcastDelay(seconds int64) bool {
+	return seconds == 0 || (seconds >= BROADCAST_DELAY_MIN && seconds <= BROADCAST_DELAY_MAX)
+}
+
+// Packet waiting in the delay buffer (media or metadata)
+type RTMPDelayedPacket struct {
+	packet      *RTMPPacket // The packet, with the timestamp of the publisher
+	isHeader    bool        // True if the packet is a sequence header or metadata
+	releaseTime int64       // Time to send the packet to the players (unix milliseconds)
+}
+
+// Buffer holding the media packets of a publisher, ordered by arrival time
+type RTMPDelayBuffer struct {
+	delay int64 // Time to hold the packets (milliseconds)
+
+	mutex *sync.Mutex // Mutex to access the queue
+
+	queue  *list.List // Packets waiting to be released (*RTMPDelayedPacket)
+	closed bool       // True if the buffer was closed
+
+	size     int64 // Size of the packets in the queue (bytes)
+	maxSize  int64 // Size limit of the queue (bytes)
+	dropping bool  // True if the media packets are being dropped until the next keyframe, since the queue was full
+
+	wake chan bool // Channel to wake up the release routine
+}
+
+// Creates a delay buffer
+// seconds - Time to hold the packets
+// maxSize - Size limit of the packets held (bytes)
+// Returns the buffer
+func CreateRTMPDelayBuffer(seconds int64, maxSize int64) *RTMPDelayBuffer {
+	return &RTMPDelayBuffer{
+		delay:   seconds * 1000,
+		mutex:   &sync.Mutex{},
+		queue:   list.New(),
+		maxSize: maxSize,
+		wake:    make(chan bool, 1),
+	}
+}
+
+// Wakes up the release routine, if it is waiting
+func (b *RTMPDelayBuffer) notify() {
+	select {
+	case b.wake <- true:
+	default:
+	}
+}
+
+// Adds a packet to the buffer
+// If the buffer is full, the media packets are dropped until the next keyframe. The sequence headers and the metadata are never dropped.
+// packet - The packet, with the timestamp of the publisher
+// isHeader - True if the packet is a sequence header or metadata
+// keyFrame - True if the packet is a keyframe, so the players can resume receiving media from it
+// Returns true if the buffer is full and started dropping packets with this one
+func (b *RTMPDelayBuffer) Push(packet *RTMPPacket, isHeader bool, keyFrame bool) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return false
+	}
+
+	size := int64(len(packet.payload)) + RTMP_PACKET_BASE_SIZE
+
+	if !isHeader {
+		if b.size+size > b.maxSize {
+			overflow := !b.dropping
+			b.dropping = true
+			return overflow
+		}
+
+		if b.dropping {
+			if !keyFrame {
+				return false
+			}
+
+			b.dropping = false
+		}
+	}
+
+	b.queue.PushBack(&RTMPDelayedPacket{
+		packet:      packet,
+		isHeader:    isHeader,
+		releaseTime: time.Now().UnixMilli() + b.delay,
+	})
+
+	b.size += size
+
+	if b.queue.Len() == 1 {
+		b.notify()
+	}
+
+	return false
+}
+
+// Removes every packet from the buffer
+// Returns the removed packets
+func (b *RTMPDelayBuffer) Clear() []*RTMPDelayedPacket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	removed := make([]*RTMPDelayedPacket, 0, b.queue.Len())
+
+	for e := b.queue.Front(); e != nil; e = e.Next() {
+		removed = append(removed, e.Value.(*RTMPDelayedPacket))
+	}
+
+	b.queue = list.New()
+	b.size = 0
+
+	return removed
+}
+
+// Closes the buffer, discarding the packets
+// The release routine ends
+func (b *RTMPDelayBuffer) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.queue = list.New()
+	b.size = 0
+
+	b.notify()
+}
+
+// Waits for the next packet to be released
+// Returns the packet, or false if the buffer was closed
+func (b *RTMPDelayBuffer) Next() (*RTMPDelayedPacket, bool) {
+	for {
+		b.mutex.Lock()
+
+		if b.closed {
+			b.mutex.Unlock()
+			return nil, false
+		}
+
+		wait := time.Duration(-1)
+
+		if front := b.queue.Front(); front != nil {
+			p := front.Value.(*RTMPDelayedPacket)
+			remaining := p.releaseTime - time.Now().UnixMilli()
+
+			if remaining <= 0 {
+				b.queue.Remove(front)
+				b.size -= int64(len(p.packet.payload)) + RTMP_PACKET_BASE_SIZE
+				b.mutex.Unlock()
+				return p, true
+			}
+
+			wait = time.Duration(remaining) * time.Millisecond
+		}
+
+		b.mutex.Unlock()
+
+		if wait < 0 {
+			<-b.wake
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-b.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Gets the broadcast delay of a channel
+// channel - The channel ID
+// Returns the delay in seconds, 0 for no delay
+func (server *RTMPServer) GetBroadcastDelay(channel string) int64 {
+	server.mutex.Lock()
+	seconds, found := server.broadcastDelays[channel]
+	server.mutex.Unlock()
+
+	if found {
+		return seconds
+	}
+
+	return server.GetConfig().broadcastDelay
+}
+
+// Sets the broadcast delay of a channel
+// It applies the next time the channel starts being published
+// channel - The channel ID
+// seconds - The delay in seconds, 0 for no delay, or -1 to use the default delay
+func (server *RTMPServer) SetBroadcastDelay(channel string, seconds int64) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if seconds < 0 {
+		delete(server.broadcastDelays, channel)
+	} else {
+		server.broadcastDelays[channel] = seconds
+	}
+}
+
+// Gets the publishers of a channel (primary and backup)
+// channel - The channel ID
+// Returns the list of publisher sessions
+func (server *RTMPServer) getChannelPublishers(channel string) []*RTMPSession {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	publishers := make([]*RTMPSession, 0)
+
+	if c == nil || !c.is_publishing {
+		return publishers
+	}
+
+	ids := []uint64{c.publisher}
+
+	if c.primary != 0 && c.primary != c.publisher {
+		ids = append(ids, c.primary)
+	}
+
+	if c.backup != 0 && c.backup != c.publisher {
+		ids = append(ids, c.backup)
+	}
+
+	for i := 0; i < len(ids); i++ {
+		if s := server.sessions[ids[i]]; s != nil {
+			publishers = append(publishers, s)
+		}
+	}
+
+	return publishers
+}
+
+// Makes the players of a channel wait for the next keyframe of the publishers
+// The timestamps continue from the last one sent to the players
+// channel - The channel ID
+func (server *RTMPServer) resetChannelOutput(channel string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || !c.is_publishing || c.switchPending {
+		return
+	}
+
+	if active := server.sessions[c.publisher]; active != nil && active.lastOutTimestamp.Load() > c.lastTimestamp {
+		c.lastTimestamp = active.lastOutTimestamp.Load()
+	}
+
+	c.switchPending = true
+}
+
+// Discards the delayed media of a channel, sending the slate to the players instead
+// The players receive the stream again when the media received after the dump is released
+// channel - The channel ID
+// Returns false if the channel is not being published with a broadcast delay
+func (server *RTMPServer) DumpBroadcastDelay(channel string) bool {
+	publishers := server.getChannelPublishers(channel)
+
+	dumped := false
+
+	for i := 0; i < len(publishers); i++ {
+		if publishers[i].DumpDelayBuffer() {
+			dumped = true
+		}
+	}
+
+	if !dumped {
+		return false
+	}
+
+	server.resetChannelOutput(channel)
+	server.StartSlate(channel)
+
+	return true
+}
+
+// Starts holding the media packets of the publisher, if the channel has a broadcast delay
+// Call only for publishers, before the session starts publishing
+func (s *RTMPSession) startDelayBuffer() {
+	seconds := s.server.GetBroadcastDelay(s.channel)
+
+	if seconds <= 0 {
+		return
+	}
+
+	buffer := CreateRTMPDelayBuffer(seconds, s.server.GetConfig().broadcastDelayMaxSize)
+
+	s.publish_mutex.Lock()
+	s.delayBuffer = buffer
+	s.publish_mutex.Unlock()
+
+	LogDebugSession(s.id, s.ip, "Broadcast delay: "+strconv.Itoa(int(seconds))+" seconds")
+
+	go s.runDelayBuffer(buffer)
+}
+
+// Stops holding the media packets. The packets in the buffer are discarded.
+// Call only for publishers, with the publish mutex locked
+func (s *RTMPSession) stopDelayBuffer() {
+	if s.delayBuffer == nil {
+		return
+	}
+
+	s.delayBuffer.Close()
+	s.delayBuffer = nil
+}
+
+// Sends the packets of the delay buffer to the players when they are released
+// Call in a separate routine.
+// buffer - The delay buffer
+func (s *RTMPSession) runDelayBuffer(buffer *RTMPDelayBuffer) {
+	for {
+		p, ok := buffer.Next()
+
+		if !ok {
+			return
+		}
+
+		s.publish_mutex.Lock()
+
+		if s.isPublishing && s.delayBuffer == buffer {
+			switch p.packet.header.packet_type {
+			case RTMP_TYPE_AUDIO:
+				s.forwardAudioPacket(p.packet, p.isHeader)
+			case RTMP_TYPE_VIDEO:
+				s.forwardVideoPacket(p.packet, p.isHeader)
+			default:
+				s.forwardMetaData(p.packet.payload)
+			}
+		}
+
+		s.publish_mutex.Unlock()
+	}
+}
+
+// Adds a packet received from the publisher to the delay buffer
+// Call only for publishers, with the publish mutex locked, if the publisher has a delay buffer
+// packet - The packet, with the timestamp of the publisher
+// isHeader - True if the packet is a sequence header or metadata
+// keyFrame - True if the packet is a keyframe
+func (s *RTMPSession) pushDelayBuffer(packet *RTMPPacket, isHeader bool, keyFrame bool) {
+	if s.delayBuffer.Push(packet, isHeader, keyFrame) {
+		LogWarning("[DELAY] The delay buffer of channel '" + s.channel + "' is full. Dropping media until the next keyframe.")
+	}
+}
+
+// Discards the packets in the delay buffer
+// The sequence headers and the metadata in the buffer are kept, to send them when the stream is resumed
+// Call only for publishers
+// Returns false if the session is not publishing with a broadcast delay
+func (s *RTMPSession) DumpDelayBuffer() bool {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing || s.delayBuffer == nil {
+		return false
+	}
+
+	dumped := s.delayBuffer.Clear()
+
+	for i := 0; i < len(dumped); i++ {
+		if !dumped[i].isHeader {
+			continue
+		}
+
+		switch dumped[i].packet.header.packet_type {
+		case RTMP_TYPE_AUDIO:
+			s.aacSequenceHeader = dumped[i].packet.payload
+		case RTMP_TYPE_VIDEO:
+			s.avcSequenceHeader = dumped[i].packet.payload
+			s.rtmpGopCache = list.New()
+			s.gopCacheSize = 0
+		default:
+			s.metaData = dumped[i].packet.payload
+		}
+	}
+
+	LogRequest(s.id, s.ip, "DUMP '"+s.channel+"': Discarded "+strconv.Itoa(len(dumped))+" delayed packets")
+
+	return true
+}
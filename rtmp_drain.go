@@ -0,0 +1,185 @@
+// Graceful drain and shutdown
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Default max time to wait for the drain to finish
+const DRAIN_DEFAULT_TIMEOUT = 30 * time.Second
+
+// Min time to wait for the remaining sessions to close
+const DRAIN_MIN_CLOSE_WAIT = 5 * time.Second
+
+// Interval to check the remaining sessions while draining
+const DRAIN_CHECK_INTERVAL = 100 * time.Millisecond
+
+// Gets the max time to wait for the drain to finish
+// Returns the timeout
+func getDrainTimeout() time.Duration {
+	customTimeout := os.Getenv("DRAIN_TIMEOUT_SECONDS")
+	if customTimeout != "" {
+		n, e := strconv.Atoi(customTimeout)
+		if e == nil && n >= 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+
+	return DRAIN_DEFAULT_TIMEOUT
+}
+
+// Drains the server gracefully:
+//  1. Stops accepting new connections
+//  2. If DRAIN_RECONNECT_REQUEST is YES, asks the publishers to reconnect to another node, and waits for them to leave
+//  3. Notifies the players that the streams are unpublished
+//  4. Ends every publishing session, so the stop events are sent
+//  5. Closes the remaining sessions and waits for them to finish, up to the deadline
+//
+// The drain only runs once. If called again, it waits for the first drain to finish.
+func (server *RTMPServer) Drain() {
+	server.drainOnce.Do(func() {
+		server.runDrain(false)
+	})
+}
+
+// Starts draining the server in a separate routine, exiting the process after it finishes
+// Every drain request (admin endpoint, Redis command, coordinator server) goes through this method
+// source - Source of the request, for logging
+func (server *RTMPServer) RequestDrain(source string) {
+	LogInfo("Drain requested by " + source)
+
+	go server.DrainAndExit()
+}
+
+// Drains the server and exits the process
+func (server *RTMPServer) DrainAndExit() {
+	server.Drain()
+	os.Exit(0)
+}
+
+// Drains the server after starting an upgraded process
+// Same as Drain(), but waits for the publishers to leave, up to the deadline,
+// even if they were not asked to reconnect
+func (server *RTMPServer) DrainForUpgrade() {
+	server.drainOnce.Do(func() {
+		server.runDrain(true)
+	})
+}
+
+// Runs the graceful drain. Call only via Drain() or DrainForUpgrade()
+// waitForPublishers - True to wait for the publishers to leave before ending them
+func (server *RTMPServer) runDrain(waitForPublishers bool) {
+	deadline := time.Now().Add(getDrainTimeout())
+
+	LogInfo("Draining server. Deadline: " + deadline.Format(time.RFC3339))
+
+	// Stop accepting connections
+	server.StartDrain()
+
+	server.closeListeners()
+
+	// Ask the publishers to reconnect
+	if os.Getenv("DRAIN_RECONNECT_REQUEST") == "YES" {
+		reconnectURL := os.Getenv("DRAIN_RECONNECT_URL")
+		publishers := server.GetPublishers()
+		requested := 0
+
+		for i := 0; i < len(publishers); i++ {
+			if publishers[i].capsEx&RTMP_CAPS_EX_RECONNECT == 0 {
+				continue // Not supported by the client
+			}
+
+			publishers[i].SendReconnectRequest(reconnectURL)
+			requested++
+		}
+
+		if requested > 0 {
+			LogInfo("Sent reconnect request to " + strconv.Itoa(requested) + " publishers.")
+			waitForPublishers = true
+		}
+	}
+
+	if waitForPublishers {
+		LogInfo("Waiting for the publishers to leave.")
+
+		for time.Now().Before(deadline) && len(server.GetPublishers()) > 0 {
+			time.Sleep(DRAIN_CHECK_INTERVAL)
+		}
+	}
+
+	// End the remaining publishing sessions
+	// This notifies the players and sends the stop events
+	publishers := server.GetPublishers()
+
+	for i := 0; i < len(publishers); i++ {
+		publishers[i].EndPublish(PUBLISH_END_REASON_DRAIN)
+	}
+
+	// End the streams waiting for their publishers to reconnect
+	server.ExpireAllGracePeriods()
+
+	// Close every session
+	server.mutex.Lock()
+
+	sessions := make([]*RTMPSession, 0, len(server.sessions))
+
+	for _, s := range server.sessions {
+		sessions = append(sessions, s)
+	}
+
+	server.mutex.Unlock()
+
+	for i := 0; i < len(sessions); i++ {
+		sessions[i].KillWithReason(PUBLISH_END_REASON_DRAIN)
+	}
+
+	// Wait for the sessions to finish
+	closeDeadline := deadline
+
+	if time.Until(closeDeadline) < DRAIN_MIN_CLOSE_WAIT {
+		closeDeadline = time.Now().Add(DRAIN_MIN_CLOSE_WAIT)
+	}
+
+	for time.Now().Before(closeDeadline) {
+		remaining, _ := server.GetCounts()
+
+		if remaining == 0 {
+			break
+		}
+
+		time.Sleep(DRAIN_CHECK_INTERVAL)
+	}
+
+	remaining, _ := server.GetCounts()
+
+	if remaining > 0 {
+		LogWarning("Drain deadline reached with " + strconv.Itoa(remaining) + " sessions remaining")
+	}
+
+	LogInfo("Server drained")
+}
+
+// Handles the termination signals (SIGINT, SIGTERM)
+// Drains the server and exits. A second signal exits immediately.
+// Runs indefinitely. Call in a separate routine.
+func (server *RTMPServer) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+
+	LogInfo("Received signal: " + sig.String() + ". Shutting down.")
+
+	go server.DrainAndExit()
+
+	sig = <-signals
+
+	LogWarning("Received signal: " + sig.String() + ". Exiting now.")
+
+	os.Exit(1)
+}
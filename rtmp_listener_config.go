@@ -0,0 +1,326 @@
+// RTMP listeners and their policies
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Actions a listener can allow
+const (
+	LISTENER_ACTION_PUBLISH = "publish" // Publish streams
+	LISTENER_ACTION_PLAY    = "play"    // Play streams
+)
+
+// Protocols of the listeners
+const (
+	LISTENER_PROTOCOL_RTMP  = "rtmp"  // RTMP over TCP
+	LISTENER_PROTOCOL_RTMPT = "rtmpt" // RTMP tunnelled over HTTP
+	LISTENER_PROTOCOL_WS    = "ws"    // RTMP over WebSocket
+)
+
+// Policy of a listener, that can be reloaded
+type RTMPListenerPolicy struct {
+	allowPublish bool // True if the clients can publish streams
+	allowPlay    bool // True if the clients can play streams
+
+	whitelist        IPWhitelist // IP addresses allowed to connect. If empty, every address is allowed
+	publishWhitelist IPWhitelist // IP addresses allowed to publish. If empty, every address is allowed
+	playWhitelist    IPWhitelist // IP addresses allowed to play. If empty, every address is allowed
+
+	maxConnections int    // Max number of active sessions in the listener. 0 for no limit
+	ipLimit        uint32 // Max number of active sessions per IP address in the listener. 0 for no limit
+}
+
+// RTMP listener
+type RTMPListener struct {
+	name     string // Name of the listener
+	address  string // Listening address (host:port)
+	secure   bool   // True if the connections use TLS
+	protocol string // Protocol of the listener (LISTENER_PROTOCOL_*)
+
+	listener net.Listener // TCP listener
+
+	policy atomic.Pointer[RTMPListenerPolicy] // Policy of the listener
+
+	mutex *sync.Mutex // Mutex to access the connection counters
+
+	connections int               // Number of active sessions
+	ipCount     map[string]uint32 // Mapping IP -> Number of active sessions
+}
+
+// Checks if a listener name is valid
+// name - The name (lowercase)
+// Returns true if valid
+func validateListenerName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parses a comma-separated list of listener names
+// list - The list
+// Returns the names (lowercase)
+func parseListenerNames(list string) []string {
+	result := make([]string, 0)
+
+	parts := strings.Split(list, ",")
+
+	for i := 0; i < len(parts); i++ {
+		part := strings.ToLower(strings.TrimSpace(parts[i]))
+
+		if part == "" {
+			continue
+		}
+
+		result = append(result, part)
+	}
+
+	return result
+}
+
+// Gets the names of the configured listeners
+// If LISTENERS is not set, the default listeners are rtmp and rtmps (if SSL_CERT and SSL_KEY, or SSL_CERTS_DIR, are set)
+// getValue - Function to get the value of an option
+// Returns the names (lowercase)
+func getListenerNames(getValue func(string) string) []string {
+	if getValue("LISTENERS") != "" {
+		return parseListenerNames(getValue("LISTENERS"))
+	}
+
+	if (getValue("SSL_CERT") != "" && getValue("SSL_KEY") != "") || getValue("SSL_CERTS_DIR") != "" {
+		return []string{LISTENER_NAME_RTMP, LISTENER_NAME_RTMPS}
+	}
+
+	return []string{LISTENER_NAME_RTMP}
+}
+
+// Gets the name of a listener option
+// listener - Name of the listener
+// option - Name of the option
+// Returns the name of the option (LISTENER_{NAME}_{OPTION})
+func getListenerOptionName(listener string, option string) string {
+	return "LISTENER_" + strings.ToUpper(listener) + "_" + option
+}
+
+// Checks if a listener uses TLS
+// The rtmps listener uses TLS by default
+// name - Name of the listener
+// getValue - Function to get the value of an option
+// Returns true if the listener uses TLS
+func isListenerSecure(name string, getValue func(string) string) bool {
+	switch getValue(getListenerOptionName(name, "TLS")) {
+	case "YES":
+		return true
+	case "NO":
+		return false
+	default:
+		return name == LISTENER_NAME_RTMPS
+	}
+}
+
+// Gets the protocol of a listener
+// name - Name of the listener
+// Returns the protocol (LISTENER_PROTOCOL_*)
+func getListenerProtocol(name string) string {
+	protocol := strings.ToLower(os.Getenv(getListenerOptionName(name, "PROTOCOL")))
+
+	if protocol == "" {
+		return LISTENER_PROTOCOL_RTMP
+	}
+
+	return protocol
+}
+
+// Gets the listening address of a listener
+// The rtmp and rtmps listeners use RTMP_PORT and SSL_PORT by default
+// name - Name of the listener
+// Returns the address (host:port)
+func getListenerAddress(name string) (string, error) {
+	bindAddr := os.Getenv(getListenerOptionName(name, "BIND_ADDRESS"))
+
+	if bindAddr == "" {
+		bindAddr = os.Getenv("BIND_ADDRESS")
+	}
+
+	port := os.Getenv(getListenerOptionName(name, "PORT"))
+
+	if port == "" {
+		switch name {
+		case LISTENER_NAME_RTMP:
+			port = os.Getenv("RTMP_PORT")
+			if port == "" {
+				port = "1935"
+			}
+		case LISTENER_NAME_RTMPS:
+			port = os.Getenv("SSL_PORT")
+			if port == "" {
+				port = "443"
+			}
+		default:
+			return "", errors.New("no port configured for the listener " + name)
+		}
+	}
+
+	_, e := strconv.Atoi(port)
+
+	if e != nil {
+		return "", errors.New("invalid port for the listener " + name + ": " + port)
+	}
+
+	return bindAddr + ":" + port, nil
+}
+
+// Loads the policy of a listener from the environment variables
+// name - Name of the listener
+// Returns the policy
+func loadRTMPListenerPolicy(name string) *RTMPListenerPolicy {
+	policy := RTMPListenerPolicy{
+		allowPublish:     true,
+		allowPlay:        true,
+		whitelist:        parseIPWhitelist(os.Getenv(getListenerOptionName(name, "WHITELIST"))),
+		publishWhitelist: parseIPWhitelist(os.Getenv(getListenerOptionName(name, "PUBLISH_WHITELIST"))),
+		playWhitelist:    parseIPWhitelist(os.Getenv(getListenerOptionName(name, "PLAY_WHITELIST"))),
+		maxConnections:   0,
+		ipLimit:          0,
+	}
+
+	allow := os.Getenv(getListenerOptionName(name, "ALLOW"))
+	if allow != "" {
+		policy.allowPublish = false
+		policy.allowPlay = false
+
+		parts := strings.Split(allow, ",")
+
+		for i := 0; i < len(parts); i++ {
+			switch strings.ToLower(strings.TrimSpace(parts[i])) {
+			case LISTENER_ACTION_PUBLISH:
+				policy.allowPublish = true
+			case LISTENER_ACTION_PLAY:
+				policy.allowPlay = true
+			}
+		}
+	}
+
+	customMaxConnections := os.Getenv(getListenerOptionName(name, "MAX_CONNECTIONS"))
+	if customMaxConnections != "" {
+		n, e := strconv.Atoi(customMaxConnections)
+		if e == nil && n >= 0 {
+			policy.maxConnections = n
+		}
+	}
+
+	customIpLimit := os.Getenv(getListenerOptionName(name, "MAX_IP_CONCURRENT_CONNECTIONS"))
+	if customIpLimit != "" {
+		n, e := strconv.Atoi(customIpLimit)
+		if e == nil && n >= 0 {
+			policy.ipLimit = uint32(n)
+		}
+	}
+
+	return &policy
+}
+
+// Creates a RTMP listener
+// name - Name of the listener
+// Returns the listener
+func CreateRTMPListener(name string) (*RTMPListener, error) {
+	address, err := getListenerAddress(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := listenTCP(name, address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &RTMPListener{
+		name:     name,
+		address:  address,
+		secure:   isListenerSecure(name, os.Getenv),
+		protocol: getListenerProtocol(name),
+		listener: l,
+		mutex:    &sync.Mutex{},
+		ipCount:  make(map[string]uint32),
+	}
+
+	listener.LoadPolicy()
+
+	return listener, nil
+}
+
+// Loads the policy of the listener and applies it
+// The existing sessions keep working
+func (l *RTMPListener) LoadPolicy() {
+	l.policy.Store(loadRTMPListenerPolicy(l.name))
+}
+
+// Gets the current policy of the listener
+// Returns the policy. Do not modify it.
+func (l *RTMPListener) GetPolicy() *RTMPListenerPolicy {
+	return l.policy.Load()
+}
+
+// Adds an active session to the listener counters
+// ip - The IP address
+// Returns true if it was added, false if it reached a limit
+func (l *RTMPListener) AddConnection(ip string) bool {
+	policy := l.GetPolicy()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if policy.maxConnections > 0 && l.connections >= policy.maxConnections {
+		return false
+	}
+
+	c := l.ipCount[ip]
+
+	if policy.ipLimit > 0 && c >= policy.ipLimit {
+		return false
+	}
+
+	l.connections++
+	l.ipCount[ip] = c + 1
+
+	return true
+}
+
+// Removes an active session from the listener counters
+// Call after the session is closed
+// ip - The IP address
+func (l *RTMPListener) RemoveConnection(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.connections > 0 {
+		l.connections--
+	}
+
+	c := l.ipCount[ip]
+
+	if c <= 1 {
+		delete(l.ipCount, ip)
+	} else {
+		l.ipCount[ip] = c - 1
+	}
+}
@@ -0,0 +1,74 @@
+// Listening sockets
+
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Names of the listening sockets, used to identify inherited sockets
+const (
+	LISTENER_NAME_RTMP  = "rtmp"  // RTMP listener
+	LISTENER_NAME_RTMPS = "rtmps" // RTMPS listener
+	LISTENER_NAME_ADMIN = "admin" // Admin HTTP server listener
+)
+
+// Default order of the inherited sockets, when they are not named
+var defaultListenerNames = []string{LISTENER_NAME_RTMP, LISTENER_NAME_RTMPS, LISTENER_NAME_ADMIN}
+
+// Sockets inherited from the parent process. Map: Name -> Listener
+var inheritedListeners map[string]net.Listener
+
+// Mutex to access the inherited sockets
+var inheritedListenersMutex = &sync.Mutex{}
+
+// Ensures the inherited sockets are only loaded once
+var inheritedListenersOnce = &sync.Once{}
+
+// Creates a TCP listener, or takes it from the inherited sockets
+// name - Name of the listener (LISTENER_NAME_*)
+// address - Address to listen if there is no inherited socket
+// Returns the listener
+func listenTCP(name string, address string) (net.Listener, error) {
+	inheritedListenersOnce.Do(func() {
+		inheritedListeners = loadInheritedListeners()
+	})
+
+	inheritedListenersMutex.Lock()
+	l := inheritedListeners[name]
+	delete(inheritedListeners, name)
+	inheritedListenersMutex.Unlock()
+
+	if l != nil {
+		LogInfo("Using inherited socket for '" + name + "': " + l.Addr().String())
+		return l, nil
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// Registers a listening socket, so it can be passed to an upgraded process
+// name - Name of the listener (LISTENER_NAME_*)
+// l - The listener
+func (server *RTMPServer) AddSocket(name string, l net.Listener) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.sockets[name] = l
+}
+
+// Gets the listening sockets of the server
+// Returns a map: Name -> Listener
+func (server *RTMPServer) GetSockets() map[string]net.Listener {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	sockets := make(map[string]net.Listener, len(server.sockets))
+
+	for name, l := range server.sockets {
+		sockets[name] = l
+	}
+
+	return sockets
+}
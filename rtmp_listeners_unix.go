@@ -0,0 +1,259 @@
+//go:build !windows
+
+// Socket activation and binary upgrades (Unix)
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by socket activation
+const LISTEN_FDS_START = 3
+
+// Max time to wait for the upgraded process to be ready
+const UPGRADE_READY_TIMEOUT = 30 * time.Second
+
+// Loads the sockets passed by the parent process (systemd socket activation or binary upgrade)
+// Uses the LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES environment variables
+// Returns the sockets. Map: Name -> Listener
+func loadInheritedListeners() map[string]net.Listener {
+	listeners := make(map[string]net.Listener)
+
+	listenFds := os.Getenv("LISTEN_FDS")
+
+	if listenFds == "" {
+		return listeners
+	}
+
+	listenPid := os.Getenv("LISTEN_PID")
+	listenFdNames := os.Getenv("LISTEN_FDNAMES")
+
+	// The variables are only for this process
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if listenPid != "" && listenPid != strconv.Itoa(os.Getpid()) {
+		return listeners // Not for this process
+	}
+
+	n, e := strconv.Atoi(listenFds)
+
+	if e != nil || n <= 0 {
+		LogWarning("Invalid LISTEN_FDS: " + listenFds)
+		return listeners
+	}
+
+	var names []string
+
+	if listenFdNames != "" {
+		names = strings.Split(listenFdNames, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		name := ""
+
+		if i < len(names) && names[i] != "unknown" {
+			name = names[i]
+		} else if i < len(defaultListenerNames) {
+			name = defaultListenerNames[i]
+		}
+
+		f := os.NewFile(uintptr(LISTEN_FDS_START+i), "listen_fd_"+strconv.Itoa(i))
+
+		if name == "" {
+			f.Close()
+			continue
+		}
+
+		l, err := net.FileListener(f)
+
+		f.Close() // The listener has its own copy
+
+		if err != nil {
+			LogWarning("Could not use inherited socket '" + name + "': " + err.Error())
+			continue
+		}
+
+		listeners[name] = l
+	}
+
+	return listeners
+}
+
+// Notifies the parent process that the upgraded process is ready to accept connections
+// Does nothing if the process was not started by an upgrade
+func notifyUpgradeReady() {
+	readyFd := os.Getenv("UPGRADE_READY_FD")
+
+	if readyFd == "" {
+		return
+	}
+
+	os.Unsetenv("UPGRADE_READY_FD")
+
+	fd, e := strconv.Atoi(readyFd)
+
+	if e != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade_ready")
+
+	_, e = f.Write([]byte{1})
+
+	if e != nil {
+		LogWarning("Could not notify the parent process: " + e.Error())
+	}
+
+	f.Close()
+}
+
+// Starts a new process of the server binary, passing it the listening sockets
+// Waits for the new process to be ready to accept connections
+// Returns an error if the new process could not be started or is not ready
+func (server *RTMPServer) StartUpgradedProcess() error {
+	executable, err := os.Executable()
+
+	if err != nil {
+		return err
+	}
+
+	sockets := server.GetSockets()
+
+	names := make([]string, 0, len(sockets))
+	files := make([]*os.File, 0, len(sockets)+1)
+
+	defer func() {
+		for i := 0; i < len(files); i++ {
+			files[i].Close()
+		}
+	}()
+
+	for name, l := range sockets {
+		tcpListener, ok := l.(*net.TCPListener)
+
+		if !ok {
+			continue
+		}
+
+		f, err := tcpListener.File()
+
+		if err != nil {
+			return err
+		}
+
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+
+	if err != nil {
+		return err
+	}
+
+	defer readyReader.Close()
+
+	files = append(files, readyWriter)
+
+	env := make([]string, 0)
+
+	for _, v := range getChildProcessEnviron() {
+		if strings.HasPrefix(v, "LISTEN_") || strings.HasPrefix(v, "UPGRADE_READY_FD=") {
+			continue
+		}
+
+		env = append(env, v)
+	}
+
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"UPGRADE_READY_FD="+strconv.Itoa(LISTEN_FDS_START+len(names)),
+	)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+
+	if err != nil {
+		return err
+	}
+
+	LogInfo("Started upgraded process. PID: " + strconv.Itoa(cmd.Process.Pid))
+
+	// Close the write end, so the read fails if the child exits
+	readyWriter.Close()
+	files = files[:len(files)-1]
+
+	readyReader.SetReadDeadline(time.Now().Add(UPGRADE_READY_TIMEOUT)) //nolint:errcheck
+
+	buf := make([]byte, 1)
+	_, err = readyReader.Read(buf)
+
+	if err != nil {
+		cmd.Process.Kill()    //nolint:errcheck
+		cmd.Process.Release() //nolint:errcheck
+		return errors.New("upgraded process is not ready: " + err.Error())
+	}
+
+	return cmd.Process.Release()
+}
+
+// Handles the upgrade signal (SIGUSR2)
+// Starts the upgraded process, then drains this process and exits
+// Runs indefinitely. Call in a separate routine.
+func (server *RTMPServer) HandleUpgradeSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	for range signals {
+		if server.IsDraining() {
+			LogWarning("Received upgrade signal while draining. Ignored.")
+			continue
+		}
+
+		LogInfo("Received upgrade signal. Starting upgraded process.")
+
+		err := server.StartUpgradedProcess()
+
+		if err != nil {
+			LogErrorMessage("Upgrade failed: " + err.Error())
+			continue
+		}
+
+		LogInfo("Upgraded process is ready. Draining this process.")
+
+		signal.Stop(signals)
+
+		// Stop accepting connections before draining, so the upgraded process
+		// accepts them instead of this one rejecting them
+		server.closeListeners()
+
+		server.StartDrain()
+
+		// Let the upgraded process serve the admin requests
+		if adminSocket := server.GetSockets()[LISTENER_NAME_ADMIN]; adminSocket != nil {
+			adminSocket.Close()
+		}
+
+		server.DrainForUpgrade()
+
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+// Socket activation and binary upgrades (Windows)
+// Not supported on Windows
+
+package main
+
+import "net"
+
+// Loads the sockets passed by the parent process
+// Not supported on Windows
+// Returns an empty map
+func loadInheritedListeners() map[string]net.Listener {
+	return make(map[string]net.Listener)
+}
+
+// Notifies the parent process that the upgraded process is ready
+// Not supported on Windows
+func notifyUpgradeReady() {
+}
+
+// Handles the upgrade signal
+// Not supported on Windows
+func (server *RTMPServer) HandleUpgradeSignal() {
+}
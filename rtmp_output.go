@@ -0,0 +1,520 @@
+// Outputs: copies of the stream of a channel, sent to recordings and relays
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Max number of packets waiting to be sent to an output
+// If exceeded, the packets are dropped until the next keyframe
+const RTMP_OUTPUT_QUEUE_SIZE = 4096
+
+// Min time to wait before opening the destination again, after it fails (milliseconds)
+const RTMP_OUTPUT_RETRY_MIN = 1000
+
+// Max time to wait before opening the destination again, after it fails (milliseconds)
+const RTMP_OUTPUT_RETRY_MAX = 30000
+
+// Status of the outputs
+const (
+	RTMP_OUTPUT_STATUS_CONNECTING = "connecting" // Opening the destination
+	RTMP_OUTPUT_STATUS_CONNECTED  = "connected"  // Sending the packets to the destination
+	RTMP_OUTPUT_STATUS_ERROR      = "error"      // The destination failed
+	RTMP_OUTPUT_STATUS_STOPPED    = "stopped"    // The output stopped
+)
+
+// Destination of the packets of an output
+type RTMPOutputSink interface {
+	// Opens the destination
+	// Returns an error if it could not be opened
+	Open() error
+
+	// Writes a packet
+	// packet - The packet, with the timestamp relative to the start of the output
+	// Returns an error if the packet could not be written
+	Write(packet *RTMPPacket) error
+
+	// Closes the destination
+	Close()
+}
+
+// Packet waiting to be sent to an output
+type RTMPOutputPacket struct {
+	packet   *RTMPPacket           // The packet, with the timestamp sent to the players
+	keyFrame bool                  // True if the output can start at this packet
+	headers  *RTMPTimeshiftHeaders // Metadata and sequence headers required to play the packet
+}
+
+// Output of a channel
+type RTMPOutput struct {
+	channel  string // The channel ID
+	streamId string // ID of the stream when the output started
+	target   string // Destination of the output (path of the file or URL)
+
+	sink      RTMPOutputSink // Destination of the packets
+	reconnect bool           // True to open the destination again if it fails
+
+	onStatus func(status string, err error) // Called when the status changes (RTMP_OUTPUT_STATUS_*), from the routine of the output. Can be nil
+
+	position atomic.Int64 // Timestamp of the last packet sent, relative to the start of the output
+
+	mutex *sync.Mutex // Mutex to access the headers and the queue status
+
+	headers  *RTMPTimeshiftHeaders // Current metadata and sequence headers
+	dropping bool                  // True if the queue was full, dropping the packets until the next keyframe
+
+	queue chan *RTMPOutputPacket // Packets waiting to be sent
+	stop  chan bool              // Closed to stop the output
+	done  chan bool              // Closed when the output stops
+
+	stopped bool // True if the output was stopped
+}
+
+// Creates an output
+// channel - The channel ID
+// target - Destination of the output (path of the file or URL)
+// sink - Destination of the packets
+// reconnect - True to open the destination again if it fails
+// Returns the output
+func CreateRTMPOutput(channel string, target string, sink RTMPOutputSink, reconnect bool) *RTMPOutput {
+	return &RTMPOutput{
+		channel:   channel,
+		target:    target,
+		sink:      sink,
+		reconnect: reconnect,
+		mutex:     &sync.Mutex{},
+		headers:   &RTMPTimeshiftHeaders{},
+		queue:     make(chan *RTMPOutputPacket, RTMP_OUTPUT_QUEUE_SIZE),
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+}
+
+// Sets the metadata and the sequence headers for the next packets
+// metaData - Metadata
+// audioCodec - Audio codec
+// videoCodec - Video codec
+// aacSequenceHeader - Sequence header for AAC codec (Audio)
+// avcSequenceHeader - Sequence header for AVC codec (Video)
+func (o *RTMPOutput) SetHeaders(metaData []byte, audioCodec uint32, videoCodec uint32, aacSequenceHeader []byte, avcSequenceHeader []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.headers = &RTMPTimeshiftHeaders{
+		metaData:          metaData,
+		audioCodec:        audioCodec,
+		videoCodec:        videoCodec,
+		aacSequenceHeader: aacSequenceHeader,
+		avcSequenceHeader: avcSequenceHeader,
+	}
+}
+
+// Adds a packet to the queue of the output
+// It never blocks. If the queue is full, the packets are dropped until the next keyframe
+// cachePacket - The packet, with the timestamp of the publisher
+// timestampOffset - Offset to add to the timestamp
+// keyFrame - True if the output can start at this packet
+func (o *RTMPOutput) Push(cachePacket *RTMPPacket, timestampOffset int64, keyFrame bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.dropping && !keyFrame {
+		return
+	}
+
+	packet := createBlankRTMPPacket()
+	packet.header.fmt = cachePacket.header.fmt
+	packet.header.cid = cachePacket.header.cid
+	packet.header.packet_type = cachePacket.header.packet_type
+	packet.payload = cachePacket.payload
+	packet.header.length = cachePacket.header.length
+	packet.header.timestamp = cachePacket.header.timestamp + timestampOffset
+
+	select {
+	case o.queue <- &RTMPOutputPacket{packet: &packet, keyFrame: keyFrame, headers: o.headers}:
+		o.dropping = false
+	default:
+		if !o.dropping {
+			LogWarning("Output queue of channel '" + o.channel + "' is full. Dropping packets until the next keyframe: " + o.target)
+		}
+		o.dropping = true
+	}
+}
+
+// Starts sending the packets to the destination
+func (o *RTMPOutput) Start() {
+	go o.run()
+}
+
+// Stops the output, sending the packets left in the queue first
+// Waits until the destination is closed
+func (o *RTMPOutput) Stop() {
+	o.mutex.Lock()
+
+	if o.stopped {
+		o.mutex.Unlock()
+		<-o.done
+		return
+	}
+
+	o.stopped = true
+	close(o.stop)
+
+	o.mutex.Unlock()
+
+	<-o.done
+}
+
+// Notifies a change of the status of the output
+// status - The status (RTMP_OUTPUT_STATUS_*)
+// err - The error, or nil
+func (o *RTMPOutput) setStatus(status string, err error) {
+	if o.onStatus != nil {
+		o.onStatus(status, err)
+	}
+}
+
+// Sends the packets to the destination, until the output is stopped
+func (o *RTMPOutput) run() {
+	defer close(o.done)
+	defer o.setStatus(RTMP_OUTPUT_STATUS_STOPPED, nil)
+
+	retryDelay := time.Duration(RTMP_OUTPUT_RETRY_MIN) * time.Millisecond
+	reconnecting := false
+
+	for {
+		if reconnecting {
+			o.discardQueue()
+		}
+
+		reconnecting = true
+
+		o.setStatus(RTMP_OUTPUT_STATUS_CONNECTING, nil)
+
+		err := o.sink.Open()
+
+		if err != nil {
+			LogWarning("Could not open output of channel '" + o.channel + "': " + err.Error())
+
+			o.setStatus(RTMP_OUTPUT_STATUS_ERROR, err)
+
+			if !o.reconnect {
+				return
+			}
+
+			timer := time.NewTimer(retryDelay)
+
+			select {
+			case <-timer.C:
+			case <-o.stop:
+				timer.Stop()
+				return
+			}
+
+			retryDelay = min(retryDelay*2, time.Duration(RTMP_OUTPUT_RETRY_MAX)*time.Millisecond)
+
+			continue
+		}
+
+		retryDelay = time.Duration(RTMP_OUTPUT_RETRY_MIN) * time.Millisecond
+
+		o.setStatus(RTMP_OUTPUT_STATUS_CONNECTED, nil)
+
+		err = o.send()
+
+		o.sink.Close()
+
+		if err == nil {
+			return // Stopped
+		}
+
+		LogWarning("Output of channel '" + o.channel + "' failed: " + err.Error())
+
+		o.setStatus(RTMP_OUTPUT_STATUS_ERROR, err)
+
+		if !o.reconnect {
+			return
+		}
+	}
+}
+
+// Discards the packets waiting in the queue
+// Called before opening the destination again, since they are outdated
+func (o *RTMPOutput) discardQueue() {
+	for {
+		select {
+		case <-o.queue:
+		default:
+			return
+		}
+	}
+}
+
+// Sends the packets of the queue to the opened destination
+// The first packet sent is a keyframe, with the headers before it
+// Returns nil if the output was stopped, or the error if the destination failed
+func (o *RTMPOutput) send() error {
+	var headers *RTMPTimeshiftHeaders
+	baseTimestamp := int64(-1)
+
+	for {
+		var item *RTMPOutputPacket
+
+		select {
+		case item = <-o.queue:
+		case <-o.stop:
+			// Send the packets left in the queue
+			select {
+			case item = <-o.queue:
+			default:
+				return nil
+			}
+		}
+
+		if baseTimestamp < 0 {
+			if !item.keyFrame {
+				continue
+			}
+
+			baseTimestamp = item.packet.header.timestamp
+		}
+
+		timestamp := max(0, item.packet.header.timestamp-baseTimestamp)
+
+		if item.headers != headers {
+			headers = item.headers
+
+			err := o.sendHeaders(headers, timestamp)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		packet := *item.packet
+		packet.header.timestamp = timestamp
+
+		err := o.sink.Write(&packet)
+
+		if err != nil {
+			return err
+		}
+
+		o.position.Store(timestamp)
+	}
+}
+
+// Sends the metadata and the sequence headers to the destination
+// headers - Metadata and sequence headers
+// timestamp - Timestamp of the packets, relative to the start of the output
+// Returns an error if the destination failed
+func (o *RTMPOutput) sendHeaders(headers *RTMPTimeshiftHeaders, timestamp int64) error {
+	packets := make([]*RTMPPacket, 0, 3)
+
+	if len(headers.metaData) > 0 {
+		packet := createBlankRTMPPacket()
+		packet.header.fmt = RTMP_CHUNK_TYPE_0
+		packet.header.cid = RTMP_CHANNEL_DATA
+		packet.header.packet_type = RTMP_TYPE_DATA
+		packet.payload = headers.metaData
+		packets = append(packets, &packet)
+	}
+
+	if (headers.audioCodec == 10 || headers.audioCodec == 13) && len(headers.aacSequenceHeader) > 0 {
+		packet := createBlankRTMPPacket()
+		packet.header.fmt = RTMP_CHUNK_TYPE_0
+		packet.header.cid = RTMP_CHANNEL_AUDIO
+		packet.header.packet_type = RTMP_TYPE_AUDIO
+		packet.payload = headers.aacSequenceHeader
+		packets = append(packets, &packet)
+	}
+
+	if (headers.videoCodec == 7 || headers.videoCodec == 12) && len(headers.avcSequenceHeader) > 0 {
+		packet := createBlankRTMPPacket()
+		packet.header.fmt = RTMP_CHUNK_TYPE_0
+		packet.header.cid = RTMP_CHANNEL_VIDEO
+		packet.header.packet_type = RTMP_TYPE_VIDEO
+		packet.payload = headers.avcSequenceHeader
+		packets = append(packets, &packet)
+	}
+
+	for i := 0; i < len(packets); i++ {
+		packets[i].header.length = uint32(len(packets[i].payload))
+		packets[i].header.timestamp = timestamp
+
+		err := o.sink.Write(packets[i])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gets the outputs of a channel
+// channel - The channel ID
+// Returns the list of outputs. The list must not be modified
+func (server *RTMPServer) GetOutputs(channel string) []*RTMPOutput {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil {
+		return nil
+	}
+
+	return c.outputs
+}
+
+// Finds an output of a channel
+// channel - The channel ID
+// target - Destination of the output
+// Returns the output, or nil if not found
+func (server *RTMPServer) GetOutput(channel string, target string) *RTMPOutput {
+	outputs := server.GetOutputs(channel)
+
+	for i := 0; i < len(outputs); i++ {
+		if outputs[i].target == target {
+			return outputs[i]
+		}
+	}
+
+	return nil
+}
+
+// Adds an output to a channel being published
+// channel - The channel ID
+// output - The output
+// Returns false if the channel is not being published, or it already has an output with the same destination
+func (server *RTMPServer) AddOutput(channel string, output *RTMPOutput) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || !c.is_publishing {
+		return false
+	}
+
+	for i := 0; i < len(c.outputs); i++ {
+		if c.outputs[i].target == output.target {
+			return false
+		}
+	}
+
+	// The list is copied, since it is read without the server mutex
+	outputs := make([]*RTMPOutput, 0, len(c.outputs)+1)
+	outputs = append(outputs, c.outputs...)
+	c.outputs = append(outputs, output)
+
+	return true
+}
+
+// Removes an output from a channel
+// The output is not stopped
+// channel - The channel ID
+// target - Destination of the output
+// Returns the removed output, or nil if not found
+func (server *RTMPServer) RemoveOutput(channel string, target string) *RTMPOutput {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil {
+		return nil
+	}
+
+	for i := 0; i < len(c.outputs); i++ {
+		if c.outputs[i].target == target {
+			output := c.outputs[i]
+
+			outputs := make([]*RTMPOutput, 0, len(c.outputs)-1)
+			outputs = append(outputs, c.outputs[:i]...)
+			c.outputs = append(outputs, c.outputs[i+1:]...)
+
+			return output
+		}
+	}
+
+	return nil
+}
+
+// Removes and stops the outputs of a channel, when the stream ends
+// channel - The channel ID
+func (server *RTMPServer) EndOutputs(channel string) {
+	server.mutex.Lock()
+
+	c := server.channels[channel]
+
+	if c == nil || len(c.outputs) == 0 {
+		server.mutex.Unlock()
+		return
+	}
+
+	outputs := c.outputs
+	c.outputs = nil
+
+	server.mutex.Unlock()
+
+	for i := 0; i < len(outputs); i++ {
+		go outputs[i].Stop()
+	}
+}
+
+// Starts an output of the channel being published
+// Call only for publishers
+// output - The output
+// Returns false if the channel is not being published, or it already has an output with the same destination
+func (s *RTMPSession) StartOutput(output *RTMPOutput) bool {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return false
+	}
+
+	output.streamId = s.stream_id
+
+	output.SetHeaders(s.metaData, s.audioCodec, s.videoCodec, s.aacSequenceHeader, s.avcSequenceHeader)
+
+	if !s.server.AddOutput(s.channel, output) {
+		return false
+	}
+
+	output.Start()
+
+	return true
+}
+
+// Sends a packet sent to the players to the outputs of the channel
+// Call only for publishers, with the publish mutex locked
+// cachePacket - The packet, with the timestamp of the publisher
+// isHeader - True if the packet is a sequence header
+// keyFrame - True if the outputs can start at this packet
+func (s *RTMPSession) recordOutputs(cachePacket *RTMPPacket, isHeader bool, keyFrame bool) {
+	outputs := s.server.GetOutputs(s.channel)
+
+	for i := 0; i < len(outputs); i++ {
+		if isHeader {
+			outputs[i].SetHeaders(s.metaData, s.audioCodec, s.videoCodec, s.aacSequenceHeader, s.avcSequenceHeader)
+		} else {
+			outputs[i].Push(cachePacket, s.timestampOffset, keyFrame)
+		}
+	}
+}
+
+// Updates the metadata and the sequence headers of the outputs of the channel
+// Call only for publishers, with the publish mutex locked
+func (s *RTMPSession) recordOutputHeaders() {
+	outputs := s.server.GetOutputs(s.channel)
+
+	for i := 0; i < len(outputs); i++ {
+		outputs[i].SetHeaders(s.metaData, s.audioCodec, s.videoCodec, s.aacSequenceHeader, s.avcSequenceHeader)
+	}
+}
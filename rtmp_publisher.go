@@ -5,6 +5,8 @@ package main
 import (
 	"container/list"
 	"crypto/subtle"
+	"sync/atomic"
+	"time"
 )
 
 // Starts sending to idle players
@@ -15,6 +17,7 @@ func (s *RTMPSession) StartIdlePlayers() {
 
 	// Start idle players
 	idlePlayers := s.server.GetIdlePlayers(s.channel)
+	active := s.server.IsActivePublisher(s.channel, s.id)
 
 	for i := 0; i < len(idlePlayers); i++ {
 		if subtle.ConstantTimeCompare([]byte(s.key), []byte(idlePlayers[i].key)) == 1 {
@@ -22,6 +25,14 @@ func (s *RTMPSession) StartIdlePlayers() {
 
 			LogRequest(player.id, player.ip, "PLAY START '"+player.channel+"'")
 
+			if !active {
+				// The players receive the stream when the publisher takes over the channel
+				player.isPlaying = true
+				player.isIdling = false
+				s.registerPlayerStart(player)
+				continue
+			}
+
 			player.SendMetadata(s.metaData, 0)
 			player.SendAudioCodecHeader(s.audioCodec, s.aacSequenceHeader, 0)
 			player.SendVideoCodecHeader(s.videoCodec, s.avcSequenceHeader, 0)
@@ -31,13 +42,14 @@ func (s *RTMPSession) StartIdlePlayers() {
 					chunks := t.Value
 					switch x := chunks.(type) {
 					case *RTMPPacket:
-						player.SendCachePacket(x)
+						player.SendCachePacket(x, s.timestampOffset)
 					}
 				}
 			}
 
 			player.isPlaying = true
 			player.isIdling = false
+			s.registerPlayerStart(player)
 
 			if player.gopPlayClear {
 				s.rtmpGopCache = list.New()
@@ -69,6 +81,14 @@ func (s *RTMPSession) StartPlayer(player *RTMPSession) {
 
 	LogRequest(player.id, player.ip, "PLAY START '"+player.channel+"'")
 
+	if !s.server.IsActivePublisher(s.channel, s.id) {
+		// The player receives the stream when the publisher takes over the channel
+		player.isPlaying = true
+		player.isIdling = false
+		s.registerPlayerStart(player)
+		return
+	}
+
 	player.SendMetadata(s.metaData, 0)
 	player.SendAudioCodecHeader(s.audioCodec, s.aacSequenceHeader, 0)
 	player.SendVideoCodecHeader(s.videoCodec, s.avcSequenceHeader, 0)
@@ -78,13 +98,14 @@ func (s *RTMPSession) StartPlayer(player *RTMPSession) {
 			chunks := t.Value
 			switch x := chunks.(type) {
 			case *RTMPPacket:
-				player.SendCachePacket(x)
+				player.SendCachePacket(x, s.timestampOffset)
 			}
 		}
 	}
 
 	player.isPlaying = true
 	player.isIdling = false
+	s.registerPlayerStart(player)
 
 	if player.gopPlayClear {
 		s.rtmpGopCache = list.New()
@@ -100,28 +121,65 @@ func (s *RTMPSession) ResumePlayer(player *RTMPSession) {
 	s.publish_mutex.Lock()
 	defer s.publish_mutex.Unlock()
 
-	player.SendAudioCodecHeader(s.audioCodec, s.aacSequenceHeader, s.clock)
-	player.SendVideoCodecHeader(s.videoCodec, s.avcSequenceHeader, s.clock)
+	player.SendAudioCodecHeader(s.audioCodec, s.aacSequenceHeader, s.lastOutTimestamp.Load())
+	player.SendVideoCodecHeader(s.videoCodec, s.avcSequenceHeader, s.lastOutTimestamp.Load())
 }
 
 // Finishes a publishing session
 // Call only for publishers
-// isClose - True if it was closed due to a disconnection
-func (s *RTMPSession) EndPublish(isClose bool) {
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+func (s *RTMPSession) EndPublish(reason string) {
+	players, remaining, killRemaining := s.finishPublish(reason)
+
+	// Stopping the time-shift playback locks the seek mutex of the players,
+	// so it is done after releasing the publish mutex
+	for i := 0; i < len(players); i++ {
+		players[i].StopTimeshift()
+	}
+
+	if remaining != nil {
+		// The remaining publisher continues the stream, so it reports the statistics of both
+		remaining.CarryPublishStats(s)
+
+		if killRemaining {
+			remaining.KillWithReason(reason)
+		}
+	}
+}
+
+// Finishes a publishing session
+// Call only for publishers
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// Returns the players of the channel if the stream ended,
+// the remaining publisher if the channel has another one, and true if the remaining publisher must end too
+func (s *RTMPSession) finishPublish(reason string) ([]*RTMPSession, *RTMPSession, bool) {
 	s.publish_mutex.Lock()
 	defer s.publish_mutex.Unlock()
 
 	if s.isPublishing {
+		if other, wasActive := s.server.RemoveRedundantPublisher(s.channel, s); other != nil {
+			return nil, other, s.endRedundantPublish(reason, other, wasActive)
+		}
+
+		if s.suspendPublish(reason) {
+			return nil, nil, false
+		}
 
-		LogRequest(s.id, s.ip, "PUBLISH END '"+s.channel+"'")
+		LogRequest(s.id, s.ip, "PUBLISH END '"+s.channel+"' ("+reason+")")
 
-		if !isClose {
+		if reason == PUBLISH_END_REASON_UNPUBLISH {
 			s.SendStatusMessage(s.publishStreamId, "status", "NetStream.Unpublish.Success", s.GetStreamPath()+" is now unpublished.")
 		}
 
 		players := s.server.GetPlayers(s.channel)
 
+		s.publishStats.endTime = time.Now().UnixMilli()
+
+		s.server.EndTimeshift(s.channel)
+		s.server.EndOutputs(s.channel)
+
 		for i := 0; i < len(players); i++ {
+			s.registerPlayerEnd(players[i])
 			players[i].isIdling = true
 			players[i].isPlaying = false
 			LogRequest(players[i].id, players[i].ip, "PLAY IDLE '"+players[i].channel+"'")
@@ -131,23 +189,51 @@ func (s *RTMPSession) EndPublish(isClose bool) {
 
 		s.server.RemovePublisher(s.channel)
 
+		s.ReleaseRegistryChannel()
+
+		s.server.StartSlate(s.channel)
+
 		s.rtmpGopCache = list.New()
 
 		s.isPublishing = false
+		s.stopDelayBuffer()
 
-		// Send event
-		if s.server.websocketControlConnection != nil {
-			if s.server.websocketControlConnection.PublishEnd(s.channel, s.stream_id) {
-				LogDebugSession(s.id, s.ip, "Stop event sent")
-			} else {
-				LogDebugSession(s.id, s.ip, "Could not send stop event")
-			}
+		if s.maxDurationTimer != nil {
+			s.maxDurationTimer.Stop()
+			s.maxDurationTimer = nil
+		}
+
+		s.sendStopEvents(reason)
+
+		return players, nil, false
+	}
+
+	return nil, nil, false
+}
+
+// Sends the events for the end of the stream (coordinator or callback, and Redis)
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+func (s *RTMPSession) sendStopEvents(reason string) {
+	s.sendStopNotification(reason)
+	s.SendPublishStopEvent(reason)
+}
+
+// Notifies the coordinator server or the callback URL about the end of the stream
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+func (s *RTMPSession) sendStopNotification(reason string) {
+	if s.server.websocketControlConnection != nil && !s.callbackFallback {
+		if s.server.websocketControlConnection.PublishEnd(s.channel, s.stream_id) {
+			LogDebugSession(s.id, s.ip, "Stop event sent")
 		} else {
-			if s.SendStopCallback() {
-				LogDebugSession(s.id, s.ip, "Stop event sent")
-			} else {
-				LogDebugSession(s.id, s.ip, "Could not send stop event")
-			}
+			LogDebugSession(s.id, s.ip, "Could not send stop event")
+		}
+	} else {
+		if s.SendStopCallback(reason) {
+			LogDebugSession(s.id, s.ip, "Stop event sent")
+		} else {
+			LogDebugSession(s.id, s.ip, "Could not send stop event")
 		}
 	}
 }
@@ -162,6 +248,7 @@ func (s *RTMPSession) SetClock(clock int64) {
 }
 
 // Sets the stream metadata that is being publishing
+// If the channel has a broadcast delay, the metadata is delayed as the media
 // metaData - The metadata
 func (s *RTMPSession) SetMetaData(metaData []byte) {
 	s.publish_mutex.Lock()
@@ -171,11 +258,233 @@ func (s *RTMPSession) SetMetaData(metaData []byte) {
 		return
 	}
 
+	if s.delayBuffer != nil {
+		packet := createBlankRTMPPacket()
+		packet.header.fmt = RTMP_CHUNK_TYPE_0
+		packet.header.cid = RTMP_CHANNEL_DATA
+		packet.header.packet_type = RTMP_TYPE_DATA
+		packet.payload = metaData
+		packet.header.length = uint32(len(packet.payload))
+		packet.header.timestamp = s.clock
+
+		s.pushDelayBuffer(&packet, true, false)
+		return
+	}
+
+	s.forwardMetaData(metaData)
+}
+
+// Stores the stream metadata and sends it to the players
+// Call only for publishers, with the publish mutex locked
+// metaData - The metadata
+func (s *RTMPSession) forwardMetaData(metaData []byte) {
 	s.metaData = metaData
 
+	if !s.server.IsActivePublisher(s.channel, s.id) {
+		return
+	}
+
+	s.recordTimeshiftHeaders()
+	s.recordOutputHeaders()
+
 	players := s.server.GetPlayers(s.channel)
 
 	for i := 0; i < len(players); i++ {
-		players[i].SendMetadata(metaData, 0)
+		if !players[i].isTimeshift {
+			players[i].SendMetadata(metaData, 0)
+		}
+	}
+}
+
+// Resets the publishing statistics
+// Call only for publishers, before setting the publisher
+func (s *RTMPSession) StartPublishStats() {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	s.publishStats = PublishStats{
+		startTime: time.Now().UnixMilli(),
+	}
+}
+
+// Updates the publishing statistics after a chunk is read
+// bytesRead - Number of bytes read
+func (s *RTMPSession) UpdatePublishStats(bytesRead uint32) {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return
+	}
+
+	s.publishStats.bytes += uint64(bytesRead)
+
+	if s.bitRate > s.publishStats.bitRatePeak {
+		s.publishStats.bitRatePeak = s.bitRate
+	}
+}
+
+// Registers a player starting to receive the stream
+// Call only for publishers, with the publish mutex locked
+// player - The player session
+func (s *RTMPSession) registerPlayerStart(player *RTMPSession) {
+	if player.playPublisher == s.id {
+		return
+	}
+
+	player.playStartTime = time.Now().UnixMilli()
+	player.playPublisher = s.id
+
+	s.publishStats.players++
+
+	if s.publishStats.players > s.publishStats.playersPeak {
+		s.publishStats.playersPeak = s.publishStats.players
 	}
 }
+
+// Registers a player no longer receiving the stream
+// Call only for publishers, with the publish mutex locked
+// player - The player session
+func (s *RTMPSession) registerPlayerEnd(player *RTMPSession) {
+	if player.playPublisher != s.id {
+		return
+	}
+
+	s.publishStats.playerTimeMs += time.Now().UnixMilli() - player.playStartTime
+
+	if s.publishStats.players > 0 {
+		s.publishStats.players--
+	}
+
+	player.playPublisher = 0
+}
+
+// Called when a player stops receiving the stream
+// Call only for publishers
+// player - The player session
+func (s *RTMPSession) OnPlayerEnd(player *RTMPSession) {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return
+	}
+
+	s.registerPlayerEnd(player)
+}
+
+// Reports the publisher this player is no longer receiving the stream
+// Call only for players, before removing them from the channel
+func (s *RTMPSession) ReportPlayEnd() {
+	if !s.isPlaying || s.playPublisher == 0 {
+		return
+	}
+
+	publisher := s.server.GetPublisher(s.channel)
+
+	if publisher != nil && publisher.id == s.playPublisher {
+		publisher.OnPlayerEnd(s)
+	}
+}
+
+// Sets the video properties of the stream being published
+// Call only for publishers
+// dataObj - The metadata object sent by the publisher
+func (s *RTMPSession) SetVideoProperties(dataObj *AMF0Value) {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return
+	}
+
+	s.videoWidth = dataObj.GetProperty("width").GetInteger()
+	s.videoHeight = dataObj.GetProperty("height").GetInteger()
+	s.videoFrameRate = dataObj.GetProperty("framerate").GetFloat()
+	s.metaAudioOnly = len(dataObj.GetObject()) > 0 && dataObj.GetProperty("videocodecid").IsUndefined() && s.videoWidth == 0
+}
+
+// Gets the statistics of the publishing session, to include them in the stop events
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// Returns the statistics as a map
+func (s *RTMPSession) GetPublishStatsData(reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"publish_start":  s.publishStats.startTime,
+		"publish_end":    s.publishStats.endTime,
+		"bytes_received": s.publishStats.bytes,
+		"bitrate_avg":    s.publishStats.GetAverageBitRate(),
+		"bitrate_peak":   s.publishStats.bitRatePeak,
+		"key_frames":     atomic.LoadUint64(&s.publishStats.keyFrames),
+		"players_peak":   s.publishStats.playersPeak,
+		"player_minutes": s.publishStats.GetPlayerMinutes(),
+		"end_reason":     reason,
+	}
+}
+
+// Gets the information of the stream being published
+// Call only for publishers
+// Returns the channel, the stream ID and the time the stream started (unix milliseconds)
+func (s *RTMPSession) GetPublishInfo() (channel string, streamId string, startTime int64) {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	return s.channel, s.stream_id, s.publishStats.startTime
+}
+
+// Registers the channel in the cluster registry, with the stream ID and the start time
+// Call only for publishers, once the stream is accepted
+// Returns false if the channel is being published in another node
+func (s *RTMPSession) ClaimRegistryChannel() bool {
+	if s.server.channelRegistry == nil {
+		return true
+	}
+
+	s.registryToken = createRegistryToken()
+
+	return s.server.channelRegistry.Claim(s.channel, s.registryToken, s.stream_id, s.publishStats.startTime)
+}
+
+// Removes the channel from the cluster registry
+// Call only for publishers
+func (s *RTMPSession) ReleaseRegistryChannel() {
+	if s.server.channelRegistry == nil {
+		return
+	}
+
+	s.server.channelRegistry.Release(s.channel, s.registryToken)
+}
+
+// Sets the max duration of the publishing session
+// When the max duration is reached, the session is killed
+// Call only for publishers
+// seconds - Max duration in seconds, counting from the start of the stream. Set to 0 to remove the limit
+// Returns false if the session is not publishing
+func (s *RTMPSession) SetMaxDuration(seconds int64) bool {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return false
+	}
+
+	if s.maxDurationTimer != nil {
+		s.maxDurationTimer.Stop()
+		s.maxDurationTimer = nil
+	}
+
+	s.maxDuration = seconds
+
+	if seconds <= 0 {
+		return true
+	}
+
+	remaining := time.Until(time.UnixMilli(s.publishStats.startTime).Add(time.Duration(seconds) * time.Second))
+
+	s.maxDurationTimer = time.AfterFunc(remaining, func() {
+		LogRequest(s.id, s.ip, "Max duration reached for '"+s.channel+"'")
+		s.KillWithReason(PUBLISH_END_REASON_MAX_DURATION)
+	})
+
+	return true
+}
@@ -0,0 +1,388 @@
+// Redundant publishers (primary and backup) for the same channel
+
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Roles of the publishers of a channel
+const (
+	PUBLISH_ROLE_PRIMARY = "primary" // Primary publisher. Feeds the players while it is healthy
+	PUBLISH_ROLE_BACKUP  = "backup"  // Backup publisher. Feeds the players when the primary stalls or disconnects
+)
+
+// Default time without media packets to consider a publisher stalled (milliseconds)
+const BACKUP_PUBLISHER_DEFAULT_STALL_TIMEOUT = 3000
+
+// Checks if the channel must fail over to the remaining publisher when a publisher ends for a reason
+// The other reasons (killed, max duration, drain) end the channel
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// Returns true if the channel must fail over
+func isFailoverReason(reason string) bool {
+	switch reason {
+	case PUBLISH_END_REASON_UNPUBLISH, PUBLISH_END_REASON_DISCONNECT, PUBLISH_END_REASON_TIMEOUT:
+		return true
+	default:
+		return false
+	}
+}
+
+// Assigns the role slot of a publisher in the channel
+// s - The publisher session
+func (c *RTMPChannel) setPublisherRole(s *RTMPSession) {
+	if s.publishRole == PUBLISH_ROLE_BACKUP {
+		c.backup = s.id
+	} else {
+		c.primary = s.id
+	}
+
+	c.switchPending = false
+}
+
+// Adds a redundant publisher to a channel that is already being published
+// channel - The channel ID
+// key - The channel key
+// s - The publisher session
+// Returns the stream ID of the channel, or an error if the key does not match or the role is taken
+func (server *RTMPServer) AddRedundantPublisher(channel string, key string, s *RTMPSession) (string, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || !c.is_publishing {
+		return "", errors.New("the channel is not being published")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key), []byte(c.key)) != 1 {
+		return "", errors.New("invalid key")
+	}
+
+	if (s.publishRole == PUBLISH_ROLE_BACKUP && c.backup != 0) || (s.publishRole != PUBLISH_ROLE_BACKUP && c.primary != 0) {
+		return "", errors.New("there is already a " + s.publishRole + " publisher")
+	}
+
+	if s.publishRole == PUBLISH_ROLE_BACKUP {
+		c.backup = s.id
+	} else {
+		c.primary = s.id
+	}
+
+	return c.stream_id, nil
+}
+
+// Checks if a publisher is feeding the players of a channel
+// channel - The channel ID
+// id - The publisher session ID
+// Returns true if the publisher is the active one
+func (server *RTMPServer) IsActivePublisher(channel string, id uint64) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	return c != nil && c.is_publishing && c.publisher == id && !c.switchPending
+}
+
+// Makes a publisher the active one of a channel, if required
+// It takes over if the active publisher left or stalled, or if it is the primary publisher
+// channel - The channel ID
+// s - The publisher session, at a keyframe
+// stallTimeout - Time without media packets to consider the active publisher stalled (milliseconds)
+// Returns:
+//
+//	taken - True if the publisher is now the active one
+//	previous - The previous active publisher, if it is still publishing, or nil
+//	lastTimestamp - Last timestamp sent to the players
+func (server *RTMPServer) TakeOverChannel(channel string, s *RTMPSession, stallTimeout int64) (taken bool, previous *RTMPSession, lastTimestamp int64) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || !c.is_publishing || (c.primary != s.id && c.backup != s.id) {
+		return false, nil, 0
+	}
+
+	active := server.sessions[c.publisher]
+
+	if c.publisher != s.id && active != nil && !c.switchPending {
+		stalled := time.Now().UnixMilli()-active.lastMediaTime.Load() > stallTimeout
+
+		if !stalled && c.primary != s.id {
+			return false, nil, 0
+		}
+
+		previous = active
+		lastTimestamp = active.lastOutTimestamp.Load()
+	} else {
+		lastTimestamp = c.lastTimestamp
+	}
+
+	c.publisher = s.id
+	c.switchPending = false
+
+	return true, previous, lastTimestamp
+}
+
+// Removes a publisher from a channel with another publisher remaining
+// If the publisher was the active one, the remaining publisher will take over at its next keyframe
+// channel - The channel ID
+// s - The publisher session
+// Returns the remaining publisher (nil if it was the only one), and true if the removed publisher was the active one
+func (server *RTMPServer) RemoveRedundantPublisher(channel string, s *RTMPSession) (*RTMPSession, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || !c.is_publishing {
+		return nil, false
+	}
+
+	var otherId uint64
+
+	if c.primary == s.id {
+		otherId = c.backup
+	} else if c.backup == s.id {
+		otherId = c.primary
+	} else {
+		return nil, false
+	}
+
+	other := server.sessions[otherId]
+
+	if other == nil {
+		return nil, false
+	}
+
+	if c.primary == s.id {
+		c.primary = 0
+	} else {
+		c.backup = 0
+	}
+
+	wasActive := c.publisher == s.id
+
+	if wasActive {
+		c.publisher = other.id
+		c.switchPending = true
+		c.lastTimestamp = s.lastOutTimestamp.Load()
+	}
+
+	return other, wasActive
+}
+
+// Handles a publish command for a channel that is already being published
+// The publisher joins as a redundant publisher, without sending start events
+// Returns false if the session must be closed
+func (s *RTMPSession) HandleRedundantPublish() bool {
+	if s.server.IsDraining() {
+		LogRequest(s.id, s.ip, "Error: Server is draining")
+		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Server is not accepting new streams")
+		return false
+	}
+
+	publisher := s.server.GetPublisher(s.channel)
+
+	if publisher != nil {
+		s.callbackFallback = publisher.callbackFallback
+		s.registryToken = publisher.registryToken
+	}
+
+	s.StartPublishStats()
+	s.lastMediaTime.Store(time.Now().UnixMilli())
+
+	streamId, err := s.server.AddRedundantPublisher(s.channel, s.key, s)
+
+	if err != nil {
+		LogRequest(s.id, s.ip, "Error: Could not publish as "+s.publishRole+": "+err.Error())
+		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Stream already publishing")
+		return false
+	}
+
+	LogRequest(s.id, s.ip, "PUBLISH ("+strconv.Itoa(int(s.publishStreamId))+") '"+s.channel+"' ("+s.publishRole+")")
+
+	s.stream_id = streamId
+	s.startDelayBuffer()
+	s.isPublishing = true
+
+	s.SendStatusMessage(s.publishStreamId, "status", "NetStream.Publish.Start", s.GetStreamPath()+" is now published.")
+
+	return true
+}
+
+// Checks if the stream being published has no video, so the players can be switched to it at any audio packet
+// Before the first video packet, the stream is considered audio-only if the metadata declares no video,
+// or if no video packet was received within the stall timeout since the session connected
+// (the publishing statistics may belong to the whole stream)
+// Call only for publishers, with the publish mutex locked
+// Returns true if the stream is audio-only
+func (s *RTMPSession) isAudioOnly() bool {
+	if s.videoCodec != 0 {
+		return false
+	}
+
+	if s.metaAudioOnly {
+		return true
+	}
+
+	return time.Now().UnixMilli()-s.connectTime > s.server.GetConfig().backupStallTimeout
+}
+
+// Checks if the publisher is the active one, taking over the channel if possible
+// Call only for publishers, with the publish mutex locked, when a media packet is sent to the players
+// timestamp - Timestamp of the packet, from the publisher
+// canSwitch - True if the players can be switched to this publisher at the current packet (keyframe)
+// Returns true if the packet must be sent to the players
+func (s *RTMPSession) checkActivePublisher(timestamp int64, canSwitch bool) bool {
+	s.lastMediaTime.Store(time.Now().UnixMilli())
+
+	if s.server.IsActivePublisher(s.channel, s.id) {
+		return true
+	}
+
+	if !canSwitch {
+		return false
+	}
+
+	taken, previous, lastTimestamp := s.server.TakeOverChannel(s.channel, s, s.server.GetConfig().backupStallTimeout)
+
+	if !taken {
+		return false
+	}
+
+	if slateTimestamp, ok := s.server.StopSlate(s.channel); ok && slateTimestamp > lastTimestamp {
+		lastTimestamp = slateTimestamp
+	}
+
+	s.timestampOffset = lastTimestamp + 1 - timestamp
+
+	timestamp += s.timestampOffset
+
+	LogRequest(s.id, s.ip, "PUBLISH ACTIVE '"+s.channel+"' ("+s.publishRole+"): Players switched to this session")
+
+	s.recordTimeshiftHeaders()
+	s.recordOutputHeaders()
+
+	players := s.server.GetPlayers(s.channel)
+
+	now := time.Now().UnixMilli()
+	movedPlayers := 0
+	movedTimeMs := int64(0)
+
+	for i := 0; i < len(players); i++ {
+		if previous != nil && players[i].playPublisher == previous.id {
+			movedPlayers++
+			movedTimeMs += now - players[i].playStartTime
+			players[i].playPublisher = 0
+		}
+
+		if !players[i].isTimeshift {
+			players[i].SendMetadata(s.metaData, timestamp)
+			players[i].SendAudioCodecHeader(s.audioCodec, s.aacSequenceHeader, timestamp)
+			players[i].SendVideoCodecHeader(s.videoCodec, s.avcSequenceHeader, timestamp)
+		}
+
+		s.registerPlayerStart(players[i])
+	}
+
+	if movedPlayers > 0 {
+		go previous.OnPlayersMoved(movedPlayers, movedTimeMs)
+	}
+
+	return true
+}
+
+// Called when players are switched to another publisher, to update the statistics
+// Call only for publishers
+// count - Number of players
+// playTimeMs - Accumulated time the players received the stream from this publisher (milliseconds)
+func (s *RTMPSession) OnPlayersMoved(count int, playTimeMs int64) {
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return
+	}
+
+	s.publishStats.playerTimeMs += playTimeMs
+	s.publishStats.players = max(0, s.publishStats.players-count)
+}
+
+// Adds the statistics of a publisher that left the channel to the statistics of this publisher,
+// so the stop events report the statistics of the whole stream
+// Call only for publishers
+// previous - The publisher that left the channel
+func (s *RTMPSession) CarryPublishStats(previous *RTMPSession) {
+	previous.publish_mutex.Lock()
+
+	stats := previous.publishStats
+
+	previous.publish_mutex.Unlock()
+
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	if !s.isPublishing {
+		return
+	}
+
+	s.publishStats.startTime = min(s.publishStats.startTime, stats.startTime)
+	s.publishStats.bytes += stats.bytes
+	s.publishStats.bitRatePeak = max(s.publishStats.bitRatePeak, stats.bitRatePeak)
+	atomic.AddUint64(&s.publishStats.keyFrames, stats.keyFrames)
+	s.publishStats.playersPeak = max(s.publishStats.playersPeak, stats.playersPeak)
+	s.publishStats.playerTimeMs += stats.playerTimeMs
+}
+
+// Finishes a publishing session while another publisher remains in the channel
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// other - The remaining publisher
+// wasActive - True if this publisher was feeding the players
+// Returns true if the remaining publisher must end too
+func (s *RTMPSession) endRedundantPublish(reason string, other *RTMPSession, wasActive bool) bool {
+	LogRequest(s.id, s.ip, "PUBLISH END '"+s.channel+"' ("+reason+") ("+s.publishRole+")")
+
+	if reason == PUBLISH_END_REASON_UNPUBLISH {
+		s.SendStatusMessage(s.publishStreamId, "status", "NetStream.Unpublish.Success", s.GetStreamPath()+" is now unpublished.")
+	}
+
+	s.publishStats.endTime = time.Now().UnixMilli()
+
+	players := s.server.GetPlayers(s.channel)
+
+	for i := 0; i < len(players); i++ {
+		s.registerPlayerEnd(players[i])
+	}
+
+	s.rtmpGopCache = list.New()
+	s.gopCacheSize = 0
+
+	s.isPublishing = false
+	s.stopDelayBuffer()
+
+	if s.maxDurationTimer != nil {
+		s.maxDurationTimer.Stop()
+		s.maxDurationTimer = nil
+	}
+
+	if !wasActive {
+		return false
+	}
+
+	if isFailoverReason(reason) {
+		LogRequest(s.id, s.ip, "PUBLISH FAILOVER '"+s.channel+"': Waiting for the "+other.publishRole+" publisher")
+		s.server.StartSlate(s.channel)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,287 @@
+// Publisher reconnect grace period
+
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"strconv"
+	"time"
+)
+
+// Checks if the publisher may reconnect after ending for a reason
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// Returns true if the channel must wait for the publisher to reconnect
+func isReconnectReason(reason string) bool {
+	return reason == PUBLISH_END_REASON_DISCONNECT || reason == PUBLISH_END_REASON_TIMEOUT
+}
+
+// Suspends the publisher of a channel, keeping the channel live while waiting for the publisher to reconnect
+// The players stay attached. If the publisher does not reconnect within the grace period, the stream ends.
+// channel - The channel ID
+// s - The publisher session
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// gracePeriod - Time to wait for the publisher to reconnect
+// Returns true if suspended, false if the session is not the publisher of the channel
+func (server *RTMPServer) SuspendPublisher(channel string, s *RTMPSession, reason string, gracePeriod time.Duration) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || !c.is_publishing || c.publisher != s.id {
+		return false
+	}
+
+	c.is_publishing = false
+	c.publisher = 0
+	c.primary = 0
+	c.backup = 0
+	c.switchPending = false
+	c.lastTimestamp = s.lastOutTimestamp.Load()
+
+	c.graceSession = s
+	c.graceReason = reason
+	c.graceTimer = time.AfterFunc(gracePeriod, func() {
+		server.ExpireGracePeriod(channel, s)
+	})
+
+	return true
+}
+
+// Resumes a suspended channel, if the publisher reconnected within the grace period
+// The new publisher takes over the channel at its first keyframe, continuing the timestamps
+// channel - The channel ID
+// key - The channel key
+// s - The new publisher session
+// Returns the suspended publisher session, or nil if the channel was not waiting for a publisher with that key
+func (server *RTMPServer) ResumePublisher(channel string, key string, s *RTMPSession) *RTMPSession {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || c.graceSession == nil {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key), []byte(c.key)) != 1 {
+		return nil
+	}
+
+	if !c.graceTimer.Stop() {
+		return nil // Already expiring
+	}
+
+	previous := c.graceSession
+
+	c.graceSession = nil
+	c.graceTimer = nil
+
+	c.is_publishing = true
+	c.publisher = s.id
+	c.setPublisherRole(s)
+	c.switchPending = true
+
+	return previous
+}
+
+// Ends the stream of a suspended channel, since the publisher did not reconnect
+// The players become idle and the stop events are sent
+// channel - The channel ID
+// s - The suspended publisher session
+func (server *RTMPServer) ExpireGracePeriod(channel string, s *RTMPSession) {
+	server.mutex.Lock()
+
+	c := server.channels[channel]
+
+	if c == nil || c.graceSession != s {
+		server.mutex.Unlock()
+		return
+	}
+
+	reason := c.graceReason
+
+	c.graceSession = nil
+	c.graceReason = ""
+
+	if c.graceTimer != nil {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+	}
+
+	timeshift := c.timeshift
+	c.timeshift = nil
+
+	outputs := c.outputs
+	c.outputs = nil
+
+	players := make([]*RTMPSession, 0)
+
+	for sid := range c.players {
+		player := server.sessions[sid]
+		if player != nil && player.isPlaying {
+			player.isIdling = true
+			player.isPlaying = false
+			players = append(players, player)
+		}
+	}
+
+	if len(c.players) == 0 {
+		delete(server.channels, channel)
+	}
+
+	server.mutex.Unlock()
+
+	LogRequest(s.id, s.ip, "PUBLISH END '"+channel+"' ("+reason+"): The publisher did not reconnect")
+
+	if timeshift != nil {
+		timeshift.Close()
+	}
+
+	for i := 0; i < len(outputs); i++ {
+		go outputs[i].Stop()
+	}
+
+	// The slate is restarted after the players are notified
+	_, slateRunning := server.StopSlate(channel)
+
+	for i := 0; i < len(players); i++ {
+		players[i].StopTimeshift()
+		LogRequest(players[i].id, players[i].ip, "PLAY IDLE '"+players[i].channel+"'")
+		players[i].SendStatusMessage(players[i].playStreamId, "status", "NetStream.Play.UnpublishNotify", "stream is now unpublished.")
+		players[i].SendStreamStatus(STREAM_EOF, players[i].playStreamId)
+	}
+
+	if slateRunning {
+		server.StartSlate(channel)
+	}
+
+	s.ReleaseRegistryChannel()
+
+	s.publish_mutex.Lock()
+	defer s.publish_mutex.Unlock()
+
+	s.sendStopEvents(reason)
+}
+
+// Gets the publisher sessions of the channels waiting for their publisher to reconnect
+// Returns the list of suspended publisher sessions
+func (server *RTMPServer) GetSuspendedPublishers() []*RTMPSession {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	sessions := make([]*RTMPSession, 0)
+
+	for _, c := range server.channels {
+		if c.graceSession != nil {
+			sessions = append(sessions, c.graceSession)
+		}
+	}
+
+	return sessions
+}
+
+// Ends the streams of every suspended channel, without waiting for the grace period
+func (server *RTMPServer) ExpireAllGracePeriods() {
+	server.mutex.Lock()
+
+	channels := make([]string, 0)
+	sessions := make([]*RTMPSession, 0)
+
+	for _, c := range server.channels {
+		if c.graceSession != nil {
+			channels = append(channels, c.channel)
+			sessions = append(sessions, c.graceSession)
+		}
+	}
+
+	server.mutex.Unlock()
+
+	for i := 0; i < len(channels); i++ {
+		server.ExpireGracePeriod(channels[i], sessions[i])
+	}
+}
+
+// Suspends the publishing session, if the grace period is enabled, waiting for the publisher to reconnect
+// Call only for publishers, with the publish mutex locked
+// reason - The reason for the publishing session to end (PUBLISH_END_REASON_*)
+// Returns true if suspended, false if the publishing session must end
+func (s *RTMPSession) suspendPublish(reason string) bool {
+	gracePeriod := s.server.GetConfig().publishGracePeriod
+
+	if gracePeriod <= 0 || !isReconnectReason(reason) || s.server.IsDraining() {
+		return false
+	}
+
+	players := s.server.GetPlayers(s.channel)
+
+	if !s.server.SuspendPublisher(s.channel, s, reason, gracePeriod) {
+		return false
+	}
+
+	LogRequest(s.id, s.ip, "PUBLISH SUSPENDED '"+s.channel+"' ("+reason+"): Waiting "+strconv.Itoa(int(gracePeriod.Seconds()))+" seconds for the publisher to reconnect")
+
+	s.publishStats.endTime = time.Now().UnixMilli()
+
+	for i := 0; i < len(players); i++ {
+		s.registerPlayerEnd(players[i])
+	}
+
+	s.rtmpGopCache = list.New()
+	s.gopCacheSize = 0
+
+	s.isPublishing = false
+	s.stopDelayBuffer()
+
+	if s.maxDurationTimer != nil {
+		s.maxDurationTimer.Stop()
+		s.maxDurationTimer = nil
+	}
+
+	s.server.StartSlate(s.channel)
+
+	return true
+}
+
+// Handles a publish command for a channel waiting for its publisher to reconnect
+// The session continues the stream of the previous session, without sending start events
+// previous - The suspended publisher session
+// Returns false if the session must be closed
+func (s *RTMPSession) HandleResumePublish(previous *RTMPSession) bool {
+	previous.publish_mutex.Lock()
+
+	stats := previous.publishStats
+	streamId := previous.stream_id
+	callbackFallback := previous.callbackFallback
+	maxDuration := previous.maxDuration
+	registryToken := previous.registryToken
+
+	previous.publish_mutex.Unlock()
+
+	LogRequest(s.id, s.ip, "PUBLISH ("+strconv.Itoa(int(s.publishStreamId))+") '"+s.channel+"' (reconnected)")
+
+	s.publish_mutex.Lock()
+
+	s.publishStats = stats
+	s.publishStats.endTime = 0
+
+	s.publish_mutex.Unlock()
+
+	s.stream_id = streamId
+	s.registryToken = registryToken
+	s.callbackFallback = callbackFallback
+	s.lastMediaTime.Store(time.Now().UnixMilli())
+	s.startDelayBuffer()
+	s.isPublishing = true
+
+	s.SendStatusMessage(s.publishStreamId, "status", "NetStream.Publish.Start", s.GetStreamPath()+" is now published.")
+
+	if maxDuration > 0 {
+		s.SetMaxDuration(maxDuration)
+	}
+
+	s.StartIdlePlayers()
+
+	return true
+}
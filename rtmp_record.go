@@ -0,0 +1,170 @@
+// Recordings: the stream of a channel is written to a FLV file
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Prefix of the destination of the recording outputs
+const RTMP_RECORD_TARGET = "record"
+
+// Destination of a recording (FLV file)
+type RTMPRecordSink struct {
+	path string // Path of the file
+
+	file   *os.File   // The file
+	writer *FLVWriter // Writer of the file, nil if not opened
+}
+
+// Creates the file of a recording
+// path - Path of the file
+// Returns the destination, or an error if the file could not be created
+func CreateRTMPRecordSink(path string) (*RTMPRecordSink, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &RTMPRecordSink{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Opens the destination, writing the file header
+// A recording can only be opened once
+// Returns an error if the header could not be written
+func (sink *RTMPRecordSink) Open() error {
+	if sink.file == nil {
+		return errors.New("the recording file is closed")
+	}
+
+	writer, err := CreateFLVWriter(sink.file)
+
+	if err != nil {
+		sink.file.Close()
+		sink.file = nil
+		return err
+	}
+
+	sink.writer = writer
+
+	return nil
+}
+
+// Writes a packet to the file
+// packet - The packet, with the timestamp relative to the start of the recording
+// Returns an error if the packet could not be written
+func (sink *RTMPRecordSink) Write(packet *RTMPPacket) error {
+	return sink.writer.WriteTag(&FLVTag{
+		tagType:   packet.header.packet_type,
+		timestamp: packet.header.timestamp,
+		data:      packet.payload,
+	})
+}
+
+// Closes the file
+func (sink *RTMPRecordSink) Close() {
+	if sink.file == nil {
+		return
+	}
+
+	if sink.writer != nil {
+		err := sink.writer.Flush()
+
+		if err != nil {
+			LogErrorMessage("Could not write the recording '" + sink.path + "': " + err.Error())
+		}
+	}
+
+	sink.file.Close()
+	sink.file = nil
+}
+
+// Starts recording a channel being published
+// The stream is written to {RECORD_DIR}/{CHANNEL}/{UNIX_MS}.flv, starting at the next keyframe
+// channel - The channel ID
+// Returns the path of the file, or an error
+func (server *RTMPServer) StartRecording(channel string) (string, error) {
+	recordDir := server.GetConfig().recordDir
+
+	if recordDir == "" {
+		return "", errors.New("recording is disabled (RECORD_DIR is not set)")
+	}
+
+	publisher := server.GetPublisher(channel)
+
+	if publisher == nil {
+		return "", errors.New("channel is not being published")
+	}
+
+	if server.GetOutput(channel, RTMP_RECORD_TARGET) != nil {
+		return "", errors.New("channel is already being recorded")
+	}
+
+	path := filepath.Join(recordDir, channel, strconv.FormatInt(time.Now().UnixMilli(), 10)+".flv")
+
+	sink, err := CreateRTMPRecordSink(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	output := CreateRTMPOutput(channel, RTMP_RECORD_TARGET, sink, false)
+
+	output.onStatus = func(status string, _ error) {
+		if status != RTMP_OUTPUT_STATUS_STOPPED {
+			return
+		}
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			return // Not created
+		}
+
+		server.SendRecordingFinishedEvent(output, path, info.Size())
+	}
+
+	if !publisher.StartOutput(output) {
+		sink.Close()
+		os.Remove(path)
+		return "", errors.New("channel is not being published or it is already being recorded")
+	}
+
+	LogInfo("[RECORD] Started recording channel '" + channel + "': " + path)
+
+	return path, nil
+}
+
+// Stops recording a channel
+// Waits until the file is closed
+// channel - The channel ID
+// Returns the path of the file, or an error if the channel is not being recorded
+func (server *RTMPServer) StopRecording(channel string) (string, error) {
+	output := server.RemoveOutput(channel, RTMP_RECORD_TARGET)
+
+	if output == nil {
+		return "", errors.New("channel is not being recorded")
+	}
+
+	output.Stop()
+
+	path := output.sink.(*RTMPRecordSink).path
+
+	LogInfo("[RECORD] Stopped recording channel '" + channel + "': " + path)
+
+	return path, nil
+}
@@ -0,0 +1,701 @@
+// Relays: the stream of a channel is published to other RTMP servers
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max time to connect and start publishing to the remote server (milliseconds)
+const RTMP_RELAY_CONNECT_TIMEOUT = 10000
+
+// Max time to send a packet to the remote server (milliseconds)
+const RTMP_RELAY_WRITE_TIMEOUT = 10000
+
+// Chunk size used to send the packets to the remote server
+const RTMP_RELAY_CHUNK_SIZE = 4096
+
+// Max size of the messages received from the remote server
+const RTMP_RELAY_MAX_MESSAGE_SIZE = 1024 * 1024
+
+// Transaction IDs of the commands sent to the remote server
+const (
+	RTMP_RELAY_TRANS_CONNECT        = 1
+	RTMP_RELAY_TRANS_RELEASE_STREAM = 2
+	RTMP_RELAY_TRANS_FC_PUBLISH     = 3
+	RTMP_RELAY_TRANS_CREATE_STREAM  = 4
+	RTMP_RELAY_TRANS_PUBLISH        = 5
+)
+
+// Destination of a relay (remote RTMP server)
+type RTMPRelaySink struct {
+	url *url.URL // URL of the remote server, including the app and the stream name
+
+	app        string // App (first element of the path)
+	streamName string // Stream name (rest of the path and the query)
+	tcUrl      string // URL of the app
+
+	conn   net.Conn         // Connection to the remote server, nil if not connected
+	reader *RTMPRelayReader // Reader of the connection, counting the bytes
+	r      *bufio.Reader    // Buffered reader of the connection
+
+	inChunkSize uint32                 // Chunk size of the remote server
+	inPackets   map[uint32]*RTMPPacket // Messages being received. Map: Chunk stream ID -> Packet
+
+	inAckSize  uint32 // Window acknowledgement size of the remote server. 0 if not set
+	inAckBytes uint64 // Bytes received when the last acknowledgement was sent
+
+	streamId uint32 // ID of the stream to publish
+
+	done chan bool // Closed when it stops receiving messages. Nil if it is not receiving
+}
+
+// Reader of the connection to the remote server of a relay, counting the bytes received
+type RTMPRelayReader struct {
+	conn  net.Conn // The connection
+	bytes uint64   // Bytes received
+}
+
+// Reads from the connection
+// b - Buffer
+// Returns the number of bytes read, and an error if the read failed
+func (r *RTMPRelayReader) Read(b []byte) (int, error) {
+	n, err := r.conn.Read(b)
+	r.bytes += uint64(n)
+	return n, err
+}
+
+// Creates the destination of a relay
+// relayURL - URL of the remote server: rtmp(s)://host[:port]/app/stream
+// Returns the destination, or an error if the URL is not valid
+func CreateRTMPRelaySink(relayURL string) (*RTMPRelaySink, error) {
+	u, err := url.Parse(relayURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "rtmp" && u.Scheme != "rtmps" {
+		return nil, errors.New("the relay URL must use rtmp or rtmps")
+	}
+
+	if u.Hostname() == "" {
+		return nil, errors.New("the relay URL must include the host")
+	}
+
+	app, streamName, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+
+	if app == "" || streamName == "" {
+		return nil, errors.New("the relay URL must include the app and the stream name")
+	}
+
+	if u.RawQuery != "" {
+		streamName += "?" + u.RawQuery
+	}
+
+	return &RTMPRelaySink{
+		url:        u,
+		app:        app,
+		streamName: streamName,
+		tcUrl:      u.Scheme + "://" + u.Host + "/" + app,
+	}, nil
+}
+
+// Connects to the remote server and starts publishing
+// Returns an error if it could not start publishing
+func (sink *RTMPRelaySink) Open() error {
+	address := sink.url.Host
+
+	if sink.url.Port() == "" {
+		if sink.url.Scheme == "rtmps" {
+			address = net.JoinHostPort(sink.url.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(sink.url.Hostname(), "1935")
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: RTMP_RELAY_CONNECT_TIMEOUT * time.Millisecond,
+	}
+
+	var conn net.Conn
+	var err error
+
+	if sink.url.Scheme == "rtmps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+			ServerName: sink.url.Hostname(),
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sink.conn = conn
+	sink.reader = &RTMPRelayReader{conn: conn}
+	sink.r = bufio.NewReader(sink.reader)
+	sink.inChunkSize = RTMP_CHUNK_SIZE
+	sink.inPackets = make(map[uint32]*RTMPPacket)
+	sink.inAckSize = 0
+	sink.inAckBytes = 0
+
+	err = conn.SetDeadline(time.Now().Add(RTMP_RELAY_CONNECT_TIMEOUT * time.Millisecond))
+
+	if err == nil {
+		err = sink.startPublishing()
+	}
+
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		sink.Close()
+		return err
+	}
+
+	// Keep answering the pings and acknowledging the bytes while publishing
+	sink.done = make(chan bool)
+	go sink.receive(sink.done)
+
+	return nil
+}
+
+// Receives the messages of the remote server while publishing, until the connection is closed
+// If the remote server ends the stream, the connection is closed, so the relay reconnects
+// done - Closed when it stops receiving
+func (sink *RTMPRelaySink) receive(done chan bool) {
+	defer close(done)
+
+	// The next write fails if the connection is closed here
+	defer sink.conn.Close()
+
+	for {
+		cmd, err := sink.readCommand()
+
+		if err != nil {
+			return
+		}
+
+		switch cmd.cmd {
+		case "close":
+			LogWarning("[RELAY] Connection closed by the remote server: " + sink.tcUrl)
+			return
+		case "onStatus":
+			info := cmd.GetArg("info")
+			code := info.GetProperty("code").GetString()
+
+			if info.GetProperty("level").GetString() == "error" || code == "NetStream.Unpublish.Success" {
+				LogWarning("[RELAY] Stream ended by the remote server: " + sink.tcUrl + ": " + code)
+				return
+			}
+		}
+	}
+}
+
+// Runs the handshake and the commands to start publishing
+// Returns an error if the remote server did not accept the stream
+func (sink *RTMPRelaySink) startPublishing() error {
+	// Handshake (C0 + C1)
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+	c0c1[0] = RTMP_VERSION
+
+	_, err := rand.Read(c0c1[9:])
+
+	if err != nil {
+		return err
+	}
+
+	_, err = sink.conn.Write(c0c1)
+
+	if err != nil {
+		return err
+	}
+
+	// S0 + S1 + S2
+	s0s1s2 := make([]byte, 1+2*RTMP_HANDSHAKE_SIZE)
+
+	_, err = io.ReadFull(sink.r, s0s1s2)
+
+	if err != nil {
+		return err
+	}
+
+	// C2 (echo of S1)
+	_, err = sink.conn.Write(s0s1s2[1 : 1+RTMP_HANDSHAKE_SIZE])
+
+	if err != nil {
+		return err
+	}
+
+	// Chunk size
+	chunkSize := createBlankRTMPPacket()
+	chunkSize.header.fmt = RTMP_CHUNK_TYPE_0
+	chunkSize.header.cid = RTMP_CHANNEL_PROTOCOL
+	chunkSize.header.packet_type = RTMP_TYPE_SET_CHUNK_SIZE
+	chunkSize.payload = binary.BigEndian.AppendUint32(nil, RTMP_RELAY_CHUNK_SIZE)
+	chunkSize.header.length = uint32(len(chunkSize.payload))
+
+	_, err = sink.conn.Write(chunkSize.CreateChunks(RTMP_CHUNK_SIZE))
+
+	if err != nil {
+		return err
+	}
+
+	// Connect
+	cmdObj := createAMF0Value(AMF0_TYPE_OBJECT)
+	cmdObj.obj_val["app"] = createAMF0StringPointer(sink.app)
+	cmdObj.obj_val["type"] = createAMF0StringPointer("nonprivate")
+	cmdObj.obj_val["flashVer"] = createAMF0StringPointer("FMLE/3.0 (compatible; FMSc/1.0)")
+	cmdObj.obj_val["tcUrl"] = createAMF0StringPointer(sink.tcUrl)
+
+	err = sink.sendCommand("connect", RTMP_RELAY_TRANS_CONNECT, 0, &cmdObj, nil)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = sink.waitResult(RTMP_RELAY_TRANS_CONNECT)
+
+	if err != nil {
+		return err
+	}
+
+	// Create stream
+	err = sink.sendCommand("releaseStream", RTMP_RELAY_TRANS_RELEASE_STREAM, 0, nil, createAMF0StringPointer(sink.streamName))
+
+	if err != nil {
+		return err
+	}
+
+	err = sink.sendCommand("FCPublish", RTMP_RELAY_TRANS_FC_PUBLISH, 0, nil, createAMF0StringPointer(sink.streamName))
+
+	if err != nil {
+		return err
+	}
+
+	err = sink.sendCommand("createStream", RTMP_RELAY_TRANS_CREATE_STREAM, 0, nil, nil)
+
+	if err != nil {
+		return err
+	}
+
+	result, err := sink.waitResult(RTMP_RELAY_TRANS_CREATE_STREAM)
+
+	if err != nil {
+		return err
+	}
+
+	sink.streamId = uint32(result.GetArg("info").GetInteger())
+
+	// Publish
+	err = sink.sendCommand("publish", RTMP_RELAY_TRANS_PUBLISH, sink.streamId, nil, createAMF0StringPointer(sink.streamName))
+
+	if err != nil {
+		return err
+	}
+
+	return sink.waitPublishStart()
+}
+
+// Creates a pointer to an AMF0 string value
+// str - The string
+// Returns the value
+func createAMF0StringPointer(str string) *AMF0Value {
+	v := createAMF0Value(AMF0_TYPE_STRING)
+	v.str_val = str
+	return &v
+}
+
+// Sends a command to the remote server
+// cmdName - Command name
+// transId - Transaction ID
+// streamId - Stream ID
+// cmdObj - Command object, or nil to send null
+// streamName - Stream name argument, or nil to omit it
+// Returns an error if the command could not be sent
+func (sink *RTMPRelaySink) sendCommand(cmdName string, transId int64, streamId uint32, cmdObj *AMF0Value, streamName *AMF0Value) error {
+	cmd := RTMPCommand{
+		cmd:       cmdName,
+		arguments: make(map[string]*AMF0Value),
+	}
+
+	tid := createAMF0Value(AMF0_TYPE_NUMBER)
+	tid.SetIntegerVal(transId)
+	cmd.arguments["transId"] = &tid
+
+	if cmdObj != nil {
+		cmd.arguments["cmdObj"] = cmdObj
+	} else {
+		null := createAMF0Value(AMF0_TYPE_NULL)
+		cmd.arguments["cmdObj"] = &null
+	}
+
+	if streamName != nil {
+		cmd.arguments["streamName"] = streamName
+
+		if cmdName == "publish" {
+			cmd.arguments["type"] = createAMF0StringPointer("live")
+		}
+	}
+
+	packet := createBlankRTMPPacket()
+	packet.header.fmt = RTMP_CHUNK_TYPE_0
+	packet.header.cid = RTMP_CHANNEL_INVOKE
+	packet.header.packet_type = RTMP_TYPE_INVOKE
+	packet.header.stream_id = streamId
+	packet.payload = cmd.Encode()
+	packet.header.length = uint32(len(packet.payload))
+
+	_, err := sink.conn.Write(packet.CreateChunks(RTMP_RELAY_CHUNK_SIZE))
+
+	return err
+}
+
+// Waits for the result of a command sent to the remote server
+// transId - Transaction ID of the command
+// Returns the result, or an error if the command failed
+func (sink *RTMPRelaySink) waitResult(transId int64) (*RTMPCommand, error) {
+	for {
+		cmd, err := sink.readCommand()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if cmd.GetArg("transId").GetInteger() != transId {
+			continue
+		}
+
+		switch cmd.cmd {
+		case "_result":
+			return cmd, nil
+		case "_error":
+			return nil, errors.New("remote server error: " + cmd.GetArg("info").GetProperty("description").GetString())
+		}
+	}
+}
+
+// Waits for the remote server to accept the stream
+// Returns an error if the stream was rejected
+func (sink *RTMPRelaySink) waitPublishStart() error {
+	for {
+		cmd, err := sink.readCommand()
+
+		if err != nil {
+			return err
+		}
+
+		if cmd.cmd != "onStatus" {
+			continue
+		}
+
+		info := cmd.GetArg("info")
+		code := info.GetProperty("code").GetString()
+
+		if code == "NetStream.Publish.Start" {
+			return nil
+		}
+
+		if info.GetProperty("level").GetString() == "error" {
+			return errors.New("remote server rejected the stream: " + code + ": " + info.GetProperty("description").GetString())
+		}
+	}
+}
+
+// Reads messages from the remote server until a command is received
+// The protocol control messages are handled and the rest are ignored
+// Returns the command, or an error
+func (sink *RTMPRelaySink) readCommand() (*RTMPCommand, error) {
+	for {
+		packet, err := sink.readMessage()
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = sink.sendAcknowledgement()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch packet.header.packet_type {
+		case RTMP_TYPE_SET_CHUNK_SIZE:
+			if len(packet.payload) < 4 {
+				return nil, errors.New("invalid chunk size message")
+			}
+
+			chunkSize := binary.BigEndian.Uint32(packet.payload) & 0x7fffffff
+
+			if chunkSize == 0 || chunkSize > RTMP_MAX_CHUNK_SIZE {
+				return nil, errors.New("invalid chunk size: " + strconv.Itoa(int(chunkSize)))
+			}
+
+			sink.inChunkSize = chunkSize
+		case RTMP_TYPE_WINDOW_ACKNOWLEDGEMENT_SIZE:
+			if len(packet.payload) >= 4 {
+				sink.inAckSize = binary.BigEndian.Uint32(packet.payload)
+			}
+		case RTMP_TYPE_EVENT:
+			// Ping request (6) -> Ping response (7)
+			if len(packet.payload) >= 6 && binary.BigEndian.Uint16(packet.payload) == 6 {
+				err = sink.sendControl(RTMP_TYPE_EVENT, append([]byte{0x00, 0x07}, packet.payload[2:6]...))
+
+				if err != nil {
+					return nil, err
+				}
+			}
+		case RTMP_TYPE_INVOKE:
+			cmd := decodeRTMPCommand(packet.payload)
+			return &cmd, nil
+		case RTMP_TYPE_FLEX_MESSAGE:
+			if len(packet.payload) > 1 {
+				cmd := decodeRTMPCommand(packet.payload[1:])
+				return &cmd, nil
+			}
+		}
+	}
+}
+
+// Sends an acknowledgement to the remote server, if it received a window of bytes since the last one
+// Returns an error if it could not be sent
+func (sink *RTMPRelaySink) sendAcknowledgement() error {
+	if sink.inAckSize == 0 || sink.reader.bytes-sink.inAckBytes < uint64(sink.inAckSize) {
+		return nil
+	}
+
+	sink.inAckBytes = sink.reader.bytes
+
+	return sink.sendControl(RTMP_TYPE_ACKNOWLEDGEMENT, binary.BigEndian.AppendUint32(nil, uint32(sink.inAckBytes)))
+}
+
+// Sends a protocol control message to the remote server
+// The connection can be written concurrently, since every message is sent in a single write
+// packetType - Type of the message
+// payload - Payload of the message
+// Returns an error if it could not be sent
+func (sink *RTMPRelaySink) sendControl(packetType uint32, payload []byte) error {
+	packet := createBlankRTMPPacket()
+	packet.header.fmt = RTMP_CHUNK_TYPE_0
+	packet.header.cid = RTMP_CHANNEL_PROTOCOL
+	packet.header.packet_type = packetType
+	packet.payload = payload
+	packet.header.length = uint32(len(packet.payload))
+
+	_, err := sink.conn.Write(packet.CreateChunks(RTMP_RELAY_CHUNK_SIZE))
+
+	return err
+}
+
+// Reads chunks from the remote server until a message is complete
+// Returns the message, or an error
+func (sink *RTMPRelaySink) readMessage() (*RTMPPacket, error) {
+	for {
+		startByte, err := sink.r.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt := uint32(startByte >> 6)
+		cid := uint32(startByte & 0x3f)
+
+		switch cid {
+		case 0:
+			b, err := sink.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			cid = 64 + uint32(b)
+		case 1:
+			b := make([]byte, 2)
+			_, err := io.ReadFull(sink.r, b)
+			if err != nil {
+				return nil, err
+			}
+			cid = 64 + uint32(b[0]) + uint32(b[1])<<8
+		}
+
+		header := make([]byte, rtmpHeaderSize[fmt])
+
+		_, err = io.ReadFull(sink.r, header)
+
+		if err != nil {
+			return nil, err
+		}
+
+		packet := sink.inPackets[cid]
+
+		if packet == nil {
+			bp := createBlankRTMPPacket()
+			packet = &bp
+			sink.inPackets[cid] = packet
+		}
+
+		if fmt <= RTMP_CHUNK_TYPE_2 {
+			packet.header.timestamp = int64(uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2]))
+		}
+
+		if fmt <= RTMP_CHUNK_TYPE_1 {
+			packet.header.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			packet.header.packet_type = uint32(header[6])
+		}
+
+		if fmt == RTMP_CHUNK_TYPE_0 {
+			packet.header.stream_id = binary.LittleEndian.Uint32(header[7:11])
+		}
+
+		if packet.header.timestamp == 0xffffff {
+			_, err = sink.r.Discard(4)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if packet.header.length > RTMP_RELAY_MAX_MESSAGE_SIZE {
+			return nil, errors.New("message too large: " + strconv.Itoa(int(packet.header.length)))
+		}
+
+		if packet.bytes == 0 {
+			packet.payload = make([]byte, packet.header.length)
+		}
+
+		size := min(sink.inChunkSize, packet.header.length-packet.bytes)
+
+		_, err = io.ReadFull(sink.r, packet.payload[packet.bytes:packet.bytes+size])
+
+		if err != nil {
+			return nil, err
+		}
+
+		packet.bytes += size
+
+		if packet.bytes >= packet.header.length {
+			packet.bytes = 0
+
+			message := *packet
+			return &message, nil
+		}
+	}
+}
+
+// Sends a packet to the remote server
+// packet - The packet, with the timestamp relative to the start of the relay
+// Returns an error if the packet could not be sent
+func (sink *RTMPRelaySink) Write(packet *RTMPPacket) error {
+	if packet.header.packet_type == RTMP_TYPE_DATA {
+		// The metadata is sent as a publisher would do
+		data := decodeRTMPData(packet.payload)
+
+		if data.tag == "onMetaData" {
+			frame := RTMPData{
+				tag:       "@setDataFrame",
+				arguments: make(map[string]*AMF0Value),
+			}
+			frame.arguments["method"] = createAMF0StringPointer("onMetaData")
+			frame.arguments["dataObj"] = data.GetArg("dataObj")
+
+			packet.payload = frame.Encode()
+			packet.header.length = uint32(len(packet.payload))
+		}
+	}
+
+	packet.header.fmt = RTMP_CHUNK_TYPE_0
+	packet.header.stream_id = sink.streamId
+
+	err := sink.conn.SetWriteDeadline(time.Now().Add(RTMP_RELAY_WRITE_TIMEOUT * time.Millisecond))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = sink.conn.Write(packet.CreateChunks(RTMP_RELAY_CHUNK_SIZE))
+
+	return err
+}
+
+// Closes the connection to the remote server
+func (sink *RTMPRelaySink) Close() {
+	if sink.conn == nil {
+		return
+	}
+
+	sink.conn.Close()
+
+	if sink.done != nil {
+		// Wait for the receiving goroutine, since it uses the connection
+		<-sink.done
+		sink.done = nil
+	}
+
+	sink.conn = nil
+	sink.reader = nil
+	sink.r = nil
+	sink.inPackets = nil
+}
+
+// Adds a relay to a channel being published
+// The stream is published to the URL, starting at the next keyframe, reconnecting if the connection fails
+// channel - The channel ID
+// relayURL - URL of the remote server: rtmp(s)://host[:port]/app/stream
+// Returns an error if the relay could not be added
+func (server *RTMPServer) AddRelay(channel string, relayURL string) error {
+	sink, err := CreateRTMPRelaySink(relayURL)
+
+	if err != nil {
+		return err
+	}
+
+	output := CreateRTMPOutput(channel, relayURL, sink, true)
+
+	output.onStatus = func(status string, err error) {
+		server.SendRelayStatusEvent(output, status, err)
+	}
+
+	publisher := server.GetPublisher(channel)
+
+	if publisher == nil || !publisher.StartOutput(output) {
+		return errors.New("channel is not being published or it already has the relay")
+	}
+
+	LogInfo("[RELAY] Started relay of channel '" + channel + "' to " + sink.tcUrl)
+
+	return nil
+}
+
+// Removes a relay from a channel
+// Waits until the connection is closed
+// channel - The channel ID
+// relayURL - URL of the relay
+// Returns an error if the channel does not have the relay
+func (server *RTMPServer) RemoveRelay(channel string, relayURL string) error {
+	if relayURL == RTMP_RECORD_TARGET {
+		return errors.New("relay not found")
+	}
+
+	output := server.RemoveOutput(channel, relayURL)
+
+	if output == nil {
+		return errors.New("relay not found")
+	}
+
+	output.Stop()
+
+	LogInfo("[RELAY] Stopped relay of channel '" + channel + "' to " + output.sink.(*RTMPRelaySink).tcUrl)
+
+	return nil
+}
@@ -9,11 +9,9 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	tls_certificate_loader "github.com/AgustinSRG/go-tls-certificate-loader"
 )
 
 // Stores status data for a specific streaming channel
@@ -26,6 +24,21 @@ type RTMPChannel struct {
 
 	stream_id string // The current stream ID
 
+	primary       uint64 // The ID of the primary publisher, 0 if none
+	backup        uint64 // The ID of the backup publisher, 0 if none
+	switchPending bool   // True if the players are waiting for the remaining publisher to take over the channel
+	lastTimestamp int64  // Last timestamp sent to the players by a publisher that left the channel
+
+	graceSession *RTMPSession // Publisher session that disconnected, while waiting for it to reconnect. Nil if not waiting
+	graceReason  string       // Reason for the publisher session to end, if waiting for it to reconnect
+	graceTimer   *time.Timer  // Timer to end the stream if the publisher does not reconnect
+
+	slate *RTMPSlatePlayer // Slate being sent to the players, nil if not running
+
+	timeshift *RTMPTimeshiftBuffer // Time-shift window of the stream, nil if disabled
+
+	outputs []*RTMPOutput // Outputs of the stream (recordings and relays)
+
 	players map[uint64]bool // Players receiving the stream or waiting for it
 }
 
@@ -34,19 +47,27 @@ type RTMPServer struct {
 	host string // Hostname
 	port int    // Port
 
-	listener       net.Listener // TCP listener
-	secureListener net.Listener // TCP + SSL listener
+	listeners []*RTMPListener // RTMP listeners
+
+	tlsConfig *tls.Config // TLS configuration for the secure listeners
+
+	sockets map[string]net.Listener // Listening TCP sockets, to pass them to an upgraded process. Map: Name -> Listener
 
 	websocketControlConnection *ControlServerConnection // Connection to the coordinator server
 
+	redisEvents *RedisEventPublisher // Publisher of lifecycle events to Redis
+
+	channelRegistry *RedisChannelRegistry // Registry of live channels in Redis (cluster)
+
 	mutex *sync.Mutex // Mutex to access the status data (sessions, channels)
 
 	sessions map[uint64]*RTMPSession // Active sessions
 	channels map[string]*RTMPChannel // Active streaming channels
 
-	streamIdMaxLength int // Max length for stream IDs, rooms and keys
+	broadcastDelays map[string]int64 // Broadcast delay of specific channels (seconds). Map: Channel ID -> Seconds
+
+	config atomic.Pointer[RTMPServerConfig] // Configuration that can be reloaded
 
-	ipLimit uint32            // Max number of active sessions
 	ipCount map[string]uint32 // Mapping IP -> Number of active sessions
 
 	ip_mutex *sync.Mutex // Mutex for the IP count mapping
@@ -54,9 +75,13 @@ type RTMPServer struct {
 	next_session_id  uint64      // ID for the next incoming session
 	session_id_mutex *sync.Mutex // Mutex to ensure session IDs are unique
 
-	gopCacheLimit int64 // Limit of the GOP cache (in bytes)
+	bytesIn  atomic.Uint64 // Total bytes received from the clients
+	bytesOut atomic.Uint64 // Total bytes sent to the clients
+
+	closed   bool // True if the server is closed
+	draining bool // True if the server is draining (not accepting new sessions)
 
-	closed bool // True if the server is closed
+	drainOnce *sync.Once // Ensures the graceful drain runs only once
 }
 
 const STREAM_ID_DEFAULT_MAX_LENGTH = 128
@@ -67,41 +92,27 @@ const IP_DEFAULT_LIMIT = 4
 func CreateRTMPServer() *RTMPServer {
 	server := RTMPServer{
 		host:                       os.Getenv("RTMP_HOST"),
-		listener:                   nil,
-		secureListener:             nil,
+		listeners:                  make([]*RTMPListener, 0),
+		sockets:                    make(map[string]net.Listener),
 		mutex:                      &sync.Mutex{},
 		session_id_mutex:           &sync.Mutex{},
 		ip_mutex:                   &sync.Mutex{},
 		sessions:                   make(map[uint64]*RTMPSession),
 		channels:                   make(map[string]*RTMPChannel),
+		broadcastDelays:            make(map[string]int64),
 		next_session_id:            1,
 		closed:                     false,
+		draining:                   false,
+		drainOnce:                  &sync.Once{},
 		ipCount:                    make(map[string]uint32),
-		ipLimit:                    IP_DEFAULT_LIMIT,
-		gopCacheLimit:              GOP_CACHE_DEFAULT_LIMIT,
 		websocketControlConnection: nil,
-		streamIdMaxLength:          STREAM_ID_DEFAULT_MAX_LENGTH,
+		redisEvents:                nil,
+		channelRegistry:            nil,
 	}
 
-	custom_ip_limit := os.Getenv("MAX_IP_CONCURRENT_CONNECTIONS")
-	if custom_ip_limit != "" {
-		cil, e := strconv.Atoi(custom_ip_limit)
-		if e != nil {
-			server.ipLimit = uint32(cil)
-		}
-	}
-
-	custom_gop_limit := os.Getenv("GOP_CACHE_SIZE_MB")
-	if custom_gop_limit != "" {
-		cgl, e := strconv.Atoi(custom_gop_limit)
-		if e != nil {
-			server.gopCacheLimit = int64(cgl) * 1024 * 1024
-		}
-	}
-
-	bind_addr := os.Getenv("BIND_ADDRESS")
+	server.LoadReloadableConfig()
 
-	// Setup RTMP server
+	// Port announced to the coordinator and the callback
 	var tcp_port int
 	tcp_port = 1935
 	customTCPPort := os.Getenv("RTMP_PORT")
@@ -113,87 +124,45 @@ func CreateRTMPServer() *RTMPServer {
 	}
 	server.port = tcp_port
 
-	lTCP, errTCP := net.Listen("tcp", bind_addr+":"+strconv.Itoa(tcp_port))
-	if errTCP != nil {
-		LogError(errTCP)
-		return nil
-	} else {
-		server.listener = lTCP
-		LogInfo("[RTMP] Listing on " + bind_addr + ":" + strconv.Itoa(tcp_port))
-	}
-
-	// Setup RTMPS server
-	var ssl_port int
-	ssl_port = 443
-	customSSLPort := os.Getenv("SSL_PORT")
-	if customSSLPort != "" {
-		sslp, e := strconv.Atoi(customSSLPort)
-		if e == nil {
-			ssl_port = sslp
-		}
-	}
-
-	certFile := os.Getenv("SSL_CERT")
-	keyFile := os.Getenv("SSL_KEY")
+	// Setup the listeners
+	listenerNames := getListenerNames(os.Getenv)
 
-	if certFile != "" && keyFile != "" {
-		checkReloadSeconds := 60
-
-		customCheckReloadSeconds := os.Getenv("SSL_CHECK_RELOAD_SECONDS")
-		if customCheckReloadSeconds != "" {
-			n, e := strconv.Atoi(customCheckReloadSeconds)
-			if e == nil {
-				checkReloadSeconds = n
-
-				if checkReloadSeconds < 1 {
-					checkReloadSeconds = 1
-				}
-			}
+	for i := 0; i < len(listenerNames); i++ {
+		if !isListenerSecure(listenerNames[i], os.Getenv) || server.tlsConfig != nil {
+			continue
 		}
 
-		cerLoader, err := tls_certificate_loader.NewTlsCertificateLoader(tls_certificate_loader.TlsCertificateLoaderConfig{
-			CertificatePath:   certFile,
-			KeyPath:           keyFile,
-			CheckReloadPeriod: time.Duration(checkReloadSeconds) * time.Second,
-			OnReload: func() {
-				LogInfo("Reloaded SSL certificates")
-			},
-			OnError: func(err error) {
-				LogError(err)
-			},
-		})
+		tlsConfig, err := createTLSConfig()
 
 		if err != nil {
 			LogError(err)
-			if server.listener != nil {
-				server.listener.Close()
-			}
 			return nil
 		}
 
-		config := &tls.Config{
-			GetCertificate: cerLoader.GetCertificate,
-		}
+		server.tlsConfig = tlsConfig
+	}
 
-		lnSSL, errSSL := tls.Listen("tcp", bind_addr+":"+strconv.Itoa(ssl_port), config)
+	for i := 0; i < len(listenerNames); i++ {
+		l, err := CreateRTMPListener(listenerNames[i])
 
-		if errSSL != nil {
-			cerLoader.Close()
-			LogError(errSSL)
+		if err != nil {
+			LogError(err)
+			server.closeListeners()
 			return nil
-		} else {
-			server.secureListener = lnSSL
-			LogInfo("[SSL] Listening on " + bind_addr + ":" + strconv.Itoa(ssl_port))
 		}
-	}
 
-	idCustomMaxLength := os.Getenv("ID_MAX_LENGTH")
-
-	if idCustomMaxLength != "" {
-		var e error
-		idMaxLen, e := strconv.Atoi(idCustomMaxLength)
-		if e == nil && idMaxLen > 0 {
-			server.streamIdMaxLength = idMaxLen
+		server.listeners = append(server.listeners, l)
+		server.sockets[l.name] = l.listener
+
+		switch {
+		case l.protocol == LISTENER_PROTOCOL_RTMPT:
+			LogInfo("[RTMPT] Listener '" + l.name + "' listening on " + l.address)
+		case l.protocol == LISTENER_PROTOCOL_WS:
+			LogInfo("[WS] Listener '" + l.name + "' listening on " + l.address)
+		case l.secure:
+			LogInfo("[SSL] Listener '" + l.name + "' listening on " + l.address)
+		default:
+			LogInfo("[RTMP] Listener '" + l.name + "' listening on " + l.address)
 		}
 	}
 
@@ -201,9 +170,19 @@ func CreateRTMPServer() *RTMPServer {
 		server.websocketControlConnection = &ControlServerConnection{}
 	}
 
+	server.redisEvents = CreateRedisEventPublisher()
+	server.channelRegistry = CreateRedisChannelRegistry(&server)
+
 	return &server
 }
 
+// Closes every listener, so no more connections are accepted
+func (server *RTMPServer) closeListeners() {
+	for i := 0; i < len(server.listeners); i++ {
+		server.listeners[i].listener.Close()
+	}
+}
+
 // Adds an active session to the count for an IP address
 // ip - The IP address
 // Returns true if it was added, false if it reached the limit
@@ -213,7 +192,7 @@ func (server *RTMPServer) AddIP(ip string) bool {
 
 	c := server.ipCount[ip]
 
-	if c >= server.ipLimit {
+	if c >= server.GetConfig().ipLimit {
 		return false
 	}
 
@@ -226,34 +205,7 @@ func (server *RTMPServer) AddIP(ip string) bool {
 // ipStr - The IP address
 // Returns true if exempted
 func (server *RTMPServer) isIPExempted(ipStr string) bool {
-	r := os.Getenv("CONCURRENT_LIMIT_WHITELIST")
-
-	if r == "" {
-		return false
-	}
-
-	if r == "*" {
-		return true
-	}
-
-	ip := net.ParseIP(ipStr)
-
-	parts := strings.Split(r, ",")
-
-	for i := 0; i < len(parts); i++ {
-		_, rang, e := net.ParseCIDR(parts[i])
-
-		if e != nil {
-			LogError(e)
-			continue
-		}
-
-		if rang.Contains(ip) {
-			return true
-		}
-	}
-
-	return false
+	return server.GetConfig().ipLimitWhitelist.Contains(ipStr)
 }
 
 // Removes an active session from the count of an IP
@@ -301,13 +253,14 @@ func (server *RTMPServer) RemoveSession(id uint64) {
 }
 
 // Checks if there is an active stream being published on a given channel
+// Includes the streams waiting for their publisher to reconnect
 // channel - Channel ID
 // Returns true if active publishing
 func (server *RTMPServer) isPublishing(channel string) bool {
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
 
-	return server.channels[channel] != nil && server.channels[channel].is_publishing
+	return server.channels[channel] != nil && (server.channels[channel].is_publishing || server.channels[channel].graceSession != nil)
 }
 
 // Obtains a reference to the session that is publishing on a given channel
@@ -360,6 +313,13 @@ func (server *RTMPServer) SetPublisher(channel string, key string, stream_id str
 		server.channels[channel].publisher = s.id
 	}
 
+	server.channels[channel].setPublisherRole(s)
+
+	server.startTimeshift(server.channels[channel])
+
+	// If the slate is running, the players are switched to the stream at its first keyframe
+	server.channels[channel].switchPending = server.channels[channel].slate != nil
+
 	return true
 }
 
@@ -373,8 +333,15 @@ func (server *RTMPServer) RemovePublisher(channel string) {
 		return
 	}
 
+	if publisher := server.sessions[server.channels[channel].publisher]; publisher != nil {
+		server.channels[channel].lastTimestamp = publisher.lastOutTimestamp.Load()
+	}
+
 	server.channels[channel].publisher = 0
 	server.channels[channel].is_publishing = false
+	server.channels[channel].primary = 0
+	server.channels[channel].backup = 0
+	server.channels[channel].switchPending = false
 
 	players := server.channels[channel].players
 
@@ -386,7 +353,7 @@ func (server *RTMPServer) RemovePublisher(channel string) {
 		}
 	}
 
-	if !server.channels[channel].is_publishing && len(server.channels[channel].players) == 0 {
+	if !server.channels[channel].is_publishing && server.channels[channel].graceSession == nil && len(server.channels[channel].players) == 0 {
 		delete(server.channels, channel)
 	}
 }
@@ -441,6 +408,49 @@ func (server *RTMPServer) GetPlayers(channel string) []*RTMPSession {
 	return playersToStart
 }
 
+// Obtains the list of players for a given channel, including idle players
+// channel - The channel ID
+// Returns the list of player sessions
+func (server *RTMPServer) GetAllPlayers(channel string) []*RTMPSession {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.channels[channel] == nil {
+		return make([]*RTMPSession, 0)
+	}
+
+	players := server.channels[channel].players
+
+	result := make([]*RTMPSession, 0, len(players))
+
+	for sid := range players {
+		player := server.sessions[sid]
+		if player != nil {
+			result = append(result, player)
+		}
+	}
+
+	return result
+}
+
+// Kicks players from a channel, closing their connections
+// channel - The channel ID
+// sessionId - ID of the player session to kick, or 0 to kick every player of the channel
+// Returns the number of kicked players
+func (server *RTMPServer) KickPlayers(channel string, sessionId uint64) int {
+	players := server.GetAllPlayers(channel)
+	kicked := 0
+
+	for i := 0; i < len(players); i++ {
+		if sessionId == 0 || players[i].id == sessionId {
+			players[i].Kill()
+			kicked++
+		}
+	}
+
+	return kicked
+}
+
 // Adds a player to a given channel
 // channel - The channel ID
 // key - The channel key used by the player
@@ -493,44 +503,131 @@ func (server *RTMPServer) RemovePlayer(channel string, key string, s *RTMPSessio
 	s.isIdling = false
 	s.isPlaying = false
 
-	if !server.channels[channel].is_publishing && len(server.channels[channel].players) == 0 {
+	if !server.channels[channel].is_publishing && server.channels[channel].graceSession == nil && len(server.channels[channel].players) == 0 {
 		delete(server.channels, channel)
 	}
 }
 
 // Runs a loop to indefinitely accept incoming connections
-// listener - The TCP listener
+// listener - The RTMP listener
 // wg - The waiting group
-func (server *RTMPServer) AcceptConnections(listener net.Listener, wg *sync.WaitGroup) {
+func (server *RTMPServer) AcceptConnections(listener *RTMPListener, wg *sync.WaitGroup) {
 	defer func() {
-		listener.Close()
+		listener.listener.Close()
 		wg.Done()
 	}()
 	for {
-		c, err := listener.Accept()
+		c, err := listener.listener.Accept()
 		if err != nil {
-			LogError(err)
+			if !server.IsDraining() {
+				LogError(err)
+			}
 			return
 		}
 		id := server.NextSessionID()
-		var ip string
-		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
-			ip = addr.IP.String()
-		} else {
-			ip = c.RemoteAddr().String()
+
+		if server.IsDraining() {
+			c.Close()
+			LogDebugSession(id, c.RemoteAddr().String(), "Connection rejected: Server is draining")
+			continue
 		}
 
-		if !server.isIPExempted(ip) {
-			if !server.AddIP(ip) {
+		go server.AcceptConnection(id, c, listener)
+	}
+}
+
+// Accepts an incoming connection
+// Reads the PROXY protocol header if enabled, and checks the listener policy and the IP limit
+// id - Session ID
+// c - The TCP connection
+// listener - The listener that accepted the connection
+func (server *RTMPServer) AcceptConnection(id uint64, c net.Conn, listener *RTMPListener) {
+	var ip string
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+
+		proxyProtocol := server.GetConfig().proxyProtocol
+
+		if proxyProtocol != nil && proxyProtocol.IsTrusted(addr.IP) {
+			clientIP, err := readProxyProtocolHeader(c)
+
+			if err != nil {
 				c.Close()
-				LogRequest(id, ip, "Connection rejected: Too many requests")
-				continue
+				LogDebugSession(id, ip, "Connection rejected: Invalid PROXY protocol header: "+err.Error())
+				return
+			}
+
+			if clientIP != nil {
+				ip = clientIP.String()
 			}
 		}
+	} else {
+		ip = c.RemoteAddr().String()
+	}
+
+	if !server.AdmitConnection(id, ip, listener) {
+		c.Close()
+		return
+	}
+
+	certSubject := ""
+
+	if listener.secure {
+		tlsConn := tls.Server(c, server.tlsConfig)
+
+		err := tlsConn.SetDeadline(time.Now().Add(RTMP_PING_TIMEOUT * time.Millisecond))
+
+		if err == nil {
+			err = tlsConn.Handshake()
+		}
 
-		LogDebugSession(id, ip, "Connection accepted!")
-		go server.HandleConnection(id, ip, c)
+		if err != nil {
+			tlsConn.Close()
+			server.RemoveIP(ip)
+			listener.RemoveConnection(ip)
+			LogDebugSession(id, ip, "Connection rejected: TLS handshake failed: "+err.Error())
+			return
+		}
+
+		tlsConn.SetDeadline(time.Time{}) //nolint:errcheck
+
+		state := tlsConn.ConnectionState()
+		certSubject = getClientCertificateSubject(&state)
+		c = tlsConn
 	}
+
+	LogDebugSession(id, ip, "Connection accepted!")
+	server.HandleConnection(id, ip, c, certSubject, listener)
+}
+
+// Checks the listener policy and the connection limits for a new connection
+// If admitted, the connection is added to the counters, and removed by HandleConnection when closed
+// id - Session ID
+// ip - Client IP address
+// listener - The listener that accepted the connection
+// Returns true if admitted
+func (server *RTMPServer) AdmitConnection(id uint64, ip string, listener *RTMPListener) bool {
+	policy := listener.GetPolicy()
+
+	if !policy.whitelist.IsEmpty() && !policy.whitelist.Contains(ip) {
+		LogRequest(id, ip, "Connection rejected: Not whitelisted in listener '"+listener.name+"'")
+		return false
+	}
+
+	if !server.isIPExempted(ip) {
+		if !server.AddIP(ip) {
+			LogRequest(id, ip, "Connection rejected: Too many requests")
+			return false
+		}
+	}
+
+	if !listener.AddConnection(ip) {
+		server.RemoveIP(ip)
+		LogRequest(id, ip, "Connection rejected: Listener '"+listener.name+"' reached its connection limit")
+		return false
+	}
+
+	return true
 }
 
 // Sends pings to active sessions
@@ -562,19 +659,53 @@ func (server *RTMPServer) Start() {
 
 	// Start RTMP server
 	var wg sync.WaitGroup
-	if server.listener != nil {
+	for i := 0; i < len(server.listeners); i++ {
 		wg.Add(1)
-		go server.AcceptConnections(server.listener, &wg)
-	}
 
-	if server.secureListener != nil {
-		wg.Add(1)
-		go server.AcceptConnections(server.secureListener, &wg)
+		switch server.listeners[i].protocol {
+		case LISTENER_PROTOCOL_RTMPT:
+			go server.ServeRTMPT(server.listeners[i], &wg)
+		case LISTENER_PROTOCOL_WS:
+			go server.ServeWebSocket(server.listeners[i], &wg)
+		default:
+			go server.AcceptConnections(server.listeners[i], &wg)
+		}
 	}
 
 	wg.Add(1)
 	go server.SendPings(&wg)
 
+	// Start admin server
+	ready := true
+	adminServer := CreateAdminServer(server)
+	if adminServer != nil {
+		adminListener, err := adminServer.Listen()
+
+		if err == nil {
+			go adminServer.Run(adminListener)
+		} else {
+			LogError(err)
+			ready = false
+		}
+	}
+
+	// Graceful shutdown on signals
+	go server.HandleSignals()
+
+	// Configuration reload
+	go server.HandleReloadSignal()
+
+	// Binary upgrades
+	go server.HandleUpgradeSignal()
+
+	// If started by an upgrade, the parent process can start draining,
+	// once every listener and the admin socket are bound
+	if ready {
+		notifyUpgradeReady()
+	} else {
+		LogWarning("The admin server could not start. Not notifying the parent process.")
+	}
+
 	wg.Wait()
 }
 
@@ -582,8 +713,11 @@ func (server *RTMPServer) Start() {
 // id - Session ID
 // ip - Client IP address
 // c - The TCP connection
-func (server *RTMPServer) HandleConnection(id uint64, ip string, c net.Conn) {
-	s := CreateRTMPSession(server, id, ip, c)
+// certSubject - Subject of the verified client certificate, or an empty string
+// listener - The listener that accepted the connection
+func (server *RTMPServer) HandleConnection(id uint64, ip string, c net.Conn, certSubject string, listener *RTMPListener) {
+	s := CreateRTMPSession(server, id, ip, c, listener)
+	s.clientCertSubject = certSubject
 
 	server.AddSession(&s)
 
@@ -602,6 +736,7 @@ func (server *RTMPServer) HandleConnection(id uint64, ip string, c net.Conn) {
 		c.Close()
 		server.RemoveSession(id)
 		server.RemoveIP(ip)
+		listener.RemoveConnection(ip)
 		LogDebugSession(id, ip, "Connection closed!")
 	}()
 
@@ -611,26 +746,16 @@ func (server *RTMPServer) HandleConnection(id uint64, ip string, c net.Conn) {
 // Returns the server chunk size for outgoing packets
 // Returns the chunk size in bytes
 func (server *RTMPServer) getOutChunkSize() uint32 {
-	r := os.Getenv("RTMP_CHUNK_SIZE")
-
-	if r == "" {
-		return RTMP_CHUNK_SIZE
-	}
-
-	n, e := strconv.Atoi(r)
-
-	if e != nil || n <= RTMP_CHUNK_SIZE {
-		return RTMP_CHUNK_SIZE
-	}
-
-	return uint32(n)
+	return server.GetConfig().outChunkSize
 }
 
-// Kills any sessions publishing streams
-func (server *RTMPServer) KillAllActivePublishers() {
-	activePublishers := make([]*RTMPSession, 0)
-
+// Obtains the list of sessions publishing streams
+// Returns the list of publishers
+func (server *RTMPServer) GetPublishers() []*RTMPSession {
 	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	activePublishers := make([]*RTMPSession, 0)
 
 	for _, channel := range server.channels {
 		if channel == nil || !channel.is_publishing {
@@ -644,9 +769,47 @@ func (server *RTMPServer) KillAllActivePublishers() {
 		}
 	}
 
-	server.mutex.Unlock()
+	return activePublishers
+}
+
+// Kills any sessions publishing streams
+// reason - The reason to end the sessions (PUBLISH_END_REASON_*)
+func (server *RTMPServer) KillAllActivePublishers(reason string) {
+	activePublishers := server.GetPublishers()
 
 	for i := 0; i < len(activePublishers); i++ {
-		activePublishers[i].Kill()
+		activePublishers[i].KillWithReason(reason)
 	}
 }
+
+// Counts the active sessions and channels
+// Returns the number of sessions and the number of channels
+func (server *RTMPServer) GetCounts() (sessions int, channels int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return len(server.sessions), len(server.channels)
+}
+
+// Starts draining the server
+// New connections, publishing sessions and players are rejected,
+// while the existing sessions are kept
+func (server *RTMPServer) StartDrain() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if !server.draining {
+		LogInfo("Draining server. New sessions will be rejected.")
+	}
+
+	server.draining = true
+}
+
+// Checks if the server is draining
+// Returns true if draining
+func (server *RTMPServer) IsDraining() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.draining
+}
@@ -0,0 +1,236 @@
+// RTMP server reloadable configuration
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// List of IP addresses and ranges
+type IPWhitelist struct {
+	all  bool         // True if every address is in the list
+	nets []*net.IPNet // Networks in the list
+}
+
+// Parses an IP whitelist
+// list - Comma-separated list of IP addresses or ranges, or *
+// Returns the whitelist
+func parseIPWhitelist(list string) IPWhitelist {
+	if list == "*" {
+		return IPWhitelist{all: true}
+	}
+
+	return IPWhitelist{
+		all:  false,
+		nets: parseIPNetList(list),
+	}
+}
+
+// Checks if an IP address is in the whitelist
+// ipStr - The IP address
+// Returns true if the address is in the whitelist
+func (w *IPWhitelist) Contains(ipStr string) bool {
+	if w.all {
+		return true
+	}
+
+	ip := net.ParseIP(ipStr)
+
+	if ip == nil {
+		return false
+	}
+
+	for i := 0; i < len(w.nets); i++ {
+		if w.nets[i].Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if the whitelist is empty
+// Returns true if empty
+func (w *IPWhitelist) IsEmpty() bool {
+	return !w.all && len(w.nets) == 0
+}
+
+// Configuration of the RTMP server that can be reloaded
+type RTMPServerConfig struct {
+	streamIdMaxLength int // Max length for stream IDs, rooms and keys
+
+	ipLimit          uint32      // Max number of active sessions per IP address
+	ipLimitWhitelist IPWhitelist // IP addresses not affected by the limit
+
+	playWhitelist IPWhitelist // IP addresses allowed to play. If empty, every address is allowed
+
+	gopCacheLimit int64  // Limit of the GOP cache (in bytes)
+	outChunkSize  uint32 // Chunk size for outgoing packets
+
+	proxyProtocol *ProxyProtocolConfig // PROXY protocol configuration, nil if disabled
+
+	rtmpe bool // True to accept the RTMPE handshake
+
+	clientCertRequired bool // True to require a valid client certificate to publish
+
+	backupPublishers   bool  // True to accept a backup publisher for the channels
+	backupStallTimeout int64 // Time without media packets to consider a publisher stalled (milliseconds)
+
+	publishGracePeriod time.Duration // Time to wait for a disconnected publisher to reconnect. 0 to end the stream immediately
+
+	slates *RTMPSlateSet // Slates loaded from SLATE_FILE and SLATE_DIR
+
+	broadcastDelay        int64 // Default broadcast delay of the channels (seconds). 0 for no delay
+	broadcastDelayMaxSize int64 // Size limit of the delay buffer of each publisher (bytes)
+
+	timeshiftWindow  int64 // Duration of the time-shift window of the channels (milliseconds). 0 to disable time-shift
+	timeshiftMaxSize int64 // Size limit of the time-shift window of each channel (bytes)
+
+	vodRoot   string // Path to the directory with the VOD files ({CHANNEL}/{NAME}). Empty to disable VOD
+	vodSecret string // Secret to check the keys of the VOD players
+
+	recordDir string // Path to the directory to store the recordings ({CHANNEL}/{UNIX_MS}.flv). Empty to disable recording
+
+	callbackURL string // URL to send the events
+	jwtSecret   string // Secret to sign the event tokens
+	jwtSubject  string // Subject of the event tokens
+}
+
+// Loads the reloadable configuration from the environment variables
+// Returns the configuration
+func loadRTMPServerConfig() *RTMPServerConfig {
+	config := RTMPServerConfig{
+		streamIdMaxLength:  STREAM_ID_DEFAULT_MAX_LENGTH,
+		ipLimit:            IP_DEFAULT_LIMIT,
+		ipLimitWhitelist:   parseIPWhitelist(os.Getenv("CONCURRENT_LIMIT_WHITELIST")),
+		playWhitelist:      parseIPWhitelist(os.Getenv("RTMP_PLAY_WHITELIST")),
+		gopCacheLimit:      GOP_CACHE_DEFAULT_LIMIT,
+		outChunkSize:       RTMP_CHUNK_SIZE,
+		proxyProtocol:      loadProxyProtocolConfig(),
+		rtmpe:              os.Getenv("RTMPE") == "YES",
+		clientCertRequired: os.Getenv("SSL_CLIENT_CERT_REQUIRED") == "YES",
+		slates:             loadRTMPSlateSet(os.Getenv("SLATE_FILE"), os.Getenv("SLATE_DIR")),
+		vodRoot:            os.Getenv("VOD_ROOT"),
+		recordDir:          os.Getenv("RECORD_DIR"),
+		backupPublishers:   os.Getenv("BACKUP_PUBLISHERS") == "YES",
+		backupStallTimeout: BACKUP_PUBLISHER_DEFAULT_STALL_TIMEOUT,
+		timeshiftMaxSize:   TIMESHIFT_DEFAULT_MAX_SIZE,
+		callbackURL:        os.Getenv("CALLBACK_URL"),
+		jwtSecret:          os.Getenv("JWT_SECRET"),
+		jwtSubject:         os.Getenv("CUSTOM_JWT_SUBJECT"),
+
+		broadcastDelayMaxSize: BROADCAST_DELAY_DEFAULT_MAX_SIZE,
+
+		vodSecret: os.Getenv("VOD_SECRET"),
+	}
+
+	if config.vodRoot != "" && config.vodSecret == "" {
+		LogWarning("VOD is not enabled, since VOD_SECRET is not set.")
+		config.vodRoot = ""
+	}
+
+	idCustomMaxLength := os.Getenv("ID_MAX_LENGTH")
+	if idCustomMaxLength != "" {
+		idMaxLen, e := strconv.Atoi(idCustomMaxLength)
+		if e == nil && idMaxLen > 0 {
+			config.streamIdMaxLength = idMaxLen
+		}
+	}
+
+	customIpLimit := os.Getenv("MAX_IP_CONCURRENT_CONNECTIONS")
+	if customIpLimit != "" {
+		cil, e := strconv.Atoi(customIpLimit)
+		if e == nil && cil > 0 {
+			config.ipLimit = uint32(cil)
+		}
+	}
+
+	customGopLimit := os.Getenv("GOP_CACHE_SIZE_MB")
+	if customGopLimit != "" {
+		cgl, e := strconv.Atoi(customGopLimit)
+		if e == nil && cgl >= 0 {
+			config.gopCacheLimit = int64(cgl) * 1024 * 1024
+		}
+	}
+
+	customChunkSize := os.Getenv("RTMP_CHUNK_SIZE")
+	if customChunkSize != "" {
+		n, e := strconv.Atoi(customChunkSize)
+		if e == nil && n > RTMP_CHUNK_SIZE {
+			config.outChunkSize = uint32(n)
+		}
+	}
+
+	customGracePeriod := os.Getenv("PUBLISH_GRACE_PERIOD_SECONDS")
+	if customGracePeriod != "" {
+		n, e := strconv.Atoi(customGracePeriod)
+		if e == nil && n > 0 {
+			config.publishGracePeriod = time.Duration(n) * time.Second
+		}
+	}
+
+	customBroadcastDelay := os.Getenv("BROADCAST_DELAY_SECONDS")
+	if customBroadcastDelay != "" {
+		n, e := strconv.ParseInt(customBroadcastDelay, 10, 64)
+		if e == nil && isValidBroadcastDelay(n) {
+			config.broadcastDelay = n
+		}
+	}
+
+	customBroadcastDelaySize := os.Getenv("BROADCAST_DELAY_MAX_SIZE_MB")
+	if customBroadcastDelaySize != "" {
+		n, e := strconv.Atoi(customBroadcastDelaySize)
+		if e == nil && n > 0 {
+			config.broadcastDelayMaxSize = int64(n) * 1024 * 1024
+		}
+	}
+
+	customTimeshiftWindow := os.Getenv("TIMESHIFT_WINDOW_SECONDS")
+	if customTimeshiftWindow != "" {
+		n, e := strconv.Atoi(customTimeshiftWindow)
+		if e == nil && n > 0 {
+			config.timeshiftWindow = int64(n) * 1000
+		}
+	}
+
+	customTimeshiftSize := os.Getenv("TIMESHIFT_MAX_SIZE_MB")
+	if customTimeshiftSize != "" {
+		n, e := strconv.Atoi(customTimeshiftSize)
+		if e == nil && n > 0 {
+			config.timeshiftMaxSize = int64(n) * 1024 * 1024
+		}
+	}
+
+	customStallTimeout := os.Getenv("BACKUP_PUBLISHER_STALL_MS")
+	if customStallTimeout != "" {
+		n, e := strconv.Atoi(customStallTimeout)
+		if e == nil && n > 0 {
+			config.backupStallTimeout = int64(n)
+		}
+	}
+
+	if config.jwtSubject == "" {
+		config.jwtSubject = "rtmp_event"
+	}
+
+	return &config
+}
+
+// Loads the reloadable configuration, including the listener policies, and applies it
+// The existing sessions keep working
+func (server *RTMPServer) LoadReloadableConfig() {
+	server.config.Store(loadRTMPServerConfig())
+
+	for i := 0; i < len(server.listeners); i++ {
+		server.listeners[i].LoadPolicy()
+	}
+}
+
+// Gets the current reloadable configuration
+// Returns the configuration. Do not modify it.
+func (server *RTMPServer) GetConfig() *RTMPServerConfig {
+	return server.config.Load()
+}
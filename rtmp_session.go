@@ -5,13 +5,16 @@ package main
 import (
 	"bufio"
 	"container/list"
+	"crypto/rc4"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,12 +25,60 @@ type BitRateCache struct {
 	bytes       uint64 // The number of bytes received
 }
 
+// Statistics of a publishing session
+type PublishStats struct {
+	startTime    int64  // Publish start time (unix milliseconds)
+	endTime      int64  // Publish end time (unix milliseconds)
+	bytes        uint64 // Total bytes received while publishing
+	bitRatePeak  uint64 // Peak bitrate (bit/ms)
+	keyFrames    uint64 // Number of video key frames received (atomic)
+	players      int    // Number of players currently receiving the stream
+	playersPeak  int    // Max number of concurrent players
+	playerTimeMs int64  // Accumulated time players spent receiving the stream (milliseconds)
+}
+
+// Gets the average bitrate of the publishing session
+// Returns the bitrate (bit/ms)
+func (stats *PublishStats) GetAverageBitRate() uint64 {
+	duration := stats.endTime - stats.startTime
+
+	if duration <= 0 {
+		return 0
+	}
+
+	return uint64(math.Round(float64(stats.bytes) * 8 / float64(duration)))
+}
+
+// Gets the total time players spent receiving the stream
+// Returns the time in minutes
+func (stats *PublishStats) GetPlayerMinutes() float64 {
+	return math.Round(float64(stats.playerTimeMs)/600) / 100
+}
+
+// Reasons for a publishing session to end
+const (
+	PUBLISH_END_REASON_UNPUBLISH      = "unpublish"      // The client unpublished the stream
+	PUBLISH_END_REASON_DISCONNECT     = "disconnect"     // The client closed the connection
+	PUBLISH_END_REASON_TIMEOUT        = "timeout"        // The client stopped sending data
+	PUBLISH_END_REASON_KILLED_REDIS   = "killed_redis"   // Killed by a Redis command
+	PUBLISH_END_REASON_KILLED_CONTROL = "killed_control" // Killed by the coordinator server
+	PUBLISH_END_REASON_KILLED_ADMIN   = "killed_admin"   // Killed by an administrator
+	PUBLISH_END_REASON_MAX_DURATION   = "max_duration"   // Reached the max duration
+	PUBLISH_END_REASON_DRAIN          = "drain"          // The server was drained or shut down
+	PUBLISH_END_REASON_CONFLICT       = "conflict"       // The channel was registered by another node
+)
+
+// Enhanced RTMP capability flag: The client supports the reconnect request
+const RTMP_CAPS_EX_RECONNECT = 0x01
+
 // Stores the status of a RTMP session
 type RTMPSession struct {
 	server *RTMPServer // Reference to the server
 
 	conn net.Conn // TCP connection
 
+	listener *RTMPListener // Listener that accepted the connection
+
 	id uint64 // Session ID
 	ip string // IP address of the client
 
@@ -39,6 +90,7 @@ type RTMPSession struct {
 	inLastAck uint32 // This is used to count bytes that must be acknowledged
 
 	objectEncoding uint32 // Encoding format required by the client
+	capsEx         uint32 // Enhanced RTMP capabilities of the client (RTMP_CAPS_EX_*)
 
 	connectTime int64 // Connection time (unix milliseconds)
 
@@ -65,11 +117,14 @@ type RTMPSession struct {
 	isIdling     bool // True if the client is waiting to play a stream
 	isPause      bool // True if the client is paused
 
-	metaData          []byte // Metadata for the stream being published
-	audioCodec        uint32 // Audio codec
-	videoCodec        uint32 // Video codec
-	aacSequenceHeader []byte // Sequence header for AAC codec (Audio)
-	avcSequenceHeader []byte // Seque4nce header for AVC codec (Video)
+	metaData          []byte  // Metadata for the stream being published
+	audioCodec        uint32  // Audio codec
+	videoCodec        uint32  // Video codec
+	aacSequenceHeader []byte  // Sequence header for AAC codec (Audio)
+	avcSequenceHeader []byte  // Seque4nce header for AVC codec (Video)
+	videoWidth        int64   // Video width (pixels), from the metadata
+	videoHeight       int64   // Video height (pixels), from the metadata
+	videoFrameRate    float64 // Video frame rate (frames per second), from the metadata
 
 	clock int64 // Current clock value
 
@@ -82,6 +137,31 @@ type RTMPSession struct {
 
 	bitRate      uint64       // Bitrate (bit/ms)
 	bitRateCache BitRateCache // Cache to compute bit rate
+
+	publishStats     PublishStats // Statistics of the publishing session
+	endReason        string       // Reason to end the session, set when killed
+	maxDuration      int64        // Max duration of the publishing session (seconds). 0 for no limit
+	maxDurationTimer *time.Timer  // Timer to end the publishing session after the max duration
+	callbackFallback bool         // True if the publishing session was accepted by the callback, since the coordinator was not reachable
+	registryToken    string       // Token of the claim of the channel in the cluster registry
+
+	publishRole      string           // Role of the publisher (PUBLISH_ROLE_*)
+	metaAudioOnly    bool             // True if the metadata of the stream being published declares no video
+	timestampOffset  int64            // Offset added to the timestamps sent to the players, to keep them monotonic after a failover
+	delayBuffer      *RTMPDelayBuffer // Buffer holding the media packets before sending them to the players. Nil if there is no broadcast delay
+	lastMediaTime    atomic.Int64     // Time the last media packet was received (unix milliseconds)
+	lastOutTimestamp atomic.Int64     // Last timestamp sent to the players
+
+	playStartTime int64  // Time the player started receiving the stream (unix milliseconds)
+	playPublisher uint64 // ID of the session sending the stream to the player
+
+	seek_mutex    *sync.Mutex          // Mutex to start and stop the time-shift and VOD playback
+	timeshift     *RTMPTimeshiftPlayer // Time-shift playback, nil if the player is receiving the live stream
+	isTimeshift   bool                 // True if the player is receiving the stream from the time-shift window
+	pausePosition int64                // Position of the stream when the player paused it
+	vod           *RTMPVODPlayer       // VOD playback, nil if the player is not playing a VOD file
+
+	clientCertSubject string // Subject of the verified client certificate, captured after the TLS handshake. Empty if not provided
 }
 
 // Creates a RTMP session
@@ -89,14 +169,17 @@ type RTMPSession struct {
 // id - Session ID
 // ip - Client IP address
 // c - TCP connection
+// listener - Listener that accepted the connection
 // Returns the session
-func CreateRTMPSession(server *RTMPServer, id uint64, ip string, c net.Conn) RTMPSession {
+func CreateRTMPSession(server *RTMPServer, id uint64, ip string, c net.Conn, listener *RTMPListener) RTMPSession {
 	return RTMPSession{
 		server:        server,
 		conn:          c,
+		listener:      listener,
 		ip:            ip,
 		mutex:         &sync.Mutex{},
 		publish_mutex: &sync.Mutex{},
+		seek_mutex:    &sync.Mutex{},
 		id:            id,
 		inChunkSize:   RTMP_CHUNK_SIZE,
 		outChunkSize:  server.getOutChunkSize(),
@@ -113,6 +196,7 @@ func CreateRTMPSession(server *RTMPServer, id uint64, ip string, c net.Conn) RTM
 		},
 
 		objectEncoding:  0,
+		capsEx:          0,
 		streams:         0,
 		playStreamId:    0,
 		publishStreamId: 0,
@@ -131,11 +215,14 @@ func CreateRTMPSession(server *RTMPServer, id uint64, ip string, c net.Conn) RTM
 		videoCodec:        0,
 		aacSequenceHeader: make([]byte, 0),
 		avcSequenceHeader: make([]byte, 0),
+		videoWidth:        0,
+		videoHeight:       0,
+		videoFrameRate:    0,
 		clock:             0,
 
 		rtmpGopCache:     list.New(),
 		gopCacheSize:     0,
-		gopCacheLimit:    server.gopCacheLimit,
+		gopCacheLimit:    server.GetConfig().gopCacheLimit,
 		gopCacheDisabled: false,
 		gopPlayNo:        false,
 		gopPlayClear:     false,
@@ -143,6 +230,13 @@ func CreateRTMPSession(server *RTMPServer, id uint64, ip string, c net.Conn) RTM
 		channel:   "",
 		key:       "",
 		stream_id: "",
+
+		publishStats:     PublishStats{},
+		endReason:        "",
+		maxDurationTimer: nil,
+
+		playStartTime: 0,
+		playPublisher: 0,
 	}
 }
 
@@ -152,7 +246,9 @@ func (s *RTMPSession) SendSync(b []byte) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.conn.Write(b) //nolint:errcheck
+	n, _ := s.conn.Write(b)
+
+	s.server.bytesOut.Add(uint64(n))
 }
 
 // Closes the connection
@@ -163,6 +259,49 @@ func (s *RTMPSession) Kill() {
 	s.conn.Close()
 }
 
+// Closes the connection, indicating the reason
+// reason - The reason to end the session (PUBLISH_END_REASON_*)
+func (s *RTMPSession) KillWithReason(reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.endReason == "" {
+		s.endReason = reason
+	}
+
+	s.conn.Close()
+}
+
+// Sets the end reason if the connection was closed due to a timeout
+// e - Error returned when reading from the connection
+func (s *RTMPSession) checkReadTimeout(e error) {
+	var netErr net.Error
+
+	if !errors.As(e, &netErr) || !netErr.Timeout() {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.endReason == "" {
+		s.endReason = PUBLISH_END_REASON_TIMEOUT
+	}
+}
+
+// Gets the reason for the connection to be closed
+// Returns the reason (PUBLISH_END_REASON_*)
+func (s *RTMPSession) GetCloseReason() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.endReason == "" {
+		return PUBLISH_END_REASON_DISCONNECT
+	}
+
+	return s.endReason
+}
+
 // Returns the stream path: /{CHANNEL}/{KEY}
 func (s *RTMPSession) GetStreamPath() string {
 	return "/" + s.channel + "/" + s.key
@@ -185,7 +324,17 @@ func (s *RTMPSession) HandleSession() {
 		return
 	}
 
-	if version != RTMP_VERSION {
+	encrypted := false
+
+	switch version {
+	case RTMP_VERSION:
+	case RTMP_VERSION_RTMPE, RTMP_VERSION_RTMPE_FP9:
+		if !s.server.GetConfig().rtmpe {
+			LogDebugSession(s.id, s.ip, "RTMPE handshake received, but RTMPE is not enabled")
+			return
+		}
+		encrypted = true
+	default:
 		LogDebugSession(s.id, s.ip, "Invalid protocol version received")
 		return
 	}
@@ -202,7 +351,20 @@ func (s *RTMPSession) HandleSession() {
 		return
 	}
 
-	s0s1s2 := generateS0S1S2(handshakeBytes)
+	var s0s1s2 []byte
+	var cipherIn *rc4.Cipher
+	var cipherOut *rc4.Cipher
+
+	if encrypted {
+		s0s1s2, cipherIn, cipherOut, e = generateRTMPES0S1S2(version, handshakeBytes)
+		if e != nil {
+			LogDebugSession(s.id, s.ip, "Invalid RTMPE handshake received: "+e.Error())
+			return
+		}
+	} else {
+		s0s1s2 = generateS0S1S2(handshakeBytes)
+	}
+
 	n, e = s.conn.Write(s0s1s2)
 	if e != nil || n != len(s0s1s2) {
 		LogDebugSession(s.id, s.ip, "Could not send handshake message")
@@ -221,6 +383,17 @@ func (s *RTMPSession) HandleSession() {
 		return
 	}
 
+	// After the RTMPE handshake, the data is encrypted
+	if encrypted {
+		r = bufio.NewReader(&RTMPEReader{r: r, cipher: cipherIn})
+
+		s.mutex.Lock()
+		s.conn = CreateRTMPEConn(s.conn, cipherOut)
+		s.mutex.Unlock()
+
+		LogDebugSession(s.id, s.ip, "RTMPE encryption enabled")
+	}
+
 	// Read RTMP chunks
 	for {
 		if !s.ReadChunk(r) {
@@ -245,6 +418,7 @@ func (s *RTMPSession) ReadChunk(r *bufio.Reader) bool {
 	startByte, e := r.ReadByte()
 	bytesReadCount++
 	if e != nil {
+		s.checkReadTimeout(e)
 		LogDebugSession(s.id, s.ip, "Could not read chunk start byte. "+e.Error())
 		return false
 	}
@@ -270,6 +444,7 @@ func (s *RTMPSession) ReadChunk(r *bufio.Reader) bool {
 		b, e := r.ReadByte()
 		bytesReadCount++
 		if e != nil {
+			s.checkReadTimeout(e)
 			LogDebugSession(s.id, s.ip, "Could not read chunk basic bytes")
 			return false
 		}
@@ -289,6 +464,7 @@ func (s *RTMPSession) ReadChunk(r *bufio.Reader) bool {
 		n, e := io.ReadFull(r, headerLeft)
 		bytesReadCount += uint32(size)
 		if e != nil || n != size {
+			s.checkReadTimeout(e)
 			LogDebugSession(s.id, s.ip, "Could not read chunk header")
 			return false
 		}
@@ -368,6 +544,7 @@ func (s *RTMPSession) ReadChunk(r *bufio.Reader) bool {
 		n, e := io.ReadFull(r, tsBytes)
 		bytesReadCount += 4
 		if e != nil || n != 4 {
+			s.checkReadTimeout(e)
 			LogDebugSession(s.id, s.ip, "Could not read extended timestamp")
 			return false
 		}
@@ -408,6 +585,7 @@ func (s *RTMPSession) ReadChunk(r *bufio.Reader) bool {
 		bytesReadCount += sizeToRead
 		if e != nil || uint32(n) != sizeToRead {
 			if e != nil {
+				s.checkReadTimeout(e)
 				LogDebugSession(s.id, s.ip, "Error: "+e.Error())
 			}
 			LogDebugSession(s.id, s.ip, "Could not read chunk payload")
@@ -456,6 +634,10 @@ func (s *RTMPSession) ReadChunk(r *bufio.Reader) bool {
 		LogDebugSession(s.id, s.ip, "Bitrate is now: "+strconv.Itoa(int(s.bitRate)))
 	}
 
+	// Publishing stats
+	s.server.bytesIn.Add(uint64(bytesReadCount))
+	s.UpdatePublishStats(bytesReadCount)
+
 	return true
 }
 
@@ -533,6 +715,8 @@ func (s *RTMPSession) HandleInvoke(packet *RTMPPacket) bool {
 		return s.HandlePlay(&cmd, packet)
 	case "pause":
 		return s.HandlePause(&cmd)
+	case "seek":
+		return s.HandleSeek(&cmd)
 	case "deleteStream":
 		return s.HandleDeleteStream(&cmd)
 	case "closeStream":
@@ -552,12 +736,13 @@ func (s *RTMPSession) HandleConnect(cmd *RTMPCommand) bool {
 	s.channel = cmd.GetArg("cmdObj").GetProperty("app").GetString()
 
 	// Validate channel
-	if !validateStreamIDString(s.channel, s.server.streamIdMaxLength) {
+	if !validateStreamIDString(s.channel, s.server.GetConfig().streamIdMaxLength) {
 		LogRequest(s.id, s.ip, "INVALID CHANNEL '"+s.channel+"'")
 		return false
 	}
 
 	s.objectEncoding = uint32(cmd.GetArg("cmdObj").GetProperty("objectEncoding").GetInteger())
+	s.capsEx = uint32(cmd.GetArg("cmdObj").GetProperty("capsEx").GetInteger())
 	s.connectTime = time.Now().UnixMilli()
 	s.bitRateCache.intervalMs = 1000
 	s.bitRateCache.last_update = s.connectTime
@@ -593,12 +778,22 @@ func (s *RTMPSession) HandlePublish(cmd *RTMPCommand, packet *RTMPPacket) bool {
 	sKeyPathSplit := strings.Split(sKeyPath, "?")
 	s.key = sKeyPathSplit[0]
 
+	s.publishRole = PUBLISH_ROLE_PRIMARY
+
+	if len(sKeyPathSplit) > 1 && s.server.GetConfig().backupPublishers {
+		publishParams := getRTMPParamsSimple(sKeyPathSplit[1])
+
+		if publishParams["role"] == PUBLISH_ROLE_BACKUP {
+			s.publishRole = PUBLISH_ROLE_BACKUP
+		}
+	}
+
 	if s.key == "" || !s.isConnected {
 		return true
 	}
 
 	// Validate key
-	if !validateStreamIDString(s.key, s.server.streamIdMaxLength) {
+	if !validateStreamIDString(s.key, s.server.GetConfig().streamIdMaxLength) {
 		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Invalid stream key provided")
 		return false
 	}
@@ -610,16 +805,65 @@ func (s *RTMPSession) HandlePublish(cmd *RTMPCommand, packet *RTMPPacket) bool {
 		return true
 	}
 
+	// Listener policy
+	if !s.CanPublish() {
+		LogRequest(s.id, s.ip, "Error: Publishing not allowed in listener '"+s.listener.name+"'")
+		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Publishing is not allowed")
+		return false
+	}
+
+	// Client certificate
+	if s.server.GetConfig().clientCertRequired && s.clientCertSubject == "" {
+		LogRequest(s.id, s.ip, "Error: No valid client certificate provided")
+		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "A valid client certificate is required to publish")
+		return false
+	}
+
+	// Reconnection within the grace period
+	if previous := s.server.ResumePublisher(s.channel, s.key, s); previous != nil {
+		return s.HandleResumePublish(previous)
+	}
+
 	if s.server.isPublishing(s.channel) {
+		if s.server.GetConfig().backupPublishers {
+			return s.HandleRedundantPublish()
+		}
+
 		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Stream already publishing")
 		return false
 	}
 
+	if s.server.IsDraining() {
+		LogRequest(s.id, s.ip, "Error: Server is draining")
+		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Server is not accepting new streams")
+		return false
+	}
+
 	LogRequest(s.id, s.ip, "PUBLISH ("+strconv.Itoa(int(s.publishStreamId))+") '"+s.channel+"'")
 
 	if s.server.websocketControlConnection != nil {
 		// Coordinator
-		pubAccepted, streamId := s.server.websocketControlConnection.RequestPublish(s.channel, s.key, s.ip)
+		pubAccepted, streamId, reachable := s.server.websocketControlConnection.RequestPublish(s.channel, s.key, s.ip)
+
+		s.callbackFallback = false
+
+		if !reachable {
+			// No coordinator is reachable, apply the fallback policy
+			switch s.server.websocketControlConnection.GetFallbackPolicy() {
+			case CONTROL_FALLBACK_ALLOW:
+				LogRequest(s.id, s.ip, "Coordinator not reachable. Allowing the stream.")
+				pubAccepted = true
+				streamId = ""
+			case CONTROL_FALLBACK_CALLBACK:
+				LogRequest(s.id, s.ip, "Coordinator not reachable. Using the callback.")
+				pubAccepted = s.SendStartCallback()
+				streamId = s.stream_id
+				s.callbackFallback = true
+			default:
+				LogRequest(s.id, s.ip, "Error: Coordinator not reachable")
+			}
+		}
+
 		if !pubAccepted {
 			LogRequest(s.id, s.ip, "Error: Invalid streaming key provided")
 			s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Invalid stream key provided")
@@ -636,11 +880,31 @@ func (s *RTMPSession) HandlePublish(cmd *RTMPCommand, packet *RTMPPacket) bool {
 	}
 
 	// Set publisher
+	s.StartPublishStats()
+
+	// Cluster registry
+	if !s.ClaimRegistryChannel() {
+		LogRequest(s.id, s.ip, "Error: Stream already publishing in another node")
+		s.SendStatusMessage(s.publishStreamId, "error", "NetStream.Publish.BadName", "Stream already publishing")
+
+		// The stream was already accepted, so its end is notified
+		s.publish_mutex.Lock()
+		s.publishStats.endTime = time.Now().UnixMilli()
+		s.sendStopNotification(PUBLISH_END_REASON_CONFLICT)
+		s.publish_mutex.Unlock()
+
+		return false
+	}
+
+	s.lastMediaTime.Store(s.publishStats.startTime)
+	s.startDelayBuffer()
 	s.isPublishing = true
 	s.server.SetPublisher(s.channel, s.key, s.stream_id, s)
 
 	s.SendStatusMessage(s.publishStreamId, "status", "NetStream.Publish.Start", s.GetStreamPath()+" is now published.")
 
+	s.SendPublishStartEvent()
+
 	s.StartIdlePlayers()
 
 	return true
@@ -654,10 +918,13 @@ func (s *RTMPSession) HandlePlay(cmd *RTMPCommand, packet *RTMPPacket) bool {
 	sKeyPathSplit := strings.Split(sKeyPath, "?")
 	s.key = sKeyPathSplit[0]
 
+	vodKey := ""
+
 	if len(sKeyPathSplit) > 1 {
 		playParams := getRTMPParamsSimple(sKeyPathSplit[1])
 		s.gopPlayNo = (playParams["cache"] == "no")
 		s.gopPlayClear = (playParams["cache"] == "clear")
+		vodKey = playParams["key"]
 	}
 
 	if s.key == "" || !s.isConnected {
@@ -666,7 +933,7 @@ func (s *RTMPSession) HandlePlay(cmd *RTMPCommand, packet *RTMPPacket) bool {
 
 	s.playStreamId = packet.header.stream_id
 
-	if s.isIdling || s.isPlaying {
+	if s.isIdling || s.isPlaying || s.IsPlayingVOD() {
 		s.SendStatusMessage(s.playStreamId, "error", "NetStream.Play.BadConnection", "Connection already playing")
 		return true
 	}
@@ -677,6 +944,23 @@ func (s *RTMPSession) HandlePlay(cmd *RTMPCommand, packet *RTMPPacket) bool {
 		return false
 	}
 
+	if s.server.IsDraining() {
+		LogRequest(s.id, s.ip, "Error: Server is draining")
+		s.SendStatusMessage(s.playStreamId, "error", "NetStream.Play.BadName", "Server is not accepting new players")
+		return false
+	}
+
+	// VOD file (unless the player requested live only, or the live stream is preferred)
+	start := float64(PLAY_START_ANY)
+
+	if startArg := cmd.GetArg("start"); !startArg.IsUndefined() {
+		start = startArg.GetFloat()
+	}
+
+	if path := s.getPlayVODPath(start); path != "" {
+		return s.HandleVODPlay(vodKey, path, int64(max(0, start)*1000), int64(cmd.GetArg("duration").GetFloat()*1000))
+	}
+
 	LogRequest(s.id, s.ip, "PLAY ("+strconv.Itoa(int(s.playStreamId))+") '"+s.channel+"'")
 
 	s.RespondPlay()
@@ -690,6 +974,8 @@ func (s *RTMPSession) HandlePlay(cmd *RTMPCommand, packet *RTMPPacket) bool {
 		return false // Invalid key
 	}
 
+	s.SendPlayerJoinEvent()
+
 	if !idle {
 		publisher := s.server.GetPublisher(s.channel)
 		if publisher != nil {
@@ -697,6 +983,7 @@ func (s *RTMPSession) HandlePlay(cmd *RTMPCommand, packet *RTMPPacket) bool {
 		}
 	} else {
 		LogRequest(s.id, s.ip, "PLAY IDLE '"+s.channel+"'")
+		s.server.StartSlate(s.channel)
 	}
 
 	return true
@@ -705,16 +992,37 @@ func (s *RTMPSession) HandlePlay(cmd *RTMPCommand, packet *RTMPPacket) bool {
 // Handles a pause command
 // cmd - The command
 func (s *RTMPSession) HandlePause(cmd *RTMPCommand) bool {
+	if s.HandleVODPause(cmd.GetArg("pause").GetBool()) {
+		return true
+	}
+
 	if !s.isPlaying {
 		return true
 	}
 
 	s.isPause = cmd.GetArg("pause").GetBool()
 
+	timeshift := s.server.GetTimeshiftBuffer(s.channel)
+
 	if s.isPause {
+		if timeshift != nil {
+			// Keep the position, to resume from it
+			position, ok := s.StopTimeshift()
+
+			if !ok {
+				position = timeshift.LastTimestamp()
+			}
+
+			s.pausePosition = position
+		}
+
 		s.SendStreamStatus(STREAM_EOF, s.playStreamId)
 		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Pause.Notify", "Paused live")
 		LogRequest(s.id, s.ip, "PAUSE '"+s.channel+"'")
+	} else if timeshift != nil && s.pausePosition != TIMESHIFT_POSITION_LIVE && s.StartTimeshift(timeshift, s.pausePosition) {
+		s.SendStreamStatus(STREAM_BEGIN, s.playStreamId)
+		LogRequest(s.id, s.ip, "RESUME '"+s.channel+"' ("+strconv.Itoa(int(s.pausePosition))+")")
+		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Unpause.Notify", "Unpaused")
 	} else {
 		s.SendStreamStatus(STREAM_BEGIN, s.playStreamId)
 		publisher := s.server.GetPublisher(s.channel)
@@ -741,6 +1049,14 @@ func (s *RTMPSession) HandleDeleteStream(cmd *RTMPCommand) bool {
 		// Close play
 		LogRequest(s.id, s.ip, "PLAY STOP '"+s.channel+"'")
 
+		s.ReportPlayEnd()
+
+		if s.isPlaying || s.isIdling {
+			s.SendPlayerLeaveEvent()
+		}
+
+		s.StopTimeshift()
+		s.StopVOD()
 		s.server.RemovePlayer(s.channel, s.key, s)
 
 		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Play.Stop", "Stopped playing stream.")
@@ -755,7 +1071,7 @@ func (s *RTMPSession) HandleDeleteStream(cmd *RTMPCommand) bool {
 		LogDebugSession(s.id, s.ip, "Close publish stream")
 
 		if s.isPublishing {
-			s.EndPublish(false)
+			s.EndPublish(PUBLISH_END_REASON_UNPUBLISH)
 		}
 
 		s.publishStreamId = 0
@@ -771,6 +1087,14 @@ func (s *RTMPSession) DeleteStream(streamId uint32) {
 		// Close play
 		LogDebugSession(s.id, s.ip, "Close play stream: "+strconv.Itoa(int(streamId)))
 
+		s.ReportPlayEnd()
+
+		if s.isPlaying || s.isIdling {
+			s.SendPlayerLeaveEvent()
+		}
+
+		s.StopTimeshift()
+		s.StopVOD()
 		s.server.RemovePlayer(s.channel, s.key, s)
 
 		s.playStreamId = 0
@@ -783,7 +1107,7 @@ func (s *RTMPSession) DeleteStream(streamId uint32) {
 		LogDebugSession(s.id, s.ip, "Close publish stream: "+strconv.Itoa(int(streamId)))
 
 		if s.isPublishing {
-			s.EndPublish(true)
+			s.EndPublish(s.GetCloseReason())
 		}
 
 		s.publishStreamId = 0
@@ -818,10 +1142,6 @@ func (s *RTMPSession) HandleAudioPacket(packet *RTMPPacket) bool {
 
 	isHeader := (sound_format == 10 || sound_format == 13) && packet.payload[1] == 0
 
-	if isHeader {
-		s.aacSequenceHeader = packet.payload
-	}
-
 	cachePacket := createBlankRTMPPacket()
 	cachePacket.header.fmt = RTMP_CHUNK_TYPE_0
 	cachePacket.header.cid = RTMP_CHANNEL_AUDIO
@@ -830,31 +1150,43 @@ func (s *RTMPSession) HandleAudioPacket(packet *RTMPPacket) bool {
 	cachePacket.header.length = uint32(len(cachePacket.payload))
 	cachePacket.header.timestamp = s.clock
 
-	if !isHeader && !s.gopCacheDisabled {
-		s.rtmpGopCache.PushBack(&cachePacket)
-		s.gopCacheSize += int64(cachePacket.header.length) + RTMP_PACKET_BASE_SIZE
+	if s.delayBuffer != nil {
+		s.pushDelayBuffer(&cachePacket, isHeader, s.videoCodec == 0)
+		return true
+	}
 
-		for s.gopCacheSize > s.gopCacheLimit {
-			toDelete := s.rtmpGopCache.Front()
-			v := toDelete.Value
-			switch x := v.(type) {
-			case *RTMPPacket:
-				s.gopCacheSize -= int64(x.header.length)
-			}
-			s.rtmpGopCache.Remove(toDelete)
-			s.gopCacheSize -= RTMP_PACKET_BASE_SIZE
-		}
+	s.forwardAudioPacket(&cachePacket, isHeader)
+
+	return true
+}
+
+// Sends an audio packet to the players, storing it in the GOP cache
+// Call only for publishers, with the publish mutex locked
+// cachePacket - The packet, with the timestamp of the publisher
+// isHeader - True if the packet is a sequence header
+func (s *RTMPSession) forwardAudioPacket(cachePacket *RTMPPacket, isHeader bool) {
+	if isHeader {
+		s.aacSequenceHeader = cachePacket.payload
+	} else {
+		s.addToGopCache(cachePacket)
+	}
+
+	// Audio-only streams can switch at any packet
+	if !s.checkActivePublisher(cachePacket.header.timestamp, !isHeader && s.isAudioOnly()) {
+		return
 	}
 
+	s.lastOutTimestamp.Store(cachePacket.header.timestamp + s.timestampOffset)
+	s.recordTimeshift(cachePacket, isHeader, s.videoCodec == 0)
+	s.recordOutputs(cachePacket, isHeader, s.videoCodec == 0)
+
 	players := s.server.GetPlayers(s.channel)
 
 	for i := 0; i < len(players); i++ {
-		if players[i].isPlaying && !players[i].isPause && players[i].receive_audio {
-			players[i].SendCachePacket(&cachePacket)
+		if players[i].isPlaying && !players[i].isPause && !players[i].isTimeshift && players[i].receive_audio {
+			players[i].SendCachePacket(cachePacket, s.timestampOffset)
 		}
 	}
-
-	return true
 }
 
 // Handles a video packet (Contains video data)
@@ -872,16 +1204,14 @@ func (s *RTMPSession) HandleVideoPacket(packet *RTMPPacket) bool {
 
 	isHeader := (codec_id == 7 || codec_id == 12) && (frame_type == 1 && packet.payload[1] == 0)
 
-	if isHeader {
-		s.avcSequenceHeader = packet.payload
-		s.rtmpGopCache = list.New()
-		s.gopCacheSize = 0
-	}
-
 	if s.videoCodec == 0 {
 		s.videoCodec = uint32(codec_id)
 	}
 
+	if frame_type == 1 && !isHeader {
+		atomic.AddUint64(&s.publishStats.keyFrames, 1)
+	}
+
 	cachePacket := createBlankRTMPPacket()
 	cachePacket.header.fmt = RTMP_CHUNK_TYPE_0
 	cachePacket.header.cid = RTMP_CHANNEL_VIDEO
@@ -890,32 +1220,69 @@ func (s *RTMPSession) HandleVideoPacket(packet *RTMPPacket) bool {
 	cachePacket.header.length = uint32(len(cachePacket.payload))
 	cachePacket.header.timestamp = s.clock
 
-	// Cache
-	if !isHeader && !s.gopCacheDisabled {
-		s.rtmpGopCache.PushBack(&cachePacket)
-		s.gopCacheSize += int64(cachePacket.header.length) + RTMP_PACKET_BASE_SIZE
-
-		for s.gopCacheSize > s.gopCacheLimit {
-			toDelete := s.rtmpGopCache.Front()
-			v := toDelete.Value
-			switch x := v.(type) {
-			case *RTMPPacket:
-				s.gopCacheSize -= int64(x.header.length)
-			}
-			s.rtmpGopCache.Remove(toDelete)
-			s.gopCacheSize -= RTMP_PACKET_BASE_SIZE
-		}
+	if s.delayBuffer != nil {
+		s.pushDelayBuffer(&cachePacket, isHeader, frame_type == 1)
+		return true
 	}
 
+	s.forwardVideoPacket(&cachePacket, isHeader)
+
+	return true
+}
+
+// Sends a video packet to the players, storing it in the GOP cache
+// Call only for publishers, with the publish mutex locked
+// cachePacket - The packet, with the timestamp of the publisher
+// isHeader - True if the packet is a sequence header
+func (s *RTMPSession) forwardVideoPacket(cachePacket *RTMPPacket, isHeader bool) {
+	isKeyFrame := (cachePacket.payload[0]>>4)&0x0f == 1
+
+	if isHeader {
+		s.avcSequenceHeader = cachePacket.payload
+		s.rtmpGopCache = list.New()
+		s.gopCacheSize = 0
+	} else {
+		s.addToGopCache(cachePacket)
+	}
+
+	if !s.checkActivePublisher(cachePacket.header.timestamp, isKeyFrame && !isHeader) {
+		return
+	}
+
+	s.lastOutTimestamp.Store(cachePacket.header.timestamp + s.timestampOffset)
+	s.recordTimeshift(cachePacket, isHeader, isKeyFrame)
+	s.recordOutputs(cachePacket, isHeader, isKeyFrame)
+
 	players := s.server.GetPlayers(s.channel)
 
 	for i := 0; i < len(players); i++ {
-		if players[i].isPlaying && !players[i].isPause && players[i].receive_video {
-			players[i].SendCachePacket(&cachePacket)
+		if players[i].isPlaying && !players[i].isPause && !players[i].isTimeshift && players[i].receive_video {
+			players[i].SendCachePacket(cachePacket, s.timestampOffset)
 		}
 	}
+}
 
-	return true
+// Stores a media packet in the GOP cache, removing the oldest packets if the cache is full
+// Call only for publishers, with the publish mutex locked
+// cachePacket - The packet
+func (s *RTMPSession) addToGopCache(cachePacket *RTMPPacket) {
+	if s.gopCacheDisabled {
+		return
+	}
+
+	s.rtmpGopCache.PushBack(cachePacket)
+	s.gopCacheSize += int64(cachePacket.header.length) + RTMP_PACKET_BASE_SIZE
+
+	for s.gopCacheSize > s.gopCacheLimit {
+		toDelete := s.rtmpGopCache.Front()
+		v := toDelete.Value
+		switch x := v.(type) {
+		case *RTMPPacket:
+			s.gopCacheSize -= int64(x.header.length)
+		}
+		s.rtmpGopCache.Remove(toDelete)
+		s.gopCacheSize -= RTMP_PACKET_BASE_SIZE
+	}
 }
 
 // Handles a data packet encoded with AMF0
@@ -941,6 +1308,7 @@ func (s *RTMPSession) HandleRTMPData(packet *RTMPPacket, data *RTMPData) bool {
 	case "@setDataFrame":
 		metaData := s.BuildMetadata(data)
 		s.SetMetaData(metaData)
+		s.SetVideoProperties(data.GetArg("dataObj"))
 	}
 
 	return true
@@ -4,9 +4,6 @@ package main
 
 import (
 	"encoding/binary"
-	"net"
-	"os"
-	"strings"
 	"time"
 )
 
@@ -207,6 +204,46 @@ func (s *RTMPSession) SendStatusMessage(stream_id uint32, level string, code str
 	s.SendInvokeMessage(stream_id, cmd)
 }
 
+// Sends an Enhanced RTMP reconnect request to the client
+// tcUrl - URL the client should reconnect to. If empty, the client reconnects to the same URL
+func (s *RTMPSession) SendReconnectRequest(tcUrl string) {
+	cmd := RTMPCommand{
+		cmd:       "onStatus",
+		arguments: make(map[string]*AMF0Value),
+	}
+
+	transId := createAMF0Value(AMF0_TYPE_NUMBER)
+	transId.SetIntegerVal(0)
+	cmd.arguments["transId"] = &transId
+
+	cmdObj := createAMF0Value(AMF0_TYPE_NULL)
+	cmd.arguments["cmdObj"] = &cmdObj
+
+	info := createAMF0Value(AMF0_TYPE_OBJECT)
+
+	info_level := createAMF0Value(AMF0_TYPE_STRING)
+	info_level.str_val = "status"
+	info.obj_val["level"] = &info_level
+
+	info_code := createAMF0Value(AMF0_TYPE_STRING)
+	info_code.str_val = "NetConnection.Connect.ReconnectRequest"
+	info.obj_val["code"] = &info_code
+
+	info_description := createAMF0Value(AMF0_TYPE_STRING)
+	info_description.str_val = "The server is shutting down. Reconnect to continue."
+	info.obj_val["description"] = &info_description
+
+	if tcUrl != "" {
+		info_tcUrl := createAMF0Value(AMF0_TYPE_STRING)
+		info_tcUrl.str_val = tcUrl
+		info.obj_val["tcUrl"] = &info_tcUrl
+	}
+
+	cmd.arguments["info"] = &info
+
+	s.SendInvokeMessage(0, cmd)
+}
+
 // Send a RtmpSampleAccess data message to the client
 // stream_id - Stream ID
 func (s *RTMPSession) SendSampleAccess(stream_id uint32) {
@@ -342,7 +379,7 @@ func (s *RTMPSession) SendMetadata(metaData []byte, timestamp int64) {
 // aacSequenceHeader - Sequence header for AAC codec
 // timestamp - Timestamp when the information was originally received
 func (s *RTMPSession) SendAudioCodecHeader(audioCodec uint32, aacSequenceHeader []byte, timestamp int64) {
-	if audioCodec != 10 && audioCodec != 13 {
+	if (audioCodec != 10 && audioCodec != 13) || len(aacSequenceHeader) == 0 {
 		return
 	}
 
@@ -369,7 +406,7 @@ func (s *RTMPSession) SendAudioCodecHeader(audioCodec uint32, aacSequenceHeader
 // avcSequenceHeader - Sequence header for AVC codec
 // timestamp - Timestamp when the information was originally received
 func (s *RTMPSession) SendVideoCodecHeader(videoCodec uint32, avcSequenceHeader []byte, timestamp int64) {
-	if videoCodec != 7 && videoCodec != 12 {
+	if (videoCodec != 7 && videoCodec != 12) || len(avcSequenceHeader) == 0 {
 		return
 	}
 
@@ -406,7 +443,7 @@ func (s *RTMPSession) BuildMetadata(data *RTMPData) []byte {
 
 // Sends a cache packet
 // cache - The cache packet
-func (s *RTMPSession) SendCachePacket(cache *RTMPPacket) {
+func (s *RTMPSession) SendCachePacket(cache *RTMPPacket, timestampOffset int64) {
 	packet := createBlankRTMPPacket()
 
 	packet.header.fmt = cache.header.fmt
@@ -415,7 +452,7 @@ func (s *RTMPSession) SendCachePacket(cache *RTMPPacket) {
 	packet.payload = cache.payload
 	packet.header.length = uint32(len(packet.payload))
 	packet.header.stream_id = s.playStreamId
-	packet.header.timestamp = cache.header.timestamp
+	packet.header.timestamp = cache.header.timestamp + timestampOffset
 
 	chunks := packet.CreateChunks(int(s.outChunkSize))
 
@@ -425,28 +462,21 @@ func (s *RTMPSession) SendCachePacket(cache *RTMPPacket) {
 // Checks if the client is allowed to play streams
 // Returns true only if the client is allowed
 func (s *RTMPSession) CanPlay() bool {
-	r := os.Getenv("RTMP_PLAY_WHITELIST")
+	playWhitelist := &s.server.GetConfig().playWhitelist
 
-	if r == "" || r == "*" {
-		return true
+	if !playWhitelist.IsEmpty() && !playWhitelist.Contains(s.ip) {
+		return false
 	}
 
-	ip := net.ParseIP(s.ip)
-
-	parts := strings.Split(r, ",")
+	policy := s.listener.GetPolicy()
 
-	for i := 0; i < len(parts); i++ {
-		_, rang, e := net.ParseCIDR(parts[i])
-
-		if e != nil {
-			LogError(e)
-			continue
-		}
+	return policy.allowPlay && (policy.playWhitelist.IsEmpty() || policy.playWhitelist.Contains(s.ip))
+}
 
-		if rang.Contains(ip) {
-			return true
-		}
-	}
+// Checks if the client is allowed to publish streams, by the listener policy
+// Returns true only if the client is allowed
+func (s *RTMPSession) CanPublish() bool {
+	policy := s.listener.GetPolicy()
 
-	return false
+	return policy.allowPublish && (policy.publishWhitelist.IsEmpty() || policy.publishWhitelist.Contains(s.ip))
 }
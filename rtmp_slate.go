@@ -0,0 +1,388 @@
+// Slate: standby content sent to the players of the channels without publisher
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max size of a slate file
+const SLATE_MAX_FILE_SIZE = 64 * 1024 * 1024
+
+// Time between the last tag of the slate and the first one of the next loop (milliseconds)
+const SLATE_LOOP_GAP = 40
+
+// Slate media, loaded from a FLV file
+type RTMPSlate struct {
+	metaData []byte // Metadata
+
+	audioCodec        uint32 // Audio codec
+	videoCodec        uint32 // Video codec
+	aacSequenceHeader []byte // Sequence header for AAC codec (Audio)
+	avcSequenceHeader []byte // Sequence header for AVC codec (Video)
+
+	tags     []*FLVTag // Media tags, with the timestamps relative to the first one
+	duration int64     // Duration of a loop (milliseconds)
+}
+
+// Loads a slate from a FLV file
+// path - Path to the file
+// Returns the slate
+func loadRTMPSlate(path string) (*RTMPSlate, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() > SLATE_MAX_FILE_SIZE {
+		return nil, errors.New("the slate file is too large: " + path)
+	}
+
+	reader, err := CreateFLVReader(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	slate := &RTMPSlate{
+		tags: make([]*FLVTag, 0),
+	}
+
+	firstTimestamp := int64(-1)
+
+	for {
+		tag, err := reader.ReadTag()
+
+		if err != nil {
+			break
+		}
+
+		if tag.tagType == RTMP_TYPE_DATA {
+			if slate.metaData == nil {
+				slate.metaData = tag.data
+			}
+			continue
+		}
+
+		if tag.tagType == RTMP_TYPE_AUDIO && slate.audioCodec == 0 {
+			slate.audioCodec = uint32((tag.data[0] >> 4) & 0x0f)
+		}
+
+		if tag.tagType == RTMP_TYPE_VIDEO && slate.videoCodec == 0 {
+			slate.videoCodec = uint32(tag.data[0] & 0x0f)
+		}
+
+		if tag.IsSequenceHeader() {
+			if tag.tagType == RTMP_TYPE_AUDIO {
+				slate.aacSequenceHeader = tag.data
+			} else {
+				slate.avcSequenceHeader = tag.data
+			}
+			continue
+		}
+
+		if firstTimestamp < 0 {
+			firstTimestamp = tag.timestamp
+		}
+
+		tag.timestamp = max(0, tag.timestamp-firstTimestamp)
+
+		if tag.timestamp > slate.duration {
+			slate.duration = tag.timestamp
+		}
+
+		slate.tags = append(slate.tags, tag)
+	}
+
+	if len(slate.tags) == 0 {
+		return nil, errors.New("the slate file has no media: " + path)
+	}
+
+	return slate, nil
+}
+
+// Slates loaded from the configuration
+// They are loaded once, when the configuration is loaded, and shared by every channel
+type RTMPSlateSet struct {
+	defaultSlate *RTMPSlate            // Slate for every channel (SLATE_FILE), nil if not set
+	channels     map[string]*RTMPSlate // Slates for specific channels (SLATE_DIR). Map: Channel ID -> Slate
+}
+
+// Loads the slates from the configuration
+// The files that cannot be loaded are logged and ignored
+// file - Path to the slate file for every channel. Empty for no slate
+// dir - Path to the directory with the slate files for specific channels ({CHANNEL}.flv). Empty if not set
+// Returns the slates
+func loadRTMPSlateSet(file string, dir string) *RTMPSlateSet {
+	set := &RTMPSlateSet{
+		channels: make(map[string]*RTMPSlate),
+	}
+
+	if file != "" {
+		slate, err := loadRTMPSlate(file)
+
+		if err != nil {
+			LogErrorMessage("Could not load the slate: " + err.Error())
+		} else {
+			set.defaultSlate = slate
+		}
+	}
+
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+
+		if err != nil {
+			LogErrorMessage("Could not load the slates: " + err.Error())
+		}
+
+		for i := 0; i < len(entries); i++ {
+			if entries[i].IsDir() || filepath.Ext(entries[i].Name()) != ".flv" {
+				continue
+			}
+
+			slate, err := loadRTMPSlate(filepath.Join(dir, entries[i].Name()))
+
+			if err != nil {
+				LogErrorMessage("Could not load the slate: " + err.Error())
+				continue
+			}
+
+			set.channels[strings.TrimSuffix(entries[i].Name(), ".flv")] = slate
+		}
+	}
+
+	return set
+}
+
+// Gets the slate for a channel
+// If SLATE_DIR contains {CHANNEL}.flv, it is used. Otherwise, SLATE_FILE is used.
+// channel - The channel ID
+// Returns the slate, or nil if there is no slate
+func (set *RTMPSlateSet) Get(channel string) *RTMPSlate {
+	if slate := set.channels[channel]; slate != nil {
+		return slate
+	}
+
+	return set.defaultSlate
+}
+
+// Slate being sent to the players of a channel
+type RTMPSlatePlayer struct {
+	server  *RTMPServer // Reference to the server
+	channel string      // The channel ID
+
+	mutex *sync.Mutex // Mutex to send the packets and stop the slate
+
+	stopped bool // True if the slate was stopped
+
+	players map[uint64]bool // Players that received the slate sequence headers
+
+	clock int64 // Last timestamp sent to the players
+}
+
+// Starts sending the slate to the players of a channel, if the channel has no active publisher
+// Call when the channel loses its publisher, or when a player starts waiting for the stream
+// channel - The channel ID
+func (server *RTMPServer) StartSlate(channel string) {
+	slate := server.GetConfig().slates.Get(channel)
+
+	if slate == nil {
+		return
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil || c.slate != nil || len(c.players) == 0 || (c.is_publishing && !c.switchPending) {
+		return
+	}
+
+	sp := &RTMPSlatePlayer{
+		server:  server,
+		channel: channel,
+		mutex:   &sync.Mutex{},
+		players: make(map[uint64]bool),
+		clock:   c.lastTimestamp,
+	}
+
+	c.slate = sp
+
+	go sp.run(slate)
+}
+
+// Stops sending the slate to the players of a channel
+// After it returns, no more slate packets are sent
+// The channel keeps the last timestamp, so the stream can continue from it
+// channel - The channel ID
+// Returns the last timestamp sent to the players, and true if the slate was running
+func (server *RTMPServer) StopSlate(channel string) (int64, bool) {
+	server.mutex.Lock()
+
+	c := server.channels[channel]
+
+	if c == nil || c.slate == nil {
+		server.mutex.Unlock()
+		return 0, false
+	}
+
+	sp := c.slate
+	c.slate = nil
+
+	server.mutex.Unlock()
+
+	sp.mutex.Lock()
+	sp.stopped = true
+	clock := sp.clock
+	sp.mutex.Unlock()
+
+	server.mutex.Lock()
+	if clock > c.lastTimestamp {
+		c.lastTimestamp = clock
+	}
+	server.mutex.Unlock()
+
+	return clock, true
+}
+
+// Gets the players that must receive the slate
+// Detaches the slate from the channel if it must stop
+// sp - The slate
+// Returns the players, and false if the slate must stop
+func (server *RTMPServer) getSlatePlayers(sp *RTMPSlatePlayer) ([]*RTMPSession, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[sp.channel]
+
+	if c == nil || c.slate != sp {
+		return nil, false
+	}
+
+	if len(c.players) == 0 || (c.is_publishing && !c.switchPending) {
+		c.slate = nil
+		return nil, false
+	}
+
+	players := make([]*RTMPSession, 0, len(c.players))
+
+	for sid := range c.players {
+		player := server.sessions[sid]
+		if player != nil && (player.isPlaying || player.isIdling) {
+			players = append(players, player)
+		}
+	}
+
+	return players, true
+}
+
+// Sends the slate in a loop, at real-time speed, until it is stopped
+// slate - The slate
+func (sp *RTMPSlatePlayer) run(slate *RTMPSlate) {
+	LogDebug("Slate started for channel '" + sp.channel + "'")
+
+	sp.mutex.Lock()
+	loopOffset := sp.clock + 1
+	sp.mutex.Unlock()
+
+	loopStart := time.Now()
+
+	for {
+		for i := 0; i < len(slate.tags); i++ {
+			tag := slate.tags[i]
+
+			time.Sleep(time.Until(loopStart.Add(time.Duration(tag.timestamp) * time.Millisecond)))
+
+			if !sp.sendTag(slate, tag, loopOffset+tag.timestamp) {
+				LogDebug("Slate stopped for channel '" + sp.channel + "'")
+				return
+			}
+		}
+
+		loopOffset += slate.duration + SLATE_LOOP_GAP
+		loopStart = loopStart.Add(time.Duration(slate.duration+SLATE_LOOP_GAP) * time.Millisecond)
+	}
+}
+
+// Sends a slate tag to the players
+// The players start receiving the slate at a keyframe, after the metadata and the sequence headers
+// slate - The slate
+// tag - The tag
+// timestamp - The timestamp to send
+// Returns false if the slate must stop
+func (sp *RTMPSlatePlayer) sendTag(slate *RTMPSlate, tag *FLVTag, timestamp int64) bool {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if sp.stopped {
+		return false
+	}
+
+	players, ok := sp.server.getSlatePlayers(sp)
+
+	if !ok {
+		sp.stopped = true
+		return false
+	}
+
+	canStart := tag.IsKeyFrame() || slate.videoCodec == 0
+
+	packet := createBlankRTMPPacket()
+	packet.header.fmt = RTMP_CHUNK_TYPE_0
+	packet.header.packet_type = tag.tagType
+	packet.payload = tag.data
+	packet.header.length = uint32(len(packet.payload))
+	packet.header.timestamp = timestamp
+
+	if tag.tagType == RTMP_TYPE_AUDIO {
+		packet.header.cid = RTMP_CHANNEL_AUDIO
+	} else {
+		packet.header.cid = RTMP_CHANNEL_VIDEO
+	}
+
+	for i := 0; i < len(players); i++ {
+		player := players[i]
+
+		if player.isPause || player.isTimeshift {
+			continue
+		}
+
+		if !sp.players[player.id] {
+			if !canStart {
+				continue
+			}
+
+			player.SendStreamStatus(STREAM_BEGIN, player.playStreamId)
+			player.SendMetadata(slate.metaData, timestamp)
+			player.SendAudioCodecHeader(slate.audioCodec, slate.aacSequenceHeader, timestamp)
+			player.SendVideoCodecHeader(slate.videoCodec, slate.avcSequenceHeader, timestamp)
+
+			sp.players[player.id] = true
+		}
+
+		if (tag.tagType == RTMP_TYPE_AUDIO && !player.receive_audio) || (tag.tagType == RTMP_TYPE_VIDEO && !player.receive_video) {
+			continue
+		}
+
+		player.SendCachePacket(&packet, 0)
+	}
+
+	sp.clock = timestamp
+
+	return true
+}
@@ -0,0 +1,541 @@
+// Time-shift: window of the stream kept in memory, so the players can pause, seek backward and catch up to live
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default size limit of the time-shift window of each channel (bytes)
+const TIMESHIFT_DEFAULT_MAX_SIZE = 512 * 1024 * 1024
+
+// Pause position of the players that must resume at the live position
+const TIMESHIFT_POSITION_LIVE = -1
+
+// Max time to wait between two packets of the time-shift window (milliseconds)
+// Longer gaps (for example, while the channel was sending the slate) are skipped
+const TIMESHIFT_MAX_GAP = 1000
+
+// Results of reading the time-shift window
+const (
+	TIMESHIFT_READ_OK      = 0 // The packet was read
+	TIMESHIFT_READ_WAIT    = 1 // The packet was not received yet
+	TIMESHIFT_READ_TRIMMED = 2 // The packet is no longer in the window
+	TIMESHIFT_READ_CLOSED  = 3 // The stream ended
+)
+
+// Metadata and sequence headers of the stream, at a point of the time-shift window or an output
+type RTMPTimeshiftHeaders struct {
+	metaData          []byte // Metadata
+	audioCodec        uint32 // Audio codec
+	videoCodec        uint32 // Video codec
+	aacSequenceHeader []byte // Sequence header for AAC codec (Audio)
+	avcSequenceHeader []byte // Sequence header for AVC codec (Video)
+}
+
+// Media packet of the time-shift window
+type RTMPTimeshiftEntry struct {
+	packet   *RTMPPacket           // The packet, with the timestamp sent to the players
+	keyFrame bool                  // True if the players can start playing at this packet
+	headers  *RTMPTimeshiftHeaders // Metadata and sequence headers required to play the packet
+}
+
+// Time-shift window of a channel
+type RTMPTimeshiftBuffer struct {
+	window  int64 // Duration of the window (milliseconds)
+	maxSize int64 // Size limit of the window (bytes)
+
+	mutex *sync.Mutex // Mutex to access the window
+
+	entries []*RTMPTimeshiftEntry // Packets in the window, ordered by timestamp
+	first   uint64                // Sequence number of the first packet in the window
+	size    int64                 // Current size of the window (bytes)
+
+	headers *RTMPTimeshiftHeaders // Current metadata and sequence headers
+
+	signal chan bool // Closed when a packet is added or the window is closed, to wake up the players
+	closed bool      // True if the stream ended
+}
+
+// Creates a time-shift window
+// window - Duration of the window (milliseconds)
+// maxSize - Size limit of the window (bytes)
+// Returns the window
+func CreateRTMPTimeshiftBuffer(window int64, maxSize int64) *RTMPTimeshiftBuffer {
+	return &RTMPTimeshiftBuffer{
+		window:  window,
+		maxSize: maxSize,
+		mutex:   &sync.Mutex{},
+		entries: make([]*RTMPTimeshiftEntry, 0),
+		first:   0,
+		headers: &RTMPTimeshiftHeaders{},
+		signal:  make(chan bool),
+	}
+}
+
+// Wakes up the players waiting for packets
+// Call with the mutex locked
+func (b *RTMPTimeshiftBuffer) wakeUp() {
+	close(b.signal)
+	b.signal = make(chan bool)
+}
+
+// Sets the metadata and the sequence headers for the next packets
+// metaData - Metadata
+// audioCodec - Audio codec
+// videoCodec - Video codec
+// aacSequenceHeader - Sequence header for AAC codec (Audio)
+// avcSequenceHeader - Sequence header for AVC codec (Video)
+func (b *RTMPTimeshiftBuffer) SetHeaders(metaData []byte, audioCodec uint32, videoCodec uint32, aacSequenceHeader []byte, avcSequenceHeader []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.headers = &RTMPTimeshiftHeaders{
+		metaData:          metaData,
+		audioCodec:        audioCodec,
+		videoCodec:        videoCodec,
+		aacSequenceHeader: aacSequenceHeader,
+		avcSequenceHeader: avcSequenceHeader,
+	}
+}
+
+// Adds a packet to the window, removing the packets that fall out of it
+// cachePacket - The packet, with the timestamp of the publisher
+// timestampOffset - Offset to add to the timestamp
+// keyFrame - True if the players can start playing at this packet
+func (b *RTMPTimeshiftBuffer) Push(cachePacket *RTMPPacket, timestampOffset int64, keyFrame bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	packet := createBlankRTMPPacket()
+	packet.header.fmt = cachePacket.header.fmt
+	packet.header.cid = cachePacket.header.cid
+	packet.header.packet_type = cachePacket.header.packet_type
+	packet.payload = cachePacket.payload
+	packet.header.length = cachePacket.header.length
+	packet.header.timestamp = cachePacket.header.timestamp + timestampOffset
+
+	b.entries = append(b.entries, &RTMPTimeshiftEntry{
+		packet:   &packet,
+		keyFrame: keyFrame,
+		headers:  b.headers,
+	})
+	b.size += int64(packet.header.length) + RTMP_PACKET_BASE_SIZE
+
+	// Remove the old packets
+	trimmed := 0
+
+	for trimmed < len(b.entries)-1 {
+		oldest := b.entries[trimmed].packet
+
+		if b.size <= b.maxSize && packet.header.timestamp-oldest.header.timestamp <= b.window {
+			break
+		}
+
+		b.size -= int64(oldest.header.length) + RTMP_PACKET_BASE_SIZE
+		b.entries[trimmed] = nil
+		trimmed++
+	}
+
+	if trimmed > 0 {
+		b.entries = b.entries[trimmed:]
+		b.first += uint64(trimmed)
+	}
+
+	b.wakeUp()
+}
+
+// Closes the window, when the stream ends
+// The players reading the window stop
+func (b *RTMPTimeshiftBuffer) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.entries = make([]*RTMPTimeshiftEntry, 0)
+	b.size = 0
+
+	b.wakeUp()
+}
+
+// Gets the timestamp of the last packet of the window (live position)
+// Returns the timestamp, or 0 if the window is empty
+func (b *RTMPTimeshiftBuffer) LastTimestamp() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.entries) == 0 {
+		return 0
+	}
+
+	return b.entries[len(b.entries)-1].packet.header.timestamp
+}
+
+// Finds the packet to start playing at a position of the window
+// It is the last keyframe at or before the position.
+// If the position is before the window, it is the first keyframe of the window.
+// timestamp - The position
+// Returns the sequence number of the packet, or false if the window has no keyframes
+func (b *RTMPTimeshiftBuffer) Find(timestamp int64) (uint64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	i := sort.Search(len(b.entries), func(i int) bool {
+		return b.entries[i].packet.header.timestamp > timestamp
+	}) - 1
+
+	for j := i; j >= 0; j-- {
+		if b.entries[j].keyFrame {
+			return b.first + uint64(j), true
+		}
+	}
+
+	for j := max(0, i+1); j < len(b.entries); j++ {
+		if b.entries[j].keyFrame {
+			return b.first + uint64(j), true
+		}
+	}
+
+	return 0, false
+}
+
+// Reads a packet of the window
+// seq - Sequence number of the packet
+// Returns the packet, the result (TIMESHIFT_READ_*), and a channel closed when there are changes in the window
+func (b *RTMPTimeshiftBuffer) Read(seq uint64) (*RTMPTimeshiftEntry, int, chan bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, TIMESHIFT_READ_CLOSED, b.signal
+	}
+
+	if seq < b.first {
+		return nil, TIMESHIFT_READ_TRIMMED, b.signal
+	}
+
+	if seq >= b.first+uint64(len(b.entries)) {
+		return nil, TIMESHIFT_READ_WAIT, b.signal
+	}
+
+	return b.entries[seq-b.first], TIMESHIFT_READ_OK, b.signal
+}
+
+// Player receiving the stream from the time-shift window
+type RTMPTimeshiftPlayer struct {
+	player *RTMPSession         // The player session
+	buffer *RTMPTimeshiftBuffer // The time-shift window
+
+	next     uint64       // Sequence number of the next packet to send
+	position atomic.Int64 // Timestamp of the last packet sent
+
+	stop chan bool // Closed to stop sending
+	done chan bool // Closed when it stops sending
+}
+
+// Sends the packets of the window to the player, at real-time speed, until it is stopped or the stream ends
+// When the player reaches the live position, it keeps receiving the packets as they are added
+func (tp *RTMPTimeshiftPlayer) run() {
+	defer close(tp.done)
+
+	var headers *RTMPTimeshiftHeaders
+
+	baseTime := int64(0)
+	baseTimestamp := int64(-1)
+	lastTimestamp := int64(-1)
+
+	for {
+		entry, result, signal := tp.buffer.Read(tp.next)
+
+		switch result {
+		case TIMESHIFT_READ_CLOSED:
+			return
+		case TIMESHIFT_READ_TRIMMED:
+			// The player fell behind the window, continue from its start
+			if seq, ok := tp.buffer.Find(-1); ok {
+				tp.next = seq
+				baseTimestamp = -1
+				continue
+			}
+		}
+
+		if result != TIMESHIFT_READ_OK {
+			select {
+			case <-signal:
+				continue
+			case <-tp.stop:
+				return
+			}
+		}
+
+		timestamp := entry.packet.header.timestamp
+		now := time.Now().UnixMilli()
+
+		if baseTimestamp < 0 || timestamp < lastTimestamp || timestamp-lastTimestamp > TIMESHIFT_MAX_GAP {
+			baseTime = now
+			baseTimestamp = timestamp
+		}
+
+		if wait := baseTime + timestamp - baseTimestamp - now; wait > 0 {
+			timer := time.NewTimer(time.Duration(wait) * time.Millisecond)
+
+			select {
+			case <-timer.C:
+			case <-tp.stop:
+				timer.Stop()
+				return
+			}
+		}
+
+		player := tp.player
+
+		if entry.headers != headers {
+			headers = entry.headers
+
+			player.SendMetadata(headers.metaData, timestamp)
+			player.SendAudioCodecHeader(headers.audioCodec, headers.aacSequenceHeader, timestamp)
+			player.SendVideoCodecHeader(headers.videoCodec, headers.avcSequenceHeader, timestamp)
+		}
+
+		if (entry.packet.header.packet_type == RTMP_TYPE_AUDIO && player.receive_audio) || (entry.packet.header.packet_type == RTMP_TYPE_VIDEO && player.receive_video) {
+			player.SendCachePacket(entry.packet, 0)
+		}
+
+		lastTimestamp = timestamp
+		tp.position.Store(timestamp)
+		tp.next++
+	}
+}
+
+// Gets the time-shift window of a channel
+// channel - The channel ID
+// Returns the window, or nil if the channel has no time-shift window
+func (server *RTMPServer) GetTimeshiftBuffer(channel string) *RTMPTimeshiftBuffer {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c := server.channels[channel]
+
+	if c == nil {
+		return nil
+	}
+
+	return c.timeshift
+}
+
+// Creates the time-shift window of a channel, if enabled
+// Call with the server mutex locked, when the stream starts
+// c - The channel
+func (server *RTMPServer) startTimeshift(c *RTMPChannel) {
+	config := server.GetConfig()
+
+	if config.timeshiftWindow <= 0 || c.timeshift != nil {
+		return
+	}
+
+	c.timeshift = CreateRTMPTimeshiftBuffer(config.timeshiftWindow, config.timeshiftMaxSize)
+}
+
+// Removes the time-shift window of a channel, when the stream ends
+// The players receiving the stream from the window stop
+// channel - The channel ID
+func (server *RTMPServer) EndTimeshift(channel string) {
+	server.mutex.Lock()
+
+	c := server.channels[channel]
+
+	if c == nil || c.timeshift == nil {
+		server.mutex.Unlock()
+		return
+	}
+
+	timeshift := c.timeshift
+	c.timeshift = nil
+
+	server.mutex.Unlock()
+
+	timeshift.Close()
+}
+
+// Stores a packet sent to the players in the time-shift window of the channel
+// Call only for publishers, with the publish mutex locked
+// cachePacket - The packet, with the timestamp of the publisher
+// isHeader - True if the packet is a sequence header
+// keyFrame - True if the players can start playing at this packet
+func (s *RTMPSession) recordTimeshift(cachePacket *RTMPPacket, isHeader bool, keyFrame bool) {
+	timeshift := s.server.GetTimeshiftBuffer(s.channel)
+
+	if timeshift == nil {
+		return
+	}
+
+	if isHeader {
+		timeshift.SetHeaders(s.metaData, s.audioCodec, s.videoCodec, s.aacSequenceHeader, s.avcSequenceHeader)
+		return
+	}
+
+	timeshift.Push(cachePacket, s.timestampOffset, keyFrame)
+}
+
+// Updates the metadata and the sequence headers of the time-shift window of the channel
+// Call only for publishers, with the publish mutex locked
+func (s *RTMPSession) recordTimeshiftHeaders() {
+	timeshift := s.server.GetTimeshiftBuffer(s.channel)
+
+	if timeshift == nil {
+		return
+	}
+
+	timeshift.SetHeaders(s.metaData, s.audioCodec, s.videoCodec, s.aacSequenceHeader, s.avcSequenceHeader)
+}
+
+// Starts sending the stream to the player from a position of the time-shift window
+// Call only for players
+// timeshift - The time-shift window
+// timestamp - The position
+// Returns false if the window has nothing to play
+func (s *RTMPSession) StartTimeshift(timeshift *RTMPTimeshiftBuffer, timestamp int64) bool {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	return s.startTimeshift(timeshift, timestamp)
+}
+
+// Starts sending the stream to the player from a position of the time-shift window
+// Call only for players, with the seek mutex locked
+// timeshift - The time-shift window
+// timestamp - The position
+// Returns false if the window has nothing to play
+func (s *RTMPSession) startTimeshift(timeshift *RTMPTimeshiftBuffer, timestamp int64) bool {
+	seq, ok := timeshift.Find(timestamp)
+
+	if !ok || s.timeshift != nil {
+		return false
+	}
+
+	tp := &RTMPTimeshiftPlayer{
+		player: s,
+		buffer: timeshift,
+		next:   seq,
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+
+	tp.position.Store(timestamp)
+
+	s.timeshift = tp
+	s.isTimeshift = true
+
+	go tp.run()
+
+	return true
+}
+
+// Stops sending the stream to the player from the time-shift window
+// After it returns, the player can receive the live stream
+// Call only for players
+// Returns the timestamp of the last packet sent, and false if the player was not receiving the stream from the window
+func (s *RTMPSession) StopTimeshift() (int64, bool) {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	return s.stopTimeshift()
+}
+
+// Stops sending the stream to the player from the time-shift window
+// Call only for players, with the seek mutex locked
+// Returns the timestamp of the last packet sent, and false if the player was not receiving the stream from the window
+func (s *RTMPSession) stopTimeshift() (int64, bool) {
+	tp := s.timeshift
+
+	if tp == nil {
+		return 0, false
+	}
+
+	close(tp.stop)
+	<-tp.done
+
+	s.timeshift = nil
+	s.isTimeshift = false
+
+	return tp.position.Load(), true
+}
+
+// Makes the player receive the live stream again, after receiving it from the time-shift window
+// Call only for players
+func (s *RTMPSession) rejoinLive() {
+	publisher := s.server.GetPublisher(s.channel)
+
+	if publisher != nil {
+		publisher.ResumePlayer(s)
+	}
+}
+
+// Handles a seek command
+// Seeking is available for VOD files, and when the channel has a time-shift window
+// Seeking to the live position or after it makes the player receive the live stream
+// cmd - The command
+func (s *RTMPSession) HandleSeek(cmd *RTMPCommand) bool {
+	if s.HandleVODSeek(cmd.GetArg("ms").GetInteger()) {
+		return true
+	}
+
+	if !s.isPlaying {
+		return true
+	}
+
+	timeshift := s.server.GetTimeshiftBuffer(s.channel)
+
+	if timeshift == nil {
+		s.SendStatusMessage(s.playStreamId, "error", "NetStream.Seek.Failed", "Seeking is not available for this stream")
+		return true
+	}
+
+	ms := cmd.GetArg("ms").GetInteger()
+
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	_, wasTimeshift := s.stopTimeshift()
+
+	live := ms >= timeshift.LastTimestamp()
+
+	if live {
+		LogRequest(s.id, s.ip, "SEEK '"+s.channel+"' (live)")
+	} else {
+		LogRequest(s.id, s.ip, "SEEK '"+s.channel+"' ("+strconv.Itoa(int(ms))+")")
+	}
+
+	if s.isPause {
+		// The player resumes from the new position
+		if live {
+			s.pausePosition = TIMESHIFT_POSITION_LIVE
+		} else {
+			s.pausePosition = ms
+		}
+		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Seek.Notify", "Seeking "+strconv.Itoa(int(ms))+".")
+		return true
+	}
+
+	s.SendStreamStatus(STREAM_BEGIN, s.playStreamId)
+	s.SendStatusMessage(s.playStreamId, "status", "NetStream.Seek.Notify", "Seeking "+strconv.Itoa(int(ms))+".")
+	s.SendStatusMessage(s.playStreamId, "status", "NetStream.Play.Start", "Started playing stream.")
+
+	if (live || !s.startTimeshift(timeshift, ms)) && wasTimeshift {
+		s.rejoinLive()
+	}
+
+	return true
+}
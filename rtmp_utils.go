@@ -297,10 +297,38 @@ func getRTMPParamsSimple(str string) map[string]string {
 		for i := 0; i < len(parts); i++ {
 			keyVal := strings.Split(parts[i], "=")
 			if len(keyVal) == 2 {
-				result[keyVal[0]] = result[keyVal[1]]
+				result[keyVal[0]] = keyVal[1]
 			}
 		}
 	}
 
 	return result
 }
+
+// Audio codec names, by codec ID
+var rtmpAudioCodecNames = []string{"", "ADPCM", "MP3", "LinearLE", "Nellymoser16", "Nellymoser8", "Nellymoser", "G711A", "G711U", "", "AAC", "Speex", "", "OPUS", "MP3-8K", "DeviceSpecific", "Uncompressed"}
+
+// Video codec names, by codec ID
+var rtmpVideoCodecNames = []string{"", "Jpeg", "Sorenson-H263", "ScreenVideo", "On2-VP6", "On2-VP6-Alpha", "ScreenVideo2", "H264", "", "", "", "", "H265", "AV1"}
+
+// Gets the name of an audio codec
+// codec - The codec ID
+// Returns the name, or an empty string if unknown
+func getAudioCodecName(codec uint32) string {
+	if int(codec) >= len(rtmpAudioCodecNames) {
+		return ""
+	}
+
+	return rtmpAudioCodecNames[codec]
+}
+
+// Gets the name of a video codec
+// codec - The codec ID
+// Returns the name, or an empty string if unknown
+func getVideoCodecName(codec uint32) string {
+	if int(codec) >= len(rtmpVideoCodecNames) {
+		return ""
+	}
+
+	return rtmpVideoCodecNames[codec]
+}
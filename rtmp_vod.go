@@ -0,0 +1,413 @@
+// VOD: playback of recorded FLV and MP4 files
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Start positions of the play command with a special meaning
+// The specification uses seconds, but some clients send milliseconds, so both values are accepted
+const (
+	PLAY_START_LIVE    = -1    // Live stream only (seconds)
+	PLAY_START_LIVE_MS = -1000 // Live stream only (milliseconds)
+	PLAY_START_ANY     = -2    // Live stream, or the VOD file if the channel is not live (seconds). Used when the play command has no start position
+)
+
+// Gets the path of the VOD file for a stream name
+// The name can have a "flv:" or "mp4:" prefix, and the extension can be omitted
+// Without extension or prefix, the FLV file is preferred
+// channel - The channel ID
+// name - The stream name
+// Returns the path, or an empty string if the name does not map to a file
+func (server *RTMPServer) getVODPath(channel string, name string) string {
+	config := server.GetConfig()
+
+	if config.vodRoot == "" {
+		return ""
+	}
+
+	extensions := []string{".flv", ".mp4"}
+
+	if prefix, rest, found := strings.Cut(name, ":"); found {
+		switch prefix {
+		case "flv", "mp4":
+			extensions = []string{"." + prefix}
+			name = rest
+		default:
+			return ""
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+
+	if !validateStreamIDString(base, config.streamIdMaxLength) {
+		return ""
+	}
+
+	switch ext {
+	case "":
+	case ".flv", ".mp4":
+		extensions = []string{ext}
+	default:
+		return ""
+	}
+
+	for i := 0; i < len(extensions); i++ {
+		path := filepath.Join(config.vodRoot, channel, base+extensions[i])
+
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// Computes the key the players must provide to play a VOD file
+// secret - The VOD secret (VOD_SECRET)
+// channel - The channel ID
+// file - Name of the file, including the extension
+// Returns the key: HMAC-SHA256 of "{CHANNEL}/{FILE}", hex-encoded
+func computeVODKey(secret string, channel string, file string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(channel + "/" + file))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the key provided by a player to play a VOD file
+// channel - The channel ID
+// file - Name of the file, including the extension
+// key - The key provided by the player
+// Returns true if the key is valid
+func (server *RTMPServer) CheckVODKey(channel string, file string, key string) bool {
+	secret := server.GetConfig().vodSecret
+
+	if secret == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(key), []byte(computeVODKey(secret, channel, file))) == 1
+}
+
+// Gets the path of the VOD file to play
+// Call only for players
+// start - Start position of the play command: PLAY_START_LIVE or PLAY_START_LIVE_MS for the live stream only,
+// PLAY_START_ANY (or any other negative value, such as -2000) to prefer the live stream, or the position in seconds
+// Returns the path, or an empty string if the live stream must be played
+func (s *RTMPSession) getPlayVODPath(start float64) string {
+	if start == PLAY_START_LIVE || start == PLAY_START_LIVE_MS {
+		return ""
+	}
+
+	if start < 0 && s.server.GetPublisher(s.channel) != nil {
+		return ""
+	}
+
+	return s.server.getVODPath(s.channel, s.key)
+}
+
+// Player receiving a VOD file
+type RTMPVODPlayer struct {
+	player *RTMPSession // The player session
+	file   *VODFile     // The file
+	name   string       // Name of the file, for logging
+
+	end int64 // Timestamp to stop playing (milliseconds). -1 to play until the end of the file
+
+	next     int          // Index of the next sample to send
+	position atomic.Int64 // Timestamp of the last sample sent
+
+	stop chan bool // Closed to stop sending. Nil if it is not sending
+	done chan bool // Closed when it stops sending
+}
+
+// Starts sending the file from the next sample
+// Call with the seek mutex of the player locked
+func (vp *RTMPVODPlayer) start() {
+	vp.stop = make(chan bool)
+	vp.done = make(chan bool)
+
+	go vp.run(vp.stop, vp.done)
+}
+
+// Stops sending the file
+// After it returns, no more samples are sent
+// Call with the seek mutex of the player locked
+func (vp *RTMPVODPlayer) halt() {
+	if vp.stop == nil {
+		return
+	}
+
+	close(vp.stop)
+	<-vp.done
+
+	vp.stop = nil
+	vp.done = nil
+}
+
+// Sends the samples of the file to the player, at real-time speed, until it is stopped or the file ends
+// stop - Closed to stop sending
+// done - Closed when it stops sending
+func (vp *RTMPVODPlayer) run(stop chan bool, done chan bool) {
+	defer close(done)
+
+	player := vp.player
+	file := vp.file
+
+	baseTime := time.Now().UnixMilli()
+	baseTimestamp := int64(-1)
+
+	for ; vp.next < len(file.samples); vp.next++ {
+		sample := &file.samples[vp.next]
+
+		if vp.end >= 0 && sample.timestamp > vp.end {
+			break
+		}
+
+		if baseTimestamp < 0 {
+			baseTimestamp = sample.timestamp
+
+			player.SendMetadata(file.metaData, sample.timestamp)
+			player.SendAudioCodecHeader(file.audioCodec, file.aacSequenceHeader, sample.timestamp)
+			player.SendVideoCodecHeader(file.videoCodec, file.avcSequenceHeader, sample.timestamp)
+		}
+
+		if wait := baseTime + sample.timestamp - baseTimestamp - time.Now().UnixMilli(); wait > 0 {
+			timer := time.NewTimer(time.Duration(wait) * time.Millisecond)
+
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		data, err := file.ReadSample(vp.next)
+
+		if err != nil {
+			LogErrorMessage("Could not read the VOD file '" + vp.name + "': " + err.Error())
+			break
+		}
+
+		if (sample.tagType == RTMP_TYPE_AUDIO && player.receive_audio) || (sample.tagType == RTMP_TYPE_VIDEO && player.receive_video) {
+			packet := createBlankRTMPPacket()
+			packet.header.fmt = RTMP_CHUNK_TYPE_0
+			packet.header.packet_type = sample.tagType
+			packet.payload = data
+			packet.header.length = uint32(len(packet.payload))
+			packet.header.timestamp = sample.timestamp
+
+			if sample.tagType == RTMP_TYPE_AUDIO {
+				packet.header.cid = RTMP_CHANNEL_AUDIO
+			} else {
+				packet.header.cid = RTMP_CHANNEL_VIDEO
+			}
+
+			player.SendCachePacket(&packet, 0)
+		}
+
+		vp.position.Store(sample.timestamp)
+	}
+
+	LogRequest(player.id, player.ip, "PLAY VOD END '"+vp.name+"'")
+
+	player.SendStreamStatus(STREAM_EOF, player.playStreamId)
+	player.SendStatusMessage(player.playStreamId, "status", "NetStream.Play.Stop", "Stopped playing stream.")
+
+	// Halting waits for this goroutine, so the file is closed from another one
+	go player.endVOD(vp, done)
+}
+
+// Closes the VOD file after the playback ends
+// Call only for players
+// vp - The VOD player
+// done - Done channel of the playback that ended
+func (s *RTMPSession) endVOD(vp *RTMPVODPlayer, done chan bool) {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	if s.vod != vp || vp.done != done {
+		return // Stopped, or restarted by a seek
+	}
+
+	vp.halt()
+	vp.file.Close()
+
+	s.vod = nil
+	s.isPause = false
+}
+
+// Handles a play command for a VOD file
+// Call only for players
+// key - Key provided by the player (see computeVODKey)
+// path - Path to the file
+// start - Position to start playing (milliseconds)
+// duration - Time to play (milliseconds). 0 or less to play until the end of the file
+func (s *RTMPSession) HandleVODPlay(key string, path string, start int64, duration int64) bool {
+	name := s.channel + "/" + filepath.Base(path)
+
+	if !s.server.CheckVODKey(s.channel, filepath.Base(path), key) {
+		LogRequest(s.id, s.ip, "Error: Invalid VOD key provided for '"+name+"'")
+		s.SendStatusMessage(s.playStreamId, "error", "NetStream.Play.BadName", "Invalid stream key provided")
+		return false // Invalid key
+	}
+
+	file, err := OpenVODFile(path)
+
+	if err != nil {
+		LogRequest(s.id, s.ip, "Error: Could not open VOD file '"+name+"': "+err.Error())
+		s.SendStatusMessage(s.playStreamId, "error", "NetStream.Play.StreamNotFound", "Could not open the stream")
+		return true
+	}
+
+	LogRequest(s.id, s.ip, "PLAY VOD ("+strconv.Itoa(int(s.playStreamId))+") '"+name+"' ("+strconv.Itoa(int(start))+")")
+
+	s.RespondPlay()
+
+	vp := &RTMPVODPlayer{
+		player: s,
+		file:   file,
+		name:   name,
+		end:    -1,
+		next:   file.Find(start),
+	}
+
+	if duration > 0 {
+		vp.end = start + duration
+	}
+
+	vp.position.Store(start)
+
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	s.vod = vp
+	vp.start()
+
+	return true
+}
+
+// Checks if the player is receiving a VOD file
+// Call only for players
+// Returns true if receiving a VOD file
+func (s *RTMPSession) IsPlayingVOD() bool {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	return s.vod != nil
+}
+
+// Handles a pause command for a VOD file
+// Call only for players
+// pause - True to pause, false to resume
+// Returns false if the player is not receiving a VOD file
+func (s *RTMPSession) HandleVODPause(pause bool) bool {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	vp := s.vod
+
+	if vp == nil {
+		return false
+	}
+
+	if s.isPause == pause {
+		return true
+	}
+
+	s.isPause = pause
+
+	if pause {
+		vp.halt()
+
+		s.SendStreamStatus(STREAM_EOF, s.playStreamId)
+		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Pause.Notify", "Paused")
+		LogRequest(s.id, s.ip, "PAUSE VOD '"+vp.name+"' ("+strconv.Itoa(int(vp.position.Load()))+")")
+	} else {
+		s.SendStreamStatus(STREAM_BEGIN, s.playStreamId)
+		LogRequest(s.id, s.ip, "RESUME VOD '"+vp.name+"' ("+strconv.Itoa(int(vp.position.Load()))+")")
+		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Unpause.Notify", "Unpaused")
+
+		vp.start()
+	}
+
+	return true
+}
+
+// Handles a seek command for a VOD file
+// Call only for players
+// ms - The position (milliseconds)
+// Returns false if the player is not receiving a VOD file
+func (s *RTMPSession) HandleVODSeek(ms int64) bool {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	vp := s.vod
+
+	if vp == nil {
+		return false
+	}
+
+	vp.halt()
+
+	ms = max(0, ms)
+
+	vp.next = vp.file.Find(ms)
+	vp.position.Store(ms)
+
+	LogRequest(s.id, s.ip, "SEEK VOD '"+vp.name+"' ("+strconv.Itoa(int(ms))+")")
+
+	if s.isPause {
+		// The player resumes from the new position
+		s.SendStatusMessage(s.playStreamId, "status", "NetStream.Seek.Notify", "Seeking "+strconv.Itoa(int(ms))+".")
+		return true
+	}
+
+	s.SendStreamStatus(STREAM_BEGIN, s.playStreamId)
+	s.SendStatusMessage(s.playStreamId, "status", "NetStream.Seek.Notify", "Seeking "+strconv.Itoa(int(ms))+".")
+	s.SendStatusMessage(s.playStreamId, "status", "NetStream.Play.Start", "Started playing stream.")
+
+	vp.start()
+
+	return true
+}
+
+// Stops playing the VOD file, and closes it
+// Call only for players
+// Returns false if the player was not playing a VOD file
+func (s *RTMPSession) StopVOD() bool {
+	s.seek_mutex.Lock()
+	defer s.seek_mutex.Unlock()
+
+	vp := s.vod
+
+	if vp == nil {
+		return false
+	}
+
+	vp.halt()
+	vp.file.Close()
+
+	s.vod = nil
+	s.isPause = false
+
+	return true
+}
@@ -0,0 +1,141 @@
+// RTMP over WebSocket
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Max size of a WebSocket message received from a client
+const RTMP_WEBSOCKET_MAX_MESSAGE_SIZE = 1024 * 1024
+
+// Max time to send a WebSocket message to a client
+const RTMP_WEBSOCKET_WRITE_TIMEOUT = 10 * time.Second
+
+// WebSocket server for a listener
+type RTMPWebSocketServer struct {
+	server   *RTMPServer   // Reference to the RTMP server
+	listener *RTMPListener // The listener
+
+	upgrader *websocket.Upgrader // Upgrader of the HTTP connections
+}
+
+// Serves RTMP over WebSocket connections on a listener
+// Runs until the listener is closed. Call in a separate routine.
+// listener - The listener
+// wg - The waiting group
+func (server *RTMPServer) ServeWebSocket(listener *RTMPListener, wg *sync.WaitGroup) {
+	defer func() {
+		listener.listener.Close()
+		wg.Done()
+	}()
+
+	wsServer := &RTMPWebSocketServer{
+		server:   server,
+		listener: listener,
+		upgrader: &websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // The streams are authorized by the key, not by the origin
+			},
+		},
+	}
+
+	l := listener.listener
+
+	if listener.secure {
+		l = tls.NewListener(l, server.tlsConfig)
+	}
+
+	err := http.Serve(l, wsServer)
+
+	if err != nil && !server.IsDraining() {
+		LogError(err)
+	}
+}
+
+// Handles a WebSocket connection request
+// The binary messages received are the RTMP byte stream, starting with the handshake
+func (wsServer *RTMPWebSocketServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	id := wsServer.server.NextSessionID()
+
+	if wsServer.server.IsDraining() {
+		LogDebugSession(id, ip, "Connection rejected: Server is draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if !wsServer.server.AdmitConnection(id, ip, wsServer.listener) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := wsServer.upgrader.Upgrade(w, req, nil)
+
+	if err != nil {
+		wsServer.server.RemoveIP(ip)
+		wsServer.listener.RemoveConnection(ip)
+		LogDebugSession(id, ip, "Could not upgrade the connection: "+err.Error())
+		return
+	}
+
+	ws.SetReadLimit(RTMP_WEBSOCKET_MAX_MESSAGE_SIZE)
+
+	writeMutex := &sync.Mutex{}
+
+	conn := CreateTunnelConn(ws.LocalAddr(), ws.RemoteAddr(), func(b []byte) (int, error) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+
+		ws.SetWriteDeadline(time.Now().Add(RTMP_WEBSOCKET_WRITE_TIMEOUT)) //nolint:errcheck
+
+		err := ws.WriteMessage(websocket.BinaryMessage, b)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return len(b), nil
+	}, func() {
+		ws.Close()
+	})
+
+	LogDebugSession(id, ip, "WebSocket connection accepted")
+
+	go wsServer.runReaderLoop(ws, conn)
+
+	wsServer.server.HandleConnection(id, ip, conn, getClientCertificateSubject(req.TLS), wsServer.listener)
+}
+
+// Reads the messages from the WebSocket connection, and pushes them to the tunnel connection
+// Closes the tunnel connection when the WebSocket connection is closed
+// ws - The WebSocket connection
+// conn - The tunnel connection
+func (wsServer *RTMPWebSocketServer) runReaderLoop(ws *websocket.Conn, conn *TunnelConn) {
+	defer conn.Close()
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		conn.Push(data)
+	}
+}
@@ -0,0 +1,288 @@
+// RTMPT (RTMP tunnelled over HTTP)
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Content type of the RTMPT requests and responses
+const RTMPT_CONTENT_TYPE = "application/x-fcs"
+
+// Max size of the body of a RTMPT request
+const RTMPT_MAX_REQUEST_SIZE = 1024 * 1024
+
+// Max amount of data pending to be sent to a RTMPT client. If reached, the session is closed.
+const RTMPT_MAX_PENDING_SIZE = 16 * 1024 * 1024
+
+// Max polling delay sent to the clients
+const RTMPT_MAX_POLLING_DELAY = 0x21
+
+// Number of consecutive empty responses before increasing the polling delay
+const RTMPT_POLLING_DELAY_STEP = 10
+
+// Status of a RTMPT session
+type RTMPTSession struct {
+	id       string // Session ID (sent to the client)
+	clientIP string // IP address of the client
+
+	conn *TunnelConn // Connection passed to the RTMP session
+
+	mutex *sync.Mutex // Mutex to access the pending data
+
+	out bytes.Buffer // Data pending to be sent to the client
+
+	pollingDelay byte // Current polling delay
+	emptyReplies int  // Number of consecutive empty responses
+}
+
+// RTMPT server for a listener
+type RTMPTServer struct {
+	server   *RTMPServer   // Reference to the RTMP server
+	listener *RTMPListener // The listener
+
+	mutex *sync.Mutex // Mutex to access the sessions
+
+	sessions map[string]*RTMPTSession // Active sessions. Map: Session ID -> Session
+}
+
+// Serves RTMPT requests on a listener
+// Runs until the listener is closed. Call in a separate routine.
+// listener - The listener
+// wg - The waiting group
+func (server *RTMPServer) ServeRTMPT(listener *RTMPListener, wg *sync.WaitGroup) {
+	defer func() {
+		listener.listener.Close()
+		wg.Done()
+	}()
+
+	rtmpt := &RTMPTServer{
+		server:   server,
+		listener: listener,
+		mutex:    &sync.Mutex{},
+		sessions: make(map[string]*RTMPTSession),
+	}
+
+	l := listener.listener
+
+	if listener.secure {
+		l = tls.NewListener(l, server.tlsConfig)
+	}
+
+	err := http.Serve(l, rtmpt)
+
+	if err != nil && !server.IsDraining() {
+		LogError(err)
+	}
+}
+
+// Writes a RTMPT response
+// w - The response writer
+// body - The response body
+func writeRTMPTResponse(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", RTMPT_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "Keep-Alive")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body) //nolint:errcheck
+}
+
+// Handles a RTMPT request
+// Requests: POST /fcs/ident2, /open/1, /send/{ID}/{SEQ}, /idle/{ID}/{SEQ}, /close/{ID}/{SEQ}
+func (rtmpt *RTMPTServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch parts[0] {
+	case "open":
+		rtmpt.handleOpen(w, req, ip)
+	case "send", "idle", "close":
+		if len(parts) < 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		session := rtmpt.getSession(parts[1])
+
+		if session == nil || session.clientIP != ip {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch parts[0] {
+		case "send":
+			rtmpt.handleSend(w, req, session)
+		case "idle":
+			writeRTMPTResponse(w, session.Poll())
+		default:
+			session.conn.Close()
+			writeRTMPTResponse(w, []byte{0x00})
+		}
+	default:
+		// Includes /fcs/ident2, used by some clients to detect the server
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Handles the request to open a RTMPT session
+// w - The response writer
+// req - The request
+// ip - The client IP address
+func (rtmpt *RTMPTServer) handleOpen(w http.ResponseWriter, req *http.Request, ip string) {
+	io.Copy(io.Discard, io.LimitReader(req.Body, RTMPT_MAX_REQUEST_SIZE)) //nolint:errcheck
+
+	id := rtmpt.server.NextSessionID()
+
+	if rtmpt.server.IsDraining() {
+		LogDebugSession(id, ip, "Connection rejected: Server is draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if !rtmpt.server.AdmitConnection(id, ip, rtmpt.listener) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	sessionIdBytes := make([]byte, 16)
+	_, err := rand.Read(sessionIdBytes)
+
+	if err != nil {
+		LogError(err)
+		rtmpt.server.RemoveIP(ip)
+		rtmpt.listener.RemoveConnection(ip)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	session := &RTMPTSession{
+		id:           hex.EncodeToString(sessionIdBytes),
+		clientIP:     ip,
+		mutex:        &sync.Mutex{},
+		pollingDelay: 0x01,
+	}
+
+	localAddr := rtmpt.listener.listener.Addr()
+
+	session.conn = CreateTunnelConn(localAddr, &TunnelAddr{network: "rtmpt", address: req.RemoteAddr}, session.Write, func() {
+		rtmpt.removeSession(session.id)
+	})
+
+	rtmpt.mutex.Lock()
+	rtmpt.sessions[session.id] = session
+	rtmpt.mutex.Unlock()
+
+	LogDebugSession(id, ip, "RTMPT session opened: "+session.id)
+
+	go rtmpt.server.HandleConnection(id, ip, session.conn, getClientCertificateSubject(req.TLS), rtmpt.listener)
+
+	writeRTMPTResponse(w, []byte(session.id+"\n"))
+}
+
+// Handles the request to send data to a RTMPT session
+// w - The response writer
+// req - The request
+// session - The session
+func (rtmpt *RTMPTServer) handleSend(w http.ResponseWriter, req *http.Request, session *RTMPTSession) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, RTMPT_MAX_REQUEST_SIZE+1))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > RTMPT_MAX_REQUEST_SIZE {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	session.conn.Push(body)
+
+	writeRTMPTResponse(w, session.Poll())
+}
+
+// Gets a RTMPT session
+// id - The session ID
+// Returns the session, or nil if not found
+func (rtmpt *RTMPTServer) getSession(id string) *RTMPTSession {
+	rtmpt.mutex.Lock()
+	defer rtmpt.mutex.Unlock()
+
+	return rtmpt.sessions[id]
+}
+
+// Removes a RTMPT session
+// id - The session ID
+func (rtmpt *RTMPTServer) removeSession(id string) {
+	rtmpt.mutex.Lock()
+	defer rtmpt.mutex.Unlock()
+
+	delete(rtmpt.sessions, id)
+}
+
+// Adds data to be sent to the client in the next response
+// b - The data
+func (session *RTMPTSession) Write(b []byte) (int, error) {
+	session.mutex.Lock()
+
+	if session.out.Len()+len(b) > RTMPT_MAX_PENDING_SIZE {
+		session.mutex.Unlock()
+
+		session.conn.Close()
+
+		return 0, errors.New("too much data pending to be sent")
+	}
+
+	n, _ := session.out.Write(b)
+
+	session.mutex.Unlock()
+
+	return n, nil
+}
+
+// Takes the data pending to be sent to the client
+// Updates the polling delay: it is reset when there is data, and increased after several empty responses
+// Returns the response body: the polling delay followed by the data
+func (session *RTMPTSession) Poll() []byte {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.out.Len() > 0 {
+		session.pollingDelay = 0x01
+		session.emptyReplies = 0
+	} else {
+		session.emptyReplies++
+
+		if session.emptyReplies >= RTMPT_POLLING_DELAY_STEP && session.pollingDelay < RTMPT_MAX_POLLING_DELAY {
+			session.pollingDelay = min(session.pollingDelay*2+1, RTMPT_MAX_POLLING_DELAY)
+			session.emptyReplies = 0
+		}
+	}
+
+	body := make([]byte, 1+session.out.Len())
+	body[0] = session.pollingDelay
+	copy(body[1:], session.out.Bytes())
+
+	session.out.Reset()
+
+	return body
+}
@@ -0,0 +1,411 @@
+// TLS configuration
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tls_certificate_loader "github.com/AgustinSRG/go-tls-certificate-loader"
+)
+
+// Extension of the certificate files in the certificates directory
+const TLS_CERT_FILE_EXTENSION = ".crt"
+
+// Extension of the key files in the certificates directory
+const TLS_KEY_FILE_EXTENSION = ".key"
+
+// Supported TLS versions. Map: Name -> Version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Store of certificates for SNI, loaded from a directory
+type TLSCertificateStore struct {
+	dir string // Path of the directory
+
+	mutex *sync.Mutex // Mutex to access the certificates
+
+	certificates []*tls.Certificate // Loaded certificates
+	modTimes     map[string]int64   // Modification time of each file (unix milliseconds), to detect changes
+}
+
+// Creates a store of certificates from a directory
+// Every certificate file ({NAME}.crt) must have a key file with the same name ({NAME}.key)
+// dir - Path of the directory
+// Returns the store
+func CreateTLSCertificateStore(dir string) (*TLSCertificateStore, error) {
+	store := &TLSCertificateStore{
+		dir:          dir,
+		mutex:        &sync.Mutex{},
+		certificates: make([]*tls.Certificate, 0),
+		modTimes:     make(map[string]int64),
+	}
+
+	err := store.Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Scans the modification times of the files in the directory
+// Returns the modification times. Map: File name -> Unix milliseconds
+func (store *TLSCertificateStore) scanModTimes() (map[string]int64, error) {
+	entries, err := os.ReadDir(store.dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	modTimes := make(map[string]int64)
+
+	for i := 0; i < len(entries); i++ {
+		ext := filepath.Ext(entries[i].Name())
+
+		if entries[i].IsDir() || (ext != TLS_CERT_FILE_EXTENSION && ext != TLS_KEY_FILE_EXTENSION) {
+			continue
+		}
+
+		info, err := entries[i].Info()
+
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes[entries[i].Name()] = info.ModTime().UnixMilli()
+	}
+
+	return modTimes, nil
+}
+
+// Loads the certificates of the directory
+// Returns an error if the directory or any certificate could not be loaded
+func (store *TLSCertificateStore) Load() error {
+	modTimes, err := store.scanModTimes()
+
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+
+	for file := range modTimes {
+		if filepath.Ext(file) == TLS_CERT_FILE_EXTENSION {
+			names = append(names, strings.TrimSuffix(file, TLS_CERT_FILE_EXTENSION))
+		}
+	}
+
+	sort.Strings(names)
+
+	certificates := make([]*tls.Certificate, 0, len(names))
+
+	for i := 0; i < len(names); i++ {
+		certFile := filepath.Join(store.dir, names[i]+TLS_CERT_FILE_EXTENSION)
+		keyFile := filepath.Join(store.dir, names[i]+TLS_KEY_FILE_EXTENSION)
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+		if err != nil {
+			return errors.New("could not load certificate " + names[i] + ": " + err.Error())
+		}
+
+		certificates = append(certificates, &cert)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.certificates = certificates
+	store.modTimes = modTimes
+
+	return nil
+}
+
+// Reloads the certificates if any file in the directory changed
+func (store *TLSCertificateStore) CheckReload() {
+	modTimes, err := store.scanModTimes()
+
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	store.mutex.Lock()
+	changed := len(modTimes) != len(store.modTimes)
+
+	for file, modTime := range modTimes {
+		if store.modTimes[file] != modTime {
+			changed = true
+		}
+	}
+	store.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	err = store.Load()
+
+	if err != nil {
+		LogError(err)
+		return
+	}
+
+	LogInfo("Reloaded SSL certificates from " + store.dir)
+}
+
+// Checks for changes in the directory periodically
+// Runs indefinitely. Call in a separate routine.
+// period - Time between checks
+func (store *TLSCertificateStore) RunReloadLoop(period time.Duration) {
+	for {
+		time.Sleep(period)
+		store.CheckReload()
+	}
+}
+
+// Finds the certificate for a client, using the server name (SNI)
+// hello - The client hello
+// Returns the certificate, or nil if no certificate matches
+func (store *TLSCertificateStore) FindCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if hello.ServerName == "" {
+		return nil
+	}
+
+	for i := 0; i < len(store.certificates); i++ {
+		if hello.SupportsCertificate(store.certificates[i]) == nil {
+			return store.certificates[i]
+		}
+	}
+
+	return nil
+}
+
+// Gets the first certificate of the store, for clients not matching any certificate
+// Returns the certificate, or nil if the store is empty
+func (store *TLSCertificateStore) GetFirstCertificate() *tls.Certificate {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(store.certificates) == 0 {
+		return nil
+	}
+
+	return store.certificates[0]
+}
+
+// Parses a comma-separated list of cipher suite names
+// list - The list
+// Returns the cipher suite IDs
+func parseTLSCipherSuites(list string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	result := make([]uint16, 0)
+
+	parts := strings.Split(list, ",")
+
+	for i := 0; i < len(parts); i++ {
+		part := strings.TrimSpace(parts[i])
+
+		if part == "" {
+			continue
+		}
+
+		id, ok := suites[part]
+
+		if !ok {
+			return nil, errors.New("unknown cipher suite: " + part)
+		}
+
+		result = append(result, id)
+	}
+
+	return result, nil
+}
+
+// Loads a pool of CA certificates from a PEM file
+// path - Path of the file
+// Returns the pool
+func loadTLSCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New("no valid certificates found in " + path)
+	}
+
+	return pool, nil
+}
+
+// Creates the TLS configuration for the secure listeners
+// Loads the certificate from SSL_CERT and SSL_KEY, and the SNI certificates from SSL_CERTS_DIR.
+// The certificates are reloaded periodically.
+// Returns the configuration
+func createTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("SSL_CERT")
+	keyFile := os.Getenv("SSL_KEY")
+	certsDir := os.Getenv("SSL_CERTS_DIR")
+
+	if (certFile == "" || keyFile == "") && certsDir == "" {
+		return nil, errors.New("SSL_CERT and SSL_KEY, or SSL_CERTS_DIR, are required for the TLS listeners")
+	}
+
+	checkReloadSeconds := 60
+
+	customCheckReloadSeconds := os.Getenv("SSL_CHECK_RELOAD_SECONDS")
+	if customCheckReloadSeconds != "" {
+		n, e := strconv.Atoi(customCheckReloadSeconds)
+		if e == nil {
+			checkReloadSeconds = n
+
+			if checkReloadSeconds < 1 {
+				checkReloadSeconds = 1
+			}
+		}
+	}
+
+	// Default certificate
+	var cerLoader *tls_certificate_loader.TlsCertificateLoader
+
+	if certFile != "" && keyFile != "" {
+		loader, err := tls_certificate_loader.NewTlsCertificateLoader(tls_certificate_loader.TlsCertificateLoaderConfig{
+			CertificatePath:   certFile,
+			KeyPath:           keyFile,
+			CheckReloadPeriod: time.Duration(checkReloadSeconds) * time.Second,
+			OnReload: func() {
+				LogInfo("Reloaded SSL certificates")
+			},
+			OnError: func(err error) {
+				LogError(err)
+			},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		cerLoader = loader
+	}
+
+	// SNI certificates
+	var store *TLSCertificateStore
+
+	if certsDir != "" {
+		s, err := CreateTLSCertificateStore(certsDir)
+
+		if err != nil {
+			if cerLoader != nil {
+				cerLoader.Close()
+			}
+			return nil, err
+		}
+
+		store = s
+
+		go store.RunReloadLoop(time.Duration(checkReloadSeconds) * time.Second)
+
+		LogInfo("Loaded SSL certificates from " + certsDir)
+	}
+
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if store != nil {
+				if cert := store.FindCertificate(hello); cert != nil {
+					return cert, nil
+				}
+			}
+
+			if cerLoader != nil {
+				return cerLoader.GetCertificate(hello)
+			}
+
+			if cert := store.GetFirstCertificate(); cert != nil {
+				return cert, nil
+			}
+
+			return nil, errors.New("no certificate available")
+		},
+	}
+
+	// Version and cipher suites
+	if minVersion := os.Getenv("SSL_MIN_VERSION"); minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+
+		if !ok {
+			return nil, errors.New("invalid SSL_MIN_VERSION: " + minVersion)
+		}
+
+		config.MinVersion = version
+	}
+
+	if cipherSuites := os.Getenv("SSL_CIPHER_SUITES"); cipherSuites != "" {
+		suites, err := parseTLSCipherSuites(cipherSuites)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.CipherSuites = suites
+	}
+
+	// Client certificates
+	if clientCA := os.Getenv("SSL_CLIENT_CA"); clientCA != "" {
+		pool, err := loadTLSCertPool(clientCA)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+
+		LogInfo("Client certificate authentication enabled")
+	}
+
+	return config, nil
+}
+
+// Gets the subject of the verified client certificate of a TLS connection
+// state - State of the connection after the handshake, or nil if the connection does not use TLS
+// Returns the subject, or an empty string if the client did not send a valid certificate
+func getClientCertificateSubject(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.String()
+}
@@ -0,0 +1,196 @@
+// Byte stream connection over a tunnel (RTMPT, WebSocket)
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Network address of a tunnelled client
+type TunnelAddr struct {
+	network string // Network name
+	address string // Address
+}
+
+// Gets the network name
+func (a *TunnelAddr) Network() string {
+	return a.network
+}
+
+// Gets the address as string
+func (a *TunnelAddr) String() string {
+	return a.address
+}
+
+// Connection adapting the messages of a tunnel to a byte stream (net.Conn)
+// The received data is pushed with Push(). The sent data is passed to the write function.
+type TunnelConn struct {
+	mutex *sync.Mutex // Mutex to access the status
+
+	in bytes.Buffer // Received data, pending to be read
+
+	readDeadline time.Time // Deadline for the reads. Zero for no deadline
+
+	notify chan struct{} // Notifies the reader when there is new data or the deadline changes
+	closed chan struct{} // Closed when the connection is closed
+
+	closeOnce *sync.Once // Ensures the connection is only closed once
+
+	localAddr  net.Addr // Local address
+	remoteAddr net.Addr // Remote address
+
+	write   func([]byte) (int, error) // Function to send data to the client
+	onClose func()                    // Function called when the connection is closed
+}
+
+// Creates a tunnel connection
+// localAddr - Local address
+// remoteAddr - Remote address
+// write - Function to send data to the client
+// onClose - Function called when the connection is closed, or nil
+// Returns the connection
+func CreateTunnelConn(localAddr net.Addr, remoteAddr net.Addr, write func([]byte) (int, error), onClose func()) *TunnelConn {
+	return &TunnelConn{
+		mutex:      &sync.Mutex{},
+		notify:     make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		write:      write,
+		onClose:    onClose,
+	}
+}
+
+// Wakes up the reader
+func (c *TunnelConn) wakeUp() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pushes data received from the client, so it can be read
+// data - The data
+func (c *TunnelConn) Push(data []byte) {
+	c.mutex.Lock()
+	c.in.Write(data)
+	c.mutex.Unlock()
+
+	c.wakeUp()
+}
+
+// Checks if the connection is closed
+// Returns true if closed
+func (c *TunnelConn) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reads data received from the client
+// Blocks until there is data, the connection is closed, or the read deadline is reached
+func (c *TunnelConn) Read(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+
+		if c.in.Len() > 0 {
+			n, _ := c.in.Read(b)
+			c.mutex.Unlock()
+			return n, nil
+		}
+
+		deadline := c.readDeadline
+
+		c.mutex.Unlock()
+
+		if c.IsClosed() {
+			return 0, io.EOF
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+
+			if remaining <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		}
+
+		select {
+		case <-c.notify:
+		case <-c.closed:
+		case <-timeout:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Sends data to the client
+func (c *TunnelConn) Write(b []byte) (int, error) {
+	if c.IsClosed() {
+		return 0, net.ErrClosed
+	}
+
+	return c.write(b)
+}
+
+// Closes the connection
+func (c *TunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+
+	return nil
+}
+
+// Gets the local address
+func (c *TunnelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// Gets the remote address
+func (c *TunnelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Sets the read deadline. The write deadline is not used, since writes do not block.
+func (c *TunnelConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// Sets the read deadline
+func (c *TunnelConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+
+	c.wakeUp()
+
+	return nil
+}
+
+// Sets the write deadline. Not used, since writes do not block.
+func (c *TunnelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
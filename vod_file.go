@@ -0,0 +1,350 @@
+// VOD files: recorded FLV and MP4 files, indexed for playback
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max number of samples of a FLV file
+const FLV_MAX_SAMPLES = 16 * 1024 * 1024
+
+// Max number of indexes kept in the VOD index cache
+const VOD_INDEX_CACHE_SIZE = 64
+
+// Max size of the data of a VOD sample (size of a FLV tag or a RTMP message)
+const VOD_MAX_SAMPLE_SIZE = 0xffffff
+
+// Media sample of a VOD file
+type VODSample struct {
+	tagType         uint32 // Type of the sample (RTMP_TYPE_AUDIO or RTMP_TYPE_VIDEO)
+	timestamp       int64  // Decoding timestamp (milliseconds)
+	compositionTime int64  // Composition time offset (milliseconds). Only for MP4 video samples
+	offset          int64  // Position of the sample data in the file
+	size            uint32 // Size of the sample data
+	keyFrame        bool   // True if it is a video keyframe
+}
+
+// Index of a VOD file
+// It is not modified once built, so it is shared by the players of the file
+type VODIndex struct {
+	isMP4 bool // True for MP4 files, false for FLV files
+
+	metaData []byte // Metadata
+
+	audioCodec        uint32 // Audio codec
+	videoCodec        uint32 // Video codec
+	aacSequenceHeader []byte // Sequence header for AAC codec (Audio)
+	avcSequenceHeader []byte // Sequence header for AVC codec (Video)
+
+	samples  []VODSample // Media samples, ordered by timestamp
+	duration int64       // Timestamp of the last sample (milliseconds)
+}
+
+// VOD file, indexed for playback
+type VODFile struct {
+	file *os.File // The file
+
+	*VODIndex // Index of the file
+}
+
+// Entry of the VOD index cache
+type VODIndexCacheEntry struct {
+	modTime time.Time // Modification time of the file when it was indexed
+	size    int64     // Size of the file when it was indexed
+	index   *VODIndex // The index
+}
+
+// Cache of the VOD indexes
+// The entries are valid while the modification time and the size of the file do not change
+type VODIndexCache struct {
+	mutex   *sync.Mutex                    // Mutex to access the entries
+	entries map[string]*VODIndexCacheEntry // Entries, by path
+}
+
+// VOD index cache
+var vodIndexCache = &VODIndexCache{
+	mutex:   &sync.Mutex{},
+	entries: make(map[string]*VODIndexCacheEntry),
+}
+
+// Finds the cached index of a VOD file
+// path - Path to the file
+// stat - Information of the file
+// Returns the index, or nil if not cached or outdated
+func (c *VODIndexCache) Get(path string, stat os.FileInfo) *VODIndex {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entries[path]
+
+	if entry == nil || !entry.modTime.Equal(stat.ModTime()) || entry.size != stat.Size() {
+		return nil
+	}
+
+	return entry.index
+}
+
+// Adds the index of a VOD file to the cache
+// If the cache is full, a random entry is removed
+// path - Path to the file
+// stat - Information of the file
+// index - The index
+func (c *VODIndexCache) Set(path string, stat os.FileInfo, index *VODIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.entries[path]; !ok && len(c.entries) >= VOD_INDEX_CACHE_SIZE {
+		for p := range c.entries {
+			delete(c.entries, p)
+			break
+		}
+	}
+
+	c.entries[path] = &VODIndexCacheEntry{
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+		index:   index,
+	}
+}
+
+// Opens and indexes a VOD file
+// The index is cached, so other players of the file do not need to index it again
+// path - Path to the file (.flv or .mp4)
+// Returns the VOD file
+func OpenVODFile(path string) (*VODFile, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if index := vodIndexCache.Get(path, stat); index != nil {
+		return &VODFile{file: f, VODIndex: index}, nil
+	}
+
+	vod := &VODFile{
+		file: f,
+		VODIndex: &VODIndex{
+			isMP4: strings.EqualFold(filepath.Ext(path), ".mp4"),
+		},
+	}
+
+	if vod.isMP4 {
+		err = indexMP4File(vod, stat.Size())
+	} else {
+		err = indexFLVFile(vod, stat.Size())
+	}
+
+	if err == nil && len(vod.samples) == 0 {
+		err = errors.New("the file has no media")
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	vodIndexCache.Set(path, stat, vod.VODIndex)
+
+	return vod, nil
+}
+
+// Indexes a FLV file for VOD playback
+// The first metadata and the first sequence headers of the file are used
+// vod - The VOD file
+// fileSize - Size of the file
+// Returns an error if the file is not a valid FLV file
+func indexFLVFile(vod *VODFile, fileSize int64) error {
+	header := make([]byte, FLV_HEADER_SIZE)
+
+	_, err := vod.file.ReadAt(header, 0)
+
+	if err != nil {
+		return err
+	}
+
+	if header[0] != 'F' || header[1] != 'L' || header[2] != 'V' {
+		return errors.New("not a FLV file")
+	}
+
+	dataOffset := binary.BigEndian.Uint32(header[5:9])
+
+	if dataOffset < FLV_HEADER_SIZE {
+		return errors.New("invalid FLV header size")
+	}
+
+	vod.samples = make([]VODSample, 0)
+
+	// Tag header and the first 2 bytes of the data
+	tagHeader := make([]byte, FLV_TAG_HEADER_SIZE+2)
+
+	for pos := int64(dataOffset) + 4; err == nil && pos+FLV_TAG_HEADER_SIZE <= fileSize; {
+		n, _ := vod.file.ReadAt(tagHeader, pos)
+
+		if n < FLV_TAG_HEADER_SIZE {
+			break
+		}
+
+		tagType := uint32(tagHeader[0] & 0x1f)
+		size := uint32(tagHeader[1])<<16 | uint32(tagHeader[2])<<8 | uint32(tagHeader[3])
+		timestamp := int64(tagHeader[7])<<24 | int64(tagHeader[4])<<16 | int64(tagHeader[5])<<8 | int64(tagHeader[6])
+
+		dataPos := pos + FLV_TAG_HEADER_SIZE
+
+		if dataPos+int64(size) > fileSize {
+			break // Truncated file
+		}
+
+		pos = dataPos + int64(size) + 4
+
+		if size < 2 || n < len(tagHeader) {
+			continue
+		}
+
+		tag := &FLVTag{
+			tagType:   tagType,
+			timestamp: timestamp,
+			data:      tagHeader[FLV_TAG_HEADER_SIZE:],
+		}
+
+		switch tagType {
+		case RTMP_TYPE_DATA:
+			if vod.metaData == nil {
+				vod.metaData, err = vod.readData(dataPos, size)
+			}
+			continue
+		case RTMP_TYPE_AUDIO:
+			if vod.audioCodec == 0 {
+				vod.audioCodec = uint32((tag.data[0] >> 4) & 0x0f)
+			}
+
+			if tag.IsSequenceHeader() {
+				if vod.aacSequenceHeader == nil {
+					vod.aacSequenceHeader, err = vod.readData(dataPos, size)
+				}
+				continue
+			}
+		case RTMP_TYPE_VIDEO:
+			if vod.videoCodec == 0 {
+				vod.videoCodec = uint32(tag.data[0] & 0x0f)
+			}
+
+			if tag.IsSequenceHeader() {
+				if vod.avcSequenceHeader == nil {
+					vod.avcSequenceHeader, err = vod.readData(dataPos, size)
+				}
+				continue
+			}
+		default:
+			continue
+		}
+
+		if len(vod.samples) >= FLV_MAX_SAMPLES {
+			return errors.New("too many samples")
+		}
+
+		vod.samples = append(vod.samples, VODSample{
+			tagType:   tagType,
+			timestamp: timestamp,
+			offset:    dataPos,
+			size:      size,
+			keyFrame:  tag.IsKeyFrame(),
+		})
+
+		vod.duration = max(vod.duration, timestamp)
+	}
+
+	return err
+}
+
+// Reads data from the file
+// offset - Position in the file
+// size - Size of the data
+// Returns the data
+func (vod *VODFile) readData(offset int64, size uint32) ([]byte, error) {
+	data := make([]byte, size)
+
+	_, err := vod.file.ReadAt(data, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Reads a sample
+// i - Index of the sample
+// Returns the sample data, as the payload of the RTMP packet
+func (vod *VODFile) ReadSample(i int) ([]byte, error) {
+	sample := &vod.samples[i]
+
+	if !vod.isMP4 {
+		return vod.readData(sample.offset, sample.size)
+	}
+
+	// MP4 samples need the FLV audio / video header
+	var header []byte
+
+	if sample.tagType == RTMP_TYPE_AUDIO {
+		header = []byte{0xaf, 1}
+	} else {
+		frameType := byte(2)
+
+		if sample.keyFrame {
+			frameType = 1
+		}
+
+		cts := sample.compositionTime
+		header = []byte{frameType<<4 | byte(vod.videoCodec), 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	}
+
+	data := make([]byte, len(header)+int(sample.size))
+	copy(data, header)
+
+	_, err := vod.file.ReadAt(data[len(header):], sample.offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Finds the sample to start playing at a position
+// It is the last keyframe at or before the position (any sample for audio-only files)
+// timestamp - The position (milliseconds)
+// Returns the index of the sample
+func (vod *VODFile) Find(timestamp int64) int {
+	i := sort.Search(len(vod.samples), func(i int) bool {
+		return vod.samples[i].timestamp > timestamp
+	}) - 1
+
+	for ; i > 0; i-- {
+		if vod.videoCodec == 0 || vod.samples[i].keyFrame {
+			break
+		}
+	}
+
+	return max(0, i)
+}
+
+// Closes the file
+func (vod *VODFile) Close() {
+	vod.file.Close()
+}
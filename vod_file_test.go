@@ -0,0 +1,357 @@
+// Tests for the VOD file parsers (FLV and MP4)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a test file
+// t - The test
+// name - Name of the file
+// data - Content of the file
+// Returns the path of the file
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Builds a FLV file
+// tags - The tags
+// Returns the content of the file
+func buildTestFLV(t *testing.T, tags []*FLVTag) []byte {
+	buf := &bytes.Buffer{}
+
+	writer, err := CreateFLVWriter(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range tags {
+		if err := writer.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestIndexFLVFile(t *testing.T) {
+	tags := []*FLVTag{
+		{tagType: RTMP_TYPE_DATA, timestamp: 0, data: []byte{0x02, 0x00, 0x0a}},
+		{tagType: RTMP_TYPE_VIDEO, timestamp: 0, data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}},                      // AVC sequence header
+		{tagType: RTMP_TYPE_AUDIO, timestamp: 0, data: []byte{0xaf, 0x00, 0x12, 0x10}},                                  // AAC sequence header
+		{tagType: RTMP_TYPE_VIDEO, timestamp: 0, data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xaa}},                      // Keyframe
+		{tagType: RTMP_TYPE_AUDIO, timestamp: 20, data: []byte{0xaf, 0x01, 0xbb}},                                       // Audio
+		{tagType: RTMP_TYPE_VIDEO, timestamp: 40, data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xcc}},                     // Interframe
+		{tagType: 0x05, timestamp: 50, data: []byte{0x00, 0x00}},                                                        // Unknown
+		{tagType: RTMP_TYPE_VIDEO, timestamp: 1000, data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xdd}},                   // Keyframe
+		{tagType: RTMP_TYPE_VIDEO, timestamp: 1040, data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xee, 0xee, 0xee, 0xee}}, // Interframe
+	}
+
+	data := buildTestFLV(t, tags)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		samples  int   // Expected number of samples, or -1 if an error is expected
+		duration int64 // Expected duration
+	}{
+		{name: "complete", data: data, samples: 5, duration: 1040},
+		{name: "truncated", data: data[:len(data)-8], samples: 4, duration: 1000},
+		{name: "not a FLV file", data: []byte("MP4 data, not FLV"), samples: -1},
+		{name: "invalid header size", data: []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 1, 0, 0, 0, 0}, samples: -1},
+		{name: "no media", data: buildTestFLV(t, tags[:3]), samples: -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vod, err := OpenVODFile(writeTestFile(t, "test.flv", test.data))
+
+			if test.samples < 0 {
+				if err == nil {
+					vod.Close()
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			defer vod.Close()
+
+			if len(vod.samples) != test.samples || vod.duration != test.duration {
+				t.Fatalf("expected %d samples and duration %d, got %d samples and duration %d", test.samples, test.duration, len(vod.samples), vod.duration)
+			}
+
+			if vod.metaData == nil || vod.avcSequenceHeader == nil || vod.aacSequenceHeader == nil {
+				t.Fatalf("the metadata and the sequence headers were not found")
+			}
+
+			if vod.videoCodec != 7 || vod.audioCodec != 10 {
+				t.Fatalf("invalid codecs: video %d, audio %d", vod.videoCodec, vod.audioCodec)
+			}
+
+			sample, err := vod.ReadSample(0)
+
+			if err != nil || !bytes.Equal(sample, tags[3].data) {
+				t.Fatalf("invalid first sample: %v, %v", sample, err)
+			}
+
+			// Seeking starts at the last keyframe
+			if i := vod.Find(1020); vod.samples[i].timestamp != 1000 {
+				t.Fatalf("expected to start at 1000, got %d", vod.samples[i].timestamp)
+			}
+
+			if i := vod.Find(500); vod.samples[i].timestamp != 0 || !vod.samples[i].keyFrame {
+				t.Fatalf("expected to start at the keyframe 0, got %d", vod.samples[i].timestamp)
+			}
+		})
+	}
+}
+
+// Builds a MP4 box
+// boxType - Type of the box
+// children - Data of the box, concatenated
+// Returns the box
+func buildTestMP4Box(boxType string, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	box = append(box, boxType...)
+
+	return append(box, data...)
+}
+
+// Builds a MP4 full box (version 0, no flags) with 32 bit fields
+// boxType - Type of the box
+// fields - The fields
+// Returns the box
+func buildTestMP4Table(boxType string, fields ...uint32) []byte {
+	data := make([]byte, 4)
+
+	for _, f := range fields {
+		data = binary.BigEndian.AppendUint32(data, f)
+	}
+
+	return buildTestMP4Box(boxType, data)
+}
+
+// Builds a MP4 track
+// handler - Handler type (vide, soun)
+// sampleEntry - Sample description entry
+// stbl - Sample table boxes, other than the sample description
+// Returns the track box
+func buildTestMP4Track(handler string, sampleEntry []byte, stbl ...[]byte) []byte {
+	hdlr := buildTestMP4Box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 13))
+	mdhd := buildTestMP4Table("mdhd", 0, 0, 1000, 0, 0)
+	stsd := buildTestMP4Box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, sampleEntry)
+
+	return buildTestMP4Box("trak", buildTestMP4Box("mdia", hdlr, mdhd, buildTestMP4Box("minf", buildTestMP4Box("stbl", append([][]byte{stsd}, stbl...)...))))
+}
+
+// Builds a MP4 file with an AVC video track and an AAC audio track
+// The samples are stored in the media data box, after the movie box
+// videoSizes - Sample size box of the video track
+// Returns the content of the file
+func buildTestMP4(videoSizes []byte) []byte {
+	avc1 := make([]byte, MP4_VISUAL_SAMPLE_ENTRY_SIZE)
+	binary.BigEndian.PutUint16(avc1[24:26], 640)
+	binary.BigEndian.PutUint16(avc1[26:28], 360)
+	avc1 = buildTestMP4Box("avc1", avc1, buildTestMP4Box("avcC", []byte{1, 0x64, 0, 0x1f}))
+
+	mp4a := buildTestMP4Box("mp4a", make([]byte, MP4_AUDIO_SAMPLE_ENTRY_SIZE), buildTestMP4Box("esds",
+		[]byte{0, 0, 0, 0},
+		[]byte{0x03, 25, 0, 1, 0}, // ES descriptor
+		[]byte{0x04, 17, 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, // Decoder config descriptor
+		[]byte{0x05, 2, 0x12, 0x10},                                   // Audio specific config
+	))
+
+	// The offsets are filled once the size of the movie box is known
+	build := func(mdatOffset uint32) []byte {
+		video := buildTestMP4Track("vide", avc1,
+			videoSizes,
+			buildTestMP4Table("stts", 1, 3, 40),
+			buildTestMP4Table("ctts", 1, 3, 80),
+			buildTestMP4Table("stsc", 1, 1, 3, 1),
+			buildTestMP4Table("stco", 1, mdatOffset),
+			buildTestMP4Table("stss", 2, 1, 3),
+		)
+
+		audio := buildTestMP4Track("soun", mp4a,
+			buildTestMP4Table("stsz", 2, 2),
+			buildTestMP4Table("stts", 1, 2, 50),
+			buildTestMP4Table("stsc", 1, 1, 2, 1),
+			buildTestMP4Table("stco", 1, mdatOffset+12),
+		)
+
+		ftyp := buildTestMP4Box("ftyp", []byte("isom"), []byte{0, 0, 0, 1})
+		moov := buildTestMP4Box("moov", video, audio)
+		mdat := buildTestMP4Box("mdat", []byte{0, 0, 0, 1, 0xaa, 0, 0, 0, 1, 0xbb, 0xcc, 0xdd}, []byte{0x21, 0x22, 0x21, 0x22})
+
+		return bytes.Join([][]byte{ftyp, moov, mdat}, nil)
+	}
+
+	data := build(0)
+
+	return build(uint32(len(data) - 16))
+}
+
+func TestIndexMP4File(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		samples  int   // Expected number of samples, or -1 if an error is expected
+		duration int64 // Expected duration
+	}{
+		{name: "complete", data: buildTestMP4(buildTestMP4Table("stsz", 0, 3, 5, 5, 2)), samples: 5, duration: 80},
+		{name: "constant sample size", data: buildTestMP4(buildTestMP4Table("stsz", 4, 3)), samples: 5, duration: 80},
+		{name: "missing sample sizes", data: buildTestMP4(buildTestMP4Table("stsz", 0, 3, 5)), samples: 2, duration: 50},
+		{name: "too many constant size samples", data: buildTestMP4(buildTestMP4Table("stsz", 4, 0x7fffffff)), samples: 2, duration: 50},
+		{name: "sample too large", data: buildTestMP4(buildTestMP4Table("stsz", 0, 3, 5, VOD_MAX_SAMPLE_SIZE, 2)), samples: 2, duration: 50},
+		{name: "sample out of the file", data: buildTestMP4(buildTestMP4Table("stsz", 0, 3, 5, 5, 200)), samples: -1},
+		{name: "not a MP4 file", data: []byte("FLV data, not MP4"), samples: -1},
+		{name: "no movie box", data: buildTestMP4Box("mdat", make([]byte, 16)), samples: -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vod, err := OpenVODFile(writeTestFile(t, "test.mp4", test.data))
+
+			if test.samples < 0 {
+				if err == nil {
+					vod.Close()
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			defer vod.Close()
+
+			if len(vod.samples) != test.samples || vod.duration != test.duration {
+				t.Fatalf("expected %d samples and duration %d, got %d samples and duration %d", test.samples, test.duration, len(vod.samples), vod.duration)
+			}
+
+			if vod.aacSequenceHeader == nil || !bytes.Equal(vod.aacSequenceHeader, []byte{0xaf, 0, 0x12, 0x10}) {
+				t.Fatalf("invalid AAC sequence header: %v", vod.aacSequenceHeader)
+			}
+
+			if test.samples < 5 {
+				return // The video track was skipped
+			}
+
+			if vod.videoCodec != 7 || !bytes.Equal(vod.avcSequenceHeader, []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0, 0x1f}) {
+				t.Fatalf("invalid video codec or AVC sequence header: %d, %v", vod.videoCodec, vod.avcSequenceHeader)
+			}
+
+			// The first sample is a video keyframe, with the composition time offset in the FLV header
+			sample, err := vod.ReadSample(0)
+
+			if err != nil || !bytes.Equal(sample[:5], []byte{0x17, 1, 0, 0, 80}) {
+				t.Fatalf("invalid first sample: %v, %v", sample, err)
+			}
+
+			if i := vod.Find(60); vod.samples[i].timestamp != 0 || !vod.samples[i].keyFrame {
+				t.Fatalf("expected to start at the keyframe 0, got %d", vod.samples[i].timestamp)
+			}
+		})
+	}
+}
+
+func TestMP4ParseBoxes(t *testing.T) {
+	free := buildTestMP4Box("free", []byte{1, 2, 3, 4})
+
+	largeSize := func(size uint64) []byte {
+		box := []byte{0, 0, 0, 1, 'b', 'a', 'd', ' '}
+		box = binary.BigEndian.AppendUint64(box, size)
+		return append(box, 0, 0, 0, 0)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		boxes int // Expected number of boxes
+	}{
+		{name: "boxes", data: append(append([]byte{}, free...), free...), boxes: 2},
+		{name: "box to the end", data: append(append([]byte{}, free...), 0, 0, 0, 0, 'l', 'a', 's', 't', 1, 2), boxes: 2},
+		{name: "truncated box", data: append(append([]byte{}, free...), 0, 0, 0, 100, 'b', 'a', 'd', ' '), boxes: 1},
+		{name: "size smaller than the header", data: append(append([]byte{}, free...), 0, 0, 0, 4, 'b', 'a', 'd', ' '), boxes: 1},
+		{name: "64 bit size", data: append(append([]byte{}, free...), largeSize(20)...), boxes: 2},
+		{name: "64 bit size out of the data", data: append(append([]byte{}, free...), largeSize(0xffffffff)...), boxes: 1},
+		{name: "64 bit size overflow", data: append(append([]byte{}, free...), largeSize(0xfffffffffffffffc)...), boxes: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if boxes := mp4ParseBoxes(test.data); len(boxes) != test.boxes {
+				t.Fatalf("expected %d boxes, got %d", test.boxes, len(boxes))
+			}
+		})
+	}
+}
+
+func TestVODIndexCache(t *testing.T) {
+	tags := []*FLVTag{
+		{tagType: RTMP_TYPE_AUDIO, timestamp: 0, data: []byte{0x2f, 0x01}},
+		{tagType: RTMP_TYPE_AUDIO, timestamp: 20, data: []byte{0x2f, 0x02}},
+	}
+
+	path := writeTestFile(t, "cached.flv", buildTestFLV(t, tags))
+
+	first, err := OpenVODFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer first.Close()
+
+	second, err := OpenVODFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer second.Close()
+
+	if first.VODIndex != second.VODIndex || first.file == second.file {
+		t.Fatalf("expected a shared index and different files")
+	}
+
+	// The index is rebuilt when the file changes
+	if err := os.WriteFile(path, buildTestFLV(t, append(tags, &FLVTag{tagType: RTMP_TYPE_AUDIO, timestamp: 40, data: []byte{0x2f, 0x03}})), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := OpenVODFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer third.Close()
+
+	if third.VODIndex == first.VODIndex || len(third.samples) != 3 {
+		t.Fatalf("expected a new index with 3 samples, got %d samples", len(third.samples))
+	}
+}